@@ -0,0 +1,137 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"trackveilapi/internal/accesslog"
+	"trackveilapi/internal/config"
+	"trackveilapi/internal/database"
+)
+
+const accessLogUsage = `usage: trackveil-api accesslog import -site ID [options] FILE...
+
+Options:
+  -format FORMAT     combined (default), common, or the server's nginx
+                     log_format or Apache LogFormat string
+  -from YYYY-MM-DD   skip hits before this day (UTC)
+  -to YYYY-MM-DD     skip hits after this day (UTC)
+  -dry-run           parse and count without writing anything
+
+FILEs are read in the order given, so list rotated logs oldest first. Files
+ending in .gz are decompressed and - reads standard input. Requests for
+assets, bots, non-GET requests, errors and the site's excluded paths are
+skipped, as are page views already imported. Visitors are identified by IP
+address and user agent.`
+
+// runAccessLog runs a `trackveil-api accesslog` command
+func runAccessLog(cfg *config.Config, db *database.DB, args []string) (err error) {
+	if len(args) == 0 || args[0] != "import" {
+		return errors.New(accessLogUsage)
+	}
+
+	fs := flag.NewFlagSet("accesslog import", flag.ContinueOnError)
+	siteID := fs.String("site", "", "site ID")
+	formatSpec := fs.String("format", "combined", "log format")
+	from := fs.String("from", "", "first day to import")
+	to := fs.String("to", "", "last day to import")
+	dryRun := fs.Bool("dry-run", false, "parse and count without writing")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *siteID == "" || fs.NArg() == 0 {
+		return errors.New(accessLogUsage)
+	}
+
+	format, err := accesslog.ParseFormat(*formatSpec)
+	if err != nil {
+		return err
+	}
+	opts := accesslog.Options{DryRun: *dryRun}
+	if opts.From, err = parseDay(*from); err != nil {
+		return err
+	}
+	if opts.To, err = parseDay(*to); err != nil {
+		return err
+	}
+	if !opts.To.IsZero() {
+		opts.To = opts.To.AddDate(0, 0, 1)
+	}
+	opts.Progress = func(s accesslog.Stats) {
+		fmt.Fprintf(os.Stderr, "%s\n", s.Describe())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bg := newWorkers()
+	store, err := newStore(bg, cfg, db)
+	if err != nil {
+		bg.Stop()
+		return err
+	}
+	defer func() {
+		if cerr := closeStore(bg, store); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+
+	importer, err := accesslog.NewImporter(db, store, *siteID, format, opts)
+	if err != nil {
+		return err
+	}
+	for _, path := range fs.Args() {
+		fmt.Fprintf(os.Stderr, "Reading %s\n", path)
+		if err := readAccessLog(ctx, importer, path); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	stats, err := importer.Finish()
+	if err != nil {
+		return err
+	}
+
+	verb := "Imported"
+	if *dryRun {
+		verb = "Would import"
+	}
+	fmt.Printf("%s %d page views into site %s from %d lines: %d new visitors, %d new sessions\n",
+		verb, stats.PageViews, *siteID, stats.Lines, stats.Visitors, stats.Sessions)
+	for _, reason := range []string{
+		accesslog.SkipMalformed, accesslog.SkipOutOfRange, accesslog.SkipMethod, accesslog.SkipStatus,
+		accesslog.SkipAsset, accesslog.SkipBot, accesslog.SkipExcluded, accesslog.SkipDuplicate,
+	} {
+		if n := stats.Skipped[reason]; n > 0 {
+			fmt.Printf("  skipped %-12s %10d\n", reason, n)
+		}
+	}
+	return nil
+}
+
+// readAccessLog feeds a log file, gzipped or not, or standard input to the
+// importer
+func readAccessLog(ctx context.Context, importer *accesslog.Importer, path string) error {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	return importer.Read(ctx, r)
+}
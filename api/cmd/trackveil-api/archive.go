@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"trackveilapi/internal/archive"
+	"trackveilapi/internal/config"
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/models"
+	"trackveilapi/internal/storage"
+)
+
+const archiveUsage = `usage: trackveil-api archive <command>
+
+Commands:
+  run [-site ID]                         archive the closed days not yet
+                                         archived, of one site or all
+  list -site ID [-from DATE] [-to DATE]  list a site's archived ranges
+  restore -site ID [-from DATE] [-to DATE]
+                                         insert the archived ranges back into
+                                         the database, skipping rows still there
+
+Dates are YYYY-MM-DD in UTC; -to is exclusive. The archive is ARCHIVE_DIR or
+ARCHIVE_S3_BUCKET.`
+
+// newBucket opens the configured archive location, or returns nil if
+// archiving is not configured
+func newBucket(cfg *config.Config) (archive.Bucket, error) {
+	switch {
+	case cfg.Archive.S3Bucket != "":
+		return archive.NewS3Bucket(cfg.Archive.S3Bucket, cfg.Archive.S3Endpoint, cfg.Archive.S3Region,
+			cfg.Archive.S3AccessKey, cfg.Archive.S3SecretKey)
+	case cfg.Archive.Dir != "":
+		return archive.NewDirBucket(cfg.Archive.Dir)
+	}
+	return nil, nil
+}
+
+// runArchive runs a `trackveil-api archive` command
+func runArchive(cfg *config.Config, db *database.DB, args []string) error {
+	if len(args) == 0 {
+		return errors.New(archiveUsage)
+	}
+	if cfg.Storage.Backend == storage.BackendClickHouse {
+		return errors.New("hits stored in ClickHouse are not archived")
+	}
+	bucket, err := newBucket(cfg)
+	if err != nil {
+		return err
+	}
+	if bucket == nil {
+		return errors.New("set ARCHIVE_DIR or ARCHIVE_S3_BUCKET")
+	}
+
+	fs := flag.NewFlagSet("archive "+args[0], flag.ContinueOnError)
+	siteID := fs.String("site", "", "site ID")
+	fromFlag := fs.String("from", "", "first day (YYYY-MM-DD)")
+	toFlag := fs.String("to", "", "day after the last (YYYY-MM-DD)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	from, err := parseDay(*fromFlag)
+	if err != nil {
+		return err
+	}
+	to, err := parseDay(*toFlag)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	switch args[0] {
+	case "run":
+		archiver := archive.NewArchiver(db, bucket, cfg.Archive.Prefix, cfg.Archive.LagDays)
+		var ranges []models.HitArchive
+		if *siteID != "" {
+			ranges, err = archiver.ArchiveSite(ctx, *siteID, time.Now())
+		} else {
+			ranges, err = archiver.Archive(ctx, time.Now())
+		}
+		for _, h := range ranges {
+			fmt.Printf("Archived %s: %d page views, %d events, %d sessions, %d visitors to %s\n",
+				describeRange(h.SiteID, h.RangeStart, h.RangeEnd), h.PageViews, h.Events, h.Sessions, h.Visitors, h.Location)
+		}
+		if err == nil && len(ranges) == 0 {
+			fmt.Println("Nothing to archive")
+		}
+		return err
+
+	case "list":
+		if *siteID == "" {
+			return errors.New("usage: trackveil-api archive list -site ID [-from DATE] [-to DATE]")
+		}
+		archives, err := archive.List(db, *siteID, from, to)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "FROM\tTO\tPAGE VIEWS\tEVENTS\tSESSIONS\tVISITORS\tBYTES\tMANIFEST")
+		for _, h := range archives {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%d\t%s\n", h.RangeStart.UTC().Format("2006-01-02"),
+				h.RangeEnd.UTC().Format("2006-01-02"), h.PageViews, h.Events, h.Sessions, h.Visitors, h.Bytes, h.Location)
+		}
+		return w.Flush()
+
+	case "restore":
+		if *siteID == "" {
+			return errors.New("usage: trackveil-api archive restore -site ID [-from DATE] [-to DATE]")
+		}
+		archives, err := archive.List(db, *siteID, from, to)
+		if err != nil {
+			return err
+		}
+		if len(archives) == 0 {
+			return errors.New("no archived range matches")
+		}
+		for _, h := range archives {
+			restored, err := archive.Restore(ctx, db, bucket, h)
+			if err != nil {
+				return fmt.Errorf("%s: %w", describeRange(h.SiteID, h.RangeStart, h.RangeEnd), err)
+			}
+			fmt.Printf("Restored %s: %s\n", describeRange(h.SiteID, h.RangeStart, h.RangeEnd), restored.Describe())
+		}
+		return nil
+	}
+	return errors.New(archiveUsage)
+}
+
+// parseDay parses a YYYY-MM-DD flag as the start of the day in UTC; empty
+// gives the zero time
+func parseDay(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q, want YYYY-MM-DD", s)
+	}
+	return t, nil
+}
+
+func describeRange(siteID string, from, to time.Time) string {
+	return fmt.Sprintf("site %s %s to %s", siteID, from.UTC().Format("2006-01-02"), to.UTC().Format("2006-01-02"))
+}
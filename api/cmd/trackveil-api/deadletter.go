@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"trackveilapi/internal/config"
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/deadletter"
+	"trackveilapi/internal/dedup"
+	"trackveilapi/internal/goals"
+	"trackveilapi/internal/handlers"
+	"trackveilapi/internal/models"
+
+	"github.com/google/uuid"
+)
+
+const deadLetterUsage = `usage: trackveil-api deadletter <command>
+
+Commands:
+  list [-site ID] [-kind KIND] [-limit N]   list dead letters, newest first
+  show <id>                                 print a dead letter with its payload
+                                            and context
+  fix <id> <file>                           replace the payload with the JSON in
+                                            file ("-" for stdin)
+  replay <id>... | -all [-site ID] [-kind KIND]
+                                            re-ingest, removing the letters
+                                            stored; failures are counted
+  discard <id>... | -all [-site ID] [-kind KIND]
+                                            remove without re-ingesting
+
+Kinds: request (a tracking request), page_view and event (rows rejected by
+a batch write).`
+
+// runDeadLetter runs a `trackveil-api deadletter` command
+func runDeadLetter(cfg *config.Config, db *database.DB, args []string) error {
+	if len(args) == 0 {
+		return errors.New(deadLetterUsage)
+	}
+
+	fs := flag.NewFlagSet("deadletter "+args[0], flag.ContinueOnError)
+	siteID := fs.String("site", "", "only dead letters of this site")
+	kind := fs.String("kind", "", "only dead letters of this kind")
+	limit := fs.Int("limit", 50, "list at most this many (0 for all)")
+	all := fs.Bool("all", false, "every dead letter matching -site and -kind")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	filter := deadletter.Filter{SiteID: *siteID, Kind: *kind}
+
+	switch args[0] {
+	case "list":
+		filter.Limit = *limit
+		letters, err := deadletter.List(db, filter)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tSITE\tKIND\tSOURCE\tATTEMPTS\tCREATED AT\tERROR")
+		for _, l := range letters {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", l.ID, l.SiteID, l.Kind, l.Source, l.Attempts,
+				l.CreatedAt.UTC().Format("2006-01-02 15:04:05"), truncate(l.Error, 80))
+		}
+		return w.Flush()
+
+	case "show":
+		if fs.NArg() != 1 {
+			return errors.New("usage: trackveil-api deadletter show <id>")
+		}
+		l, err := getDeadLetter(db, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		out, err := json.MarshalIndent(l, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+
+	case "fix":
+		if fs.NArg() != 2 {
+			return errors.New("usage: trackveil-api deadletter fix <id> <file>")
+		}
+		l, err := getDeadLetter(db, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		payload, err := readPayload(fs.Arg(1))
+		if err != nil {
+			return err
+		}
+		if err := checkPayload(l.Kind, payload); err != nil {
+			return err
+		}
+		if err := deadletter.SetPayload(db, l.ID, payload); err != nil {
+			return err
+		}
+		fmt.Printf("Updated the payload of %s\n", l.ID)
+		return nil
+
+	case "replay":
+		letters, err := selectDeadLetters(db, fs, *all, filter)
+		if err != nil {
+			return err
+		}
+		return replayDeadLetters(cfg, db, letters)
+
+	case "discard":
+		letters, err := selectDeadLetters(db, fs, *all, filter)
+		if err != nil {
+			return err
+		}
+		for _, l := range letters {
+			if err := deadletter.Delete(db, l.ID); err != nil {
+				return err
+			}
+			fmt.Printf("Discarded %s\n", l.ID)
+		}
+		return nil
+	}
+	return errors.New(deadLetterUsage)
+}
+
+// replayDeadLetters re-ingests dead letters through the configured storage,
+// removing those stored and recording the error of the others
+func replayDeadLetters(cfg *config.Config, db *database.DB, letters []models.DeadLetter) (err error) {
+	bg := newWorkers()
+	store, err := newStore(bg, cfg, db)
+	if err != nil {
+		bg.Stop()
+		return err
+	}
+	defer func() {
+		if cerr := closeStore(bg, store); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+	// Re-ingested hits are streamed too; queued hits are delivered on return
+	dispatcher, err := newDispatcher(cfg, db)
+	if err != nil {
+		return err
+	}
+	if dispatcher != nil {
+		defer func() {
+			if cerr := dispatcher.Close(); cerr != nil && err == nil {
+				err = fmt.Errorf("failed to close sinks: %w", cerr)
+			}
+		}()
+	}
+	deduplicator := dedup.New(db, store,
+		time.Duration(cfg.Dedup.WindowSeconds)*time.Second,
+		time.Duration(cfg.Dedup.EventIDRetention)*time.Hour)
+	trackHandler := handlers.NewTrackHandler(db, store, goals.NewEvaluator(db, store), deduplicator, false, nil, dispatcher)
+
+	failed := 0
+	for i := range letters {
+		l := &letters[i]
+		if err := trackHandler.ReingestDeadLetter(l); err != nil {
+			failed++
+			fmt.Printf("Failed %s: %v\n", l.ID, err)
+			if err := deadletter.RecordFailure(db, l.ID, err.Error()); err != nil {
+				return err
+			}
+			continue
+		}
+		// A rejected batch write dead-letters the hit again, by its own ID
+		if err := store.Flush(); err != nil {
+			return err
+		}
+		if err := deadletter.Delete(db, l.ID); err != nil {
+			return err
+		}
+		fmt.Printf("Re-ingested %s\n", l.ID)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d dead letters failed", failed, len(letters))
+	}
+	return nil
+}
+
+// selectDeadLetters returns the letters named by ID, or with -all those
+// matching the filter
+func selectDeadLetters(db *database.DB, fs *flag.FlagSet, all bool, filter deadletter.Filter) ([]models.DeadLetter, error) {
+	if all {
+		if fs.NArg() > 0 {
+			return nil, errors.New("pass either IDs or -all")
+		}
+		return deadletter.List(db, filter)
+	}
+	if fs.NArg() == 0 {
+		return nil, errors.New(deadLetterUsage)
+	}
+	var letters []models.DeadLetter
+	for _, arg := range fs.Args() {
+		l, err := getDeadLetter(db, arg)
+		if err != nil {
+			return nil, err
+		}
+		letters = append(letters, *l)
+	}
+	return letters, nil
+}
+
+func getDeadLetter(db *database.DB, arg string) (*models.DeadLetter, error) {
+	id, err := uuid.Parse(arg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dead letter ID: %q", arg)
+	}
+	l, err := deadletter.Get(db, id)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", id, err)
+	}
+	return l, nil
+}
+
+// readPayload reads a file, or stdin for "-"
+func readPayload(path string) ([]byte, error) {
+	if path == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(path)
+}
+
+// checkPayload checks that a fixed payload decodes as its kind
+func checkPayload(kind string, payload []byte) error {
+	var target interface{}
+	switch kind {
+	case deadletter.KindRequest:
+		target = &models.TrackRequest{}
+	case deadletter.KindPageView:
+		target = &models.PageView{}
+	case deadletter.KindEvent:
+		target = &models.Event{}
+	default:
+		return fmt.Errorf("unknown dead letter kind %q", kind)
+	}
+	if err := json.Unmarshal(payload, target); err != nil {
+		return fmt.Errorf("invalid %s payload: %w", kind, err)
+	}
+	return nil
+}
+
+func truncate(s string, n int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-3] + "..."
+}
@@ -1,20 +1,46 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 
+	"trackveilapi/internal/archive"
+	"trackveilapi/internal/certs"
 	"trackveilapi/internal/config"
 	"trackveilapi/internal/database"
+	"trackveilapi/internal/dedup"
+	"trackveilapi/internal/domains"
+	"trackveilapi/internal/goals"
 	"trackveilapi/internal/handlers"
 	"trackveilapi/internal/middleware"
+	"trackveilapi/internal/migrate"
+	"trackveilapi/internal/models"
+	"trackveilapi/internal/partitions"
+	"trackveilapi/internal/retention"
+	"trackveilapi/internal/rollups"
+	"trackveilapi/internal/script"
+	"trackveilapi/internal/spool"
+	"trackveilapi/internal/storage"
 
 	"github.com/gin-gonic/gin"
 )
 
+// sinkReloadInterval is how often the sites' sink settings are reloaded, to
+// pick up changes made through other instances
+const sinkReloadInterval = 30 * time.Second
+
+// shutdownTimeout is how long requests in flight get to finish on shutdown
+const shutdownTimeout = 30 * time.Second
+
 var (
 	Version   = "dev"
 	BuildTime = "unknown"
@@ -29,42 +55,335 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
-	// Connect to database
-	db, err := database.Connect(cfg.ConnectionString())
+	// Connect to database: a SQLite file if configured, Postgres otherwise
+	var db *database.DB
+	if cfg.Database.SQLitePath != "" {
+		db, err = database.OpenSQLite(cfg.Database.SQLitePath)
+	} else {
+		db, err = database.Open(database.Config{
+			Primary: cfg.ConnectionString(),
+			PrimaryPool: database.PoolConfig{
+				MaxConns:          int32(cfg.Database.MaxConns),
+				MinConns:          int32(cfg.Database.MinConns),
+				MaxConnLifetime:   cfg.Database.MaxConnLifetime,
+				MaxConnIdleTime:   cfg.Database.MaxConnIdleTime,
+				HealthCheckPeriod: cfg.Database.HealthCheckPeriod,
+			},
+			Replicas: cfg.Database.ReplicaDSNs,
+			ReplicaPool: database.PoolConfig{
+				MaxConns:          int32(cfg.Database.ReplicaMaxConns),
+				MinConns:          int32(cfg.Database.ReplicaMinConns),
+				MaxConnLifetime:   cfg.Database.MaxConnLifetime,
+				MaxConnIdleTime:   cfg.Database.MaxConnIdleTime,
+				HealthCheckPeriod: cfg.Database.HealthCheckPeriod,
+			},
+			MaxLag:         cfg.Database.ReplicaMaxLag,
+			StatementCache: cfg.Database.StatementCache,
+		})
+	}
 	if err != nil {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
 	defer db.Close()
 
-	log.Println("Successfully connected to database")
+	log.Printf("Successfully connected to %s database", db.Driver)
+	if n := len(cfg.Database.ReplicaDSNs); n > 0 {
+		log.Printf("Analytics reads are routed to %d read replicas", n)
+	}
+
+	// `trackveil-api migrate <command>` manages the schema instead of serving
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(db, os.Args[2:]); err != nil {
+			log.Fatalf("migrate: %v", err)
+		}
+		return
+	}
+
+	// Apply pending migrations if enabled; concurrent instances wait on a
+	// lock. Otherwise the schema must already match this binary.
+	migrator, err := migrate.New(db)
+	if err != nil {
+		log.Fatalf("Failed to load migrations: %v", err)
+	}
+	if cfg.Database.MigrateOnStart {
+		applied, err := migrator.Up(context.Background())
+		for _, version := range applied {
+			log.Printf("Applied migration %s", version)
+		}
+		if err != nil {
+			log.Fatalf("Failed to apply migrations: %v", err)
+		}
+	} else {
+		problems, err := migrator.Verify(context.Background())
+		if err != nil {
+			log.Fatalf("Failed to check migrations: %v", err)
+		}
+		if len(problems) > 0 {
+			log.Fatalf("Database schema does not match this binary; run `trackveil-api migrate up` (or set MIGRATE_ON_START=true):\n  %s",
+				strings.Join(problems, "\n  "))
+		}
+	}
+
+	// `trackveil-api deadletter <command>` manages rejected hits instead of serving
+	if len(os.Args) > 1 && os.Args[1] == "deadletter" {
+		if err := runDeadLetter(cfg, db, os.Args[2:]); err != nil {
+			log.Fatalf("deadletter: %v", err)
+		}
+		return
+	}
+
+	// `trackveil-api archive <command>` archives and restores raw hits instead of serving
+	if len(os.Args) > 1 && os.Args[1] == "archive" {
+		if err := runArchive(cfg, db, os.Args[2:]); err != nil {
+			log.Fatalf("archive: %v", err)
+		}
+		return
+	}
+
+	// `trackveil-api site <command>` exports and imports whole sites instead of serving
+	if len(os.Args) > 1 && os.Args[1] == "site" {
+		if err := runSite(cfg, db, os.Args[2:]); err != nil {
+			log.Fatalf("site: %v", err)
+		}
+		return
+	}
+
+	// `trackveil-api accesslog import` imports page views from web server logs instead of serving
+	if len(os.Args) > 1 && os.Args[1] == "accesslog" {
+		if err := runAccessLog(cfg, db, os.Args[2:]); err != nil {
+			log.Fatalf("accesslog: %v", err)
+		}
+		return
+	}
 
 	// Set Gin mode
 	if cfg.API.Env == "production" {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
-	// Initialize router
-	router := gin.Default()
+	// Initialize router; every request gets an ID that is logged and echoed back
+	router := gin.New()
+	router.Use(middleware.RequestID(), middleware.Logger(), gin.Recovery())
+
+	// Client IPs (rate limits, hits) come from forwarding headers only when
+	// set by a trusted proxy; gin would otherwise trust any sender
+	if err := router.SetTrustedProxies(cfg.API.TrustedProxies); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
 
 	// Add CORS middleware
 	router.Use(middleware.CORS(cfg.CORS.AllowedOrigins))
 
+	// Background jobs stop on shutdown, once the servers have
+	bg := newWorkers()
+
+	// Page views and events go to the configured storage backend
+	store, err := newStore(bg, cfg, db)
+	if err != nil {
+		log.Fatalf("Failed to set up storage: %v", err)
+	}
+	log.Printf("Storing hits in %s", store.Backend())
+
+	// Duplicate suppression; expired client event IDs are purged hourly
+	deduplicator := dedup.New(db, store,
+		time.Duration(cfg.Dedup.WindowSeconds)*time.Second,
+		time.Duration(cfg.Dedup.EventIDRetention)*time.Hour)
+	bg.Go(func(ctx context.Context) { deduplicator.Run(ctx, time.Hour) })
+
+	// Replicas are health checked; lagging or unreachable ones fall back to the primary
+	bg.Go(func(ctx context.Context) {
+		db.RunReplicaChecks(ctx, time.Duration(cfg.Database.ReplicaCheckSeconds)*time.Second)
+	})
+
+	if store.Backend() == storage.BackendPostgres {
+		// Monthly hit partitions are created ahead and expired ones removed daily
+		partitionMaintainer := partitions.New(db,
+			cfg.Partition.MonthsAhead, cfg.Partition.RetentionMonths, cfg.Partition.DropExpired)
+		bg.Go(func(ctx context.Context) { partitionMaintainer.Run(ctx, 24*time.Hour) })
+	}
+	if store.Backend() != storage.BackendClickHouse {
+		// Hourly and daily reporting rollups, with catch-up and late hit recomputation
+		aggregator := rollups.NewAggregator(db)
+		bg.Go(func(ctx context.Context) {
+			aggregator.Run(ctx, time.Duration(cfg.Rollup.IntervalSeconds)*time.Second)
+		})
+	}
+
+	// Data past its retention period is purged in batches
+	retentionDefaults := models.RetentionPolicy{
+		RawHitDays:  &cfg.Retention.RawHitDays,
+		VisitorDays: &cfg.Retention.VisitorDays,
+		RollupDays:  &cfg.Retention.RollupDays,
+	}
+	purger := retention.NewPurger(db, retentionDefaults, cfg.Retention.BatchSize)
+
+	// Closed days of raw hits are archived to Parquet
+	bucket, err := newBucket(cfg)
+	if err != nil {
+		log.Fatalf("Failed to set up the archive: %v", err)
+	}
+	if bucket != nil {
+		if store.Backend() == storage.BackendClickHouse {
+			log.Fatalf("Hits stored in ClickHouse are not archived; unset ARCHIVE_DIR and ARCHIVE_S3_BUCKET")
+		}
+		archiver := archive.NewArchiver(db, bucket, cfg.Archive.Prefix, cfg.Archive.LagDays)
+		bg.Go(func(ctx context.Context) {
+			archiver.Run(ctx, time.Duration(cfg.Archive.IntervalMinutes)*time.Minute)
+		})
+		log.Printf("Archiving raw hits to %s", bucket)
+		if cfg.Archive.RetentionOnly {
+			purger.ArchivedOnly()
+		}
+	}
+	bg.Go(func(ctx context.Context) {
+		purger.Run(ctx, time.Duration(cfg.Retention.IntervalMinutes)*time.Minute)
+	})
+
+	// Browser hits are spooled to disk while storage is unavailable
+	var hitSpool *spool.Spool
+	if cfg.Spool.Dir != "" {
+		hitSpool, err = spool.Open(cfg.Spool.Dir, int64(cfg.Spool.SegmentMB)<<20, int64(cfg.Spool.MaxMB)<<20)
+		if err != nil {
+			log.Fatalf("Failed to open spool: %v", err)
+		}
+		log.Printf("Spooling hits to %s (%d queued)", cfg.Spool.Dir, hitSpool.Stats().Records)
+	}
+
+	// Stored hits are streamed to the sinks enabled for their site
+	dispatcher, err := newDispatcher(cfg, db)
+	if err != nil {
+		log.Fatalf("Failed to set up sinks: %v", err)
+	}
+	if dispatcher != nil {
+		bg.Go(func(ctx context.Context) { dispatcher.Run(ctx, sinkReloadInterval) })
+		log.Printf("Streaming hits to %s", strings.Join(dispatcher.Sinks(), ", "))
+	}
+
 	// Initialize handlers
-	trackHandler := handlers.NewTrackHandler(db)
+	goalEvaluator := goals.NewEvaluator(db, store)
+	trackHandler := handlers.NewTrackHandler(db, store, goalEvaluator, deduplicator, cfg.API.EnforceOrigin, hitSpool, dispatcher)
+	goalsHandler := handlers.NewGoalsHandler(db, store, goalEvaluator)
+	funnelsHandler := handlers.NewFunnelsHandler(db, store)
+	apiKeysHandler := handlers.NewAPIKeysHandler(db)
+	diagnosticsHandler := handlers.NewDiagnosticsHandler(deduplicator)
+	statsHandler := handlers.NewStatsHandler(store)
+	scriptHandler := handlers.NewScriptHandler(db, script.NewServer(db), cfg.API.PublicURL)
+	domainResolver := domains.NewResolver(db)
+	domainsHandler := handlers.NewDomainsHandler(db, domainResolver)
+	retentionHandler := handlers.NewRetentionHandler(db, retentionDefaults)
+	sinksHandler := handlers.NewSinksHandler(db, dispatcher)
+	archivesHandler := handlers.NewArchivesHandler(db)
+
+	// Spooled hits are replayed in order once the database answers again
+	var replayer *spool.Replayer
+	if hitSpool != nil {
+		replayer = spool.NewReplayer(hitSpool, db.Ping, trackHandler.Replay)
+		bg.Go(func(ctx context.Context) {
+			replayer.Run(ctx, time.Duration(cfg.Spool.ReplayIntervalSeconds)*time.Second)
+		})
+	}
+	metricsHandler := handlers.NewMetricsHandler(hitSpool, replayer, dispatcher)
+
+	// Tracker and hits on customer custom domains resolve the site from the Host header
+	customDomain := handlers.CustomDomain(domainResolver)
+	ingestCustomDomain := handlers.IngestCustomDomain(domainResolver)
 
 	// Routes
 	router.GET("/health", trackHandler.Health)
-	router.POST("/track", trackHandler.Track)
-	router.GET("/track", trackHandler.Track) // Support GET for image pixel fallback
+	router.GET("/metrics", middleware.AdminAuth(cfg.API.AdminToken), metricsHandler.Metrics)
+
+	// Tracker script, with per-site settings at /js/<site_id>.js
+	router.GET("/tracker.js", customDomain, scriptHandler.Tracker)
+	router.GET("/js/:file", customDomain, scriptHandler.SiteScript)
+
+	// Ingestion endpoints, rate limited per client IP
+	rateLimit := middleware.RateLimit(cfg.RateLimit.Requests, time.Duration(cfg.RateLimit.WindowSeconds)*time.Second)
+	router.POST("/track", rateLimit, ingestCustomDomain, trackHandler.Track)
+	router.GET("/track", middleware.Pixel(), rateLimit, ingestCustomDomain, trackHandler.Track) // Image pixel fallback; always answers with the GIF
+	router.POST("/track/server", rateLimit, trackHandler.ServerTrack)                           // Server-to-server, per-site key
+	router.POST("/api/event", rateLimit, trackHandler.PlausibleEvent)                           // Plausible-compatible ingestion
+	router.POST("/mp/collect", rateLimit, trackHandler.GA4Collect)                              // GA4 Measurement Protocol
+	router.POST("/debug/mp/collect", rateLimit, trackHandler.GA4DebugCollect)
+
+	// Management and analytics API (bearer token)
+	site := router.Group("/api/sites/:site_id", middleware.AdminAuth(cfg.API.AdminToken), handlers.RequireSite(db))
+	site.GET("/stats", statsHandler.Stats)
+	site.GET("/stats/:dimension", statsHandler.Breakdown)
+	site.GET("/goals", goalsHandler.List)
+	site.POST("/goals", goalsHandler.Create)
+	site.GET("/goals/report", goalsHandler.Report)
+	site.DELETE("/goals/:goal_id", goalsHandler.Delete)
+	site.GET("/funnels", funnelsHandler.List)
+	site.POST("/funnels", funnelsHandler.Create)
+	site.GET("/funnels/:funnel_id/report", funnelsHandler.Report)
+	site.DELETE("/funnels/:funnel_id", funnelsHandler.Delete)
+	site.GET("/keys", apiKeysHandler.List)
+	site.POST("/keys", apiKeysHandler.Create)
+	site.POST("/keys/:key_id/rotate", apiKeysHandler.Rotate)
+	site.DELETE("/keys/:key_id", apiKeysHandler.Revoke)
+	site.GET("/diagnostics/duplicates", diagnosticsHandler.Duplicates)
+	site.GET("/tracker", scriptHandler.GetSettings)
+	site.PUT("/tracker", scriptHandler.UpdateSettings)
+	site.GET("/domains", domainsHandler.List)
+	site.POST("/domains", domainsHandler.Create)
+	site.DELETE("/domains/:domain_id", domainsHandler.Delete)
+	site.GET("/retention", retentionHandler.GetSite)
+	site.PUT("/retention", retentionHandler.UpdateSite)
+	site.GET("/sinks", sinksHandler.List)
+	site.PUT("/sinks/:sink", sinksHandler.Save)
+	site.DELETE("/sinks/:sink", sinksHandler.Delete)
+	site.GET("/archives", archivesHandler.List)
+
+	// Retention plans, assigned per account
+	admin := router.Group("/api", middleware.AdminAuth(cfg.API.AdminToken))
+	admin.GET("/retention/plans", retentionHandler.ListPlans)
+	admin.PUT("/retention/plans/:name", retentionHandler.SavePlan)
+	admin.DELETE("/retention/plans/:name", retentionHandler.DeletePlan)
+	admin.PUT("/accounts/:account_id/retention", retentionHandler.SetAccountPlan)
 
 	// Start server
 	addr := fmt.Sprintf(":%d", cfg.API.Port)
 	log.Printf("Starting Trackveil API on %s", addr)
 	log.Printf("Environment: %s", cfg.API.Env)
 
-	// Graceful shutdown
+	// HTTPS for custom domains, with certificates from the certificate
+	// directory and, if configured, issued on demand through ACME
+	var handler http.Handler = router
+	servers := []*http.Server{}
+	if cfg.TLS.CertDir != "" {
+		provider := certs.Chain{certs.NewDirProvider(cfg.TLS.CertDir)}
+		if cfg.TLS.ACMEDirectoryURL != "" {
+			acmeProvider, err := certs.NewACMEProvider(certs.ACMEConfig{
+				DirectoryURL: cfg.TLS.ACMEDirectoryURL,
+				Email:        cfg.TLS.ACMEEmail,
+				CacheDir:     filepath.Join(cfg.TLS.CertDir, "acme"),
+				CAFile:       cfg.TLS.ACMECAFile,
+			}, domainResolver.Allowed)
+			if err != nil {
+				log.Fatalf("Failed to configure ACME: %v", err)
+			}
+			provider = append(provider, acmeProvider)
+			handler = acmeProvider.HTTPHandler(router) // HTTP-01 challenges
+		}
+
+		tlsServer := &http.Server{
+			Addr:      cfg.TLS.Addr,
+			Handler:   router,
+			TLSConfig: certs.TLSConfig(provider),
+		}
+		servers = append(servers, tlsServer)
+		log.Printf("Starting HTTPS for custom domains on %s", cfg.TLS.Addr)
+		go func() {
+			if err := tlsServer.ListenAndServeTLS("", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalf("Failed to start HTTPS server: %v", err)
+			}
+		}()
+	}
+
+	server := &http.Server{Addr: addr, Handler: handler}
+	servers = append(servers, server)
 	go func() {
-		if err := router.Run(addr); err != nil {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Fatalf("Failed to start server: %v", err)
 		}
 	}()
@@ -74,5 +393,28 @@ func main() {
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
+	// Graceful shutdown: stop accepting requests and let those in flight
+	// finish, stop the background jobs, then write what is buffered
 	log.Println("Shutting down server...")
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelShutdown()
+	for _, s := range servers {
+		if err := s.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Failed to shut down server on %s: %v", s.Addr, err)
+		}
+	}
+	if err := closeStore(bg, store); err != nil {
+		log.Printf("Failed to close storage: %v", err)
+	}
+	if dispatcher != nil {
+		if err := dispatcher.Close(); err != nil {
+			log.Printf("Failed to close sinks: %v", err)
+		}
+	}
+	if hitSpool != nil {
+		if err := hitSpool.Close(); err != nil {
+			log.Printf("Failed to close spool: %v", err)
+		}
+	}
+	log.Println("Server stopped")
 }
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/migrate"
+)
+
+const migrateUsage = `usage: trackveil-api migrate <command>
+
+Commands:
+  up                  apply all pending migrations
+  down [N]            roll back the last N applied migrations (default 1)
+  status              list migrations and when they were applied
+  verify              fail unless every migration is applied and unchanged
+  baseline <version>  record migrations up to version as applied without
+                      running them, for a database migrated by hand
+  seed                insert the development data (test account and site)`
+
+// runMigrate runs a `trackveil-api migrate` command
+func runMigrate(db *database.DB, args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	ctx := context.Background()
+	m, err := migrate.New(db)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "up":
+		applied, err := m.Up(ctx)
+		for _, version := range applied {
+			fmt.Printf("Applied %s\n", version)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Println("Schema is up to date")
+		}
+		return err
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of migrations: %q", args[1])
+			}
+		}
+		reverted, err := m.Down(ctx, steps)
+		for _, version := range reverted {
+			fmt.Printf("Rolled back %s\n", version)
+		}
+		return err
+
+	case "status":
+		statuses, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tSTATUS\tAPPLIED AT\tDOWN")
+		for _, s := range statuses {
+			state, appliedAt, down := "pending", "", "no"
+			switch {
+			case s.Unknown:
+				state = "unknown"
+			case s.Modified:
+				state = "modified"
+			case s.Applied:
+				state = "applied"
+			}
+			if s.Applied {
+				appliedAt = s.AppliedAt.UTC().Format("2006-01-02 15:04:05")
+			}
+			if s.Reversible {
+				down = "yes"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", s.Version, state, appliedAt, down)
+		}
+		return w.Flush()
+
+	case "verify":
+		problems, err := m.Verify(ctx)
+		if err != nil {
+			return err
+		}
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		if len(problems) > 0 {
+			return fmt.Errorf("schema does not match this binary (%d problems)", len(problems))
+		}
+		fmt.Println("Schema matches this binary")
+		return nil
+
+	case "baseline":
+		if len(args) < 2 {
+			return errors.New("usage: trackveil-api migrate baseline <version>")
+		}
+		recorded, err := m.Baseline(ctx, args[1])
+		for _, version := range recorded {
+			fmt.Printf("Recorded %s as applied\n", version)
+		}
+		return err
+
+	case "seed":
+		if err := m.Seed(ctx); err != nil {
+			return err
+		}
+		fmt.Println("Seed data applied")
+		return nil
+	}
+	return errors.New(migrateUsage)
+}
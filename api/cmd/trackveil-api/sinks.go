@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"trackveilapi/internal/config"
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/sinks"
+)
+
+// newDispatcher sets up the configured streaming sinks, with the sites' sink
+// settings loaded. It returns nil when no sink is configured.
+func newDispatcher(cfg *config.Config, db *database.DB) (*sinks.Dispatcher, error) {
+	var configured []sinks.Sink
+	if cfg.Sinks.NDJSONDir != "" {
+		ndjson, err := sinks.NewNDJSONSink(cfg.Sinks.NDJSONDir,
+			int64(cfg.Sinks.NDJSONRotateMB)<<20,
+			time.Duration(cfg.Sinks.NDJSONRotateMinutes)*time.Minute)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open the NDJSON sink: %w", err)
+		}
+		configured = append(configured, ndjson)
+	}
+	if cfg.Sinks.WebhookURL != "" {
+		configured = append(configured, sinks.NewWebhookSink(cfg.Sinks.WebhookURL, cfg.Sinks.WebhookSecret,
+			time.Duration(cfg.Sinks.WebhookTimeoutSeconds)*time.Second, cfg.Sinks.WebhookRetries))
+	}
+	if cfg.Sinks.NATSURL != "" {
+		nats, err := sinks.NewNATSSink(cfg.Sinks.NATSURL, cfg.Sinks.NATSSubject,
+			time.Duration(cfg.Sinks.NATSTimeoutSeconds)*time.Second)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SINK_NATS_URL: %w", err)
+		}
+		configured = append(configured, nats)
+	}
+	if len(configured) == 0 {
+		return nil, nil
+	}
+
+	dispatcher := sinks.NewDispatcher(db, sinks.Options{
+		QueueSize:     cfg.Sinks.QueueSize,
+		BatchSize:     cfg.Sinks.BatchSize,
+		FlushInterval: time.Duration(cfg.Sinks.FlushMillis) * time.Millisecond,
+	}, configured...)
+	if err := dispatcher.Reload(); err != nil {
+		dispatcher.Close()
+		return nil, fmt.Errorf("failed to load site sinks: %w", err)
+	}
+	return dispatcher, nil
+}
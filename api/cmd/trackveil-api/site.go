@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"trackveilapi/internal/config"
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/storage"
+	"trackveilapi/internal/transfer"
+)
+
+const siteUsage = `usage: trackveil-api site <command>
+
+Commands:
+  export -site ID [-o FILE]              write the site's configuration and
+                                         data to FILE (default
+                                         <site ID>.tar.gz)
+  verify FILE                            check an export against its manifest
+  import [-site ID] [-account ID] [-conflict fail|new|replace] FILE
+                                         import an export, under its own site
+                                         ID and account unless given others
+
+If the site ID is taken, -conflict new imports under a generated ID and
+-conflict replace deletes the existing site and its data first. API keys are
+not exported.`
+
+// runSite runs a `trackveil-api site` command
+func runSite(cfg *config.Config, db *database.DB, args []string) error {
+	if len(args) == 0 {
+		return errors.New(siteUsage)
+	}
+	if cfg.Storage.Backend == storage.BackendClickHouse {
+		return errors.New("sites with hits stored in ClickHouse cannot be exported or imported")
+	}
+
+	fs := flag.NewFlagSet("site "+args[0], flag.ContinueOnError)
+	siteID := fs.String("site", "", "site ID")
+	accountID := fs.String("account", "", "account to import into")
+	conflict := fs.String("conflict", transfer.ConflictFail, "if the site ID is taken: fail, new or replace")
+	output := fs.String("o", "", "export file")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	switch args[0] {
+	case "export":
+		if *siteID == "" || fs.NArg() > 0 {
+			return errors.New("usage: trackveil-api site export -site ID [-o FILE]")
+		}
+		path := *output
+		if path == "" {
+			path = *siteID + ".tar.gz"
+		}
+		m, err := exportSite(ctx, db, *siteID, path)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Exported site %s to %s: %d visitors, %d sessions, %d page views, %d events\n",
+			m.SiteID, path, m.Rows("visitors"), m.Rows("sessions"), m.Rows("page_views"), m.Rows("events"))
+		return nil
+
+	case "verify":
+		if fs.NArg() != 1 {
+			return errors.New("usage: trackveil-api site verify FILE")
+		}
+		m, err := transfer.Verify(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: site %s exported %s, version %d\n", fs.Arg(0), m.SiteID,
+			m.ExportedAt.Format("2006-01-02 15:04:05 MST"), m.Version)
+		for _, f := range m.Files {
+			fmt.Printf("  %-22s %10d rows\n", f.Table, f.Rows)
+		}
+		return nil
+
+	case "import":
+		if fs.NArg() != 1 {
+			return errors.New("usage: trackveil-api site import [-site ID] [-account ID] [-conflict fail|new|replace] FILE")
+		}
+		result, err := transfer.Import(ctx, db, fs.Arg(0), transfer.Options{
+			SiteID:    *siteID,
+			AccountID: *accountID,
+			Conflict:  *conflict,
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Imported site %s: %s\n", result.SiteID, result.Describe())
+		return nil
+	}
+	return errors.New(siteUsage)
+}
+
+// exportSite writes an export next to path and renames it into place once
+// complete
+func exportSite(ctx context.Context, db *database.DB, siteID, path string) (*transfer.Manifest, error) {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp)
+
+	m, err := transfer.Export(ctx, db, siteID, f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return m, os.Rename(tmp, path)
+}
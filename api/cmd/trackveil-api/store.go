@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"trackveilapi/internal/config"
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/storage"
+)
+
+// newStore sets up the configured storage backend. Buffered hits are
+// flushed in the background until bg is stopped; closeStore then writes the rest.
+func newStore(bg *workers, cfg *config.Config, db *database.DB) (storage.Store, error) {
+	switch cfg.Storage.Backend {
+	case storage.BackendClickHouse:
+		chStore, err := storage.NewClickHouse(storage.ClickHouseConfig{
+			URL:           cfg.Storage.ClickHouseURL,
+			Database:      cfg.Storage.ClickHouseDatabase,
+			User:          cfg.Storage.ClickHouseUser,
+			Password:      cfg.Storage.ClickHousePassword,
+			BatchSize:     cfg.Storage.ClickHouseBatchSize,
+			FlushInterval: time.Duration(cfg.Storage.ClickHouseFlushMillis) * time.Millisecond,
+		}, db)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to ClickHouse: %w", err)
+		}
+		bg.Go(chStore.Run)
+		return chStore, nil
+	case storage.BackendSQLite:
+		sqliteStore, err := storage.NewSQLite(db, storage.SQLiteConfig{
+			BatchSize:     cfg.Storage.SQLiteBatchSize,
+			FlushInterval: time.Duration(cfg.Storage.SQLiteFlushMillis) * time.Millisecond,
+		})
+		if err != nil {
+			return nil, err
+		}
+		bg.Go(sqliteStore.Run)
+		return sqliteStore, nil
+	default:
+		pgStore, err := storage.NewPostgres(db, storage.PostgresConfig{
+			WriteMode:     cfg.Storage.PostgresWriteMode,
+			BatchSize:     cfg.Storage.PostgresBatchSize,
+			FlushInterval: time.Duration(cfg.Storage.PostgresFlushMillis) * time.Millisecond,
+		})
+		if err != nil {
+			return nil, err
+		}
+		bg.Go(pgStore.Run)
+		return pgStore, nil
+	}
+}
+
+// closeStore stops the background flushes, then writes the buffered hits
+// and closes the store
+func closeStore(bg *workers, store storage.Store) error {
+	bg.Stop()
+	if err := store.Close(); err != nil {
+		return fmt.Errorf("failed to flush %s storage: %w", store.Backend(), err)
+	}
+	return nil
+}
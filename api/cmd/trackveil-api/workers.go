@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// workers runs background loops until Stop, so shutdown can wait for them
+// to return before closing what they write to
+type workers struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newWorkers() *workers {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &workers{ctx: ctx, cancel: cancel}
+}
+
+// Go runs a loop that returns once its context is cancelled
+func (w *workers) Go(run func(ctx context.Context)) {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		run(w.ctx)
+	}()
+}
+
+// Stop cancels the loops and waits for them to return
+func (w *workers) Stop() {
+	w.cancel()
+	w.wg.Wait()
+}
@@ -0,0 +1,65 @@
+package accesslog
+
+import (
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/mssola/user_agent"
+)
+
+// assetExtensions are the file extensions of requests that are not pages
+var assetExtensions = map[string]bool{
+	".css": true, ".js": true, ".mjs": true, ".map": true, ".json": true, ".xml": true, ".txt": true,
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".svg": true, ".ico": true, ".webp": true,
+	".avif": true, ".bmp": true, ".woff": true, ".woff2": true, ".ttf": true, ".otf": true, ".eot": true,
+	".mp4": true, ".webm": true, ".mp3": true, ".ogg": true, ".wav": true, ".pdf": true, ".zip": true,
+	".gz": true, ".wasm": true, ".webmanifest": true,
+}
+
+// IsAsset reports whether a request path is for a static asset, not a page
+func IsAsset(p string) bool {
+	if i := strings.IndexAny(p, "?#"); i >= 0 {
+		p = p[:i]
+	}
+	return assetExtensions[strings.ToLower(path.Ext(p))]
+}
+
+// botMarkers are user agent fragments of crawlers, monitors and HTTP
+// clients the user agent library does not flag as bots. "bot" alone would
+// match phone models such as Cubot.
+var botMarkers = []string{
+	"bot/", "bot;", "bot)", "bot-", "+http", "crawler", "spider", "slurp", "curl/", "wget/",
+	"python-requests", "python-urllib", "go-http-client", "java/", "okhttp", "libwww-perl",
+	"httpclient", "headlesschrome", "lighthouse", "pingdom", "uptimerobot", "statuscake",
+	"facebookexternalhit",
+}
+
+// IsBot reports whether a user agent is a bot or a script. Requests without
+// one are bots too.
+func IsBot(ua string) bool {
+	if ua == "" {
+		return true
+	}
+	if user_agent.New(ua).Bot() {
+		return true
+	}
+	lower := strings.ToLower(ua)
+	for _, m := range botMarkers {
+		if strings.Contains(lower, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// compilePathPatterns turns the site's excluded path patterns (* matches
+// anything) into anchored regexps, like the tracker does
+func compilePathPatterns(patterns []string) []*regexp.Regexp {
+	res := make([]*regexp.Regexp, len(patterns))
+	for i, p := range patterns {
+		quoted := regexp.QuoteMeta(p)
+		res[i] = regexp.MustCompile("^" + strings.ReplaceAll(quoted, `\*`, ".*") + "$")
+	}
+	return res
+}
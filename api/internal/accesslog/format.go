@@ -0,0 +1,339 @@
+// Package accesslog imports historical page views from web server access
+// logs: nginx and Apache Common and Combined Log Format, or any nginx
+// log_format or Apache LogFormat string.
+package accesslog
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Named formats, in nginx log_format syntax
+var namedFormats = map[string]string{
+	"combined": `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent"`,
+	"common":   `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent`,
+}
+
+// Apache LogFormat directives and the nginx variables they log
+var apacheDirectives = map[string]string{
+	"h":                    "remote_addr",
+	"a":                    "remote_addr",
+	"t":                    "apache_time", // [time_local], brackets included
+	"r":                    "request",
+	"s":                    "status",
+	">s":                   "status",
+	"m":                    "request_method",
+	"U":                    "uri",
+	"q":                    "query_string",
+	"v":                    "host",
+	"{Host}i":              "host",
+	"{Referer}i":           "http_referer",
+	"{User-Agent}i":        "http_user_agent",
+	"{User-agent}i":        "http_user_agent",
+	"{X-Forwarded-For}i":   "http_x_forwarded_for",
+	"{X-Forwarded-Proto}i": "scheme",
+}
+
+// Entry is a parsed access log line
+type Entry struct {
+	IP        string
+	Time      time.Time
+	Method    string
+	URI       string // path and query
+	Status    int
+	Referrer  string
+	UserAgent string
+	Host      string // "" if not logged
+	Scheme    string // "" if not logged
+}
+
+// Format parses the lines of one access log format
+type Format struct {
+	spec     string
+	literals []string // literals[i] precedes fields[i]; the last follows the last field
+	fields   []string
+}
+
+// ParseFormat compiles a log format: "combined", "common", an nginx
+// log_format string ($variables) or an Apache LogFormat string (%directives).
+// Variables that are not needed are skipped.
+func ParseFormat(spec string) (*Format, error) {
+	if named, ok := namedFormats[spec]; ok {
+		spec = named
+	}
+	f := &Format{spec: spec}
+	var lit strings.Builder
+	addField := func(name string) error {
+		if len(f.fields) > 0 && lit.Len() == 0 {
+			return fmt.Errorf("log format %q: %s directly follows %s; fields must be separated", spec, name, f.fields[len(f.fields)-1])
+		}
+		f.literals = append(f.literals, lit.String())
+		f.fields = append(f.fields, name)
+		lit.Reset()
+		return nil
+	}
+
+	for i := 0; i < len(spec); i++ {
+		switch c := spec[i]; {
+		case c == '$':
+			j := i + 1
+			if j < len(spec) && spec[j] == '{' {
+				end := strings.IndexByte(spec[j:], '}')
+				if end < 0 {
+					return nil, fmt.Errorf("log format %q: unterminated ${", spec)
+				}
+				if err := addField(spec[j+1 : j+end]); err != nil {
+					return nil, err
+				}
+				i = j + end
+				continue
+			}
+			for j < len(spec) && (spec[j] == '_' || isAlnum(spec[j])) {
+				j++
+			}
+			if j == i+1 {
+				lit.WriteByte(c)
+				continue
+			}
+			if err := addField(spec[i+1 : j]); err != nil {
+				return nil, err
+			}
+			i = j - 1
+		case c == '%' && i+1 < len(spec) && spec[i+1] == '%':
+			lit.WriteByte('%')
+			i++
+		case c == '%' && i+1 < len(spec):
+			directive, n := apacheDirective(spec[i+1:])
+			if n == 0 {
+				return nil, fmt.Errorf("log format %q: invalid directive at %q", spec, spec[i:])
+			}
+			name, ok := apacheDirectives[directive]
+			if !ok {
+				name = "%" + directive // logged, but not needed
+			}
+			if err := addField(name); err != nil {
+				return nil, err
+			}
+			i += n
+		case c == '\\' && i+1 < len(spec) && spec[i+1] == '"':
+			// Apache formats are usually quoted for the config file
+			lit.WriteByte('"')
+			i++
+		default:
+			lit.WriteByte(c)
+		}
+	}
+	f.literals = append(f.literals, lit.String())
+
+	if !f.has("remote_addr") && !f.has("http_x_forwarded_for") {
+		return nil, fmt.Errorf("log format %q logs no client address", spec)
+	}
+	if !f.has("time_local") && !f.has("apache_time") && !f.has("time_iso8601") && !f.has("msec") {
+		return nil, fmt.Errorf("log format %q logs no time", spec)
+	}
+	if !f.has("request") && !f.has("request_uri") && !f.has("uri") {
+		return nil, fmt.Errorf("log format %q logs no request", spec)
+	}
+	return f, nil
+}
+
+// apacheDirective returns the directive at the start of s, without its %,
+// and its length: a letter with an optional > or < and {argument} before it
+func apacheDirective(s string) (string, int) {
+	i := 0
+	for i < len(s) && (s[i] == '>' || s[i] == '<') {
+		i++
+	}
+	if i < len(s) && s[i] == '{' {
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			return "", 0
+		}
+		i += end + 1
+	}
+	if i >= len(s) || !isAlnum(s[i]) {
+		return "", 0
+	}
+	return s[:i+1], i + 1
+}
+
+func isAlnum(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+func (f *Format) has(field string) bool {
+	for _, name := range f.fields {
+		if name == field {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the format, with a named format expanded
+func (f *Format) String() string {
+	return f.spec
+}
+
+// Parse parses a line
+func (f *Format) Parse(line string) (*Entry, error) {
+	if !strings.HasPrefix(line, f.literals[0]) {
+		return nil, errors.New("line does not match the log format")
+	}
+	values := make(map[string]string, len(f.fields))
+	rest := line[len(f.literals[0]):]
+	for i, name := range f.fields {
+		next := f.literals[i+1]
+		quoted := strings.HasSuffix(f.literals[i], `"`) && strings.HasPrefix(next, `"`)
+
+		var end int
+		switch {
+		case next == "" && i == len(f.fields)-1:
+			end = len(rest)
+		case quoted:
+			end = closingQuote(rest, next)
+		default:
+			end = strings.Index(rest, next)
+		}
+		if end < 0 {
+			return nil, errors.New("line does not match the log format")
+		}
+		value := rest[:end]
+		if quoted {
+			value = unescape(value)
+		}
+		values[name] = value
+		rest = rest[end+len(next):]
+	}
+	if strings.TrimSpace(rest) != "" {
+		return nil, errors.New("line does not match the log format")
+	}
+	return entry(values)
+}
+
+// closingQuote returns the index of the quote ending a quoted value and
+// starting next, skipping escaped quotes
+func closingQuote(s, next string) int {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			if strings.HasPrefix(s[i:], next) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// unescape undoes the escaping of quoted values: \xHH by nginx, \" and \\
+// by Apache
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		switch s[i+1] {
+		case 'x':
+			if i+3 < len(s) {
+				if n, err := strconv.ParseUint(s[i+2:i+4], 16, 8); err == nil {
+					b.WriteByte(byte(n))
+					i += 3
+					continue
+				}
+			}
+			b.WriteByte(s[i])
+		case '"', '\\':
+			b.WriteByte(s[i+1])
+			i++
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// entry builds an entry from the logged values
+func entry(v map[string]string) (*Entry, error) {
+	e := &Entry{
+		IP:        v["remote_addr"],
+		Method:    v["request_method"],
+		Referrer:  dash(v["http_referer"]),
+		UserAgent: dash(v["http_user_agent"]),
+		Host:      dash(v["host"]),
+		Scheme:    dash(v["scheme"]),
+	}
+	if e.Host == "" {
+		e.Host = dash(v["http_host"])
+	}
+	if e.Host == "_" {
+		e.Host = "" // nginx's catch-all server_name
+	}
+
+	// Behind a proxy the client is the first forwarded address
+	if fwd := dash(v["http_x_forwarded_for"]); fwd != "" {
+		e.IP = strings.TrimSpace(strings.Split(fwd, ",")[0])
+	}
+	if e.IP == "" {
+		return nil, errors.New("no client address")
+	}
+
+	var err error
+	switch {
+	case v["time_local"] != "":
+		e.Time, err = time.Parse("02/Jan/2006:15:04:05 -0700", v["time_local"])
+	case v["apache_time"] != "":
+		e.Time, err = time.Parse("[02/Jan/2006:15:04:05 -0700]", v["apache_time"])
+	case v["time_iso8601"] != "":
+		e.Time, err = time.Parse(time.RFC3339, v["time_iso8601"])
+	default:
+		var secs float64
+		secs, err = strconv.ParseFloat(v["msec"], 64)
+		e.Time = time.UnixMilli(int64(secs * 1000))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid time: %w", err)
+	}
+
+	if request := v["request"]; request != "" {
+		parts := strings.Fields(request)
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("invalid request %q", request)
+		}
+		e.Method, e.URI = parts[0], parts[1]
+	} else {
+		e.URI = v["request_uri"]
+		if e.URI == "" {
+			e.URI = v["uri"]
+			if q := dash(v["query_string"]); q != "" {
+				e.URI += "?" + q
+			} else if q := dash(v["args"]); q != "" {
+				e.URI += "?" + q
+			}
+		}
+	}
+
+	if s := v["status"]; s != "" {
+		if e.Status, err = strconv.Atoi(s); err != nil {
+			return nil, fmt.Errorf("invalid status %q", s)
+		}
+	}
+	return e, nil
+}
+
+// dash returns "" for the "-" logged for missing values
+func dash(s string) string {
+	if s == "-" {
+		return ""
+	}
+	return s
+}
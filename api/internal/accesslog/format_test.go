@@ -0,0 +1,154 @@
+package accesslog
+
+import (
+	"testing"
+	"time"
+)
+
+const firefox = "Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0"
+
+func TestParse(t *testing.T) {
+	at := time.Date(2026, 10, 10, 11, 55, 36, 0, time.UTC)
+
+	cases := []struct {
+		name   string
+		format string
+		line   string
+		want   Entry
+	}{
+		{
+			"combined", "combined",
+			`203.0.113.5 - alice [10/Oct/2026:13:55:36 +0200] "GET /pricing?ref=hn HTTP/1.1" 200 2326 "https://news.ycombinator.com/" "` + firefox + `"`,
+			Entry{IP: "203.0.113.5", Time: at, Method: "GET", URI: "/pricing?ref=hn", Status: 200,
+				Referrer: "https://news.ycombinator.com/", UserAgent: firefox},
+		},
+		{
+			"combined without referrer or user agent", "combined",
+			`203.0.113.5 - - [10/Oct/2026:13:55:36 +0200] "GET / HTTP/1.1" 304 0 "-" "-"`,
+			Entry{IP: "203.0.113.5", Time: at, Method: "GET", URI: "/", Status: 304},
+		},
+		{
+			"common", "common",
+			`2001:db8::1 - - [10/Oct/2026:11:55:36 +0000] "HEAD /docs HTTP/1.0" 200 -`,
+			Entry{IP: "2001:db8::1", Time: at, Method: "HEAD", URI: "/docs", Status: 200},
+		},
+		{
+			"nginx log_format behind a proxy",
+			`$remote_addr [$time_iso8601] $host "$request" $status "$http_referer" "$http_user_agent" "$http_x_forwarded_for"`,
+			`10.0.0.1 [2026-10-10T11:55:36+00:00] example.com "GET /blog HTTP/2.0" 200 "-" "` + firefox + `" "198.51.100.7, 10.0.0.2"`,
+			Entry{IP: "198.51.100.7", Time: at, Method: "GET", URI: "/blog", Status: 200, UserAgent: firefox, Host: "example.com"},
+		},
+		{
+			"nginx log_format with uri and args",
+			`${remote_addr}|$msec|$scheme|$request_method|$uri|$args|$status`,
+			`203.0.113.5|1791633336.250|http|GET|/search|q=go|200`,
+			Entry{IP: "203.0.113.5", Time: at.Add(250 * time.Millisecond), Method: "GET", URI: "/search?q=go", Status: 200, Scheme: "http"},
+		},
+		{
+			"apache LogFormat",
+			`%v %h %l %u %t \"%r\" %>s %b \"%{Referer}i\" \"%{User-Agent}i\" %{X-Forwarded-Proto}i`,
+			`shop.example.com 192.0.2.44 - - [10/Oct/2026:11:55:36 +0000] "GET /cart HTTP/1.1" 200 10 "https://www.google.com/" "` + firefox + `" https`,
+			Entry{IP: "192.0.2.44", Time: at, Method: "GET", URI: "/cart", Status: 200,
+				Referrer: "https://www.google.com/", UserAgent: firefox, Host: "shop.example.com", Scheme: "https"},
+		},
+		{
+			"nginx escaped quotes", "combined",
+			`203.0.113.5 - - [10/Oct/2026:13:55:36 +0200] "GET /a HTTP/1.1" 200 1 "https://example.com/?q=\x22x\x22" "Agent \x22quoted\x22 \x5C"`,
+			Entry{IP: "203.0.113.5", Time: at, Method: "GET", URI: "/a", Status: 200,
+				Referrer: `https://example.com/?q="x"`, UserAgent: `Agent "quoted" \`},
+		},
+		{
+			"apache escaped quotes",
+			`%h %l %u %t \"%r\" %>s %b \"%{Referer}i\" \"%{User-Agent}i\"`,
+			`203.0.113.5 - - [10/Oct/2026:13:55:36 +0200] "GET /a HTTP/1.1" 200 1 "-" "Agent \"quoted\" \\ \" \"end"`,
+			Entry{IP: "203.0.113.5", Time: at, Method: "GET", URI: "/a", Status: 200, UserAgent: `Agent "quoted" \ " "end`},
+		},
+	}
+	for _, c := range cases {
+		f, err := ParseFormat(c.format)
+		if err != nil {
+			t.Errorf("%s: ParseFormat: %v", c.name, err)
+			continue
+		}
+		e, err := f.Parse(c.line)
+		if err != nil {
+			t.Errorf("%s: Parse: %v", c.name, err)
+			continue
+		}
+		if !e.Time.Equal(c.want.Time) {
+			t.Errorf("%s: time %s, want %s", c.name, e.Time, c.want.Time)
+		}
+		e.Time = c.want.Time
+		if *e != c.want {
+			t.Errorf("%s:\n got %+v\nwant %+v", c.name, *e, c.want)
+		}
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	f, err := ParseFormat("combined")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"",
+		"garbage line",
+		`203.0.113.5 - - [10/Oct/2026:13:55:36 +0200] "GET / HTTP/1.1" 200 1 "-"`,                  // user agent missing
+		`203.0.113.5 - - [10/Oct/2026:13:55:36 +0200] "GET / HTTP/1.1" 200 1 "-" "ua" trailing`,    // extra field
+		`203.0.113.5 - - [2026-10-10 13:55:36] "GET / HTTP/1.1" 200 1 "-" "ua"`,                    // wrong time format
+		`203.0.113.5 - - [10/Oct/2026:13:55:36 +0200] "\x16\x03\x01" 400 1 "-" "-"`,                // TLS on the HTTP port
+		`203.0.113.5 - - [10/Oct/2026:13:55:36 +0200] "GET / HTTP/1.1" OK 1 "-" "ua"`,              // status
+		`203.0.113.5 - - [10/Oct/2026:13:55:36 +0200] "GET / HTTP/1.1" 200 1 "-" "unterminated \"`, // quote escaped
+	} {
+		if e, err := f.Parse(line); err == nil {
+			t.Errorf("Parse(%q) = %+v, want an error", line, *e)
+		}
+	}
+}
+
+func TestParseFormatErrors(t *testing.T) {
+	for _, spec := range []string{
+		`$remote_addr$remote_user [$time_local] "$request"`, // adjacent fields
+		`$remote_addr "$request" $status`,                   // no time
+		`[$time_local] "$request" $status`,                  // no address
+		`$remote_addr [$time_local] $status`,                // no request
+		`$remote_addr [${time_local] "$request"`,            // unterminated ${
+		`%h %{Referer "%r" %t`,                              // unterminated directive
+	} {
+		if _, err := ParseFormat(spec); err == nil {
+			t.Errorf("ParseFormat(%q) succeeded, want an error", spec)
+		}
+	}
+}
+
+func TestFilters(t *testing.T) {
+	assets := map[string]bool{
+		"/":                    false,
+		"/pricing":             false,
+		"/blog/post.html":      false,
+		"/static/app.css":      true,
+		"/img/Logo.PNG?v=2":    true,
+		"/fonts/a.woff2#x":     true,
+		"/download.php?f=a.js": false,
+	}
+	for p, want := range assets {
+		if got := IsAsset(p); got != want {
+			t.Errorf("IsAsset(%q) = %v, want %v", p, got, want)
+		}
+	}
+
+	bots := map[string]bool{
+		"":         true,
+		firefox:    false,
+		"curl/8.0": true,
+		"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)":         true,
+		"Mozilla/5.0 (Linux; Android 10; Cubot X30) AppleWebKit/537.36 Chrome/91.0 Mobile": false,
+		"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 HeadlessChrome/120.0":          true,
+		"python-requests/2.31.0": true,
+	}
+	for ua, want := range bots {
+		if got := IsBot(ua); got != want {
+			t.Errorf("IsBot(%q) = %v, want %v", ua, got, want)
+		}
+	}
+}
@@ -0,0 +1,473 @@
+package accesslog
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/goals"
+	"trackveilapi/internal/models"
+	"trackveilapi/internal/script"
+	"trackveilapi/internal/storage"
+
+	"github.com/google/uuid"
+)
+
+// Reasons lines are skipped
+const (
+	SkipMalformed  = "malformed"
+	SkipOutOfRange = "out_of_range"
+	SkipMethod     = "method"
+	SkipStatus     = "status"
+	SkipAsset      = "asset"
+	SkipBot        = "bot"
+	SkipExcluded   = "excluded"
+	SkipDuplicate  = "duplicate"
+)
+
+// progressEvery is the number of lines between progress reports
+const progressEvery = 100000
+
+// Options control an import
+type Options struct {
+	From, To time.Time   // hits in [From, To) are imported; zero times leave the range open
+	DryRun   bool        // parse and count without writing
+	Progress func(Stats) // called every progressEvery lines, if set
+}
+
+// Stats counts what an import read and stored
+type Stats struct {
+	Lines     int64
+	PageViews int64
+	Visitors  int64 // created
+	Sessions  int64 // created
+	Skipped   map[string]int64
+}
+
+// Describe summarizes the stats
+func (s Stats) Describe() string {
+	desc := fmt.Sprintf("%d lines, %d page views, %d new visitors, %d new sessions",
+		s.Lines, s.PageViews, s.Visitors, s.Sessions)
+	var reasons []string
+	for reason, n := range s.Skipped {
+		reasons = append(reasons, fmt.Sprintf("%d %s", n, reason))
+	}
+	if len(reasons) > 0 {
+		sort.Strings(reasons)
+		desc += "; skipped " + strings.Join(reasons, ", ")
+	}
+	return desc
+}
+
+// Importer turns access log lines into the page views, visitors and sessions
+// the API would have recorded for them. Visitors are identified by IP
+// address and user agent like privacy mode hits, and a visitor's page views
+// within models.SessionTimeout of each other share a session. Logs must be
+// read oldest first. Page views already stored, e.g. by an earlier import of
+// the same log, are skipped.
+type Importer struct {
+	db       *database.DB
+	store    storage.Store
+	goals    *goals.Evaluator
+	format   *Format
+	opts     Options
+	siteID   string
+	domain   string
+	excluded []*regexp.Regexp
+
+	visitors  map[string]*visitor // by fingerprint hash, while their session may continue
+	swept     time.Time           // when visitors were last evicted, in log time
+	dryRun    map[string]bool     // fingerprint hashes of evicted visitors a dry run created
+	watermark time.Time           // of the rollups
+	hours     map[time.Time]bool  // aggregated hours with imported page views
+	stats     Stats
+}
+
+type visitor struct {
+	id        uuid.UUID
+	existing  bool      // stored before the visitor was loaded
+	firstSeen time.Time // the earliest hit
+	lastSeen  time.Time // the latest hit stored when the visitor was loaded
+	session   *session  // the latest
+}
+
+type session struct {
+	id           uuid.UUID
+	started      time.Time
+	lastActivity time.Time
+}
+
+// NewImporter imports page views for a site into store
+func NewImporter(db *database.DB, store storage.Store, siteID string, format *Format, opts Options) (*Importer, error) {
+	im := &Importer{
+		db:       db,
+		store:    store,
+		goals:    goals.NewEvaluator(db, store),
+		format:   format,
+		opts:     opts,
+		siteID:   siteID,
+		visitors: map[string]*visitor{},
+		dryRun:   map[string]bool{},
+		hours:    map[time.Time]bool{},
+		stats:    Stats{Skipped: map[string]int64{}},
+	}
+
+	err := db.QueryRow(`SELECT domain FROM sites WHERE id = $1`, siteID).Scan(&im.domain)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("site %s does not exist", siteID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	im.domain = strings.ToLower(strings.TrimSpace(im.domain))
+
+	// Paths the site's tracker does not track are not imported either
+	settings, err := script.GetSettings(db, siteID)
+	if err != nil {
+		return nil, err
+	}
+	im.excluded = compilePathPatterns(settings.ExcludedPaths)
+
+	// Without the Postgres triggers, hours already aggregated are only
+	// recomputed if marked dirty
+	if store.Backend() == storage.BackendSQLite {
+		var through sql.NullTime
+		err := db.QueryRow(`SELECT completed_through FROM rollup_state WHERE name = 'hourly'`).Scan(&through)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		im.watermark = through.Time
+	}
+	return im, nil
+}
+
+// Read imports the lines of a log
+func (im *Importer) Read(ctx context.Context, r io.Reader) error {
+	br := bufio.NewReaderSize(r, 64*1024)
+	for {
+		line, err := br.ReadString('\n')
+		if line = strings.TrimRight(line, "\r\n"); line != "" {
+			if ierr := im.line(line); ierr != nil {
+				return fmt.Errorf("line %d: %w", im.stats.Lines, ierr)
+			}
+			if im.opts.Progress != nil && im.stats.Lines%progressEvery == 0 {
+				im.opts.Progress(im.Stats())
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// Finish writes the page views still buffered and returns the stats
+func (im *Importer) Finish() (Stats, error) {
+	if im.opts.DryRun {
+		return im.Stats(), nil
+	}
+	if err := im.store.Flush(); err != nil {
+		return im.Stats(), err
+	}
+	for hour := range im.hours {
+		if _, err := im.db.Exec(`
+			INSERT INTO rollup_dirty_hours (site_id, hour) VALUES ($1, $2)
+			ON CONFLICT DO NOTHING
+		`, im.siteID, hour); err != nil {
+			return im.Stats(), err
+		}
+	}
+	return im.Stats(), nil
+}
+
+// Stats returns what was imported so far
+func (im *Importer) Stats() Stats {
+	s := im.stats
+	s.Skipped = make(map[string]int64, len(im.stats.Skipped))
+	for reason, n := range im.stats.Skipped {
+		s.Skipped[reason] = n
+	}
+	return s
+}
+
+// line imports a line, or counts why it is skipped. Only storage failures
+// are returned.
+func (im *Importer) line(line string) error {
+	im.stats.Lines++
+	skip := func(reason string) error {
+		im.stats.Skipped[reason]++
+		return nil
+	}
+
+	e, err := im.format.Parse(line)
+	if err != nil || net.ParseIP(e.IP) == nil {
+		return skip(SkipMalformed)
+	}
+	at := e.Time.UTC()
+	if !im.opts.From.IsZero() && at.Before(im.opts.From) || !im.opts.To.IsZero() && !at.Before(im.opts.To) {
+		return skip(SkipOutOfRange)
+	}
+	if e.Method != "" && e.Method != "GET" {
+		return skip(SkipMethod)
+	}
+	if e.Status != 0 && (e.Status < 200 || e.Status > 299) && e.Status != 304 {
+		return skip(SkipStatus)
+	}
+	if !strings.HasPrefix(e.URI, "/") {
+		return skip(SkipMalformed)
+	}
+	if IsAsset(e.URI) {
+		return skip(SkipAsset)
+	}
+	if IsBot(e.UserAgent) {
+		return skip(SkipBot)
+	}
+	path := e.URI
+	if i := strings.IndexAny(path, "?#"); i >= 0 {
+		path = path[:i]
+	}
+	for _, re := range im.excluded {
+		if re.MatchString(path) {
+			return skip(SkipExcluded)
+		}
+	}
+
+	scheme, host := e.Scheme, strings.ToLower(e.Host)
+	if scheme != "http" {
+		scheme = "https"
+	}
+	if host == "" {
+		host = im.domain
+	}
+	req := models.TrackRequest{PageURL: scheme + "://" + host + e.URI, Referrer: e.Referrer}
+	if errs := req.Sanitize(); len(errs) > 0 {
+		return skip(SkipMalformed)
+	}
+	return im.record(e, at, &req)
+}
+
+// record stores a page view, with its visitor and session
+func (im *Importer) record(e *Entry, at time.Time, req *models.TrackRequest) error {
+	im.evict(at)
+	v, err := im.visitor(models.HashFingerprint(e.IP+"|"+e.UserAgent), at)
+	if err != nil {
+		return err
+	}
+
+	// Only hits up to the visitor's last stored visit can have been imported
+	// before; later ones are new even if they repeat a hit of this import
+	if v.existing && !at.After(v.lastSeen) {
+		stored, err := im.store.RecentPageView(im.siteID, v.id, req.PageURL, at.Add(-time.Nanosecond), at)
+		if err != nil {
+			return err
+		}
+		if stored {
+			im.stats.Skipped[SkipDuplicate]++
+			return nil
+		}
+	}
+
+	s, err := im.session(v, at)
+	if err != nil {
+		return err
+	}
+	im.stats.PageViews++
+	if im.opts.DryRun {
+		return nil
+	}
+
+	userAgent := models.CleanText(e.UserAgent, models.MaxUserAgentLength)
+	browserInfo := models.ParseUserAgent(userAgent)
+	pageView := &models.PageView{
+		SiteID:         im.siteID,
+		VisitorID:      v.id,
+		SessionID:      s.id,
+		PageURL:        req.PageURL,
+		Referrer:       nullString(req.Referrer),
+		UserAgent:      nullString(userAgent),
+		IPAddress:      e.IP,
+		BrowserName:    nullString(browserInfo.BrowserName),
+		BrowserVersion: nullString(browserInfo.BrowserVersion),
+		OSName:         nullString(browserInfo.OSName),
+		OSVersion:      nullString(browserInfo.OSVersion),
+		DeviceType:     nullString(browserInfo.DeviceType),
+		ViewedAt:       at,
+	}
+	if err := im.store.InsertPageView(pageView); err != nil {
+		return err
+	}
+	if at.Before(im.watermark) {
+		im.hours[at.Truncate(time.Hour)] = true
+	}
+
+	// Like for tracked hits, failures are only logged
+	if _, err := im.goals.Evaluate(goals.Hit{
+		SiteID:     im.siteID,
+		VisitorID:  v.id,
+		SessionID:  s.id,
+		PageViewID: &pageView.ID,
+		PageURL:    pageView.PageURL,
+		At:         at,
+	}); err != nil {
+		log.Printf("Goal evaluation failed for site %s: %v", im.siteID, err)
+	}
+	return nil
+}
+
+// visitor gets the visitor with a fingerprint, or creates it like the API
+// does for its first hit
+func (im *Importer) visitor(fingerprintHash string, at time.Time) (*visitor, error) {
+	if v, ok := im.visitors[fingerprintHash]; ok {
+		return v, im.seen(v, at)
+	}
+
+	v := &visitor{}
+	err := im.db.QueryRow(`
+		SELECT id, first_seen_at, last_seen_at FROM visitors
+		WHERE site_id = $1 AND fingerprint_hash = $2
+	`, im.siteID, fingerprintHash).Scan(&v.id, &v.firstSeen, &v.lastSeen)
+	switch {
+	case err == nil:
+		v.existing = true
+		if err := im.seen(v, at); err != nil {
+			return nil, err
+		}
+	case err == sql.ErrNoRows:
+		v.id = uuid.New()
+		v.firstSeen = at
+		if !im.dryRun[fingerprintHash] {
+			im.stats.Visitors++
+		}
+		if !im.opts.DryRun {
+			if _, err := im.db.Exec(`
+				INSERT INTO visitors (id, site_id, fingerprint_hash, first_seen_at, last_seen_at, total_visits)
+				VALUES ($1, $2, $3, $4, $5, 0)
+			`, v.id, im.siteID, fingerprintHash, at, at); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, err
+	}
+	im.visitors[fingerprintHash] = v
+	return v, nil
+}
+
+// evict forgets the visitors whose latest session timed out before a hit,
+// so memory stays bounded over years of logs. A visitor seen again is loaded
+// from the database like at the start of the import. Evictions run once per
+// models.SessionTimeout of log time.
+func (im *Importer) evict(at time.Time) {
+	cutoff := at.Add(-models.SessionTimeout)
+	if !im.swept.Before(cutoff) {
+		return
+	}
+	for hash, v := range im.visitors {
+		if v.session == nil || v.session.lastActivity.Before(cutoff) {
+			delete(im.visitors, hash)
+			if im.opts.DryRun && !v.existing {
+				im.dryRun[hash] = true // not in the database, but not new either
+			}
+		}
+	}
+	im.swept = at
+}
+
+// seen moves a visitor's first visit back to a hit older than it. Inserting
+// the page view only ever moves the last visit forward.
+func (im *Importer) seen(v *visitor, at time.Time) error {
+	if !at.Before(v.firstSeen) {
+		return nil
+	}
+	v.firstSeen = at
+	if im.opts.DryRun {
+		return nil
+	}
+	_, err := im.db.Exec(`UPDATE visitors SET first_seen_at = $2 WHERE id = $1`, v.id, at)
+	return err
+}
+
+// session returns the visitor's session open at the time of a hit, or
+// starts one. A session is open if it started by the hit and had activity
+// within models.SessionTimeout before it, as for tracked hits.
+func (im *Importer) session(v *visitor, at time.Time) (*session, error) {
+	open := func(s *session) bool {
+		return s != nil && s.lastActivity.After(at.Add(-models.SessionTimeout)) && !s.started.After(at)
+	}
+
+	s := v.session
+	if !open(s) && v.existing && s == nil {
+		var err error
+		if s, err = im.storedSession(v.id, at); err != nil {
+			return nil, err
+		}
+	}
+	if open(s) {
+		if at.After(s.lastActivity) {
+			s.lastActivity = at
+		}
+		v.session = s
+		return s, nil
+	}
+
+	s = &session{id: uuid.New(), started: at, lastActivity: at}
+	im.stats.Sessions++
+	if !im.opts.DryRun {
+		if _, err := im.db.Exec(`
+			INSERT INTO sessions (id, visitor_id, site_id, started_at, last_activity_at)
+			VALUES ($1, $2, $3, $4, $5)
+		`, s.id, v.id, im.siteID, at, at); err != nil {
+			return nil, err
+		}
+	}
+	// A hit logged out of order starts a session before the latest one,
+	// which stays the one later hits continue
+	if v.session == nil || !s.started.Before(v.session.started) {
+		v.session = s
+	}
+	return s, nil
+}
+
+// storedSession returns a visitor's stored session open at the time of a
+// hit, or nil
+func (im *Importer) storedSession(visitorID uuid.UUID, at time.Time) (*session, error) {
+	s := &session{}
+	err := im.db.QueryRow(`
+		SELECT id, started_at, last_activity_at FROM sessions
+		WHERE visitor_id = $1
+		AND site_id = $2
+		AND last_activity_at > $3
+		AND started_at <= $4
+		AND ended_at IS NULL
+		ORDER BY started_at DESC
+		LIMIT 1
+	`, visitorID, im.siteID, at.Add(-models.SessionTimeout), at).Scan(&s.id, &s.started, &s.lastActivity)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func nullString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
@@ -0,0 +1,296 @@
+package accesslog
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/migrate"
+	"trackveilapi/internal/models"
+	"trackveilapi/internal/storage"
+
+	"github.com/google/uuid"
+)
+
+var start = time.Date(2026, 10, 10, 9, 0, 0, 0, time.UTC)
+
+// TestImportFilters checks which requests are imported as page views
+func TestImportFilters(t *testing.T) {
+	it := newImportTest(t)
+	if _, err := it.db.Exec(`
+		INSERT INTO site_tracker_settings (site_id, excluded_paths) VALUES ($1, '["/admin/*"]')
+	`, it.siteID); err != nil {
+		t.Fatalf("exclude paths: %v", err)
+	}
+	im := it.importer(t, Options{From: start, To: start.Add(24 * time.Hour)})
+
+	at := start.Add(time.Hour)
+	cases := []struct {
+		name string
+		line string
+		skip string // empty if imported
+	}{
+		{"page", hit("203.0.113.5", firefox, at, "GET", "/pricing", 200), ""},
+		{"not modified", hit("203.0.113.5", firefox, at, "GET", "/", 304), ""},
+		{"query string", hit("203.0.113.5", firefox, at, "GET", "/admin?tab=1", 200), ""},
+		{"post", hit("203.0.113.5", firefox, at, "POST", "/signup", 200), SkipMethod},
+		{"head", hit("203.0.113.5", firefox, at, "HEAD", "/", 200), SkipMethod},
+		{"redirect", hit("203.0.113.5", firefox, at, "GET", "/old", 301), SkipStatus},
+		{"not found", hit("203.0.113.5", firefox, at, "GET", "/missing", 404), SkipStatus},
+		{"server error", hit("203.0.113.5", firefox, at, "GET", "/", 502), SkipStatus},
+		{"stylesheet", hit("203.0.113.5", firefox, at, "GET", "/static/app.css", 200), SkipAsset},
+		{"image", hit("203.0.113.5", firefox, at, "GET", "/logo.png?v=2", 200), SkipAsset},
+		{"crawler", hit("66.249.66.1", "Googlebot/2.1 (+http://www.google.com/bot.html)", at, "GET", "/", 200), SkipBot},
+		{"no user agent", hit("203.0.113.5", "-", at, "GET", "/", 200), SkipBot},
+		{"excluded path", hit("203.0.113.5", firefox, at, "GET", "/admin/users", 200), SkipExcluded},
+		{"before range", hit("203.0.113.5", firefox, start.Add(-time.Second), "GET", "/", 200), SkipOutOfRange},
+		{"after range", hit("203.0.113.5", firefox, start.Add(24*time.Hour), "GET", "/", 200), SkipOutOfRange},
+		{"bad address", hit("localhost", firefox, at, "GET", "/", 200), SkipMalformed},
+		{"absolute URI", hit("203.0.113.5", firefox, at, "GET", "http://proxy.example/", 200), SkipMalformed},
+		{"unparsable", "not a log line", SkipMalformed},
+	}
+	for _, c := range cases {
+		before := im.Stats()
+		if err := im.Read(context.Background(), strings.NewReader(c.line+"\n")); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		after := im.Stats()
+		imported := after.PageViews - before.PageViews
+		switch {
+		case c.skip == "" && imported != 1:
+			t.Errorf("%s: not imported, skipped %v", c.name, after.Skipped)
+		case c.skip != "" && after.Skipped[c.skip]-before.Skipped[c.skip] != 1:
+			t.Errorf("%s: %d page views imported, skipped %v; want skipped as %s", c.name, imported, after.Skipped, c.skip)
+		}
+	}
+
+	stats, err := im.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Lines != int64(len(cases)) {
+		t.Errorf("%d lines, want %d", stats.Lines, len(cases))
+	}
+	if n := it.count(t, `SELECT COUNT(*) FROM page_views WHERE site_id = $1`); n != 3 {
+		t.Errorf("%d page views stored, want 3", n)
+	}
+}
+
+// TestImportSessions checks that sessions are rebuilt from the gaps between
+// a visitor's hits
+func TestImportSessions(t *testing.T) {
+	it := newImportTest(t)
+	other := "Mozilla/5.0 (Macintosh; Intel Mac OS X 14_0) AppleWebKit/605.1.15 Safari/605.1.15"
+	timeout := models.SessionTimeout
+
+	hits := []struct {
+		ip, ua  string
+		offset  time.Duration
+		session int // expected, numbered in order of appearance
+	}{
+		{"203.0.113.5", firefox, 0, 1},
+		{"203.0.113.5", firefox, time.Minute, 1},
+		{"203.0.113.5", other, 2 * time.Minute, 2}, // another visitor on the same address
+		{"198.51.100.7", firefox, 3 * time.Minute, 3},
+		// Exactly SessionTimeout after the last hit starts a new session
+		{"203.0.113.5", firefox, time.Minute + timeout, 4},
+		// Just within SessionTimeout continues it
+		{"203.0.113.5", firefox, time.Minute + 2*timeout - time.Second, 4},
+		{"198.51.100.7", firefox, 3*time.Minute + timeout - time.Second, 3},
+	}
+	var log strings.Builder
+	for i, h := range hits {
+		fmt.Fprintln(&log, hit(h.ip, h.ua, start.Add(h.offset), "GET", fmt.Sprintf("/page/%d", i), 200))
+	}
+	im := it.importer(t, Options{})
+	if err := im.Read(context.Background(), strings.NewReader(log.String())); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := im.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.PageViews != 7 || stats.Visitors != 3 || stats.Sessions != 4 {
+		t.Errorf("imported %d page views, %d visitors, %d sessions; want 7, 3, 4",
+			stats.PageViews, stats.Visitors, stats.Sessions)
+	}
+
+	sessions := map[string]int{} // stored session IDs by expected number
+	for i, h := range hits {
+		var sessionID string
+		var startedAt, lastActivity time.Time
+		if err := it.db.QueryRow(`
+			SELECT pv.session_id, s.started_at, s.last_activity_at
+			FROM page_views pv JOIN sessions s ON s.id = pv.session_id
+			WHERE pv.site_id = $1 AND pv.page_url = $2
+		`, it.siteID, fmt.Sprintf("https://example.com/page/%d", i)).Scan(&sessionID, &startedAt, &lastActivity); err != nil {
+			t.Fatalf("page view %d: %v", i, err)
+		}
+		if want, ok := sessions[sessionID]; ok && want != h.session {
+			t.Errorf("page view %d in session %d, want %d", i, want, h.session)
+		}
+		sessions[sessionID] = h.session
+		if at := start.Add(h.offset); at.Before(startedAt) || at.After(lastActivity) {
+			t.Errorf("page view %d at %s outside its session %s to %s", i, at, startedAt, lastActivity)
+		}
+	}
+	if len(sessions) != 4 {
+		t.Errorf("page views in %d sessions, want 4", len(sessions))
+	}
+}
+
+// TestImportTwice checks that importing a log again adds nothing, and that
+// a longer log only adds its new hits
+func TestImportTwice(t *testing.T) {
+	it := newImportTest(t)
+	var first, second strings.Builder
+	for i := 0; i < 4; i++ {
+		line := hit("203.0.113.5", firefox, start.Add(time.Duration(i)*time.Minute), "GET", "/", 200)
+		fmt.Fprintln(&first, line)
+		fmt.Fprintln(&second, line)
+	}
+	fmt.Fprintln(&second, hit("203.0.113.5", firefox, start.Add(10*time.Minute), "GET", "/", 200))
+
+	for _, c := range []struct {
+		log                                  string
+		pageViews, sessions, visitors, dupes int64
+	}{
+		{first.String(), 4, 1, 1, 0},
+		{first.String(), 0, 0, 0, 4},
+		{second.String(), 1, 0, 0, 4},
+	} {
+		im := it.importer(t, Options{})
+		if err := im.Read(context.Background(), strings.NewReader(c.log)); err != nil {
+			t.Fatal(err)
+		}
+		stats, err := im.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.PageViews != c.pageViews || stats.Sessions != c.sessions || stats.Visitors != c.visitors ||
+			stats.Skipped[SkipDuplicate] != c.dupes {
+			t.Errorf("got %s; want %d page views, %d visitors, %d sessions, %d duplicates",
+				stats.Describe(), c.pageViews, c.visitors, c.sessions, c.dupes)
+		}
+	}
+	if n := it.count(t, `SELECT COUNT(*) FROM page_views WHERE site_id = $1`); n != 5 {
+		t.Errorf("%d page views stored, want 5", n)
+	}
+	if n := it.count(t, `SELECT COUNT(*) FROM sessions WHERE site_id = $1`); n != 1 {
+		t.Errorf("%d sessions stored, want 1", n)
+	}
+}
+
+// TestImportEvicts checks that visitors whose session ended are forgotten,
+// and are neither counted nor created again when they come back
+func TestImportEvicts(t *testing.T) {
+	for _, dryRun := range []bool{false, true} {
+		it := newImportTest(t)
+		im := it.importer(t, Options{DryRun: dryRun})
+
+		// A new visitor every ten minutes for a day; one returns every hour
+		var log strings.Builder
+		for i := 0; i < 6*24; i++ {
+			at := start.Add(time.Duration(i) * 10 * time.Minute)
+			fmt.Fprintln(&log, hit(fmt.Sprintf("10.0.%d.%d", i/256, i%256), firefox, at, "GET", "/", 200))
+			if i%6 == 0 {
+				fmt.Fprintln(&log, hit("203.0.113.5", firefox, at, "GET", "/", 200))
+			}
+			if n := len(im.visitors); n > 10 {
+				t.Fatalf("dry run %v: %d visitors in memory after %s", dryRun, n, at)
+			}
+			if err := im.Read(context.Background(), strings.NewReader(log.String())); err != nil {
+				t.Fatal(err)
+			}
+			log.Reset()
+		}
+		stats, err := im.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Visitors != 6*24+1 || stats.Sessions != 6*24+24 || stats.PageViews != 6*24+24 {
+			t.Errorf("dry run %v: got %s; want %d visitors, %d sessions and page views",
+				dryRun, stats.Describe(), 6*24+1, 6*24+24)
+		}
+
+		visitors := int64(6*24 + 1)
+		if dryRun {
+			visitors = 0
+		}
+		if n := it.count(t, `SELECT COUNT(*) FROM visitors WHERE site_id = $1`); n != visitors {
+			t.Errorf("dry run %v: %d visitors stored, want %d", dryRun, n, visitors)
+		}
+	}
+}
+
+// importTest is a migrated SQLite database with one site to import into
+type importTest struct {
+	db     *database.DB
+	store  storage.Store
+	siteID string
+}
+
+func newImportTest(t *testing.T) *importTest {
+	db, err := database.OpenSQLite(filepath.Join(t.TempDir(), "trackveil.db"))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	m, err := migrate.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(context.Background()); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	siteID, err := models.GenerateSiteID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accountID := uuid.New()
+	if _, err := db.Exec(`INSERT INTO accounts (id, name) VALUES ($1, 'Import')`, accountID); err != nil {
+		t.Fatalf("create account: %v", err)
+	}
+	if _, err := db.Exec(`
+		INSERT INTO sites (id, account_id, name, domain) VALUES ($1, $2, 'Import', 'example.com')
+	`, siteID, accountID); err != nil {
+		t.Fatalf("create site: %v", err)
+	}
+
+	store, err := storage.NewSQLite(db, storage.SQLiteConfig{BatchSize: 100, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &importTest{db: db, store: store, siteID: siteID}
+}
+
+func (it *importTest) importer(t *testing.T, opts Options) *Importer {
+	f, err := ParseFormat("combined")
+	if err != nil {
+		t.Fatal(err)
+	}
+	im, err := NewImporter(it.db, it.store, it.siteID, f, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return im
+}
+
+func (it *importTest) count(t *testing.T, query string) int64 {
+	var n int64
+	if err := it.db.QueryRow(query, it.siteID).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// hit formats a request as a combined log line
+func hit(ip, userAgent string, at time.Time, method, uri string, status int) string {
+	return fmt.Sprintf(`%s - - [%s] "%s %s HTTP/1.1" %d 512 "-" "%s"`,
+		ip, at.Format("02/Jan/2006:15:04:05 -0700"), method, uri, status, userAgent)
+}
@@ -0,0 +1,111 @@
+package apierror
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Code is a stable, machine-readable error identifier. Messages may change
+// between releases; codes do not.
+type Code string
+
+// Error codes
+const (
+	CodeInvalidRequest     Code = "invalid_request"
+	CodeInvalidSiteID      Code = "invalid_site_id"
+	CodeSiteNotFound       Code = "site_not_found"
+	CodeOriginMismatch     Code = "origin_mismatch"
+	CodeRateLimited        Code = "rate_limited"
+	CodeStorageUnavailable Code = "storage_unavailable"
+	CodeHitRejected        Code = "hit_rejected"
+	CodePayloadTooLarge    Code = "payload_too_large"
+	CodeUnauthorized       Code = "unauthorized"
+	CodeForbidden          Code = "forbidden"
+	CodeNotFound           Code = "not_found"
+	CodeAdminDisabled      Code = "admin_disabled"
+	CodeNotImplemented     Code = "not_implemented"
+	CodeInternal           Code = "internal_error"
+)
+
+// Response headers
+const (
+	// RequestIDHeader carries the request ID, echoed from the client or generated
+	RequestIDHeader = "X-Request-ID"
+	// ResultHeader reports the outcome of a pixel request: "ok", "duplicate", "queued" or an error code
+	ResultHeader = "X-Trackveil-Result"
+)
+
+// Context keys
+const (
+	requestIDKey = "trackveil.request_id"
+	pixelKey     = "trackveil.pixel"
+	codeKey      = "trackveil.error_code"
+)
+
+// Response is the JSON body of an error
+type Response struct {
+	Error     string      `json:"error"`
+	Code      Code        `json:"code"`
+	RequestID string      `json:"request_id,omitempty"`
+	Fields    interface{} `json:"fields,omitempty"`
+}
+
+// transparentGIF is a 1x1 transparent GIF (43 bytes)
+var transparentGIF = []byte{0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00, 0x00, 0xFF, 0xFF, 0xFF, 0x00, 0x00, 0x00, 0x21, 0xF9, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x2C, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3B}
+
+// SetRequestID stores the request ID of the current request
+func SetRequestID(c *gin.Context, id string) {
+	c.Set(requestIDKey, id)
+}
+
+// RequestID returns the ID of the current request, or "" if none was assigned
+func RequestID(c *gin.Context) string {
+	return c.GetString(requestIDKey)
+}
+
+// UsePixel switches the current request to pixel mode: every response,
+// including errors, is the transparent GIF with the outcome in ResultHeader.
+func UsePixel(c *gin.Context) {
+	c.Set(pixelKey, true)
+}
+
+// ErrorCode returns the code of the error sent for the current request, if any
+func ErrorCode(c *gin.Context) Code {
+	code, _ := c.Get(codeKey)
+	if code == nil {
+		return ""
+	}
+	return code.(Code)
+}
+
+// Abort ends the request with an error response
+func Abort(c *gin.Context, status int, code Code, message string) {
+	AbortWithFields(c, status, code, message, nil)
+}
+
+// AbortWithFields ends the request with an error response listing invalid fields
+func AbortWithFields(c *gin.Context, status int, code Code, message string, fields interface{}) {
+	c.Set(codeKey, code)
+
+	if c.GetBool(pixelKey) {
+		Pixel(c, string(code))
+		c.Abort()
+		return
+	}
+
+	c.AbortWithStatusJSON(status, Response{
+		Error:     message,
+		Code:      code,
+		RequestID: RequestID(c),
+		Fields:    fields,
+	})
+}
+
+// Pixel writes the transparent GIF with the outcome of the request.
+// Pixel responses are always 200 so the browser never retries or logs an error.
+func Pixel(c *gin.Context, result string) {
+	c.Header(ResultHeader, result)
+	c.Header("Cache-Control", "no-cache, no-store, must-revalidate")
+	c.Data(http.StatusOK, "image/gif", transparentGIF)
+}
@@ -0,0 +1,448 @@
+package apikeys
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/dedup"
+	"trackveilapi/internal/models"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// KeyPrefix starts every server key: tvsk_<key_id>_<secret>
+	KeyPrefix = "tvsk_"
+
+	// Request headers for HMAC-signed requests
+	HeaderKeyID     = "X-Trackveil-Key-Id"
+	HeaderTimestamp = "X-Trackveil-Timestamp"
+	HeaderNonce     = "X-Trackveil-Nonce"
+	HeaderSignature = "X-Trackveil-Signature"
+
+	// MaxClockSkew is how far an HMAC timestamp may be from the server clock
+	MaxClockSkew = 5 * time.Minute
+
+	// DefaultRotationGrace is how long a rotated-out key keeps working
+	DefaultRotationGrace = 24 * time.Hour
+
+	// Nonces are unique per key, e.g. a UUID
+	MinNonceLength = 16
+	MaxNonceLength = 64
+
+	keyIDLength  = 12
+	secretLength = 32
+	// nonceIDPrefix marks claimed nonces among the site's client event IDs
+	nonceIDPrefix = "nonce:"
+	// lastUsedResolution limits how often last_used_at is written per key
+	lastUsedResolution = time.Minute
+)
+
+var (
+	// ErrUnauthorized is returned for missing, unknown, expired or revoked keys and bad signatures
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrNotFound is returned when a key does not exist for the site
+	ErrNotFound = errors.New("key not found")
+	// ErrReplayed is returned for an HMAC request whose nonce was already used
+	ErrReplayed = errors.New("nonce already used")
+)
+
+// Generate creates a new key for a site. The returned plaintext key is
+// only available now; the database keeps its hash (and the signing secret
+// for HMAC keys).
+func Generate(siteID, name, authType string) (*models.SiteAPIKey, string, error) {
+	if authType != models.AuthTypeBearer && authType != models.AuthTypeHMAC {
+		return nil, "", fmt.Errorf("unknown auth_type %q", authType)
+	}
+
+	keyID, err := models.GenerateSiteID()
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := randomHex(secretLength)
+	if err != nil {
+		return nil, "", err
+	}
+
+	key := &models.SiteAPIKey{
+		ID:         uuid.New(),
+		SiteID:     siteID,
+		Name:       name,
+		KeyID:      keyID[:keyIDLength],
+		AuthType:   authType,
+		SecretHash: hashSecret(secret),
+		CreatedAt:  time.Now(),
+	}
+	if authType == models.AuthTypeHMAC {
+		key.SigningSecret = &secret
+	}
+
+	return key, KeyPrefix + key.KeyID + "_" + secret, nil
+}
+
+// Create generates and stores a new key. It returns the plaintext key.
+func Create(db *database.DB, siteID, name, authType string) (*models.SiteAPIKey, string, error) {
+	key, plaintext, err := Generate(siteID, name, authType)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := insert(db, key); err != nil {
+		return nil, "", err
+	}
+	return key, plaintext, nil
+}
+
+// Rotate issues a replacement for a key. The old key keeps working for the
+// grace period so callers can roll the new secret out.
+func Rotate(db *database.DB, siteID string, id uuid.UUID, grace time.Duration) (*models.SiteAPIKey, string, error) {
+	old, err := Get(db, siteID, id)
+	if err != nil {
+		return nil, "", err
+	}
+	if old.RevokedAt != nil {
+		return nil, "", ErrNotFound
+	}
+
+	var key *models.SiteAPIKey
+	var plaintext string
+	if old.AuthType == models.AuthTypeGA4 {
+		// The measurement_id stays, only the api_secret changes
+		plaintext, err = randomHex(secretLength)
+		key = &models.SiteAPIKey{
+			ID:         uuid.New(),
+			SiteID:     siteID,
+			Name:       old.Name,
+			KeyID:      old.KeyID,
+			AuthType:   old.AuthType,
+			SecretHash: hashSecret(plaintext),
+			CreatedAt:  time.Now(),
+		}
+	} else {
+		key, plaintext, err = Generate(siteID, old.Name, old.AuthType)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	key.RotatedFrom = &old.ID
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, "", err
+	}
+	defer tx.Rollback()
+
+	expires := time.Now().Add(grace)
+	if _, err := tx.Exec(`
+		UPDATE site_api_keys SET expires_at = $1
+		WHERE id = $2 AND (expires_at IS NULL OR expires_at > $1)
+	`, expires, old.ID); err != nil {
+		return nil, "", err
+	}
+	if _, err := tx.Exec(insertSQL, insertArgs(key)...); err != nil {
+		return nil, "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, "", err
+	}
+
+	return key, plaintext, nil
+}
+
+// Revoke disables a key immediately
+func Revoke(db *database.DB, siteID string, id uuid.UUID) error {
+	res, err := db.Exec(`
+		UPDATE site_api_keys SET revoked_at = $3
+		WHERE id = $1 AND site_id = $2 AND revoked_at IS NULL
+	`, id, siteID, time.Now())
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// List returns all keys of a site, newest first
+func List(db *database.DB, siteID string) ([]models.SiteAPIKey, error) {
+	rows, err := db.Query(selectSQL+` WHERE site_id = $1 ORDER BY created_at DESC`, siteID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := []models.SiteAPIKey{}
+	for rows.Next() {
+		key, err := scanKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *key)
+	}
+	return keys, rows.Err()
+}
+
+// Get returns one key of a site
+func Get(db *database.DB, siteID string, id uuid.UUID) (*models.SiteAPIKey, error) {
+	key, err := scanKey(db.QueryRow(selectSQL+` WHERE id = $1 AND site_id = $2`, id, siteID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return key, err
+}
+
+// Authenticate verifies a server request, either with
+// "Authorization: Bearer tvsk_..." or with an HMAC-SHA256 signature over
+// "<timestamp>.<nonce>.<body>" in the X-Trackveil-* headers. The nonce of a
+// signed request is claimed in dd, so a captured request cannot be replayed.
+func Authenticate(db *database.DB, dd *dedup.Deduplicator, r *http.Request, body []byte) (*models.SiteAPIKey, error) {
+	now := time.Now()
+
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		keyID, secret, ok := parseKey(strings.TrimPrefix(auth, "Bearer "))
+		if !ok {
+			return nil, ErrUnauthorized
+		}
+		key, err := lookupActive(db, keyID, now)
+		if err != nil {
+			return nil, err
+		}
+		if key.AuthType != models.AuthTypeBearer {
+			return nil, ErrUnauthorized
+		}
+		if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(key.SecretHash)) != 1 {
+			return nil, ErrUnauthorized
+		}
+		touch(db, key, now)
+		return key, nil
+	}
+
+	keyID := r.Header.Get(HeaderKeyID)
+	if keyID == "" {
+		return nil, ErrUnauthorized
+	}
+
+	ts, err := strconv.ParseInt(r.Header.Get(HeaderTimestamp), 10, 64)
+	if err != nil {
+		return nil, ErrUnauthorized
+	}
+	if skew := now.Sub(time.Unix(ts, 0)); skew > MaxClockSkew || skew < -MaxClockSkew {
+		return nil, ErrUnauthorized
+	}
+	nonce := r.Header.Get(HeaderNonce)
+	if !validNonce(nonce) {
+		return nil, ErrUnauthorized
+	}
+
+	key, err := lookupActive(db, keyID, now)
+	if err != nil {
+		return nil, err
+	}
+	if key.AuthType != models.AuthTypeHMAC || key.SigningSecret == nil {
+		return nil, ErrUnauthorized
+	}
+
+	expected := Sign(*key.SigningSecret, ts, nonce, body)
+	provided := strings.TrimPrefix(r.Header.Get(HeaderSignature), "sha256=")
+	if !hmac.Equal([]byte(expected), []byte(provided)) {
+		return nil, ErrUnauthorized
+	}
+
+	// Claimed only after the signature checks, so unsigned requests cannot
+	// use up nonces. Claims outlive MaxClockSkew, the only time a copy of
+	// the request would be accepted.
+	fresh, err := dd.Claim(key.SiteID, nonceID(key.KeyID, nonce))
+	if err != nil {
+		return nil, err
+	}
+	if !fresh {
+		return nil, ErrReplayed
+	}
+
+	touch(db, key, now)
+	return key, nil
+}
+
+// CreateGA4 registers a GA4 api_secret for a measurement_id. An empty
+// apiSecret generates a new one; existing secrets can be reused so senders
+// only need to change the collector host.
+func CreateGA4(db *database.DB, siteID, name, measurementID, apiSecret string) (*models.SiteAPIKey, string, error) {
+	if measurementID == "" || len(measurementID) > 32 {
+		return nil, "", errors.New("invalid measurement_id")
+	}
+	if apiSecret == "" {
+		var err error
+		if apiSecret, err = randomHex(secretLength); err != nil {
+			return nil, "", err
+		}
+	}
+
+	key := &models.SiteAPIKey{
+		ID:         uuid.New(),
+		SiteID:     siteID,
+		Name:       name,
+		KeyID:      measurementID,
+		AuthType:   models.AuthTypeGA4,
+		SecretHash: hashSecret(apiSecret),
+		CreatedAt:  time.Now(),
+	}
+	if err := insert(db, key); err != nil {
+		return nil, "", err
+	}
+
+	return key, apiSecret, nil
+}
+
+// AuthenticateGA4 verifies a Measurement Protocol measurement_id and api_secret pair
+func AuthenticateGA4(db *database.DB, measurementID, apiSecret string) (*models.SiteAPIKey, error) {
+	if measurementID == "" || apiSecret == "" {
+		return nil, ErrUnauthorized
+	}
+
+	// A measurement_id may have several secrets during rotation, so the
+	// lookup includes the secret hash
+	now := time.Now()
+	key, err := scanKey(db.QueryRow(selectSQL+`
+		WHERE key_id = $1 AND secret_hash = $2 AND auth_type = 'ga4'
+		AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > $3)
+	`, measurementID, hashSecret(apiSecret), now))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUnauthorized
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	touch(db, key, now)
+	return key, nil
+}
+
+// Sign computes the hex HMAC-SHA256 signature of a request body
+func Sign(secret string, timestamp int64, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write([]byte(nonce))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validNonce accepts MinNonceLength to MaxNonceLength letters, digits, '-'
+// and '_'. Without '.' the nonce cannot shift into the signed body.
+func validNonce(nonce string) bool {
+	if len(nonce) < MinNonceLength || len(nonce) > MaxNonceLength {
+		return false
+	}
+	for i := 0; i < len(nonce); i++ {
+		c := nonce[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// nonceID is the event ID a nonce is claimed under: hashed with the key ID
+// so keys of a site do not share nonces, and to fit the event ID column
+func nonceID(keyID, nonce string) string {
+	sum := sha256.Sum256([]byte(keyID + "." + nonce))
+	return nonceIDPrefix + hex.EncodeToString(sum[:])[:models.MaxEventIDLength-len(nonceIDPrefix)]
+}
+
+// lookupActive finds a generated (bearer or HMAC) key that is neither revoked nor expired
+func lookupActive(db *database.DB, keyID string, now time.Time) (*models.SiteAPIKey, error) {
+	key, err := scanKey(db.QueryRow(selectSQL+` WHERE key_id = $1 AND auth_type <> 'ga4'`, keyID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUnauthorized
+	}
+	if err != nil {
+		return nil, err
+	}
+	if key.RevokedAt != nil || (key.ExpiresAt != nil && !now.Before(*key.ExpiresAt)) {
+		return nil, ErrUnauthorized
+	}
+	return key, nil
+}
+
+// touch records key usage, at most once per lastUsedResolution
+func touch(db *database.DB, key *models.SiteAPIKey, now time.Time) {
+	if key.LastUsedAt != nil && now.Sub(*key.LastUsedAt) < lastUsedResolution {
+		return
+	}
+	_, _ = db.Exec(`UPDATE site_api_keys SET last_used_at = $1 WHERE id = $2`, now, key.ID)
+}
+
+// parseKey splits tvsk_<key_id>_<secret>
+func parseKey(s string) (keyID, secret string, ok bool) {
+	if !strings.HasPrefix(s, KeyPrefix) {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(s, KeyPrefix), "_", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n/2)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+const selectSQL = `
+	SELECT id, site_id, name, key_id, auth_type, secret_hash, signing_secret,
+		created_at, expires_at, revoked_at, last_used_at, rotated_from
+	FROM site_api_keys`
+
+const insertSQL = `
+	INSERT INTO site_api_keys (
+		id, site_id, name, key_id, auth_type, secret_hash, signing_secret, created_at, rotated_from
+	) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+
+func insert(db *database.DB, key *models.SiteAPIKey) error {
+	_, err := db.Exec(insertSQL, insertArgs(key)...)
+	return err
+}
+
+func insertArgs(key *models.SiteAPIKey) []interface{} {
+	return []interface{}{
+		key.ID, key.SiteID, key.Name, key.KeyID, key.AuthType, key.SecretHash,
+		key.SigningSecret, key.CreatedAt, key.RotatedFrom,
+	}
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanKey(row scanner) (*models.SiteAPIKey, error) {
+	var k models.SiteAPIKey
+	err := row.Scan(
+		&k.ID, &k.SiteID, &k.Name, &k.KeyID, &k.AuthType, &k.SecretHash, &k.SigningSecret,
+		&k.CreatedAt, &k.ExpiresAt, &k.RevokedAt, &k.LastUsedAt, &k.RotatedFrom,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
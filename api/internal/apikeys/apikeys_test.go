@@ -0,0 +1,338 @@
+package apikeys
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/dedup"
+	"trackveilapi/internal/migrate"
+	"trackveilapi/internal/models"
+
+	"github.com/google/uuid"
+)
+
+type keyTest struct {
+	db     *database.DB
+	dd     *dedup.Deduplicator
+	siteID string
+}
+
+func newKeyTest(t *testing.T) *keyTest {
+	db, err := database.OpenSQLite(filepath.Join(t.TempDir(), "trackveil.db"))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	m, err := migrate.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(context.Background()); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	siteID, err := models.GenerateSiteID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accountID := uuid.New()
+	if _, err := db.Exec(`INSERT INTO accounts (id, name) VALUES ($1, 'Keys')`, accountID); err != nil {
+		t.Fatalf("create account: %v", err)
+	}
+	if _, err := db.Exec(`
+		INSERT INTO sites (id, account_id, name, domain) VALUES ($1, $2, 'Keys', 'example.com')
+	`, siteID, accountID); err != nil {
+		t.Fatalf("create site: %v", err)
+	}
+	return &keyTest{db: db, dd: dedup.New(db, nil, 0, time.Hour), siteID: siteID}
+}
+
+func (kt *keyTest) create(t *testing.T, authType string) (*models.SiteAPIKey, string) {
+	t.Helper()
+	key, plaintext, err := Create(kt.db, kt.siteID, "test", authType)
+	if err != nil {
+		t.Fatalf("create %s key: %v", authType, err)
+	}
+	return key, plaintext
+}
+
+func (kt *keyTest) authenticate(r *http.Request, body string) (*models.SiteAPIKey, error) {
+	return Authenticate(kt.db, kt.dd, r, []byte(body))
+}
+
+func bearer(plaintext string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/track/server", nil)
+	r.Header.Set("Authorization", "Bearer "+plaintext)
+	return r
+}
+
+// signed builds an HMAC request; the secret is the last part of the plaintext key
+func signed(key *models.SiteAPIKey, secret string, ts int64, nonce, body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/track/server", nil)
+	r.Header.Set(HeaderKeyID, key.KeyID)
+	r.Header.Set(HeaderTimestamp, strconv.FormatInt(ts, 10))
+	r.Header.Set(HeaderNonce, nonce)
+	r.Header.Set(HeaderSignature, "sha256="+Sign(secret, ts, nonce, []byte(body)))
+	return r
+}
+
+func secretOf(t *testing.T, plaintext string) string {
+	t.Helper()
+	_, secret, ok := parseKey(plaintext)
+	if !ok {
+		t.Fatalf("generated key %q does not parse", plaintext)
+	}
+	return secret
+}
+
+func TestParseKey(t *testing.T) {
+	cases := []struct {
+		in            string
+		keyID, secret string
+		ok            bool
+	}{
+		{"tvsk_abc_def", "abc", "def", true},
+		{"tvsk_abc_def_ghi", "abc", "def_ghi", true},
+		{"tvsk_abc", "", "", false},
+		{"tvsk__def", "", "", false},
+		{"tvsk_abc_", "", "", false},
+		{"abc_def", "", "", false},
+		{"TVSK_abc_def", "", "", false},
+		{"", "", "", false},
+	}
+	for _, c := range cases {
+		keyID, secret, ok := parseKey(c.in)
+		if keyID != c.keyID || secret != c.secret || ok != c.ok {
+			t.Errorf("parseKey(%q) = %q, %q, %v, want %q, %q, %v", c.in, keyID, secret, ok, c.keyID, c.secret, c.ok)
+		}
+	}
+}
+
+func TestAuthenticateBearer(t *testing.T) {
+	kt := newKeyTest(t)
+	key, plaintext := kt.create(t, models.AuthTypeBearer)
+	_, hmacPlaintext := kt.create(t, models.AuthTypeHMAC)
+	revoked, revokedPlaintext := kt.create(t, models.AuthTypeBearer)
+	if err := Revoke(kt.db, kt.siteID, revoked.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := kt.authenticate(bearer(plaintext), "")
+	if err != nil {
+		t.Fatalf("valid key: %v", err)
+	}
+	if got.ID != key.ID {
+		t.Errorf("authenticated as %s, want %s", got.ID, key.ID)
+	}
+
+	for name, auth := range map[string]string{
+		"wrong secret":     KeyPrefix + key.KeyID + "_" + strings.Repeat("0", secretLength),
+		"unknown key":      KeyPrefix + "unknownkey12_" + secretOf(t, plaintext),
+		"missing prefix":   strings.TrimPrefix(plaintext, KeyPrefix),
+		"no secret":        KeyPrefix + key.KeyID,
+		"HMAC key":         hmacPlaintext,
+		"revoked":          revokedPlaintext,
+		"empty":            "",
+		"secret only":      secretOf(t, plaintext),
+		"different prefix": "tvpk_" + key.KeyID + "_" + secretOf(t, plaintext),
+	} {
+		if _, err := kt.authenticate(bearer(auth), ""); !errors.Is(err, ErrUnauthorized) {
+			t.Errorf("%s: got %v, want %v", name, err, ErrUnauthorized)
+		}
+	}
+
+	// Neither header
+	r := httptest.NewRequest(http.MethodPost, "/track/server", nil)
+	if _, err := kt.authenticate(r, ""); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("no credentials: got %v, want %v", err, ErrUnauthorized)
+	}
+}
+
+func TestAuthenticateHMAC(t *testing.T) {
+	kt := newKeyTest(t)
+	key, plaintext := kt.create(t, models.AuthTypeHMAC)
+	secret := secretOf(t, plaintext)
+	bearerKey, bearerPlaintext := kt.create(t, models.AuthTypeBearer)
+	now := time.Now().Unix()
+	body := `{"page_url":"https://example.com/"}`
+
+	got, err := kt.authenticate(signed(key, secret, now, uuid.NewString(), body), body)
+	if err != nil {
+		t.Fatalf("valid signature: %v", err)
+	}
+	if got.ID != key.ID {
+		t.Errorf("authenticated as %s, want %s", got.ID, key.ID)
+	}
+
+	// The sha256= prefix is optional
+	r := signed(key, secret, now, uuid.NewString(), body)
+	r.Header.Set(HeaderSignature, strings.TrimPrefix(r.Header.Get(HeaderSignature), "sha256="))
+	if _, err := kt.authenticate(r, body); err != nil {
+		t.Errorf("signature without prefix: %v", err)
+	}
+
+	cases := []struct {
+		name string
+		req  func() *http.Request
+		body string
+	}{
+		{"wrong secret", func() *http.Request {
+			return signed(key, strings.Repeat("0", secretLength), now, uuid.NewString(), body)
+		}, body},
+		{"changed body", func() *http.Request { return signed(key, secret, now, uuid.NewString(), body) }, body + " "},
+		{"changed timestamp", func() *http.Request {
+			r := signed(key, secret, now, uuid.NewString(), body)
+			r.Header.Set(HeaderTimestamp, strconv.FormatInt(now+1, 10))
+			return r
+		}, body},
+		{"changed nonce", func() *http.Request {
+			r := signed(key, secret, now, uuid.NewString(), body)
+			r.Header.Set(HeaderNonce, uuid.NewString())
+			return r
+		}, body},
+		{"nonce moved into the body", func() *http.Request {
+			// Nonces have no '.', so "<ts>.<nonce>.<body>" splits one way only
+			r := signed(key, secret, now, "abcdefghijklmnopqrst", body)
+			r.Header.Set(HeaderNonce, "abcdefghijklmnop")
+			return r
+		}, "qrst." + body},
+		{"missing signature", func() *http.Request {
+			r := signed(key, secret, now, uuid.NewString(), body)
+			r.Header.Del(HeaderSignature)
+			return r
+		}, body},
+		{"missing nonce", func() *http.Request { return signed(key, secret, now, "", body) }, body},
+		{"short nonce", func() *http.Request { return signed(key, secret, now, strings.Repeat("a", MinNonceLength-1), body) }, body},
+		{"long nonce", func() *http.Request { return signed(key, secret, now, strings.Repeat("a", MaxNonceLength+1), body) }, body},
+		{"nonce with a dot", func() *http.Request { return signed(key, secret, now, "0123456789.abcdef", body) }, body},
+		{"missing timestamp", func() *http.Request {
+			r := signed(key, secret, now, uuid.NewString(), body)
+			r.Header.Del(HeaderTimestamp)
+			return r
+		}, body},
+		{"timestamp too old", func() *http.Request {
+			return signed(key, secret, now-int64(MaxClockSkew/time.Second)-5, uuid.NewString(), body)
+		}, body},
+		{"timestamp too new", func() *http.Request {
+			return signed(key, secret, now+int64(MaxClockSkew/time.Second)+5, uuid.NewString(), body)
+		}, body},
+		{"unknown key", func() *http.Request {
+			r := signed(key, secret, now, uuid.NewString(), body)
+			r.Header.Set(HeaderKeyID, "unknownkey12")
+			return r
+		}, body},
+		{"bearer key", func() *http.Request {
+			return signed(bearerKey, secretOf(t, bearerPlaintext), now, uuid.NewString(), body)
+		}, body},
+	}
+	for _, c := range cases {
+		if _, err := kt.authenticate(c.req(), c.body); !errors.Is(err, ErrUnauthorized) {
+			t.Errorf("%s: got %v, want %v", c.name, err, ErrUnauthorized)
+		}
+	}
+
+	// Within the clock skew either way
+	for _, ts := range []int64{now - int64(MaxClockSkew/time.Second) + 5, now + int64(MaxClockSkew/time.Second) - 5} {
+		if _, err := kt.authenticate(signed(key, secret, ts, uuid.NewString(), body), body); err != nil {
+			t.Errorf("timestamp %+ds: %v", ts-now, err)
+		}
+	}
+}
+
+func TestAuthenticateReplay(t *testing.T) {
+	kt := newKeyTest(t)
+	key, plaintext := kt.create(t, models.AuthTypeHMAC)
+	other, otherPlaintext := kt.create(t, models.AuthTypeHMAC)
+	now := time.Now().Unix()
+	body := `{"page_url":"https://example.com/"}`
+	nonce := uuid.NewString()
+
+	req := func() *http.Request { return signed(key, secretOf(t, plaintext), now, nonce, body) }
+	if _, err := kt.authenticate(req(), body); err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	if _, err := kt.authenticate(req(), body); !errors.Is(err, ErrReplayed) {
+		t.Errorf("replayed request: got %v, want %v", err, ErrReplayed)
+	}
+
+	// A badly signed request with a fresh nonce does not claim it
+	fresh := uuid.NewString()
+	bad := signed(key, secretOf(t, plaintext), now, fresh, body)
+	if _, err := kt.authenticate(bad, body+" "); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("bad signature: got %v, want %v", err, ErrUnauthorized)
+	}
+	if _, err := kt.authenticate(signed(key, secretOf(t, plaintext), now, fresh, body), body); err != nil {
+		t.Errorf("nonce of a rejected request: %v", err)
+	}
+
+	// Nonces are per key
+	if _, err := kt.authenticate(signed(other, secretOf(t, otherPlaintext), now, nonce, body), body); err != nil {
+		t.Errorf("same nonce with another key: %v", err)
+	}
+	if id := nonceID(key.KeyID, strings.Repeat("z", MaxNonceLength)); len(id) != models.MaxEventIDLength {
+		t.Errorf("nonce ID %q is %d long, want %d", id, len(id), models.MaxEventIDLength)
+	}
+}
+
+func TestAuthenticateRotated(t *testing.T) {
+	for _, authType := range []string{models.AuthTypeBearer, models.AuthTypeHMAC} {
+		kt := newKeyTest(t)
+		old, oldPlaintext := kt.create(t, authType)
+		body := `{}`
+
+		auth := func(key *models.SiteAPIKey, plaintext string) error {
+			r := bearer(plaintext)
+			if authType == models.AuthTypeHMAC {
+				r = signed(key, secretOf(t, plaintext), time.Now().Unix(), uuid.NewString(), body)
+			}
+			_, err := kt.authenticate(r, body)
+			return err
+		}
+
+		key, plaintext, err := Rotate(kt.db, kt.siteID, old.ID, time.Hour)
+		if err != nil {
+			t.Fatalf("%s: rotate: %v", authType, err)
+		}
+		if key.RotatedFrom == nil || *key.RotatedFrom != old.ID {
+			t.Errorf("%s: rotated_from %v, want %s", authType, key.RotatedFrom, old.ID)
+		}
+		if err := auth(key, plaintext); err != nil {
+			t.Errorf("%s: new key: %v", authType, err)
+		}
+		if err := auth(old, oldPlaintext); err != nil {
+			t.Errorf("%s: old key inside the grace period: %v", authType, err)
+		}
+
+		// The grace period runs out
+		if _, err := kt.db.Exec(`UPDATE site_api_keys SET expires_at = $1 WHERE id = $2`,
+			time.Now().Add(-time.Second), old.ID); err != nil {
+			t.Fatal(err)
+		}
+		if err := auth(old, oldPlaintext); !errors.Is(err, ErrUnauthorized) {
+			t.Errorf("%s: old key after the grace period: got %v, want %v", authType, err, ErrUnauthorized)
+		}
+		if err := auth(key, plaintext); err != nil {
+			t.Errorf("%s: new key after the grace period: %v", authType, err)
+		}
+
+		// Without a grace period the old key stops at once
+		newer, newerPlaintext, err := Rotate(kt.db, kt.siteID, key.ID, 0)
+		if err != nil {
+			t.Fatalf("%s: rotate again: %v", authType, err)
+		}
+		if err := auth(key, plaintext); !errors.Is(err, ErrUnauthorized) {
+			t.Errorf("%s: key rotated without grace: got %v, want %v", authType, err, ErrUnauthorized)
+		}
+		if err := auth(newer, newerPlaintext); err != nil {
+			t.Errorf("%s: newest key: %v", authType, err)
+		}
+	}
+}
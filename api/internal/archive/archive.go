@@ -0,0 +1,335 @@
+// Package archive exports closed days of a site's raw hits to Parquet files
+// in a local directory or an S3-compatible bucket, and restores them.
+//
+// Each archived range holds the page views and events of one UTC day with
+// data, plus the sessions and visitors they reference, so it restores on its
+// own. Its files are written first and its manifest.json last, listing them
+// with their row counts and SHA-256; the range is then recorded in
+// hit_archives. A site's ranges are contiguous: the end of its last range is
+// the point before which all its hits are archived. Hits stored late for a
+// day already archived are not archived; ARCHIVE_LAG_DAYS leaves days open
+// for them first.
+package archive
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"time"
+
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/models"
+	"trackveilapi/internal/parquet"
+
+	"github.com/google/uuid"
+)
+
+// ManifestVersion is the version of the manifests written
+const ManifestVersion = 1
+
+// rowGroupSize is the number of rows per Parquet row group
+const rowGroupSize = 10000
+
+// Manifest describes an archived range
+type Manifest struct {
+	Version   int       `json:"version"`
+	SiteID    string    `json:"site_id"`
+	From      time.Time `json:"from"`
+	To        time.Time `json:"to"` // exclusive
+	CreatedAt time.Time `json:"created_at"`
+	Files     []File    `json:"files"`
+}
+
+// File is an archived table of a range
+type File struct {
+	Table  string `json:"table"`
+	Key    string `json:"key"`
+	Rows   int64  `json:"rows"`
+	Bytes  int64  `json:"bytes"`
+	SHA256 string `json:"sha256"`
+}
+
+// Archiver archives the closed days of every site
+type Archiver struct {
+	db      *database.DB
+	bucket  Bucket
+	prefix  string
+	lagDays int
+}
+
+// NewArchiver archives to keys under prefix in bucket. A day is archived
+// once lagDays full days have passed since it ended.
+func NewArchiver(db *database.DB, bucket Bucket, prefix string, lagDays int) *Archiver {
+	return &Archiver{db: db, bucket: bucket, prefix: prefix, lagDays: lagDays}
+}
+
+// Archive archives every site's closed days with hits not yet archived, and
+// returns the ranges archived
+func (a *Archiver) Archive(ctx context.Context, now time.Time) ([]models.HitArchive, error) {
+	siteIDs, err := a.sites()
+	if err != nil {
+		return nil, err
+	}
+	// A site that fails is retried on the next run; the others go on
+	var archived []models.HitArchive
+	var errs []error
+	for _, siteID := range siteIDs {
+		if ctx.Err() != nil {
+			break
+		}
+		ranges, err := a.ArchiveSite(ctx, siteID, now)
+		archived = append(archived, ranges...)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("site %s: %w", siteID, err))
+		}
+	}
+	return archived, errors.Join(errs...)
+}
+
+// ArchiveSite archives a site's closed days not yet archived
+func (a *Archiver) ArchiveSite(ctx context.Context, siteID string, now time.Time) ([]models.HitArchive, error) {
+	closed := now.UTC().Truncate(24*time.Hour).AddDate(0, 0, -a.lagDays)
+
+	from, ok, err := ArchivedThrough(a.db, siteID)
+	if err != nil {
+		return nil, err
+	}
+	var archived []models.HitArchive
+	for ctx.Err() == nil {
+		// The next day with hits, skipping empty ones
+		next, found, err := a.firstHit(siteID, from)
+		if err != nil || !found {
+			return archived, err
+		}
+		day := next.UTC().Truncate(24 * time.Hour)
+		to := day.AddDate(0, 0, 1)
+		if to.After(closed) {
+			return archived, nil
+		}
+		if !ok {
+			from, ok = day, true
+		}
+
+		h, err := a.archiveRange(ctx, siteID, from, to, day)
+		if err != nil {
+			return archived, err
+		}
+		archived = append(archived, *h)
+		from = to
+	}
+	return archived, ctx.Err()
+}
+
+// archiveRange writes the files and manifest of a range and records it
+func (a *Archiver) archiveRange(ctx context.Context, siteID string, from, to, day time.Time) (*models.HitArchive, error) {
+	dir := path.Join(a.prefix, "site_id="+siteID, "date="+day.Format("2006-01-02"))
+	m := Manifest{Version: ManifestVersion, SiteID: siteID, From: from, To: to, CreatedAt: time.Now().UTC()}
+	h := &models.HitArchive{ID: uuid.New(), SiteID: siteID, RangeStart: from, RangeEnd: to, Location: path.Join(dir, "manifest.json")}
+
+	for i := range tables {
+		t := &tables[i]
+		data, rows, err := a.export(ctx, t, siteID, from, to)
+		if err != nil {
+			return nil, fmt.Errorf("exporting %s: %w", t.name, err)
+		}
+		key := path.Join(dir, t.name+".parquet")
+		if err := a.bucket.Put(ctx, key, data); err != nil {
+			return nil, fmt.Errorf("writing %s: %w", key, err)
+		}
+		sum := sha256.Sum256(data)
+		m.Files = append(m.Files, File{Table: t.name, Key: key, Rows: rows, Bytes: int64(len(data)), SHA256: hex.EncodeToString(sum[:])})
+
+		h.Bytes += int64(len(data))
+		switch t.name {
+		case "page_views":
+			h.PageViews = rows
+		case "events":
+			h.Events = rows
+		case "sessions":
+			h.Sessions = rows
+		case "visitors":
+			h.Visitors = rows
+		}
+	}
+
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := a.bucket.Put(ctx, h.Location, manifest); err != nil {
+		return nil, fmt.Errorf("writing %s: %w", h.Location, err)
+	}
+	if err := record(a.db, h); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// export writes a table's rows of a range to a Parquet file
+func (a *Archiver) export(ctx context.Context, t *table, siteID string, from, to time.Time) ([]byte, int64, error) {
+	rows, err := a.db.QueryContext(ctx, t.selectQuery(a.db), siteID, from, to)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var buf bytes.Buffer
+	w, err := parquet.NewWriter(&buf, t.schema(), rowGroupSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	var n int64
+	for rows.Next() {
+		row, err := t.scanRow(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := w.Write(row); err != nil {
+			return nil, 0, err
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, 0, err
+	}
+	return buf.Bytes(), n, nil
+}
+
+// firstHit returns the time of a site's first page view or event at or
+// after from
+func (a *Archiver) firstHit(siteID string, from time.Time) (time.Time, bool, error) {
+	// Not MIN(): SQLite returns aggregates as text, not timestamps
+	var first time.Time
+	found := false
+	for _, q := range []string{
+		`SELECT viewed_at FROM page_views WHERE site_id = $1 AND viewed_at >= $2 ORDER BY viewed_at LIMIT 1`,
+		`SELECT occurred_at FROM events WHERE site_id = $1 AND occurred_at >= $2 ORDER BY occurred_at LIMIT 1`,
+	} {
+		var at time.Time
+		err := a.db.QueryRow(q, siteID, from).Scan(&at)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return time.Time{}, false, err
+		}
+		if !found || at.Before(first) {
+			first, found = at, true
+		}
+	}
+	return first, found, nil
+}
+
+func (a *Archiver) sites() ([]string, error) {
+	rows, err := a.db.Query(`SELECT id FROM sites ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Run archives closed days immediately and then every interval until ctx is cancelled
+func (a *Archiver) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		archived, err := a.Archive(ctx, time.Now())
+		for _, h := range archived {
+			log.Printf("Archive: archived %d page views and %d events of site %s from %s to %s",
+				h.PageViews, h.Events, h.SiteID, h.RangeStart.Format(time.RFC3339), h.RangeEnd.Format(time.RFC3339))
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Archive failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ArchivedThrough returns the end of a site's last archived range: all its
+// hits before it are archived. ok is false if nothing is archived.
+func ArchivedThrough(db *database.DB, siteID string) (time.Time, bool, error) {
+	var end time.Time
+	err := db.QueryRow(`
+		SELECT range_end FROM hit_archives WHERE site_id = $1 ORDER BY range_end DESC LIMIT 1
+	`, siteID).Scan(&end)
+	if err == sql.ErrNoRows {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return end.UTC(), true, nil
+}
+
+// List returns a site's archived ranges overlapping [from, to), oldest
+// first; zero times leave the range open
+func List(db *database.DB, siteID string, from, to time.Time) ([]models.HitArchive, error) {
+	query := `
+		SELECT id, site_id, range_start, range_end, location, page_views, events, sessions, visitors, bytes, created_at
+		FROM hit_archives
+		WHERE site_id = $1`
+	args := []interface{}{siteID}
+	if !from.IsZero() {
+		args = append(args, from)
+		query += fmt.Sprintf(" AND range_end > $%d", len(args))
+	}
+	if !to.IsZero() {
+		args = append(args, to)
+		query += fmt.Sprintf(" AND range_start < $%d", len(args))
+	}
+	rows, err := db.Query(query+" ORDER BY range_start", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	archives := []models.HitArchive{}
+	for rows.Next() {
+		var h models.HitArchive
+		if err := rows.Scan(&h.ID, &h.SiteID, &h.RangeStart, &h.RangeEnd, &h.Location,
+			&h.PageViews, &h.Events, &h.Sessions, &h.Visitors, &h.Bytes, &h.CreatedAt); err != nil {
+			return nil, err
+		}
+		archives = append(archives, h)
+	}
+	return archives, rows.Err()
+}
+
+// record adds an archived range
+func record(db *database.DB, h *models.HitArchive) error {
+	h.CreatedAt = time.Now().UTC()
+	_, err := db.Exec(`
+		INSERT INTO hit_archives (id, site_id, range_start, range_end, location, page_views, events, sessions, visitors, bytes, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+	`, h.ID, h.SiteID, h.RangeStart, h.RangeEnd, h.Location, h.PageViews, h.Events, h.Sessions, h.Visitors, h.Bytes, h.CreatedAt)
+	if database.IsUniqueViolation(err) {
+		return errors.New("range already archived by another instance")
+	}
+	return err
+}
@@ -0,0 +1,160 @@
+package archive
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/migrate"
+	"trackveilapi/internal/models"
+
+	"github.com/google/uuid"
+)
+
+// TestArchiveRestore checks that a day archived to Parquet and deleted is
+// restored with every value, nulls included, and that restoring it again
+// inserts nothing
+func TestArchiveRestore(t *testing.T) {
+	ctx := context.Background()
+	db, siteID := newArchiveSite(t)
+	day := time.Date(2026, 10, 12, 0, 0, 0, 0, time.UTC)
+
+	visitorID, sessionID := uuid.New(), uuid.New()
+	if _, err := db.Exec(`
+		INSERT INTO visitors (id, site_id, fingerprint_hash, first_seen_at, last_seen_at, total_visits)
+		VALUES ($1, $2, 'fp', $3, $4, 3)
+	`, visitorID, siteID, day.Add(9*time.Hour), day.Add(10*time.Hour)); err != nil {
+		t.Fatalf("create visitor: %v", err)
+	}
+	if _, err := db.Exec(`
+		INSERT INTO sessions (id, visitor_id, site_id, started_at, last_activity_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`, sessionID, visitorID, siteID, day.Add(9*time.Hour), day.Add(10*time.Hour)); err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	if _, err := db.Exec(`
+		INSERT INTO page_views (id, site_id, visitor_id, session_id, page_url, page_title, referrer, user_agent,
+			ip_address, country_code, browser_name, browser_version, os_name, os_version, device_type,
+			screen_width, screen_height, viewed_at, page_load_time)
+		VALUES ($1, $2, $3, $4, 'https://example.com/pricing', 'Pricing – Example', 'https://news.ycombinator.com/',
+			'Mozilla/5.0', '203.0.113.5', 'DE', 'Firefox', '120.0', 'Linux', '', 'desktop',
+			2560, 1440, $5, 1234)
+	`, uuid.New(), siteID, visitorID, sessionID, day.Add(9*time.Hour+123456*time.Microsecond)); err != nil {
+		t.Fatalf("create page view: %v", err)
+	}
+	if _, err := db.Exec(`
+		INSERT INTO page_views (id, site_id, visitor_id, session_id, page_url, viewed_at)
+		VALUES ($1, $2, $3, $4, 'https://example.com/', $5)
+	`, uuid.New(), siteID, visitorID, sessionID, day.Add(10*time.Hour)); err != nil {
+		t.Fatalf("create page view: %v", err)
+	}
+	if _, err := db.Exec(`
+		INSERT INTO events (id, site_id, visitor_id, session_id, event_name, page_url, properties, occurred_at)
+		VALUES ($1, $2, $3, $4, 'signup', NULL, '{"plan":"pro","value":"10"}', $5)
+	`, uuid.New(), siteID, visitorID, sessionID, day.Add(10*time.Hour)); err != nil {
+		t.Fatalf("create event: %v", err)
+	}
+
+	archived := snapshot(t, db, siteID, day)
+	for _, name := range []string{"visitors", "sessions", "page_views", "events"} {
+		if len(archived[name]) == 0 {
+			t.Fatalf("no %s to archive", name)
+		}
+	}
+
+	bucket, err := NewDirBucket(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ranges, err := NewArchiver(db, bucket, "archive", 0).ArchiveSite(ctx, siteID, day.AddDate(0, 0, 2))
+	if err != nil {
+		t.Fatalf("archive: %v", err)
+	}
+	if len(ranges) != 1 || ranges[0].PageViews != 2 || ranges[0].Events != 1 {
+		t.Fatalf("archived %+v, want a range of 2 page views and 1 event", ranges)
+	}
+
+	for _, table := range []string{"events", "page_views", "sessions", "visitors"} {
+		if _, err := db.Exec(`DELETE FROM `+table+` WHERE site_id = $1`, siteID); err != nil {
+			t.Fatalf("delete %s: %v", table, err)
+		}
+	}
+	restored, err := Restore(ctx, db, bucket, ranges[0])
+	if err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	want := Restored{"visitors": 1, "sessions": 1, "page_views": 2, "events": 1}
+	if !reflect.DeepEqual(restored, want) {
+		t.Errorf("restored %s, want %s", restored.Describe(), want.Describe())
+	}
+	for name, rows := range snapshot(t, db, siteID, day) {
+		if !reflect.DeepEqual(rows, archived[name]) {
+			t.Errorf("%s restored as\n%v, want\n%v", name, rows, archived[name])
+		}
+	}
+
+	restored, err = Restore(ctx, db, bucket, ranges[0])
+	if err != nil {
+		t.Fatalf("restore again: %v", err)
+	}
+	if !reflect.DeepEqual(restored, Restored{"visitors": 0, "sessions": 0, "page_views": 0, "events": 0}) {
+		t.Errorf("restoring again inserted %s", restored.Describe())
+	}
+}
+
+// snapshot reads a day's rows of every archived table as the archiver does
+func snapshot(t *testing.T, db *database.DB, siteID string, day time.Time) map[string][][]interface{} {
+	t.Helper()
+	out := map[string][][]interface{}{}
+	for i := range tables {
+		tb := &tables[i]
+		rows, err := db.Query(tb.selectQuery(db), siteID, day, day.AddDate(0, 0, 1))
+		if err != nil {
+			t.Fatalf("%s: %v", tb.name, err)
+		}
+		for rows.Next() {
+			row, err := tb.scanRow(rows)
+			if err != nil {
+				t.Fatalf("%s: %v", tb.name, err)
+			}
+			out[tb.name] = append(out[tb.name], row)
+		}
+		if err := rows.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return out
+}
+
+func newArchiveSite(t *testing.T) (*database.DB, string) {
+	db, err := database.OpenSQLite(filepath.Join(t.TempDir(), "trackveil.db"))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	m, err := migrate.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(context.Background()); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	siteID, err := models.GenerateSiteID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accountID := uuid.New()
+	if _, err := db.Exec(`INSERT INTO accounts (id, name) VALUES ($1, 'Archive')`, accountID); err != nil {
+		t.Fatalf("create account: %v", err)
+	}
+	if _, err := db.Exec(`
+		INSERT INTO sites (id, account_id, name, domain) VALUES ($1, $2, 'Archive', 'example.com')
+	`, siteID, accountID); err != nil {
+		t.Fatalf("create site: %v", err)
+	}
+	return db, siteID
+}
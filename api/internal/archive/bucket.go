@@ -0,0 +1,149 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// ErrNotFound is returned by Bucket.Get for a missing key
+var ErrNotFound = errors.New("archive object not found")
+
+// Bucket stores archive files by key, slash-separated
+type Bucket interface {
+	Put(ctx context.Context, key string, data []byte) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	String() string // where the files are, for logs
+}
+
+// DirBucket stores files in a local directory
+type DirBucket struct {
+	dir string
+}
+
+// NewDirBucket stores files under dir, creating it if needed
+func NewDirBucket(dir string) (*DirBucket, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &DirBucket{dir: dir}, nil
+}
+
+func (b *DirBucket) path(key string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(key))
+	if clean == "." || filepath.IsAbs(clean) || strings.HasPrefix(clean, ".."+string(filepath.Separator)) || clean == ".." {
+		return "", fmt.Errorf("invalid archive key %q", key)
+	}
+	return filepath.Join(b.dir, clean), nil
+}
+
+// Put implements Bucket. The file is written under a temporary name and
+// renamed, so a crash never leaves a partial file under the key.
+func (b *DirBucket) Put(_ context.Context, key string, data []byte) error {
+	path, err := b.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Get implements Bucket
+func (b *DirBucket) Get(_ context.Context, key string) ([]byte, error) {
+	path, err := b.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+func (b *DirBucket) String() string { return b.dir }
+
+// S3Bucket stores files in an S3-compatible bucket
+type S3Bucket struct {
+	bucket string
+	client *minio.Client
+}
+
+// NewS3Bucket stores files in bucket. With an endpoint, such as
+// http://localhost:9000 for MinIO, objects are addressed by path
+// (endpoint/bucket/key); without one, on AWS by virtual host. Without an
+// access key requests are anonymous.
+func NewS3Bucket(bucket, endpoint, region, accessKey, secretKey string) (*S3Bucket, error) {
+	opts := &minio.Options{
+		Creds:        credentials.NewStaticV4(accessKey, secretKey, ""),
+		Secure:       true,
+		Region:       region,
+		BucketLookup: minio.BucketLookupDNS,
+	}
+	host := "s3.amazonaws.com"
+	if endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+			return nil, fmt.Errorf("invalid S3 endpoint %q", endpoint)
+		}
+		host = u.Host
+		opts.Secure = u.Scheme == "https"
+		opts.BucketLookup = minio.BucketLookupPath
+	}
+	client, err := minio.New(host, opts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint %q: %w", endpoint, err)
+	}
+	return &S3Bucket{bucket: bucket, client: client}, nil
+}
+
+// Put implements Bucket
+func (b *S3Bucket) Put(ctx context.Context, key string, data []byte) error {
+	_, err := b.client.PutObject(ctx, b.bucket, key, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{})
+	return err
+}
+
+// Get implements Bucket
+func (b *S3Bucket) Get(ctx context.Context, key string) ([]byte, error) {
+	obj, err := b.client.GetObject(ctx, b.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	data, err := io.ReadAll(obj)
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+func (b *S3Bucket) String() string {
+	return "s3://" + b.bucket
+}
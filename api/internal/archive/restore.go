@@ -0,0 +1,240 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/models"
+	"trackveilapi/internal/parquet"
+)
+
+// restoredFingerprint is the fingerprint of a restored visitor whose
+// fingerprint now belongs to another visitor of the site
+const restoredFingerprint = "restored:"
+
+// Restored counts the rows a restore inserted, by table
+type Restored map[string]int64
+
+// Restore inserts an archived range back into the database in one
+// transaction. Its files are checked against the manifest first. Rows still
+// in the database are left alone, so restoring twice is harmless. Reporting
+// rollups are not recomputed.
+func Restore(ctx context.Context, db *database.DB, bucket Bucket, h models.HitArchive) (Restored, error) {
+	data, err := bucket.Get(ctx, h.Location)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", h.Location, err)
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", h.Location, err)
+	}
+	if m.Version < 1 || m.Version > ManifestVersion {
+		return nil, fmt.Errorf("%s: unsupported manifest version %d", h.Location, m.Version)
+	}
+	if m.SiteID != h.SiteID {
+		return nil, fmt.Errorf("%s: manifest is for site %s", h.Location, m.SiteID)
+	}
+
+	files := map[string]*parquet.Table{}
+	for _, f := range m.Files {
+		t, err := readFile(ctx, bucket, f)
+		if err != nil {
+			return nil, err
+		}
+		files[f.Table] = t
+	}
+
+	var exists bool
+	if err := db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM sites WHERE id = $1)`, h.SiteID).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("site %s does not exist", h.SiteID)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	r := &restore{db: db, tx: tx, restored: Restored{}, visitors: map[string]*visitorFix{}}
+	for i := range tables {
+		if file, ok := files[tables[i].name]; ok {
+			if err := r.insert(ctx, &tables[i], file); err != nil {
+				return nil, fmt.Errorf("restoring %s: %w", tables[i].name, err)
+			}
+		}
+	}
+	if !db.SQLite() {
+		if err := r.fixVisitors(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return r.restored, nil
+}
+
+// readFile reads a file of a manifest, checking its size, digest and rows
+func readFile(ctx context.Context, bucket Bucket, f File) (*parquet.Table, error) {
+	if _, ok := tableNamed(f.Table); !ok {
+		return nil, fmt.Errorf("%s: unknown table %q", f.Key, f.Table)
+	}
+	data, err := bucket.Get(ctx, f.Key)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", f.Key, err)
+	}
+	sum := sha256.Sum256(data)
+	if int64(len(data)) != f.Bytes || hex.EncodeToString(sum[:]) != f.SHA256 {
+		return nil, fmt.Errorf("%s does not match its manifest", f.Key)
+	}
+	t, err := parquet.Read(data)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", f.Key, err)
+	}
+	if int64(len(t.Rows)) != f.Rows {
+		return nil, fmt.Errorf("%s holds %d rows, its manifest %d", f.Key, len(t.Rows), f.Rows)
+	}
+	return t, nil
+}
+
+// visitorFix is what a restored visitor's counters are set back to once
+// the Postgres triggers have counted its restored page views
+type visitorFix struct {
+	inserted    bool // by the restore; else it was still in the database
+	totalVisits interface{}
+	lastSeenAt  interface{}
+	pageViews   int64 // restored
+}
+
+type restore struct {
+	db       *database.DB
+	tx       *sql.Tx
+	restored Restored
+	visitors map[string]*visitorFix
+}
+
+// insert inserts a file's rows into its table
+func (r *restore) insert(ctx context.Context, t *table, file *parquet.Table) error {
+	var columns []column
+	for _, fc := range file.Columns {
+		found := false
+		for _, c := range t.columns {
+			if c.Name == fc.Name {
+				if c.Type != fc.Type {
+					return fmt.Errorf("column %s holds %s values, not %s", c.Name, fc.Type, c.Type)
+				}
+				columns = append(columns, c)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown column %s", fc.Name)
+		}
+	}
+	stmt, err := r.tx.PrepareContext(ctx, t.insertQuery(r.db, columns))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	at := func(row []interface{}, name string) interface{} {
+		if i := file.Index(name); i >= 0 {
+			return row[i]
+		}
+		return nil
+	}
+	for _, row := range file.Rows {
+		res, err := stmt.ExecContext(ctx, row...)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		switch t.name {
+		case "visitors":
+			id, _ := at(row, "id").(string)
+			if n == 0 {
+				if n, err = r.insertClashingVisitor(ctx, stmt, file, row, id); err != nil {
+					return err
+				}
+			}
+			r.visitors[id] = &visitorFix{inserted: n > 0, totalVisits: at(row, "total_visits"), lastSeenAt: at(row, "last_seen_at")}
+		case "page_views":
+			if id, _ := at(row, "visitor_id").(string); n > 0 && r.visitors[id] != nil {
+				r.visitors[id].pageViews++
+			}
+		}
+		r.restored[t.name] += n
+	}
+	return nil
+}
+
+// insertClashingVisitor inserts a visitor that was not inserted because
+// another visitor of the site now has its fingerprint, under a fingerprint
+// that cannot clash. Nothing is inserted if the visitor is still there.
+func (r *restore) insertClashingVisitor(ctx context.Context, stmt *sql.Stmt, file *parquet.Table, row []interface{}, id string) (int64, error) {
+	var exists bool
+	if err := r.tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM visitors WHERE id = $1)`, id).Scan(&exists); err != nil {
+		return 0, err
+	}
+	fp := file.Index("fingerprint_hash")
+	if exists || fp < 0 {
+		return 0, nil
+	}
+	renamed := append([]interface{}(nil), row...)
+	renamed[fp] = restoredFingerprint + id
+	res, err := stmt.ExecContext(ctx, renamed...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// fixVisitors undoes what the Postgres page view trigger did to the
+// counters of the restored visitors: those inserted get their archived
+// counters back, those still there had counted the page views already
+func (r *restore) fixVisitors(ctx context.Context) error {
+	for id, v := range r.visitors {
+		var err error
+		switch {
+		case v.inserted:
+			_, err = r.tx.ExecContext(ctx, `
+				UPDATE visitors SET total_visits = COALESCE($2, total_visits), last_seen_at = COALESCE($3, last_seen_at)
+				WHERE id = $1
+			`, id, v.totalVisits, v.lastSeenAt)
+		case v.pageViews > 0:
+			_, err = r.tx.ExecContext(ctx, `
+				UPDATE visitors SET total_visits = total_visits - $2 WHERE id = $1
+			`, id, v.pageViews)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Describe summarizes what a restore inserted, in restore order
+func (r Restored) Describe() string {
+	var buf bytes.Buffer
+	for i, t := range tables {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		fmt.Fprintf(&buf, "%d %s", r[t.name], t.name)
+	}
+	return buf.String()
+}
@@ -0,0 +1,207 @@
+package archive
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/parquet"
+)
+
+// column is an archived column. pgSelect and pgInsert adapt Postgres types
+// the files store as text.
+type column struct {
+	parquet.Column
+	pgSelect string // expression read, if not the column
+	pgInsert string // cast of the placeholder written, e.g. "::inet"
+}
+
+func col(name string, t parquet.Type, optional bool) column {
+	return column{Column: parquet.Column{Name: name, Type: t, Optional: optional}}
+}
+
+// table is an archived table. Its rows of a range are selected by filter,
+// with $1 the site and $2 and $3 the start and end of the range.
+type table struct {
+	name    string
+	columns []column
+	filter  string
+	order   string
+}
+
+// hitsFilter selects the IDs a range's hits reference
+const hitsFilter = `id IN (
+	SELECT %[1]s FROM page_views WHERE site_id = $1 AND viewed_at >= $2 AND viewed_at < $3
+	UNION
+	SELECT %[1]s FROM events WHERE site_id = $1 AND occurred_at >= $2 AND occurred_at < $3
+)`
+
+// tables in restore order: the hits reference the sessions and visitors
+var tables = []table{
+	{
+		name: "visitors",
+		columns: []column{
+			col("id", parquet.String, false),
+			col("site_id", parquet.String, false),
+			col("fingerprint_hash", parquet.String, false),
+			col("first_seen_at", parquet.Timestamp, true),
+			col("last_seen_at", parquet.Timestamp, true),
+			col("total_visits", parquet.Int32, true),
+		},
+		filter: fmt.Sprintf(hitsFilter, "visitor_id"),
+		order:  "id",
+	},
+	{
+		name: "sessions",
+		columns: []column{
+			col("id", parquet.String, false),
+			col("visitor_id", parquet.String, false),
+			col("site_id", parquet.String, false),
+			col("started_at", parquet.Timestamp, true),
+			col("last_activity_at", parquet.Timestamp, true),
+			col("ended_at", parquet.Timestamp, true),
+		},
+		filter: fmt.Sprintf(hitsFilter, "session_id"),
+		order:  "id",
+	},
+	{
+		name: "page_views",
+		columns: []column{
+			col("id", parquet.String, false),
+			col("site_id", parquet.String, false),
+			col("visitor_id", parquet.String, false),
+			col("session_id", parquet.String, false),
+			col("page_url", parquet.String, false),
+			col("page_title", parquet.String, true),
+			col("referrer", parquet.String, true),
+			col("user_agent", parquet.String, true),
+			{Column: parquet.Column{Name: "ip_address", Type: parquet.String, Optional: true},
+				pgSelect: "host(ip_address)", pgInsert: "::inet"},
+			col("country_code", parquet.String, true),
+			col("browser_name", parquet.String, true),
+			col("browser_version", parquet.String, true),
+			col("os_name", parquet.String, true),
+			col("os_version", parquet.String, true),
+			col("device_type", parquet.String, true),
+			col("screen_width", parquet.Int32, true),
+			col("screen_height", parquet.Int32, true),
+			col("viewed_at", parquet.Timestamp, false),
+			col("page_load_time", parquet.Int32, true),
+		},
+		filter: "site_id = $1 AND viewed_at >= $2 AND viewed_at < $3",
+		order:  "viewed_at, id",
+	},
+	{
+		name: "events",
+		columns: []column{
+			col("id", parquet.String, false),
+			col("site_id", parquet.String, false),
+			col("visitor_id", parquet.String, false),
+			col("session_id", parquet.String, false),
+			col("event_name", parquet.String, false),
+			col("page_url", parquet.String, true),
+			{Column: parquet.Column{Name: "properties", Type: parquet.String, Optional: true},
+				pgSelect: "properties::text", pgInsert: "::jsonb"},
+			col("occurred_at", parquet.Timestamp, false),
+		},
+		filter: "site_id = $1 AND occurred_at >= $2 AND occurred_at < $3",
+		order:  "occurred_at, id",
+	},
+}
+
+// tableNamed returns the table of a manifest file
+func tableNamed(name string) (*table, bool) {
+	for i := range tables {
+		if tables[i].name == name {
+			return &tables[i], true
+		}
+	}
+	return nil, false
+}
+
+func (t *table) schema() []parquet.Column {
+	schema := make([]parquet.Column, len(t.columns))
+	for i, c := range t.columns {
+		schema[i] = c.Column
+	}
+	return schema
+}
+
+// selectQuery reads a range's rows
+func (t *table) selectQuery(db *database.DB) string {
+	exprs := make([]string, len(t.columns))
+	for i, c := range t.columns {
+		exprs[i] = c.Name
+		if c.pgSelect != "" && !db.SQLite() {
+			exprs[i] = c.pgSelect
+		}
+	}
+	return fmt.Sprintf("SELECT %s FROM %s WHERE %s ORDER BY %s",
+		strings.Join(exprs, ", "), t.name, t.filter, t.order)
+}
+
+// insertQuery writes a row of the given columns, leaving existing rows alone
+func (t *table) insertQuery(db *database.DB, columns []column) string {
+	names := make([]string, len(columns))
+	placeholders := make([]string, len(columns))
+	for i, c := range columns {
+		names[i] = c.Name
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+		if !db.SQLite() {
+			placeholders[i] += c.pgInsert
+		}
+	}
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON CONFLICT DO NOTHING",
+		t.name, strings.Join(names, ", "), strings.Join(placeholders, ", "))
+}
+
+// scanRow scans a row into the values the Parquet writer takes
+func (t *table) scanRow(rows *sql.Rows) ([]interface{}, error) {
+	dest := make([]interface{}, len(t.columns))
+	for i, c := range t.columns {
+		switch c.Type {
+		case parquet.String:
+			dest[i] = new(sql.NullString)
+		case parquet.Int32:
+			dest[i] = new(sql.NullInt32)
+		case parquet.Int64:
+			dest[i] = new(sql.NullInt64)
+		case parquet.Timestamp:
+			dest[i] = new(sql.NullTime)
+		default:
+			dest[i] = new(sql.NullBool)
+		}
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return nil, err
+	}
+
+	row := make([]interface{}, len(dest))
+	for i, d := range dest {
+		switch v := d.(type) {
+		case *sql.NullString:
+			if v.Valid {
+				row[i] = v.String
+			}
+		case *sql.NullInt32:
+			if v.Valid {
+				row[i] = v.Int32
+			}
+		case *sql.NullInt64:
+			if v.Valid {
+				row[i] = v.Int64
+			}
+		case *sql.NullTime:
+			if v.Valid {
+				row[i] = v.Time.UTC().Truncate(time.Microsecond)
+			}
+		case *sql.NullBool:
+			if v.Valid {
+				row[i] = v.Bool
+			}
+		}
+	}
+	return row, nil
+}
@@ -0,0 +1,202 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// reloadInterval is how often a cached directory certificate is checked for changes
+const reloadInterval = 30 * time.Second
+
+// ErrNoCertificate is returned by a provider that has no certificate for the
+// requested hostname, so the next provider in a Chain can be tried
+var ErrNoCertificate = errors.New("no certificate for hostname")
+
+// Provider supplies TLS certificates for custom domains
+type Provider interface {
+	GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+}
+
+// HostPolicy decides whether a certificate may be issued for a hostname
+type HostPolicy func(host string) error
+
+// TLSConfig returns a server TLS configuration that takes certificates from p.
+// It also advertises the ACME TLS-ALPN-01 protocol so an ACMEProvider can
+// answer challenges on the TLS port.
+func TLSConfig(p Provider) *tls.Config {
+	return &tls.Config{
+		GetCertificate: p.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1", acme.ALPNProto},
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// Chain tries providers in order until one has a certificate
+type Chain []Provider
+
+// GetCertificate implements Provider
+func (c Chain) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	for _, p := range c {
+		cert, err := p.GetCertificate(hello)
+		if errors.Is(err, ErrNoCertificate) {
+			continue
+		}
+		return cert, err
+	}
+	return nil, ErrNoCertificate
+}
+
+// DirProvider loads certificates from a directory with one subdirectory per
+// hostname, each holding cert.pem (full chain) and key.pem:
+//
+//	<dir>/stats.customer.com/cert.pem
+//	<dir>/stats.customer.com/key.pem
+//
+// Certificates are reloaded when the files change, so renewals need no restart.
+type DirProvider struct {
+	dir string
+
+	mu    sync.Mutex
+	cache map[string]*dirEntry
+}
+
+type dirEntry struct {
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+// NewDirProvider creates a provider for a certificate directory
+func NewDirProvider(dir string) *DirProvider {
+	return &DirProvider{dir: dir, cache: make(map[string]*dirEntry)}
+}
+
+// GetCertificate implements Provider
+func (p *DirProvider) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+	if !safeHostname(host) || isACMEChallenge(hello) {
+		return nil, ErrNoCertificate
+	}
+
+	p.mu.Lock()
+	entry := p.cache[host]
+	p.mu.Unlock()
+	if entry != nil && time.Since(entry.checkedAt) < reloadInterval {
+		return entry.cert, nil
+	}
+
+	certFile := filepath.Join(p.dir, host, "cert.pem")
+	info, err := os.Stat(certFile)
+	if errors.Is(err, os.ErrNotExist) {
+		p.mu.Lock()
+		delete(p.cache, host)
+		p.mu.Unlock()
+		return nil, ErrNoCertificate
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Unchanged since the last load
+	if entry != nil && info.ModTime().Equal(entry.modTime) {
+		p.mu.Lock()
+		entry.checkedAt = time.Now()
+		p.mu.Unlock()
+		return entry.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, filepath.Join(p.dir, host, "key.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate for %s: %w", host, err)
+	}
+
+	p.mu.Lock()
+	p.cache[host] = &dirEntry{cert: &cert, modTime: info.ModTime(), checkedAt: time.Now()}
+	p.mu.Unlock()
+	return &cert, nil
+}
+
+// ACMEConfig configures certificate issuance
+type ACMEConfig struct {
+	DirectoryURL string // e.g. Let's Encrypt, or a local test server such as Pebble
+	Email        string // contact address for the ACME account
+	CacheDir     string // where issued certificates and the account key are stored
+	CAFile       string // optional CA bundle to trust the ACME server (test servers)
+}
+
+// ACMEProvider issues certificates on demand for hostnames allowed by the host policy
+type ACMEProvider struct {
+	manager *autocert.Manager
+}
+
+// NewACMEProvider creates an ACME certificate provider
+func NewACMEProvider(cfg ACMEConfig, policy HostPolicy) (*ACMEProvider, error) {
+	client := &acme.Client{DirectoryURL: cfg.DirectoryURL}
+
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ACME CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in ACME CA file")
+		}
+		client.HTTPClient = &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		}
+	}
+
+	return &ACMEProvider{manager: &autocert.Manager{
+		Prompt: autocert.AcceptTOS,
+		Cache:  autocert.DirCache(cfg.CacheDir),
+		HostPolicy: func(_ context.Context, host string) error {
+			return policy(host)
+		},
+		Email:  cfg.Email,
+		Client: client,
+	}}, nil
+}
+
+// GetCertificate implements Provider
+func (p *ACMEProvider) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return p.manager.GetCertificate(hello)
+}
+
+// HTTPHandler answers HTTP-01 challenges and passes other requests to fallback
+func (p *ACMEProvider) HTTPHandler(fallback http.Handler) http.Handler {
+	return p.manager.HTTPHandler(fallback)
+}
+
+// isACMEChallenge reports whether the handshake is a TLS-ALPN-01 challenge,
+// which only the ACME provider can answer
+func isACMEChallenge(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto
+}
+
+// safeHostname rejects names that could escape the certificate directory
+func safeHostname(host string) bool {
+	if host == "" || len(host) > 253 || strings.Contains(host, "..") {
+		return false
+	}
+	for i := 0; i < len(host); i++ {
+		c := host[i]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
@@ -2,9 +2,12 @@ package config
 
 import (
 	"fmt"
+	"net"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -14,6 +17,15 @@ type Config struct {
 	API       APIConfig
 	CORS      CORSConfig
 	RateLimit RateLimitConfig
+	Dedup     DedupConfig
+	TLS       TLSConfig
+	Partition PartitionConfig
+	Rollup    RollupConfig
+	Retention RetentionConfig
+	Storage   StorageConfig
+	Spool     SpoolConfig
+	Sinks     SinksConfig
+	Archive   ArchiveConfig
 }
 
 type DatabaseConfig struct {
@@ -23,11 +35,46 @@ type DatabaseConfig struct {
 	Password string
 	DBName   string
 	SSLMode  string
+
+	// SQLitePath is a SQLite database file used instead of Postgres
+	SQLitePath string
+
+	// MigrateOnStart applies pending schema migrations at startup. Off by
+	// default, since some rewrite whole tables; startup then fails until
+	// they are applied with `trackveil-api migrate up`.
+	MigrateOnStart bool
+
+	// Connection pools, per primary and per replica
+	MaxConns          int
+	MinConns          int
+	MaxConnLifetime   time.Duration
+	MaxConnIdleTime   time.Duration
+	HealthCheckPeriod time.Duration
+	StatementCache    int // prepared statements per connection, 0 disables
+
+	// ReplicaDSNs are PostgreSQL read replicas that serve analytics queries
+	ReplicaDSNs         []string
+	ReplicaMaxConns     int
+	ReplicaMinConns     int
+	ReplicaMaxLag       time.Duration // replicas further behind are skipped
+	ReplicaCheckSeconds int
 }
 
 type APIConfig struct {
-	Port int
-	Env  string
+	Port       int
+	Env        string
+	AdminToken string // Bearer token for the /api management and analytics routes
+
+	// PublicURL is the external base URL of the API, used in the served
+	// tracker and snippets (http://localhost:<port> if unset)
+	PublicURL string
+
+	// EnforceOrigin rejects browser hits whose Origin/Referer is not the site's domain
+	EnforceOrigin bool
+
+	// TrustedProxies are the proxy IPs and CIDRs whose X-Forwarded-For and
+	// X-Real-IP headers give the client IP; with none the connection's IP is used
+	TrustedProxies []string
 }
 
 type CORSConfig struct {
@@ -39,6 +86,113 @@ type RateLimitConfig struct {
 	WindowSeconds int
 }
 
+type DedupConfig struct {
+	WindowSeconds    int // same visitor + URL within this window is a duplicate (0 disables)
+	EventIDRetention int // hours a client event ID is remembered
+}
+
+// TLSConfig configures HTTPS for customer custom domains
+type TLSConfig struct {
+	Addr    string // listen address of the HTTPS server
+	CertDir string // per-hostname certificate directory; empty disables HTTPS
+
+	// ACME issuance for custom domains without a certificate in CertDir
+	// (disabled if ACMEDirectoryURL is empty)
+	ACMEDirectoryURL string
+	ACMEEmail        string
+	ACMECAFile       string // CA bundle to trust a local ACME test server
+}
+
+// PartitionConfig controls maintenance of the monthly page_views and events partitions
+type PartitionConfig struct {
+	MonthsAhead     int  // future months to create partitions for
+	RetentionMonths int  // months of hits kept, including the current one (0 keeps all)
+	DropExpired     bool // drop expired partitions instead of only detaching them
+}
+
+// RollupConfig controls the reporting rollup aggregator
+type RollupConfig struct {
+	IntervalSeconds int // how often open hours and days are re-aggregated
+}
+
+// RetentionConfig holds the default retention periods, used by sites whose
+// overrides and plan do not set them (0 keeps data forever), and the purger
+type RetentionConfig struct {
+	RawHitDays      int
+	VisitorDays     int
+	RollupDays      int
+	BatchSize       int // rows deleted per statement
+	IntervalMinutes int // how often expired data is purged
+}
+
+// StorageConfig selects where page views and events are stored
+type StorageConfig struct {
+	Backend string // "postgres", "sqlite" or "clickhouse"
+
+	// Writes of the postgres backend
+	PostgresWriteMode   string // "insert", "batch" or "copy"
+	PostgresBatchSize   int    // buffered hits that trigger a write
+	PostgresFlushMillis int    // longest a hit stays buffered
+
+	// Batched writes of the sqlite backend
+	SQLiteBatchSize   int // buffered hits that trigger a write
+	SQLiteFlushMillis int // longest a hit stays buffered
+
+	// ClickHouse HTTP interface, used by the clickhouse backend
+	ClickHouseURL         string
+	ClickHouseDatabase    string
+	ClickHouseUser        string
+	ClickHousePassword    string
+	ClickHouseBatchSize   int // buffered hits that trigger a write
+	ClickHouseFlushMillis int // longest a hit stays buffered
+}
+
+// SpoolConfig is the on-disk queue for browser hits while storage is down
+type SpoolConfig struct {
+	Dir                   string // empty disables spooling
+	MaxMB                 int    // hits are refused beyond this
+	SegmentMB             int    // size of each segment file
+	ReplayIntervalSeconds int
+}
+
+// SinksConfig is where accepted hits are streamed; each sink is enabled per
+// site through the API
+type SinksConfig struct {
+	QueueSize   int // hits queued per sink; beyond, the sink's hits are dropped
+	BatchSize   int // hits delivered at once
+	FlushMillis int // longest a hit waits for a batch to fill
+
+	NDJSONDir           string // empty disables the NDJSON sink
+	NDJSONRotateMB      int
+	NDJSONRotateMinutes int
+
+	WebhookURL            string // empty disables the webhook sink
+	WebhookSecret         string // signs the batches
+	WebhookTimeoutSeconds int
+	WebhookRetries        int
+
+	NATSURL            string // empty disables the NATS sink
+	NATSSubject        string // hits are published to <subject>.<site_id>
+	NATSTimeoutSeconds int
+}
+
+// ArchiveConfig is where closed days of raw hits are archived as Parquet:
+// a local directory or an S3-compatible bucket
+type ArchiveConfig struct {
+	Dir string // local archive directory
+
+	S3Bucket    string // S3 bucket, used instead of Dir
+	S3Endpoint  string // e.g. http://localhost:9000 for MinIO; empty for AWS
+	S3Region    string
+	S3AccessKey string
+	S3SecretKey string
+
+	Prefix          string // key prefix within the directory or bucket
+	LagDays         int    // days a day is left closed before it is archived
+	IntervalMinutes int    // how often new days are archived
+	RetentionOnly   bool   // retention purges only archived hits
+}
+
 // Load loads configuration from environment variables
 func Load() (*Config, error) {
 	// Load .env file if it exists (for development)
@@ -56,6 +210,11 @@ func Load() (*Config, error) {
 		return nil, fmt.Errorf("invalid API_PORT: %w", err)
 	}
 
+	publicURL := strings.TrimSuffix(getEnv("API_PUBLIC_URL", fmt.Sprintf("http://localhost:%d", apiPort)), "/")
+	if u, err := url.Parse(publicURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid API_PUBLIC_URL: %q", publicURL)
+	}
+
 	// Parse rate limit
 	rateLimitRequests, err := strconv.Atoi(getEnv("RATE_LIMIT_REQUESTS", "1000"))
 	if err != nil {
@@ -67,6 +226,264 @@ func Load() (*Config, error) {
 		return nil, fmt.Errorf("invalid RATE_LIMIT_WINDOW_SECONDS: %w", err)
 	}
 
+	// Parse duplicate suppression
+	dedupWindow, err := strconv.Atoi(getEnv("DEDUP_WINDOW_SECONDS", "10"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid DEDUP_WINDOW_SECONDS: %w", err)
+	}
+
+	dedupRetention, err := strconv.Atoi(getEnv("DEDUP_EVENT_ID_RETENTION_HOURS", "48"))
+	if err != nil || dedupRetention < 1 {
+		return nil, fmt.Errorf("invalid DEDUP_EVENT_ID_RETENTION_HOURS: %q", getEnv("DEDUP_EVENT_ID_RETENTION_HOURS", "48"))
+	}
+
+	// Parse partition maintenance
+	monthsAhead, err := strconv.Atoi(getEnv("PARTITION_MONTHS_AHEAD", "3"))
+	if err != nil || monthsAhead < 1 {
+		return nil, fmt.Errorf("invalid PARTITION_MONTHS_AHEAD: %q", getEnv("PARTITION_MONTHS_AHEAD", "3"))
+	}
+
+	retentionMonths, err := strconv.Atoi(getEnv("PARTITION_RETENTION_MONTHS", "0"))
+	if err != nil || retentionMonths < 0 {
+		return nil, fmt.Errorf("invalid PARTITION_RETENTION_MONTHS: %q", getEnv("PARTITION_RETENTION_MONTHS", "0"))
+	}
+
+	// Parse rollup aggregation
+	rollupInterval, err := strconv.Atoi(getEnv("ROLLUP_INTERVAL_SECONDS", "300"))
+	if err != nil || rollupInterval < 1 {
+		return nil, fmt.Errorf("invalid ROLLUP_INTERVAL_SECONDS: %q", getEnv("ROLLUP_INTERVAL_SECONDS", "300"))
+	}
+
+	// Parse default retention periods and the purger
+	retentionDays := make(map[string]int)
+	for _, key := range []string{"RETENTION_RAW_HIT_DAYS", "RETENTION_VISITOR_DAYS", "RETENTION_ROLLUP_DAYS"} {
+		days, err := strconv.Atoi(getEnv(key, "0"))
+		if err != nil || days < 0 {
+			return nil, fmt.Errorf("invalid %s: %q", key, getEnv(key, "0"))
+		}
+		retentionDays[key] = days
+	}
+
+	retentionBatch, err := strconv.Atoi(getEnv("RETENTION_BATCH_SIZE", "5000"))
+	if err != nil || retentionBatch < 1 {
+		return nil, fmt.Errorf("invalid RETENTION_BATCH_SIZE: %q", getEnv("RETENTION_BATCH_SIZE", "5000"))
+	}
+
+	retentionInterval, err := strconv.Atoi(getEnv("RETENTION_INTERVAL_MINUTES", "60"))
+	if err != nil || retentionInterval < 1 {
+		return nil, fmt.Errorf("invalid RETENTION_INTERVAL_MINUTES: %q", getEnv("RETENTION_INTERVAL_MINUTES", "60"))
+	}
+
+	// Parse storage backend; hits default to the database in use
+	sqlitePath := getEnv("SQLITE_PATH", "")
+	defaultBackend := "postgres"
+	if sqlitePath != "" {
+		defaultBackend = "sqlite"
+	}
+	storageBackend := getEnv("STORAGE_BACKEND", defaultBackend)
+	if storageBackend != "postgres" && storageBackend != "sqlite" && storageBackend != "clickhouse" {
+		return nil, fmt.Errorf("invalid STORAGE_BACKEND: %q (want postgres, sqlite or clickhouse)", storageBackend)
+	}
+	if storageBackend == "sqlite" && sqlitePath == "" {
+		return nil, fmt.Errorf("SQLITE_PATH is required with STORAGE_BACKEND=sqlite")
+	}
+	if storageBackend == "postgres" && sqlitePath != "" {
+		return nil, fmt.Errorf("STORAGE_BACKEND=postgres cannot be used with SQLITE_PATH")
+	}
+
+	postgresWriteMode := getEnv("POSTGRES_WRITE_MODE", "insert")
+	if postgresWriteMode != "insert" && postgresWriteMode != "batch" && postgresWriteMode != "copy" {
+		return nil, fmt.Errorf("invalid POSTGRES_WRITE_MODE: %q (want insert, batch or copy)", postgresWriteMode)
+	}
+
+	postgresBatch, err := strconv.Atoi(getEnv("POSTGRES_BATCH_SIZE", "1000"))
+	if err != nil || postgresBatch < 1 {
+		return nil, fmt.Errorf("invalid POSTGRES_BATCH_SIZE: %q", getEnv("POSTGRES_BATCH_SIZE", "1000"))
+	}
+
+	postgresFlush, err := strconv.Atoi(getEnv("POSTGRES_FLUSH_MILLIS", "1000"))
+	if err != nil || postgresFlush < 1 {
+		return nil, fmt.Errorf("invalid POSTGRES_FLUSH_MILLIS: %q", getEnv("POSTGRES_FLUSH_MILLIS", "1000"))
+	}
+
+	sqliteBatch, err := strconv.Atoi(getEnv("SQLITE_BATCH_SIZE", "500"))
+	if err != nil || sqliteBatch < 1 {
+		return nil, fmt.Errorf("invalid SQLITE_BATCH_SIZE: %q", getEnv("SQLITE_BATCH_SIZE", "500"))
+	}
+
+	sqliteFlush, err := strconv.Atoi(getEnv("SQLITE_FLUSH_MILLIS", "1000"))
+	if err != nil || sqliteFlush < 1 {
+		return nil, fmt.Errorf("invalid SQLITE_FLUSH_MILLIS: %q", getEnv("SQLITE_FLUSH_MILLIS", "1000"))
+	}
+
+	// Parse connection pools and read replicas
+	maxConns, err := strconv.Atoi(getEnv("DB_MAX_CONNS", "25"))
+	if err != nil || maxConns < 1 {
+		return nil, fmt.Errorf("invalid DB_MAX_CONNS: %q", getEnv("DB_MAX_CONNS", "25"))
+	}
+
+	minConns, err := strconv.Atoi(getEnv("DB_MIN_CONNS", "0"))
+	if err != nil || minConns < 0 || minConns > maxConns {
+		return nil, fmt.Errorf("invalid DB_MIN_CONNS: %q", getEnv("DB_MIN_CONNS", "0"))
+	}
+
+	connLifetime, err := strconv.Atoi(getEnv("DB_MAX_CONN_LIFETIME_SECONDS", "300"))
+	if err != nil || connLifetime < 1 {
+		return nil, fmt.Errorf("invalid DB_MAX_CONN_LIFETIME_SECONDS: %q", getEnv("DB_MAX_CONN_LIFETIME_SECONDS", "300"))
+	}
+
+	connIdle, err := strconv.Atoi(getEnv("DB_MAX_CONN_IDLE_SECONDS", "300"))
+	if err != nil || connIdle < 1 {
+		return nil, fmt.Errorf("invalid DB_MAX_CONN_IDLE_SECONDS: %q", getEnv("DB_MAX_CONN_IDLE_SECONDS", "300"))
+	}
+
+	healthCheck, err := strconv.Atoi(getEnv("DB_HEALTH_CHECK_SECONDS", "60"))
+	if err != nil || healthCheck < 1 {
+		return nil, fmt.Errorf("invalid DB_HEALTH_CHECK_SECONDS: %q", getEnv("DB_HEALTH_CHECK_SECONDS", "60"))
+	}
+
+	statementCache, err := strconv.Atoi(getEnv("DB_STATEMENT_CACHE_SIZE", "512"))
+	if err != nil || statementCache < 0 {
+		return nil, fmt.Errorf("invalid DB_STATEMENT_CACHE_SIZE: %q", getEnv("DB_STATEMENT_CACHE_SIZE", "512"))
+	}
+
+	var replicaDSNs []string
+	for _, dsn := range strings.Split(getEnv("DB_REPLICA_DSNS", ""), ",") {
+		if dsn = strings.TrimSpace(dsn); dsn != "" {
+			replicaDSNs = append(replicaDSNs, dsn)
+		}
+	}
+	if len(replicaDSNs) > 0 && sqlitePath != "" {
+		return nil, fmt.Errorf("DB_REPLICA_DSNS cannot be used with SQLITE_PATH")
+	}
+
+	replicaMaxConns, err := strconv.Atoi(getEnv("DB_REPLICA_MAX_CONNS", "10"))
+	if err != nil || replicaMaxConns < 1 {
+		return nil, fmt.Errorf("invalid DB_REPLICA_MAX_CONNS: %q", getEnv("DB_REPLICA_MAX_CONNS", "10"))
+	}
+
+	replicaMinConns, err := strconv.Atoi(getEnv("DB_REPLICA_MIN_CONNS", "0"))
+	if err != nil || replicaMinConns < 0 || replicaMinConns > replicaMaxConns {
+		return nil, fmt.Errorf("invalid DB_REPLICA_MIN_CONNS: %q", getEnv("DB_REPLICA_MIN_CONNS", "0"))
+	}
+
+	replicaMaxLag, err := strconv.Atoi(getEnv("DB_REPLICA_MAX_LAG_SECONDS", "30"))
+	if err != nil || replicaMaxLag < 0 {
+		return nil, fmt.Errorf("invalid DB_REPLICA_MAX_LAG_SECONDS: %q", getEnv("DB_REPLICA_MAX_LAG_SECONDS", "30"))
+	}
+
+	replicaCheck, err := strconv.Atoi(getEnv("DB_REPLICA_CHECK_SECONDS", "5"))
+	if err != nil || replicaCheck < 1 {
+		return nil, fmt.Errorf("invalid DB_REPLICA_CHECK_SECONDS: %q", getEnv("DB_REPLICA_CHECK_SECONDS", "5"))
+	}
+
+	clickHouseURL := getEnv("CLICKHOUSE_URL", "")
+	if storageBackend == "clickhouse" && clickHouseURL == "" {
+		return nil, fmt.Errorf("CLICKHOUSE_URL is required with STORAGE_BACKEND=clickhouse")
+	}
+
+	clickHouseBatch, err := strconv.Atoi(getEnv("CLICKHOUSE_BATCH_SIZE", "1000"))
+	if err != nil || clickHouseBatch < 1 {
+		return nil, fmt.Errorf("invalid CLICKHOUSE_BATCH_SIZE: %q", getEnv("CLICKHOUSE_BATCH_SIZE", "1000"))
+	}
+
+	clickHouseFlush, err := strconv.Atoi(getEnv("CLICKHOUSE_FLUSH_MILLIS", "1000"))
+	if err != nil || clickHouseFlush < 1 {
+		return nil, fmt.Errorf("invalid CLICKHOUSE_FLUSH_MILLIS: %q", getEnv("CLICKHOUSE_FLUSH_MILLIS", "1000"))
+	}
+
+	spoolMax, err := strconv.Atoi(getEnv("SPOOL_MAX_MB", "1024"))
+	if err != nil || spoolMax < 1 {
+		return nil, fmt.Errorf("invalid SPOOL_MAX_MB: %q", getEnv("SPOOL_MAX_MB", "1024"))
+	}
+
+	spoolSegment, err := strconv.Atoi(getEnv("SPOOL_SEGMENT_MB", "16"))
+	if err != nil || spoolSegment < 1 || spoolSegment > spoolMax {
+		return nil, fmt.Errorf("invalid SPOOL_SEGMENT_MB: %q", getEnv("SPOOL_SEGMENT_MB", "16"))
+	}
+
+	spoolReplay, err := strconv.Atoi(getEnv("SPOOL_REPLAY_INTERVAL_SECONDS", "5"))
+	if err != nil || spoolReplay < 1 {
+		return nil, fmt.Errorf("invalid SPOOL_REPLAY_INTERVAL_SECONDS: %q", getEnv("SPOOL_REPLAY_INTERVAL_SECONDS", "5"))
+	}
+
+	sinkQueue, err := strconv.Atoi(getEnv("SINK_QUEUE_SIZE", "10000"))
+	if err != nil || sinkQueue < 1 {
+		return nil, fmt.Errorf("invalid SINK_QUEUE_SIZE: %q", getEnv("SINK_QUEUE_SIZE", "10000"))
+	}
+
+	sinkBatch, err := strconv.Atoi(getEnv("SINK_BATCH_SIZE", "100"))
+	if err != nil || sinkBatch < 1 {
+		return nil, fmt.Errorf("invalid SINK_BATCH_SIZE: %q", getEnv("SINK_BATCH_SIZE", "100"))
+	}
+
+	sinkFlush, err := strconv.Atoi(getEnv("SINK_FLUSH_MILLIS", "1000"))
+	if err != nil || sinkFlush < 1 {
+		return nil, fmt.Errorf("invalid SINK_FLUSH_MILLIS: %q", getEnv("SINK_FLUSH_MILLIS", "1000"))
+	}
+
+	ndjsonRotateMB, err := strconv.Atoi(getEnv("SINK_NDJSON_ROTATE_MB", "100"))
+	if err != nil || ndjsonRotateMB < 1 {
+		return nil, fmt.Errorf("invalid SINK_NDJSON_ROTATE_MB: %q", getEnv("SINK_NDJSON_ROTATE_MB", "100"))
+	}
+
+	ndjsonRotateMinutes, err := strconv.Atoi(getEnv("SINK_NDJSON_ROTATE_MINUTES", "60"))
+	if err != nil || ndjsonRotateMinutes < 1 {
+		return nil, fmt.Errorf("invalid SINK_NDJSON_ROTATE_MINUTES: %q", getEnv("SINK_NDJSON_ROTATE_MINUTES", "60"))
+	}
+
+	webhookURL := getEnv("SINK_WEBHOOK_URL", "")
+	webhookSecret := getEnv("SINK_WEBHOOK_SECRET", "")
+	if webhookURL != "" && webhookSecret == "" {
+		return nil, fmt.Errorf("SINK_WEBHOOK_SECRET is required with SINK_WEBHOOK_URL")
+	}
+
+	webhookTimeout, err := strconv.Atoi(getEnv("SINK_WEBHOOK_TIMEOUT_SECONDS", "10"))
+	if err != nil || webhookTimeout < 1 {
+		return nil, fmt.Errorf("invalid SINK_WEBHOOK_TIMEOUT_SECONDS: %q", getEnv("SINK_WEBHOOK_TIMEOUT_SECONDS", "10"))
+	}
+
+	webhookRetries, err := strconv.Atoi(getEnv("SINK_WEBHOOK_RETRIES", "5"))
+	if err != nil || webhookRetries < 0 {
+		return nil, fmt.Errorf("invalid SINK_WEBHOOK_RETRIES: %q", getEnv("SINK_WEBHOOK_RETRIES", "5"))
+	}
+
+	natsTimeout, err := strconv.Atoi(getEnv("SINK_NATS_TIMEOUT_SECONDS", "5"))
+	if err != nil || natsTimeout < 1 {
+		return nil, fmt.Errorf("invalid SINK_NATS_TIMEOUT_SECONDS: %q", getEnv("SINK_NATS_TIMEOUT_SECONDS", "5"))
+	}
+
+	archiveDir := getEnv("ARCHIVE_DIR", "")
+	archiveBucket := getEnv("ARCHIVE_S3_BUCKET", "")
+	if archiveDir != "" && archiveBucket != "" {
+		return nil, fmt.Errorf("set either ARCHIVE_DIR or ARCHIVE_S3_BUCKET, not both")
+	}
+	archiveOnly := getEnv("RETENTION_ARCHIVED_ONLY", "false") == "true"
+	if archiveOnly && archiveDir == "" && archiveBucket == "" {
+		return nil, fmt.Errorf("RETENTION_ARCHIVED_ONLY requires ARCHIVE_DIR or ARCHIVE_S3_BUCKET")
+	}
+
+	archiveLag, err := strconv.Atoi(getEnv("ARCHIVE_LAG_DAYS", "1"))
+	if err != nil || archiveLag < 0 {
+		return nil, fmt.Errorf("invalid ARCHIVE_LAG_DAYS: %q", getEnv("ARCHIVE_LAG_DAYS", "1"))
+	}
+
+	archiveInterval, err := strconv.Atoi(getEnv("ARCHIVE_INTERVAL_MINUTES", "60"))
+	if err != nil || archiveInterval < 1 {
+		return nil, fmt.Errorf("invalid ARCHIVE_INTERVAL_MINUTES: %q", getEnv("ARCHIVE_INTERVAL_MINUTES", "60"))
+	}
+
+	var trustedProxies []string
+	for _, proxy := range strings.Split(getEnv("TRUSTED_PROXIES", ""), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy == "" {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			return nil, fmt.Errorf("invalid TRUSTED_PROXIES entry: %q", proxy)
+		}
+		trustedProxies = append(trustedProxies, proxy)
+	}
+
 	// Parse CORS origins
 	originsStr := getEnv("ALLOWED_ORIGINS", "*")
 	origins := strings.Split(originsStr, ",")
@@ -82,10 +499,32 @@ func Load() (*Config, error) {
 			Password: getEnv("DB_PASSWORD", ""),
 			DBName:   getEnv("DB_NAME", "trackveil"),
 			SSLMode:  getEnv("DB_SSLMODE", "require"),
+
+			SQLitePath:     sqlitePath,
+			MigrateOnStart: getEnv("MIGRATE_ON_START", "false") == "true",
+
+			MaxConns:          maxConns,
+			MinConns:          minConns,
+			MaxConnLifetime:   time.Duration(connLifetime) * time.Second,
+			MaxConnIdleTime:   time.Duration(connIdle) * time.Second,
+			HealthCheckPeriod: time.Duration(healthCheck) * time.Second,
+			StatementCache:    statementCache,
+
+			ReplicaDSNs:         replicaDSNs,
+			ReplicaMaxConns:     replicaMaxConns,
+			ReplicaMinConns:     replicaMinConns,
+			ReplicaMaxLag:       time.Duration(replicaMaxLag) * time.Second,
+			ReplicaCheckSeconds: replicaCheck,
 		},
 		API: APIConfig{
-			Port: apiPort,
-			Env:  getEnv("API_ENV", "development"),
+			Port:       apiPort,
+			Env:        getEnv("API_ENV", "development"),
+			AdminToken: getEnv("API_ADMIN_TOKEN", ""),
+
+			PublicURL:     publicURL,
+			EnforceOrigin: getEnv("ENFORCE_SITE_ORIGIN", "false") == "true",
+
+			TrustedProxies: trustedProxies,
 		},
 		CORS: CORSConfig{
 			AllowedOrigins: origins,
@@ -94,6 +533,79 @@ func Load() (*Config, error) {
 			Requests:      rateLimitRequests,
 			WindowSeconds: rateLimitWindow,
 		},
+		Dedup: DedupConfig{
+			WindowSeconds:    dedupWindow,
+			EventIDRetention: dedupRetention,
+		},
+		TLS: TLSConfig{
+			Addr:             getEnv("TLS_ADDR", ":443"),
+			CertDir:          getEnv("TLS_CERT_DIR", ""),
+			ACMEDirectoryURL: getEnv("ACME_DIRECTORY_URL", ""),
+			ACMEEmail:        getEnv("ACME_EMAIL", ""),
+			ACMECAFile:       getEnv("ACME_CA_FILE", ""),
+		},
+		Partition: PartitionConfig{
+			MonthsAhead:     monthsAhead,
+			RetentionMonths: retentionMonths,
+			DropExpired:     getEnv("PARTITION_DROP_EXPIRED", "false") == "true",
+		},
+		Rollup: RollupConfig{
+			IntervalSeconds: rollupInterval,
+		},
+		Retention: RetentionConfig{
+			RawHitDays:      retentionDays["RETENTION_RAW_HIT_DAYS"],
+			VisitorDays:     retentionDays["RETENTION_VISITOR_DAYS"],
+			RollupDays:      retentionDays["RETENTION_ROLLUP_DAYS"],
+			BatchSize:       retentionBatch,
+			IntervalMinutes: retentionInterval,
+		},
+		Storage: StorageConfig{
+			Backend:               storageBackend,
+			PostgresWriteMode:     postgresWriteMode,
+			PostgresBatchSize:     postgresBatch,
+			PostgresFlushMillis:   postgresFlush,
+			SQLiteBatchSize:       sqliteBatch,
+			SQLiteFlushMillis:     sqliteFlush,
+			ClickHouseURL:         clickHouseURL,
+			ClickHouseDatabase:    getEnv("CLICKHOUSE_DATABASE", "trackveil"),
+			ClickHouseUser:        getEnv("CLICKHOUSE_USER", ""),
+			ClickHousePassword:    getEnv("CLICKHOUSE_PASSWORD", ""),
+			ClickHouseBatchSize:   clickHouseBatch,
+			ClickHouseFlushMillis: clickHouseFlush,
+		},
+		Spool: SpoolConfig{
+			Dir:                   getEnv("SPOOL_DIR", ""),
+			MaxMB:                 spoolMax,
+			SegmentMB:             spoolSegment,
+			ReplayIntervalSeconds: spoolReplay,
+		},
+		Sinks: SinksConfig{
+			QueueSize:             sinkQueue,
+			BatchSize:             sinkBatch,
+			FlushMillis:           sinkFlush,
+			NDJSONDir:             getEnv("SINK_NDJSON_DIR", ""),
+			NDJSONRotateMB:        ndjsonRotateMB,
+			NDJSONRotateMinutes:   ndjsonRotateMinutes,
+			WebhookURL:            webhookURL,
+			WebhookSecret:         webhookSecret,
+			WebhookTimeoutSeconds: webhookTimeout,
+			WebhookRetries:        webhookRetries,
+			NATSURL:               getEnv("SINK_NATS_URL", ""),
+			NATSSubject:           getEnv("SINK_NATS_SUBJECT", "trackveil.hits"),
+			NATSTimeoutSeconds:    natsTimeout,
+		},
+		Archive: ArchiveConfig{
+			Dir:             archiveDir,
+			S3Bucket:        archiveBucket,
+			S3Endpoint:      strings.TrimSuffix(getEnv("ARCHIVE_S3_ENDPOINT", ""), "/"),
+			S3Region:        getEnv("ARCHIVE_S3_REGION", "us-east-1"),
+			S3AccessKey:     getEnv("ARCHIVE_S3_ACCESS_KEY", ""),
+			S3SecretKey:     getEnv("ARCHIVE_S3_SECRET_KEY", ""),
+			Prefix:          strings.Trim(getEnv("ARCHIVE_PREFIX", "trackveil"), "/"),
+			LagDays:         archiveLag,
+			IntervalMinutes: archiveInterval,
+			RetentionOnly:   archiveOnly,
+		},
 	}, nil
 }
 
@@ -2,38 +2,96 @@ package database
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
-	"time"
+	"strings"
 
-	_ "github.com/lib/pq"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
 )
 
-// DB is a wrapper around sql.DB
+// Drivers
+const (
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite"
+)
+
+// DB is a wrapper around sql.DB. Queries run on the primary; ReadOnly
+// routes reads that tolerate replication lag to a replica.
 type DB struct {
 	*sql.DB
+	Driver string // DriverPostgres or DriverSQLite
+
+	pool     *pgxpool.Pool // nil on SQLite
+	replicas *replicaSet   // nil without replicas
 }
 
-// Connect establishes a connection to the PostgreSQL database
-func Connect(connectionString string) (*DB, error) {
-	db, err := sql.Open("postgres", connectionString)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %w", err)
+// Close closes the database connections, including replicas
+func (db *DB) Close() error {
+	if db.replicas != nil {
+		db.replicas.close()
 	}
+	err := db.DB.Close()
+	if db.pool != nil {
+		db.pool.Close()
+	}
+	return err
+}
+
+// SQLite reports whether the database is SQLite
+func (db *DB) SQLite() bool {
+	return db.Driver == DriverSQLite
+}
 
-	// Set connection pool settings
-	db.SetMaxOpenConns(25)
-	db.SetMaxIdleConns(5)
-	db.SetConnMaxLifetime(5 * time.Minute)
+// Array returns a query argument or scan destination for a text array
+// column: TEXT[] on Postgres, a JSON array in a TEXT column on SQLite
+func (db *DB) Array(a *[]string) interface{} {
+	if db.SQLite() {
+		return &jsonArray{a}
+	}
+	return &pgArray{a}
+}
 
-	// Test the connection
-	if err := db.Ping(); err != nil {
-		return nil, fmt.Errorf("failed to ping database: %w", err)
+// Placeholders returns n comma-separated placeholders starting at $start,
+// for IN lists
+func Placeholders(start, n int) string {
+	p := make([]string, n)
+	for i := range p {
+		p[i] = fmt.Sprintf("$%d", start+i)
 	}
+	return strings.Join(p, ", ")
+}
 
-	return &DB{db}, nil
+// IsUniqueViolation reports whether err is a unique constraint violation
+func IsUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == "23505" // unique_violation
+	}
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		code := sqliteErr.Code()
+		return code == sqlite3.SQLITE_CONSTRAINT_UNIQUE || code == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY
+	}
+	return false
 }
 
-// Close closes the database connection
-func (db *DB) Close() error {
-	return db.DB.Close()
+// IsPermanent reports whether the database rejected a statement for its
+// data, so running it again will fail the same way: a constraint violation
+// or invalid data (Postgres classes 22 and 23)
+func IsPermanent(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return strings.HasPrefix(pgErr.Code, "22") || strings.HasPrefix(pgErr.Code, "23")
+	}
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		switch sqliteErr.Code() & 0xff {
+		case sqlite3.SQLITE_CONSTRAINT, sqlite3.SQLITE_MISMATCH, sqlite3.SQLITE_TOOBIG:
+			return true
+		}
+	}
+	return false
 }
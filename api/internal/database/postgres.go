@@ -0,0 +1,189 @@
+package database
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// PoolConfig sizes a pgxpool connection pool
+type PoolConfig struct {
+	MaxConns          int32
+	MinConns          int32 // kept open even when idle
+	MaxConnLifetime   time.Duration
+	MaxConnIdleTime   time.Duration
+	HealthCheckPeriod time.Duration // how often idle connections are checked
+}
+
+// DefaultPool is the pool of a primary opened with Connect
+var DefaultPool = PoolConfig{
+	MaxConns:          25,
+	MaxConnLifetime:   5 * time.Minute,
+	MaxConnIdleTime:   5 * time.Minute,
+	HealthCheckPeriod: time.Minute,
+}
+
+// DefaultStatementCache is how many prepared statements each connection
+// keeps by default
+const DefaultStatementCache = 512
+
+// Config is a PostgreSQL primary and its read replicas
+type Config struct {
+	Primary     string // connection string
+	PrimaryPool PoolConfig
+
+	Replicas    []string // connection strings
+	ReplicaPool PoolConfig
+	MaxLag      time.Duration // replicas further behind are not read from
+
+	// StatementCache is how many prepared statements each connection keeps.
+	// 0 disables preparing, for transaction-mode poolers such as PgBouncer.
+	StatementCache int
+}
+
+// Connect establishes a connection to the PostgreSQL database
+func Connect(connectionString string) (*DB, error) {
+	return Open(Config{Primary: connectionString, PrimaryPool: DefaultPool, StatementCache: DefaultStatementCache})
+}
+
+// Open connects to a PostgreSQL primary and its replicas. The primary must
+// be reachable; replicas that are not are read from once they are (see
+// CheckReplicas).
+func Open(cfg Config) (*DB, error) {
+	db, err := openPool(cfg.Primary, cfg.PrimaryPool, cfg.StatementCache)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	// Test the connection
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	if len(cfg.Replicas) > 0 {
+		db.replicas = &replicaSet{maxLag: cfg.MaxLag}
+		for i, dsn := range cfg.Replicas {
+			replica, err := openPool(dsn, cfg.ReplicaPool, cfg.StatementCache)
+			if err != nil {
+				db.Close()
+				return nil, fmt.Errorf("failed to open replica %d: %w", i+1, err)
+			}
+			db.replicas.add(fmt.Sprintf("replica %d (%s)", i+1, hostOf(dsn)), replica)
+		}
+		db.CheckReplicas(context.Background())
+	}
+	return db, nil
+}
+
+// openPool creates a pgx connection pool, and a database/sql handle that
+// borrows its connections, without connecting
+func openPool(dsn string, pool PoolConfig, statementCache int) (*DB, error) {
+	cfg, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return nil, err
+	}
+	cfg.MaxConns = pool.MaxConns
+	cfg.MinConns = pool.MinConns
+	cfg.MaxConnLifetime = pool.MaxConnLifetime
+	cfg.MaxConnIdleTime = pool.MaxConnIdleTime
+	cfg.HealthCheckPeriod = pool.HealthCheckPeriod
+	if statementCache > 0 {
+		cfg.ConnConfig.DefaultQueryExecMode = pgx.QueryExecModeCacheStatement
+		cfg.ConnConfig.StatementCacheCapacity = statementCache
+	} else {
+		cfg.ConnConfig.DefaultQueryExecMode = pgx.QueryExecModeExec
+	}
+
+	p, err := pgxpool.NewWithConfig(context.Background(), cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &DB{DB: stdlib.OpenDBFromPool(p), Driver: DriverPostgres, pool: p}, nil
+}
+
+// Pool returns the pgx pool behind a Postgres database, for COPY and
+// pipelined batches; nil on SQLite
+func (db *DB) Pool() *pgxpool.Pool {
+	return db.pool
+}
+
+// CopyFrom bulk inserts rows into table with COPY and returns how many were
+// inserted. All rows are inserted, or none.
+func (db *DB) CopyFrom(ctx context.Context, table string, columns []string, rows [][]interface{}) (int64, error) {
+	if db.pool == nil {
+		return 0, fmt.Errorf("COPY needs a Postgres database")
+	}
+	return db.pool.CopyFrom(ctx, pgx.Identifier{table}, columns, pgx.CopyFromRows(rows))
+}
+
+// Query is a statement and its arguments, for SendBatch
+type Query struct {
+	SQL  string
+	Args []interface{}
+}
+
+// SendBatch runs queries in one round trip: they are pipelined and applied
+// in an implicit transaction, so all are applied, or none.
+func (db *DB) SendBatch(ctx context.Context, queries []Query) error {
+	if db.pool == nil {
+		return fmt.Errorf("batches need a Postgres database")
+	}
+	batch := &pgx.Batch{}
+	for _, q := range queries {
+		batch.Queue(q.SQL, q.Args...)
+	}
+
+	results := db.pool.SendBatch(ctx, batch)
+	for range queries {
+		if _, err := results.Exec(); err != nil {
+			results.Close()
+			return err
+		}
+	}
+	return results.Close()
+}
+
+// pgArray stores a text array in a TEXT[] column (see DB.Array)
+type pgArray struct {
+	a *[]string
+}
+
+// textArrays encodes and decodes text arrays; a pgtype.Map is not safe for
+// concurrent use
+var (
+	textArrays   = pgtype.NewMap()
+	textArraysMu sync.Mutex
+)
+
+func (p *pgArray) Value() (driver.Value, error) {
+	if *p.a == nil {
+		return "{}", nil
+	}
+	textArraysMu.Lock()
+	defer textArraysMu.Unlock()
+	buf, err := textArrays.Encode(pgtype.TextArrayOID, pgtype.TextFormatCode, *p.a, nil)
+	return string(buf), err
+}
+
+func (p *pgArray) Scan(src interface{}) error {
+	textArraysMu.Lock()
+	defer textArraysMu.Unlock()
+	switch v := src.(type) {
+	case nil:
+		*p.a = nil
+		return nil
+	case string:
+		return textArrays.Scan(pgtype.TextArrayOID, pgtype.TextFormatCode, []byte(v), p.a)
+	case []byte:
+		return textArrays.Scan(pgtype.TextArrayOID, pgtype.TextFormatCode, v, p.a)
+	}
+	return fmt.Errorf("cannot scan %T into a text array", src)
+}
@@ -0,0 +1,149 @@
+package database
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// replicaCheckTimeout bounds one replica's ping and lag query
+const replicaCheckTimeout = 3 * time.Second
+
+// lagQuery returns how far a replica's replay is behind its primary, in
+// seconds. A replica that has replayed everything it received is not
+// behind even if the primary has been idle since.
+const lagQuery = `
+	SELECT CASE
+		WHEN NOT pg_is_in_recovery() THEN 0
+		WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+		ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+	END
+`
+
+// replica is a read replica and the result of its last health check
+type replica struct {
+	name    string
+	db      *DB
+	healthy atomic.Bool
+}
+
+// replicaSet routes reads round-robin across healthy replicas
+type replicaSet struct {
+	maxLag time.Duration
+	all    []*replica
+	next   atomic.Uint64
+
+	checkMu sync.Mutex // one health check at a time
+}
+
+func (s *replicaSet) add(name string, db *DB) {
+	s.all = append(s.all, &replica{name: name, db: db})
+}
+
+// pick returns the next healthy replica, or nil if there is none
+func (s *replicaSet) pick() *DB {
+	n := uint64(len(s.all))
+	start := s.next.Add(1)
+	for i := uint64(0); i < n; i++ {
+		if r := s.all[(start+i)%n]; r.healthy.Load() {
+			return r.db
+		}
+	}
+	return nil
+}
+
+func (s *replicaSet) close() {
+	for _, r := range s.all {
+		r.db.Close()
+	}
+}
+
+// ReadOnly returns a handle for queries that tolerate replication lag, such
+// as dashboard reports: a healthy replica, or the primary when no replica is
+// configured or none is reachable and caught up. Anything that writes, or
+// reads its own recent writes, must use the primary.
+func (db *DB) ReadOnly() *DB {
+	if db.replicas == nil {
+		return db
+	}
+	if r := db.replicas.pick(); r != nil {
+		return r
+	}
+	return db
+}
+
+// CheckReplicas pings every replica and measures its lag. Replicas that are
+// unreachable or further behind than the maximum lag are not read from
+// until a later check finds them healthy.
+func (db *DB) CheckReplicas(ctx context.Context) {
+	if db.replicas == nil {
+		return
+	}
+	s := db.replicas
+	s.checkMu.Lock()
+	defer s.checkMu.Unlock()
+
+	for _, r := range s.all {
+		lag, err := r.lag(ctx)
+		healthy := err == nil && (s.maxLag <= 0 || lag <= s.maxLag)
+
+		if was := r.healthy.Swap(healthy); was != healthy {
+			switch {
+			case healthy:
+				log.Printf("Database %s is healthy, routing reads to it", r.name)
+			case err != nil:
+				log.Printf("Database %s is unavailable, reading from the primary: %v", r.name, err)
+			default:
+				log.Printf("Database %s is %s behind (max %s), reading from the primary", r.name, lag.Round(time.Second), s.maxLag)
+			}
+		}
+	}
+}
+
+// lag returns how far the replica is behind its primary
+func (r *replica) lag(ctx context.Context) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, replicaCheckTimeout)
+	defer cancel()
+
+	var seconds float64
+	if err := r.db.QueryRowContext(ctx, lagQuery).Scan(&seconds); err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// RunReplicaChecks checks the replicas every interval until ctx is cancelled
+func (db *DB) RunReplicaChecks(ctx context.Context, interval time.Duration) {
+	if db.replicas == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			db.CheckReplicas(ctx)
+		}
+	}
+}
+
+// hostOf returns the host of a connection string for logging, without
+// credentials
+func hostOf(dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && u.Host != "" {
+		return u.Host
+	}
+	for _, field := range strings.Fields(dsn) {
+		if host, ok := strings.CutPrefix(field, "host="); ok {
+			return host
+		}
+	}
+	return "unknown host"
+}
@@ -0,0 +1,161 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite"
+)
+
+// SQLiteTimeFormat is how timestamps are stored in SQLite: UTC with fixed
+// millisecond precision, so text comparisons order them correctly. Column
+// defaults use the same format (strftime('%Y-%m-%d %H:%M:%f', 'now')).
+const SQLiteTimeFormat = "2006-01-02 15:04:05.000"
+
+// OpenSQLite opens (creating it if needed) a SQLite database file in WAL
+// mode. The schema is applied by the migrate package.
+func OpenSQLite(path string) (*DB, error) {
+	dsn := "file:" + path + "?" + url.Values{
+		// busy_timeout first, so switching to WAL waits for other processes
+		"_pragma": {
+			"busy_timeout(5000)",
+			"journal_mode(WAL)",
+			"synchronous(NORMAL)",
+			"foreign_keys(1)",
+		},
+		// Transactions take the write lock up front, so they wait on
+		// busy_timeout instead of failing when upgrading from a read
+		"_txlock": {"immediate"},
+	}.Encode()
+
+	db := sql.OpenDB(sqliteConnector{dsn: dsn})
+
+	// Readers run concurrently under WAL; writers wait on busy_timeout
+	db.SetMaxOpenConns(8)
+	db.SetMaxIdleConns(8)
+	db.SetConnMaxLifetime(0)
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open SQLite database %s: %w", path, err)
+	}
+
+	return &DB{DB: db, Driver: DriverSQLite}, nil
+}
+
+// jsonArray stores a text array as a JSON array (see DB.Array)
+type jsonArray struct {
+	a *[]string
+}
+
+func (j *jsonArray) Value() (driver.Value, error) {
+	if *j.a == nil {
+		return "[]", nil
+	}
+	data, err := json.Marshal(*j.a)
+	return string(data), err
+}
+
+func (j *jsonArray) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*j.a = nil
+		return nil
+	case string:
+		return json.Unmarshal([]byte(v), j.a)
+	case []byte:
+		return json.Unmarshal(v, j.a)
+	}
+	return fmt.Errorf("cannot scan %T into a text array", src)
+}
+
+func init() {
+	// url_path(url) is the normalized path of a URL, like the Postgres
+	// expression the funnel queries use
+	sqlite.MustRegisterDeterministicScalarFunction("url_path", 1, func(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		s, ok := args[0].(string)
+		if !ok {
+			return nil, nil
+		}
+		return urlPath(s), nil
+	})
+}
+
+var urlSchemeHost = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*://[^/]*`)
+
+// urlPath strips the scheme, host, query, fragment and trailing slashes
+// from a URL, leaving at least "/"
+func urlPath(u string) string {
+	if i := strings.IndexByte(u, '?'); i >= 0 {
+		u = u[:i]
+	}
+	if i := strings.IndexByte(u, '#'); i >= 0 {
+		u = u[:i]
+	}
+	u = strings.TrimRight(urlSchemeHost.ReplaceAllString(u, ""), "/")
+	if u == "" {
+		return "/"
+	}
+	return u
+}
+
+// sqliteConnector opens modernc.org/sqlite connections that store time
+// arguments in SQLiteTimeFormat
+type sqliteConnector struct {
+	dsn string
+}
+
+func (c sqliteConnector) Connect(context.Context) (driver.Conn, error) {
+	conn, err := sqliteDriver.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteConn{conn.(sqliteDriverConn)}, nil
+}
+
+func (c sqliteConnector) Driver() driver.Driver {
+	return sqliteDriver
+}
+
+// sqliteDriver is the driver modernc.org/sqlite registers, which adds the
+// registered functions to its connections
+var sqliteDriver = func() driver.Driver {
+	db, _ := sql.Open("sqlite", "") // does not connect
+	defer db.Close()
+	return db.Driver()
+}()
+
+// sqliteDriverConn is what modernc.org/sqlite connections implement
+type sqliteDriverConn interface {
+	driver.Conn
+	driver.ConnBeginTx
+	driver.ConnPrepareContext
+	driver.ExecerContext
+	driver.QueryerContext
+	driver.Pinger
+}
+
+type sqliteConn struct {
+	sqliteDriverConn
+}
+
+// CheckNamedValue implements driver.NamedValueChecker. The driver would
+// store times as time.Time.String(), which does not sort as text.
+func (c *sqliteConn) CheckNamedValue(nv *driver.NamedValue) error {
+	v, err := driver.DefaultParameterConverter.ConvertValue(nv.Value)
+	if err != nil {
+		return err
+	}
+	if t, ok := v.(time.Time); ok {
+		v = t.UTC().Format(SQLiteTimeFormat)
+	}
+	nv.Value = v
+	return nil
+}
@@ -0,0 +1,157 @@
+// Package deadletter keeps hits the database rejected for a reason a retry
+// will not fix, such as a constraint violation, so they can be inspected,
+// fixed and re-ingested or discarded instead of being lost.
+package deadletter
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/models"
+
+	"github.com/google/uuid"
+)
+
+// Kinds of dead letters
+const (
+	KindRequest  = "request"   // a tracking request, re-ingested like a new hit
+	KindPageView = "page_view" // an enriched page view rejected by a batch write
+	KindEvent    = "event"     // an enriched event rejected by a batch write
+)
+
+// ErrNotFound is returned for an unknown dead letter
+var ErrNotFound = errors.New("dead letter not found")
+
+// Filter selects dead letters; empty fields match all
+type Filter struct {
+	SiteID string
+	Kind   string
+	Limit  int
+}
+
+const selectColumns = `id, site_id, kind, source, payload, context, error, attempts, created_at, updated_at`
+
+// Add keeps a dead letter, assigning its ID if unset. Adding a letter with
+// the ID of an existing one, e.g. of a page view rejected again, replaces
+// its payload and error and counts a failed attempt.
+func Add(db *database.DB, l *models.DeadLetter) error {
+	if l.ID == uuid.Nil {
+		l.ID = uuid.New()
+	}
+	now := time.Now().UTC()
+	if l.CreatedAt.IsZero() {
+		l.CreatedAt = now
+	}
+	l.UpdatedAt = now
+
+	var context interface{}
+	if len(l.Context) > 0 {
+		context = string(l.Context)
+	}
+	_, err := db.Exec(`
+		INSERT INTO dead_letters (id, site_id, kind, source, payload, context, error, attempts, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (id) DO UPDATE SET
+			payload = EXCLUDED.payload,
+			context = EXCLUDED.context,
+			error = EXCLUDED.error,
+			attempts = dead_letters.attempts + 1,
+			updated_at = EXCLUDED.updated_at
+	`, l.ID, l.SiteID, l.Kind, l.Source, string(l.Payload), context, l.Error, l.Attempts, l.CreatedAt, l.UpdatedAt)
+	return err
+}
+
+// List returns dead letters, newest first
+func List(db *database.DB, f Filter) ([]models.DeadLetter, error) {
+	query := `SELECT ` + selectColumns + ` FROM dead_letters WHERE 1 = 1`
+	var args []interface{}
+	if f.SiteID != "" {
+		args = append(args, f.SiteID)
+		query += fmt.Sprintf(` AND site_id = $%d`, len(args))
+	}
+	if f.Kind != "" {
+		args = append(args, f.Kind)
+		query += fmt.Sprintf(` AND kind = $%d`, len(args))
+	}
+	query += ` ORDER BY created_at DESC`
+	if f.Limit > 0 {
+		args = append(args, f.Limit)
+		query += fmt.Sprintf(` LIMIT $%d`, len(args))
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	letters := []models.DeadLetter{}
+	for rows.Next() {
+		l, err := scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		letters = append(letters, *l)
+	}
+	return letters, rows.Err()
+}
+
+// Get returns a dead letter
+func Get(db *database.DB, id uuid.UUID) (*models.DeadLetter, error) {
+	l, err := scan(db.QueryRow(`SELECT `+selectColumns+` FROM dead_letters WHERE id = $1`, id))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return l, err
+}
+
+// SetPayload replaces the payload of a dead letter, e.g. after fixing it
+func SetPayload(db *database.DB, id uuid.UUID, payload []byte) error {
+	return update(db, `UPDATE dead_letters SET payload = $2, updated_at = $3 WHERE id = $1`,
+		id, string(payload), time.Now().UTC())
+}
+
+// RecordFailure counts a failed re-ingestion of a dead letter
+func RecordFailure(db *database.DB, id uuid.UUID, reason string) error {
+	return update(db, `UPDATE dead_letters SET error = $2, attempts = attempts + 1, updated_at = $3 WHERE id = $1`,
+		id, reason, time.Now().UTC())
+}
+
+// Delete removes a dead letter, once re-ingested or discarded
+func Delete(db *database.DB, id uuid.UUID) error {
+	return update(db, `DELETE FROM dead_letters WHERE id = $1`, id)
+}
+
+// update runs a statement on one dead letter
+func update(db *database.DB, query string, args ...interface{}) error {
+	result, err := db.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scan(row scanner) (*models.DeadLetter, error) {
+	var l models.DeadLetter
+	var payload, context []byte
+	if err := row.Scan(&l.ID, &l.SiteID, &l.Kind, &l.Source, &payload, &context,
+		&l.Error, &l.Attempts, &l.CreatedAt, &l.UpdatedAt); err != nil {
+		return nil, err
+	}
+	l.Payload, l.Context = payload, context
+	return &l, nil
+}
@@ -0,0 +1,159 @@
+package dedup
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/storage"
+
+	"github.com/google/uuid"
+)
+
+// Reasons a hit was suppressed
+const (
+	ReasonEventID   = "event_id"  // client event ID already recorded
+	ReasonHeuristic = "heuristic" // same visitor and URL within the window
+)
+
+// purgeBatchSize bounds each delete of expired event IDs
+const purgeBatchSize = 5000
+
+// Deduplicator suppresses retried and prefetched duplicate hits
+type Deduplicator struct {
+	db          *database.DB
+	store       storage.Store // page views for the heuristic
+	window      time.Duration // heuristic window, 0 disables it
+	idRetention time.Duration // how long client event IDs are remembered
+}
+
+// New creates a deduplicator
+func New(db *database.DB, store storage.Store, window, idRetention time.Duration) *Deduplicator {
+	return &Deduplicator{db: db, store: store, window: window, idRetention: idRetention}
+}
+
+// Claim records a client event ID for a site. It returns false if the ID
+// was already seen within the retention window. Retention runs from receipt,
+// not from the (possibly backdated) hit time.
+func (d *Deduplicator) Claim(siteID, eventID string) (bool, error) {
+	res, err := d.db.Exec(`
+		INSERT INTO hit_event_ids (site_id, event_id)
+		VALUES ($1, $2)
+		ON CONFLICT (site_id, event_id) DO NOTHING
+	`, siteID, eventID)
+	if err != nil {
+		return false, fmt.Errorf("failed to claim event id: %w", err)
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// Release forgets a claimed event ID, so a hit that failed to store can be retried
+func (d *Deduplicator) Release(siteID, eventID string) {
+	if _, err := d.db.Exec(`DELETE FROM hit_event_ids WHERE site_id = $1 AND event_id = $2`, siteID, eventID); err != nil {
+		log.Printf("Failed to release event id %s for site %s: %v", eventID, siteID, err)
+	}
+}
+
+// IsRecentPageView reports whether the visitor viewed the same URL within the window
+func (d *Deduplicator) IsRecentPageView(siteID string, visitorID uuid.UUID, pageURL string, at time.Time) (bool, error) {
+	if d.window <= 0 {
+		return false, nil
+	}
+	return d.store.RecentPageView(siteID, visitorID, pageURL, at.Add(-d.window), at)
+}
+
+// CountSuppressed increments the per-site daily counter of suppressed duplicates
+func (d *Deduplicator) CountSuppressed(siteID, reason string, at time.Time) {
+	_, err := d.db.Exec(`
+		INSERT INTO suppressed_hits (site_id, day, reason, count)
+		VALUES ($1, $2, $3, 1)
+		ON CONFLICT (site_id, day, reason) DO UPDATE SET count = suppressed_hits.count + 1
+	`, siteID, at.UTC().Format("2006-01-02"), reason)
+	if err != nil {
+		log.Printf("Failed to count suppressed hit for site %s: %v", siteID, err)
+	}
+}
+
+// SuppressedCount is the number of duplicates suppressed for a site on one day
+type SuppressedCount struct {
+	Day    string `json:"day"`
+	Reason string `json:"reason"`
+	Count  int64  `json:"count"`
+}
+
+// Suppressed returns the daily suppressed duplicate counts of a site for the
+// days from through to (inclusive, UTC)
+func (d *Deduplicator) Suppressed(siteID string, from, to time.Time) ([]SuppressedCount, error) {
+	rows, err := d.db.Query(`
+		SELECT day, reason, count
+		FROM suppressed_hits
+		WHERE site_id = $1 AND day >= $2 AND day <= $3
+		ORDER BY day, reason
+	`, siteID, from.UTC().Format("2006-01-02"), to.UTC().Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []SuppressedCount{}
+	for rows.Next() {
+		var sc SuppressedCount
+		var day time.Time
+		if err := rows.Scan(&day, &sc.Reason, &sc.Count); err != nil {
+			return nil, err
+		}
+		sc.Day = day.Format("2006-01-02")
+		counts = append(counts, sc)
+	}
+	return counts, rows.Err()
+}
+
+// Purge deletes event IDs older than the retention window in bounded batches
+func (d *Deduplicator) Purge() (int64, error) {
+	cutoff := time.Now().Add(-d.idRetention)
+	rowID := "ctid"
+	if d.db.SQLite() {
+		rowID = "rowid"
+	}
+	var total int64
+	for {
+		res, err := d.db.Exec(`
+			DELETE FROM hit_event_ids
+			WHERE `+rowID+` IN (
+				SELECT `+rowID+` FROM hit_event_ids
+				WHERE received_at < $1
+				LIMIT $2
+			)
+		`, cutoff, purgeBatchSize)
+		if err != nil {
+			return total, err
+		}
+		n, _ := res.RowsAffected()
+		total += n
+		if n < purgeBatchSize {
+			return total, nil
+		}
+	}
+}
+
+// Run purges expired event IDs every interval until ctx is cancelled
+func (d *Deduplicator) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if n, err := d.Purge(); err != nil {
+				log.Printf("Event ID purge failed: %v", err)
+			} else if n > 0 {
+				log.Printf("Purged %d expired event IDs", n)
+			}
+		}
+	}
+}
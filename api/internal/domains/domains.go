@@ -0,0 +1,187 @@
+package domains
+
+import (
+	"database/sql"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/models"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// resolveTTL is how long hostname lookups (including misses) are cached
+	resolveTTL = time.Minute
+	// maxCached bounds the cache, since misses for arbitrary Host headers are cached too
+	maxCached = 10000
+)
+
+var (
+	// ErrNotFound is returned when a custom domain does not exist for the site
+	ErrNotFound = errors.New("custom domain not found")
+	// ErrTaken is returned when the hostname is already registered
+	ErrTaken = errors.New("hostname is already registered")
+)
+
+// Normalize lowercases a hostname and strips a port and trailing dot
+func Normalize(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+}
+
+// ValidHostname checks that a normalized hostname is a fully qualified DNS name
+func ValidHostname(host string) bool {
+	if len(host) == 0 || len(host) > 253 || net.ParseIP(host) != nil {
+		return false
+	}
+	labels := strings.Split(host, ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// List returns the custom domains of a site
+func List(db *database.DB, siteID string) ([]models.CustomDomain, error) {
+	rows, err := db.Query(`
+		SELECT id, site_id, hostname, created_at
+		FROM site_custom_domains
+		WHERE site_id = $1
+		ORDER BY hostname
+	`, siteID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []models.CustomDomain{}
+	for rows.Next() {
+		var d models.CustomDomain
+		if err := rows.Scan(&d.ID, &d.SiteID, &d.Hostname, &d.CreatedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, d)
+	}
+	return list, rows.Err()
+}
+
+// Create registers a hostname for a site
+func Create(db *database.DB, siteID, hostname string) (*models.CustomDomain, error) {
+	d := models.CustomDomain{ID: uuid.New(), SiteID: siteID, Hostname: hostname}
+	err := db.QueryRow(`
+		INSERT INTO site_custom_domains (id, site_id, hostname)
+		VALUES ($1, $2, $3)
+		RETURNING created_at
+	`, d.ID, d.SiteID, d.Hostname).Scan(&d.CreatedAt)
+
+	if database.IsUniqueViolation(err) {
+		return nil, ErrTaken
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// Delete removes a custom domain of a site and returns its hostname
+func Delete(db *database.DB, siteID string, id uuid.UUID) (string, error) {
+	var hostname string
+	err := db.QueryRow(`
+		DELETE FROM site_custom_domains WHERE id = $1 AND site_id = $2
+		RETURNING hostname
+	`, id, siteID).Scan(&hostname)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+	return hostname, err
+}
+
+// Resolver maps request hostnames to sites, with a short-lived cache
+type Resolver struct {
+	db *database.DB
+
+	mu    sync.Mutex
+	cache map[string]cachedSite
+}
+
+type cachedSite struct {
+	siteID   string // empty if the hostname is not a custom domain
+	loadedAt time.Time
+}
+
+// NewResolver creates a hostname resolver
+func NewResolver(db *database.DB) *Resolver {
+	return &Resolver{db: db, cache: make(map[string]cachedSite)}
+}
+
+// SiteID returns the site a hostname belongs to, or "" if it is not a custom
+// domain. While the database is unavailable, an expired cached answer is
+// still returned.
+func (r *Resolver) SiteID(host string) (string, error) {
+	host = Normalize(host)
+	if !ValidHostname(host) {
+		return "", nil
+	}
+
+	r.mu.Lock()
+	cached, ok := r.cache[host]
+	r.mu.Unlock()
+	if ok && time.Since(cached.loadedAt) < resolveTTL {
+		return cached.siteID, nil
+	}
+
+	var siteID string
+	err := r.db.QueryRow(`SELECT site_id FROM site_custom_domains WHERE hostname = $1`, host).Scan(&siteID)
+	if err != nil && err != sql.ErrNoRows {
+		if ok {
+			return cached.siteID, nil
+		}
+		return "", err
+	}
+
+	r.mu.Lock()
+	if len(r.cache) >= maxCached {
+		r.cache = make(map[string]cachedSite)
+	}
+	r.cache[host] = cachedSite{siteID: siteID, loadedAt: time.Now()}
+	r.mu.Unlock()
+	return siteID, nil
+}
+
+// Invalidate drops a cached hostname after it is added or removed
+func (r *Resolver) Invalidate(host string) {
+	r.mu.Lock()
+	delete(r.cache, Normalize(host))
+	r.mu.Unlock()
+}
+
+// Allowed reports whether a hostname is a registered custom domain. It is
+// the host policy for certificate issuance.
+func (r *Resolver) Allowed(host string) error {
+	siteID, err := r.SiteID(host)
+	if err != nil {
+		return err
+	}
+	if siteID == "" {
+		return errors.New("not a registered custom domain: " + host)
+	}
+	return nil
+}
@@ -0,0 +1,314 @@
+package funnels
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/models"
+
+	"github.com/google/uuid"
+)
+
+// Breakdown dimensions
+const (
+	BreakdownSource = "source"
+	BreakdownDevice = "device"
+)
+
+// Report is the result of running a funnel over a time range
+type Report struct {
+	Funnel    models.Funnel     `json:"funnel"`
+	From      time.Time         `json:"from"`
+	To        time.Time         `json:"to"`
+	Steps     []StepResult      `json:"steps"`
+	Breakdown []BreakdownResult `json:"breakdown,omitempty"`
+}
+
+// StepResult is the number of visitors reaching a step and the drop-off from the previous step
+type StepResult struct {
+	Step           int     `json:"step"`
+	Name           string  `json:"name"`
+	Visitors       int     `json:"visitors"`
+	ConversionRate float64 `json:"conversion_rate"` // percent of step 1 visitors
+	DropOff        int     `json:"drop_off"`        // visitors lost since the previous step
+	DropOffRate    float64 `json:"drop_off_rate"`   // percent of the previous step
+}
+
+// BreakdownResult is the funnel for visitors with one dimension value
+type BreakdownResult struct {
+	Value string       `json:"value"`
+	Steps []StepResult `json:"steps"`
+}
+
+// entrant is one visitor's furthest progress through the funnel
+type entrant struct {
+	reached   int
+	dimension string
+}
+
+// Run evaluates a funnel over page views and events in [from, to).
+// breakdown is empty, BreakdownSource or BreakdownDevice.
+func Run(db *database.DB, f *models.Funnel, from, to time.Time, breakdown string) (*Report, error) {
+	if breakdown != "" && breakdown != BreakdownSource && breakdown != BreakdownDevice {
+		return nil, fmt.Errorf("unknown breakdown %q", breakdown)
+	}
+
+	query, args := buildQuery(f, from, to, breakdown != "", db.SQLite())
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run funnel: %w", err)
+	}
+	defer rows.Close()
+
+	// A visitor is counted once, at the furthest step reached in any session
+	visitors := make(map[uuid.UUID]entrant)
+	for rows.Next() {
+		var visitorID uuid.UUID
+		var reached int
+		var landingURL, referrer, device sql.NullString
+		if err := rows.Scan(&visitorID, &reached, &landingURL, &referrer, &device); err != nil {
+			return nil, fmt.Errorf("failed to scan funnel row: %w", err)
+		}
+
+		if prev, ok := visitors[visitorID]; ok && prev.reached >= reached {
+			continue
+		}
+
+		e := entrant{reached: reached}
+		switch breakdown {
+		case BreakdownSource:
+			e.dimension = models.DirectSource
+			if landingURL.Valid {
+				e.dimension = models.TrafficSource(landingURL.String, referrer.String)
+			}
+		case BreakdownDevice:
+			e.dimension = "unknown"
+			if device.Valid && device.String != "" {
+				e.dimension = device.String
+			}
+		}
+		visitors[visitorID] = e
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	report := &Report{
+		Funnel: *f,
+		From:   from,
+		To:     to,
+		Steps:  stepResults(f.Steps, countReached(visitors, len(f.Steps), nil)),
+	}
+
+	if breakdown != "" {
+		values := make(map[string]bool)
+		for _, e := range visitors {
+			values[e.dimension] = true
+		}
+		for value := range values {
+			v := value
+			report.Breakdown = append(report.Breakdown, BreakdownResult{
+				Value: v,
+				Steps: stepResults(f.Steps, countReached(visitors, len(f.Steps), &v)),
+			})
+		}
+		sort.Slice(report.Breakdown, func(i, j int) bool {
+			a, b := report.Breakdown[i], report.Breakdown[j]
+			if a.Steps[0].Visitors != b.Steps[0].Visitors {
+				return a.Steps[0].Visitors > b.Steps[0].Visitors
+			}
+			return a.Value < b.Value
+		})
+	}
+
+	return report, nil
+}
+
+// countReached returns how many visitors reached each step, optionally for one dimension value
+func countReached(visitors map[uuid.UUID]entrant, steps int, dimension *string) []int {
+	counts := make([]int, steps)
+	for _, e := range visitors {
+		if dimension != nil && e.dimension != *dimension {
+			continue
+		}
+		for i := 0; i < e.reached && i < steps; i++ {
+			counts[i]++
+		}
+	}
+	return counts
+}
+
+func stepResults(steps []models.FunnelStep, counts []int) []StepResult {
+	results := make([]StepResult, len(steps))
+	for i, step := range steps {
+		r := StepResult{Step: i + 1, Name: step.Name, Visitors: counts[i]}
+		if counts[0] > 0 {
+			r.ConversionRate = percent(counts[i], counts[0])
+		}
+		if i > 0 {
+			r.DropOff = counts[i-1] - counts[i]
+			if counts[i-1] > 0 {
+				r.DropOffRate = percent(r.DropOff, counts[i-1])
+			}
+		}
+		results[i] = r
+	}
+	return results
+}
+
+func percent(part, total int) float64 {
+	return float64(int(float64(part)/float64(total)*1000+0.5)) / 10
+}
+
+// buildQuery generates one CTE per step. Each step keeps the earliest
+// matching hit after the previous step, per session (session mode) or per
+// visitor within the window of the first step (window mode). SQLite has no
+// DISTINCT ON or LATERAL joins, so it gets window functions and a
+// correlated subquery instead.
+func buildQuery(f *models.Funnel, from, to time.Time, withLanding, sqlite bool) (string, []interface{}) {
+	args := []interface{}{f.SiteID, from, to}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	key := "session_id"
+	join := "h.session_id = p.session_id"
+	if f.Mode == models.FunnelModeWindow {
+		key = "visitor_id"
+		if sqlite {
+			join = "h.visitor_id = p.visitor_id AND h.at <= strftime('%Y-%m-%d %H:%M:%f', p.started, '+' || " + arg(*f.WindowSeconds) + " || ' seconds')"
+		} else {
+			join = "h.visitor_id = p.visitor_id AND h.at <= p.started + " + arg(*f.WindowSeconds) + "::int * INTERVAL '1 second'"
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(`
+		WITH hits AS (
+			SELECT visitor_id, session_id, viewed_at AS at, CAST(NULL AS TEXT) AS event_name, ` + pathExpr("page_url", sqlite) + ` AS path
+			FROM page_views
+			WHERE site_id = $1 AND viewed_at >= $2 AND viewed_at < $3
+			UNION ALL
+			SELECT visitor_id, session_id, occurred_at, event_name, CAST(NULL AS TEXT)
+			FROM events
+			WHERE site_id = $1 AND occurred_at >= $2 AND occurred_at < $3
+		)`)
+
+	for i, step := range f.Steps {
+		var match string
+		if step.Type == models.StepTypeEvent {
+			match = "h.event_name = " + arg(step.Value)
+		} else {
+			match = "h.event_name IS NULL AND h.path LIKE " + arg(likePattern(step.Value)) + ` ESCAPE '\'`
+		}
+
+		if sqlite {
+			if i == 0 {
+				fmt.Fprintf(&b, `,
+		s1 AS (
+			SELECT visitor_id, session_id, at, started FROM (
+				SELECT h.visitor_id, h.session_id, h.at, h.at AS started,
+					ROW_NUMBER() OVER (PARTITION BY h.%[1]s ORDER BY h.at) AS n
+				FROM hits h
+				WHERE %[2]s
+			) WHERE n = 1
+		)`, key, match)
+				continue
+			}
+			fmt.Fprintf(&b, `,
+		s%[1]d AS (
+			SELECT visitor_id, session_id, at, started FROM (
+				SELECT p.visitor_id, p.session_id, h.at, p.started,
+					ROW_NUMBER() OVER (PARTITION BY p.%[3]s ORDER BY h.at) AS n
+				FROM s%[2]d p
+				JOIN hits h ON %[4]s AND h.at > p.at
+				WHERE %[5]s
+			) WHERE n = 1
+		)`, i+1, i, key, join, match)
+			continue
+		}
+
+		if i == 0 {
+			fmt.Fprintf(&b, `,
+		s1 AS (
+			SELECT DISTINCT ON (h.%[1]s) h.visitor_id, h.session_id, h.at, h.at AS started
+			FROM hits h
+			WHERE %[2]s
+			ORDER BY h.%[1]s, h.at
+		)`, key, match)
+			continue
+		}
+
+		fmt.Fprintf(&b, `,
+		s%[1]d AS (
+			SELECT DISTINCT ON (p.%[3]s) p.visitor_id, p.session_id, h.at, p.started
+			FROM s%[2]d p
+			JOIN hits h ON %[4]s AND h.at > p.at
+			WHERE %[5]s
+			ORDER BY p.%[3]s, h.at
+		)`, i+1, i, key, join, match)
+	}
+
+	// Furthest step per entrant
+	reached := "CASE"
+	for i := len(f.Steps); i > 1; i-- {
+		reached += fmt.Sprintf(" WHEN s%d.%s IS NOT NULL THEN %d", i, key, i)
+	}
+	reached += " ELSE 1 END"
+
+	b.WriteString(`
+		SELECT s1.visitor_id, ` + reached + ` AS reached,`)
+	if withLanding {
+		b.WriteString(` l.page_url, l.referrer, l.device_type`)
+	} else {
+		b.WriteString(` CAST(NULL AS TEXT), CAST(NULL AS TEXT), CAST(NULL AS TEXT)`)
+	}
+	b.WriteString(`
+		FROM s1`)
+	for i := 2; i <= len(f.Steps); i++ {
+		fmt.Fprintf(&b, `
+		LEFT JOIN s%[1]d ON s%[1]d.%[2]s = s1.%[2]s`, i, key)
+	}
+	if withLanding && sqlite {
+		b.WriteString(`
+		LEFT JOIN page_views l ON l.id = (
+			SELECT id FROM page_views
+			WHERE session_id = s1.session_id
+			ORDER BY viewed_at
+			LIMIT 1
+		)`)
+	} else if withLanding {
+		b.WriteString(`
+		LEFT JOIN LATERAL (
+			SELECT page_url, referrer, device_type FROM page_views
+			WHERE session_id = s1.session_id
+			ORDER BY viewed_at
+			LIMIT 1
+		) l ON true`)
+	}
+
+	return b.String(), args
+}
+
+// pathExpr extracts the normalized path (no scheme, host, query, fragment or trailing slash) from a URL column
+func pathExpr(col string, sqlite bool) string {
+	if sqlite {
+		return "url_path(" + col + ")" // registered by the database package
+	}
+	stripped := fmt.Sprintf(`regexp_replace(split_part(split_part(%s, '?', 1), '#', 1), '^[a-zA-Z][a-zA-Z0-9+.-]*://[^/]*', '')`, col)
+	return fmt.Sprintf(`COALESCE(NULLIF(regexp_replace(%s, '/+$', ''), ''), '/')`, stripped)
+}
+
+// likePattern converts a step path such as /blog/* into a LIKE pattern
+func likePattern(p string) string {
+	if len(p) > 1 {
+		p = strings.TrimRight(p, "/")
+	}
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`, `*`, `%`)
+	return r.Replace(p)
+}
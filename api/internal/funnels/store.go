@@ -0,0 +1,162 @@
+package funnels
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/models"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// MaxSteps is the maximum number of steps in a funnel
+	MaxSteps = 10
+	// MaxWindow is the longest allowed conversion window for window funnels
+	MaxWindow = 90 * 24 * time.Hour
+)
+
+// ErrNotFound is returned when a funnel does not exist for the site
+var ErrNotFound = errors.New("funnel not found")
+
+// Validate checks and normalizes a funnel definition
+func Validate(f *models.Funnel) error {
+	f.Name = strings.TrimSpace(f.Name)
+	if f.Name == "" {
+		return errors.New("name is required")
+	}
+
+	if len(f.Steps) < 2 {
+		return errors.New("a funnel needs at least 2 steps")
+	}
+	if len(f.Steps) > MaxSteps {
+		return fmt.Errorf("a funnel can have at most %d steps", MaxSteps)
+	}
+
+	for i := range f.Steps {
+		step := &f.Steps[i]
+		step.Value = strings.TrimSpace(step.Value)
+		if step.Value == "" {
+			return fmt.Errorf("step %d: value is required", i+1)
+		}
+		switch step.Type {
+		case models.StepTypePagePath:
+			if !strings.HasPrefix(step.Value, "/") {
+				step.Value = "/" + step.Value
+			}
+		case models.StepTypeEvent:
+		default:
+			return fmt.Errorf("step %d: unknown type %q", i+1, step.Type)
+		}
+		if step.Name == "" {
+			step.Name = step.Value
+		}
+	}
+
+	switch f.Mode {
+	case "", models.FunnelModeSession:
+		f.Mode = models.FunnelModeSession
+		f.WindowSeconds = nil
+	case models.FunnelModeWindow:
+		if f.WindowSeconds == nil || *f.WindowSeconds < 1 {
+			return errors.New("window_seconds is required for window funnels")
+		}
+		if time.Duration(*f.WindowSeconds)*time.Second > MaxWindow {
+			return fmt.Errorf("window_seconds can be at most %d", int(MaxWindow.Seconds()))
+		}
+	default:
+		return fmt.Errorf("unknown mode %q", f.Mode)
+	}
+
+	return nil
+}
+
+// List returns the funnels of a site
+func List(db *database.DB, siteID string) ([]models.Funnel, error) {
+	rows, err := db.Query(`
+		SELECT id, site_id, name, steps, mode, window_seconds, created_at, updated_at
+		FROM funnels
+		WHERE site_id = $1
+		ORDER BY name
+	`, siteID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list funnels: %w", err)
+	}
+	defer rows.Close()
+
+	list := []models.Funnel{}
+	for rows.Next() {
+		f, err := scanFunnel(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, *f)
+	}
+
+	return list, rows.Err()
+}
+
+// Get returns a single funnel of a site
+func Get(db *database.DB, siteID string, funnelID uuid.UUID) (*models.Funnel, error) {
+	row := db.QueryRow(`
+		SELECT id, site_id, name, steps, mode, window_seconds, created_at, updated_at
+		FROM funnels
+		WHERE id = $1 AND site_id = $2
+	`, funnelID, siteID)
+
+	f, err := scanFunnel(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+// Create inserts a validated funnel definition
+func Create(db *database.DB, f *models.Funnel) error {
+	steps, err := json.Marshal(f.Steps)
+	if err != nil {
+		return err
+	}
+
+	f.ID = uuid.New()
+	f.CreatedAt = time.Now()
+	f.UpdatedAt = f.CreatedAt
+
+	_, err = db.Exec(`
+		INSERT INTO funnels (id, site_id, name, steps, mode, window_seconds, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, f.ID, f.SiteID, f.Name, string(steps), f.Mode, f.WindowSeconds, f.CreatedAt, f.UpdatedAt)
+
+	return err
+}
+
+// Delete removes a funnel. It reports whether the funnel existed.
+func Delete(db *database.DB, siteID string, funnelID uuid.UUID) (bool, error) {
+	res, err := db.Exec(`DELETE FROM funnels WHERE id = $1 AND site_id = $2`, funnelID, siteID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanFunnel(row scanner) (*models.Funnel, error) {
+	var f models.Funnel
+	var steps []byte
+	if err := row.Scan(&f.ID, &f.SiteID, &f.Name, &steps, &f.Mode, &f.WindowSeconds, &f.CreatedAt, &f.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(steps, &f.Steps); err != nil {
+		return nil, fmt.Errorf("invalid steps for funnel %s: %w", f.ID, err)
+	}
+	return &f, nil
+}
@@ -0,0 +1,212 @@
+package goals
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/models"
+	"trackveilapi/internal/storage"
+
+	"github.com/google/uuid"
+)
+
+// cacheTTL is how long a site's goal definitions are reused before reloading
+const cacheTTL = time.Minute
+
+// Hit is the subset of a recorded page view or event that goals are matched against
+type Hit struct {
+	SiteID     string
+	VisitorID  uuid.UUID
+	SessionID  uuid.UUID
+	PageViewID *uuid.UUID
+	EventID    *uuid.UUID
+	PageURL    string
+	EventName  string // empty for page views
+	At         time.Time
+}
+
+// Evaluator matches recorded hits against a site's goals and writes conversions
+type Evaluator struct {
+	db    *database.DB
+	store storage.Store // session page views
+
+	mu    sync.Mutex
+	cache map[string]cachedGoals
+}
+
+type cachedGoals struct {
+	goals    []compiledGoal
+	loadedAt time.Time
+}
+
+type compiledGoal struct {
+	models.Goal
+	pathPattern *regexp.Regexp
+}
+
+// NewEvaluator creates a new goal evaluator
+func NewEvaluator(db *database.DB, store storage.Store) *Evaluator {
+	return &Evaluator{
+		db:    db,
+		store: store,
+		cache: make(map[string]cachedGoals),
+	}
+}
+
+// Invalidate drops the cached goal definitions for a site
+func (e *Evaluator) Invalidate(siteID string) {
+	e.mu.Lock()
+	delete(e.cache, siteID)
+	e.mu.Unlock()
+}
+
+// Evaluate checks a hit against every active goal of its site and records
+// any new conversions. It returns the number of conversions recorded.
+func (e *Evaluator) Evaluate(hit Hit) (int, error) {
+	goals, err := e.siteGoals(hit.SiteID)
+	if err != nil {
+		return 0, err
+	}
+	if len(goals) == 0 {
+		return 0, nil
+	}
+
+	var matched []compiledGoal
+	var engagement *sessionEngagement
+	var summary *storage.SessionSummary
+	loadSummary := func() error {
+		if summary != nil {
+			return nil
+		}
+		summary, err = e.store.SessionSummary(hit.SiteID, hit.SessionID)
+		if err != nil {
+			return fmt.Errorf("failed to load session page views: %w", err)
+		}
+		return nil
+	}
+	for _, g := range goals {
+		switch g.GoalType {
+		case models.GoalTypePagePath:
+			if hit.EventName == "" && g.pathPattern != nil && g.pathPattern.MatchString(models.PagePath(hit.PageURL)) {
+				matched = append(matched, g)
+			}
+		case models.GoalTypeEvent:
+			if hit.EventName != "" && g.EventName != nil && *g.EventName == hit.EventName {
+				matched = append(matched, g)
+			}
+		case models.GoalTypeEngagement:
+			if engagement == nil {
+				if err := loadSummary(); err != nil {
+					return 0, err
+				}
+				engagement, err = e.loadEngagement(hit.SessionID, summary.PageViews)
+				if err != nil {
+					return 0, err
+				}
+			}
+			if engagement.reaches(g.Goal) {
+				matched = append(matched, g)
+			}
+		}
+	}
+	if len(matched) == 0 {
+		return 0, nil
+	}
+
+	// Conversions are attributed to the traffic source of the session's landing page
+	if err := loadSummary(); err != nil {
+		return 0, err
+	}
+	source := summary.Source()
+
+	recorded := 0
+	for _, g := range matched {
+		res, err := e.db.Exec(`
+			INSERT INTO conversions (id, goal_id, site_id, visitor_id, session_id, page_view_id, event_id, source, converted_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			ON CONFLICT (goal_id, session_id) DO NOTHING
+		`, uuid.New(), g.ID, hit.SiteID, hit.VisitorID, hit.SessionID, hit.PageViewID, hit.EventID, source, hit.At)
+		if err != nil {
+			return recorded, fmt.Errorf("failed to record conversion for goal %s: %w", g.ID, err)
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			recorded++
+		}
+	}
+
+	return recorded, nil
+}
+
+// siteGoals returns the active goals for a site, using the cache when fresh
+func (e *Evaluator) siteGoals(siteID string) ([]compiledGoal, error) {
+	e.mu.Lock()
+	cached, ok := e.cache[siteID]
+	e.mu.Unlock()
+	if ok && time.Since(cached.loadedAt) < cacheTTL {
+		return cached.goals, nil
+	}
+
+	list, err := ListGoals(e.db, siteID, true)
+	if err != nil {
+		return nil, err
+	}
+
+	compiled := make([]compiledGoal, 0, len(list))
+	for _, g := range list {
+		cg := compiledGoal{Goal: g}
+		if g.GoalType == models.GoalTypePagePath && g.PagePath != nil {
+			cg.pathPattern = compilePathPattern(*g.PagePath)
+		}
+		compiled = append(compiled, cg)
+	}
+
+	e.mu.Lock()
+	e.cache[siteID] = cachedGoals{goals: compiled, loadedAt: time.Now()}
+	e.mu.Unlock()
+
+	return compiled, nil
+}
+
+// sessionEngagement is the activity of a session so far
+type sessionEngagement struct {
+	pageViews int
+	duration  time.Duration
+}
+
+func (s *sessionEngagement) reaches(g models.Goal) bool {
+	if g.MinPageViews == nil && g.MinDurationSeconds == nil {
+		return false
+	}
+	if g.MinPageViews != nil && s.pageViews < *g.MinPageViews {
+		return false
+	}
+	if g.MinDurationSeconds != nil && s.duration < time.Duration(*g.MinDurationSeconds)*time.Second {
+		return false
+	}
+	return true
+}
+
+func (e *Evaluator) loadEngagement(sessionID uuid.UUID, pageViews int) (*sessionEngagement, error) {
+	var startedAt, lastActivityAt time.Time
+	err := e.db.QueryRow(`
+		SELECT started_at, last_activity_at FROM sessions WHERE id = $1
+	`, sessionID).Scan(&startedAt, &lastActivityAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load session engagement: %w", err)
+	}
+
+	return &sessionEngagement{
+		pageViews: pageViews,
+		duration:  lastActivityAt.Sub(startedAt),
+	}, nil
+}
+
+// compilePathPattern turns a goal path such as /blog/* into an anchored regexp
+func compilePathPattern(pattern string) *regexp.Regexp {
+	quoted := regexp.QuoteMeta(models.NormalizePath(pattern))
+	return regexp.MustCompile("^" + strings.ReplaceAll(quoted, `\*`, ".*") + "$")
+}
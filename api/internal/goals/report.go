@@ -0,0 +1,127 @@
+package goals
+
+import (
+	"fmt"
+	"time"
+
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/rollups"
+	"trackveilapi/internal/storage"
+
+	"github.com/google/uuid"
+)
+
+// Report is the conversion summary of a site's goals over a time range
+type Report struct {
+	From           time.Time    `json:"from"`
+	To             time.Time    `json:"to"`
+	UniqueVisitors int          `json:"unique_visitors"`
+	Goals          []GoalReport `json:"goals"`
+}
+
+// GoalReport is the conversion summary of one goal
+type GoalReport struct {
+	GoalID         uuid.UUID      `json:"goal_id"`
+	Name           string         `json:"name"`
+	GoalType       string         `json:"goal_type"`
+	Conversions    int            `json:"conversions"`
+	Converters     int            `json:"unique_converters"`
+	ConversionRate float64        `json:"conversion_rate"` // percent of unique visitors
+	Sources        []SourceReport `json:"sources"`
+}
+
+// SourceReport is the number of conversions attributed to a traffic source
+type SourceReport struct {
+	Source      string `json:"source"`
+	Conversions int    `json:"conversions"`
+}
+
+// BuildReport computes conversion counts, rates and source attribution for a
+// site. The range is widened to whole UTC hours, which unique visitors are
+// counted over. Visitors who converted count as visitors even if the rollups
+// do not include them yet, so a rate never exceeds 100%.
+func BuildReport(db *database.DB, store storage.Store, siteID string, from, to time.Time) (*Report, error) {
+	from, to, err := rollups.Snap(rollups.IntervalHour, from, to)
+	if err != nil {
+		return nil, err
+	}
+	report := &Report{From: from, To: to, Goals: []GoalReport{}}
+
+	visitors, err := store.UniqueVisitors(siteID, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count visitors: %w", err)
+	}
+	var converters int64
+	if err := db.QueryRow(`
+		SELECT COUNT(DISTINCT visitor_id) FROM conversions
+		WHERE site_id = $1 AND converted_at >= $2 AND converted_at < $3
+	`, siteID, from, to).Scan(&converters); err != nil {
+		return nil, fmt.Errorf("failed to count converters: %w", err)
+	}
+	if converters > visitors {
+		visitors = converters
+	}
+	report.UniqueVisitors = int(visitors)
+
+	rows, err := db.Query(`
+		SELECT g.id, g.name, g.goal_type,
+			COUNT(c.id),
+			COUNT(DISTINCT c.visitor_id)
+		FROM goals g
+		LEFT JOIN conversions c
+			ON c.goal_id = g.id AND c.converted_at >= $2 AND c.converted_at < $3
+		WHERE g.site_id = $1
+		GROUP BY g.id, g.name, g.goal_type
+		ORDER BY g.name
+	`, siteID, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count conversions: %w", err)
+	}
+	defer rows.Close()
+
+	index := make(map[uuid.UUID]int)
+	for rows.Next() {
+		var gr GoalReport
+		if err := rows.Scan(&gr.GoalID, &gr.Name, &gr.GoalType, &gr.Conversions, &gr.Converters); err != nil {
+			return nil, fmt.Errorf("failed to scan goal report: %w", err)
+		}
+		if report.UniqueVisitors > 0 {
+			gr.ConversionRate = roundPercent(gr.Converters, report.UniqueVisitors)
+		}
+		gr.Sources = []SourceReport{}
+		index[gr.GoalID] = len(report.Goals)
+		report.Goals = append(report.Goals, gr)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	srcRows, err := db.Query(`
+		SELECT goal_id, source, COUNT(*) AS conversions
+		FROM conversions
+		WHERE site_id = $1 AND converted_at >= $2 AND converted_at < $3
+		GROUP BY goal_id, source
+		ORDER BY conversions DESC, source
+	`, siteID, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to attribute conversions: %w", err)
+	}
+	defer srcRows.Close()
+
+	for srcRows.Next() {
+		var goalID uuid.UUID
+		var sr SourceReport
+		if err := srcRows.Scan(&goalID, &sr.Source, &sr.Conversions); err != nil {
+			return nil, fmt.Errorf("failed to scan source report: %w", err)
+		}
+		if i, ok := index[goalID]; ok {
+			report.Goals[i].Sources = append(report.Goals[i].Sources, sr)
+		}
+	}
+
+	return report, srcRows.Err()
+}
+
+func roundPercent(part, total int) float64 {
+	return float64(int(float64(part)/float64(total)*1000+0.5)) / 10
+}
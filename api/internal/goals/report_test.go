@@ -0,0 +1,116 @@
+package goals
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/migrate"
+	"trackveilapi/internal/models"
+	"trackveilapi/internal/rollups"
+	"trackveilapi/internal/storage"
+
+	"github.com/google/uuid"
+)
+
+// TestReportNotAggregated checks that conversion rates stay within 100%
+// while the rollups lag behind the conversions
+func TestReportNotAggregated(t *testing.T) {
+	db, err := database.OpenSQLite(filepath.Join(t.TempDir(), "trackveil.db"))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer db.Close()
+	m, err := migrate.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(context.Background()); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	siteID, err := models.GenerateSiteID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accountID := uuid.New()
+	if _, err := db.Exec(`INSERT INTO accounts (id, name) VALUES ($1, 'Goals')`, accountID); err != nil {
+		t.Fatalf("create account: %v", err)
+	}
+	if _, err := db.Exec(`
+		INSERT INTO sites (id, account_id, name, domain) VALUES ($1, $2, 'Goals', 'example.com')
+	`, siteID, accountID); err != nil {
+		t.Fatalf("create site: %v", err)
+	}
+	path := "/signup"
+	if err := CreateGoal(db, &models.Goal{SiteID: siteID, Name: "Signup", GoalType: models.GoalTypePagePath, PagePath: &path}); err != nil {
+		t.Fatalf("create goal: %v", err)
+	}
+
+	store, err := storage.NewSQLite(db, storage.SQLiteConfig{BatchSize: 100, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	evaluator := NewEvaluator(db, store)
+	aggregator := rollups.NewAggregator(db)
+
+	// view stores a page view of a new visitor and evaluates the goals
+	base := time.Now().UTC().Truncate(time.Hour).Add(-48 * time.Hour)
+	view := func(pageURL string, at time.Time) {
+		t.Helper()
+		visitorID, sessionID := uuid.New(), uuid.New()
+		if _, err := db.Exec(`INSERT INTO visitors (id, site_id, fingerprint_hash) VALUES ($1, $2, $3)`, visitorID, siteID, visitorID.String()); err != nil {
+			t.Fatalf("create visitor: %v", err)
+		}
+		if _, err := db.Exec(`INSERT INTO sessions (id, visitor_id, site_id) VALUES ($1, $2, $3)`, sessionID, visitorID, siteID); err != nil {
+			t.Fatalf("create session: %v", err)
+		}
+		pv := &models.PageView{SiteID: siteID, VisitorID: visitorID, SessionID: sessionID, PageURL: pageURL, IPAddress: "192.0.2.1", ViewedAt: at}
+		if err := store.InsertPageView(pv); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		hit := Hit{SiteID: siteID, VisitorID: visitorID, SessionID: sessionID, PageViewID: &pv.ID, PageURL: pageURL, At: at}
+		if _, err := evaluator.Evaluate(hit); err != nil {
+			t.Fatalf("evaluate: %v", err)
+		}
+	}
+	check := func(name string, visitors int, rate float64) {
+		t.Helper()
+		report, err := BuildReport(db, store, siteID, base.Add(5*time.Minute), base.Add(55*time.Minute))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !report.From.Equal(base) || !report.To.Equal(base.Add(time.Hour)) {
+			t.Errorf("%s: range %s - %s, want the whole hour %s", name, report.From, report.To, base)
+		}
+		if report.UniqueVisitors != visitors {
+			t.Errorf("%s: %d unique visitors, want %d", name, report.UniqueVisitors, visitors)
+		}
+		if len(report.Goals) != 1 || report.Goals[0].Converters != 4 || report.Goals[0].ConversionRate != rate {
+			t.Errorf("%s: goals %+v, want 4 converters at %v%%", name, report.Goals, rate)
+		}
+	}
+
+	view("https://example.com/", base.Add(10*time.Minute))
+	if err := aggregator.Aggregate(context.Background(), time.Now()); err != nil {
+		t.Fatalf("aggregate: %v", err)
+	}
+	// Converters within the requested range, and one at each edge of its hour
+	view("https://example.com/signup", base.Add(20*time.Minute))
+	view("https://example.com/signup", base.Add(30*time.Minute))
+	view("https://example.com/signup", base.Add(2*time.Minute))
+	view("https://example.com/signup", base.Add(58*time.Minute))
+
+	// The rollup still counts one visitor; the converters count as visitors
+	check("not aggregated", 4, 100)
+
+	if err := aggregator.Aggregate(context.Background(), time.Now()); err != nil {
+		t.Fatalf("aggregate: %v", err)
+	}
+	check("aggregated", 5, 80)
+}
@@ -0,0 +1,109 @@
+package goals
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/models"
+
+	"github.com/google/uuid"
+)
+
+// Validate checks that a goal definition is complete for its type
+func Validate(g *models.Goal) error {
+	g.Name = strings.TrimSpace(g.Name)
+	if g.Name == "" {
+		return errors.New("name is required")
+	}
+
+	switch g.GoalType {
+	case models.GoalTypePagePath:
+		if g.PagePath == nil || strings.TrimSpace(*g.PagePath) == "" {
+			return errors.New("page_path is required for page_path goals")
+		}
+		p := models.NormalizePath(strings.TrimSpace(*g.PagePath))
+		g.PagePath = &p
+		g.EventName, g.MinPageViews, g.MinDurationSeconds = nil, nil, nil
+	case models.GoalTypeEvent:
+		if g.EventName == nil || strings.TrimSpace(*g.EventName) == "" {
+			return errors.New("event_name is required for event goals")
+		}
+		name := strings.TrimSpace(*g.EventName)
+		g.EventName = &name
+		g.PagePath, g.MinPageViews, g.MinDurationSeconds = nil, nil, nil
+	case models.GoalTypeEngagement:
+		if g.MinPageViews == nil && g.MinDurationSeconds == nil {
+			return errors.New("min_page_views or min_duration_seconds is required for engagement goals")
+		}
+		if (g.MinPageViews != nil && *g.MinPageViews < 1) || (g.MinDurationSeconds != nil && *g.MinDurationSeconds < 1) {
+			return errors.New("engagement thresholds must be positive")
+		}
+		g.PagePath, g.EventName = nil, nil
+	default:
+		return fmt.Errorf("unknown goal_type %q", g.GoalType)
+	}
+
+	return nil
+}
+
+// ListGoals returns the goals of a site, optionally only the active ones
+func ListGoals(db *database.DB, siteID string, activeOnly bool) ([]models.Goal, error) {
+	rows, err := db.Query(`
+		SELECT id, site_id, name, goal_type, page_path, event_name,
+			min_page_views, min_duration_seconds, active, created_at, updated_at
+		FROM goals
+		WHERE site_id = $1 AND (active OR NOT $2)
+		ORDER BY name
+	`, siteID, activeOnly)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list goals: %w", err)
+	}
+	defer rows.Close()
+
+	var list []models.Goal
+	for rows.Next() {
+		var g models.Goal
+		if err := rows.Scan(
+			&g.ID, &g.SiteID, &g.Name, &g.GoalType, &g.PagePath, &g.EventName,
+			&g.MinPageViews, &g.MinDurationSeconds, &g.Active, &g.CreatedAt, &g.UpdatedAt,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan goal: %w", err)
+		}
+		list = append(list, g)
+	}
+
+	return list, rows.Err()
+}
+
+// CreateGoal inserts a validated goal definition
+func CreateGoal(db *database.DB, g *models.Goal) error {
+	g.ID = uuid.New()
+	g.Active = true
+	g.CreatedAt = time.Now()
+	g.UpdatedAt = g.CreatedAt
+
+	_, err := db.Exec(`
+		INSERT INTO goals (
+			id, site_id, name, goal_type, page_path, event_name,
+			min_page_views, min_duration_seconds, active, created_at, updated_at
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+	`,
+		g.ID, g.SiteID, g.Name, g.GoalType, g.PagePath, g.EventName,
+		g.MinPageViews, g.MinDurationSeconds, g.Active, g.CreatedAt, g.UpdatedAt,
+	)
+
+	return err
+}
+
+// DeleteGoal removes a goal and its conversions. It reports whether the goal existed.
+func DeleteGoal(db *database.DB, siteID string, goalID uuid.UUID) (bool, error) {
+	res, err := db.Exec(`DELETE FROM goals WHERE id = $1 AND site_id = $2`, goalID, siteID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
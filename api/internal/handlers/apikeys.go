@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"trackveilapi/internal/apierror"
+	"trackveilapi/internal/apikeys"
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// APIKeysHandler manages per-site server tracking keys
+type APIKeysHandler struct {
+	db *database.DB
+}
+
+// NewAPIKeysHandler creates a new API keys handler
+func NewAPIKeysHandler(db *database.DB) *APIKeysHandler {
+	return &APIKeysHandler{db: db}
+}
+
+type createKeyRequest struct {
+	Name     string `json:"name" binding:"required"`
+	AuthType string `json:"auth_type"`
+
+	// ga4 keys only: the stream's measurement_id and an optional existing api_secret
+	MeasurementID string `json:"measurement_id"`
+	APISecret     string `json:"api_secret"`
+}
+
+type rotateKeyRequest struct {
+	GraceSeconds *int `json:"grace_seconds"`
+}
+
+// List handles GET /api/sites/:site_id/keys
+func (h *APIKeysHandler) List(c *gin.Context) {
+	siteID := c.Param("site_id")
+
+	keys, err := apikeys.List(h.db, siteID)
+	if err != nil {
+		log.Printf("Failed to list keys for site %s: %v", siteID, err)
+		apierror.Abort(c, http.StatusServiceUnavailable, apierror.CodeStorageUnavailable, "Database error")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
+
+// Create handles POST /api/sites/:site_id/keys
+// The plaintext key is only returned in this response.
+func (h *APIKeysHandler) Create(c *gin.Context) {
+	siteID := c.Param("site_id")
+
+	var req createKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.Name) == "" {
+		apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid request body")
+		return
+	}
+	if req.AuthType == "" {
+		req.AuthType = models.AuthTypeBearer
+	}
+
+	var key *models.SiteAPIKey
+	var plaintext string
+	var err error
+	switch req.AuthType {
+	case models.AuthTypeBearer, models.AuthTypeHMAC:
+		key, plaintext, err = apikeys.Create(h.db, siteID, strings.TrimSpace(req.Name), req.AuthType)
+	case models.AuthTypeGA4:
+		measurementID := strings.TrimSpace(req.MeasurementID)
+		if measurementID == "" || len(measurementID) > 32 {
+			apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "measurement_id is required for ga4 keys")
+			return
+		}
+		key, plaintext, err = apikeys.CreateGA4(h.db, siteID, strings.TrimSpace(req.Name), measurementID, req.APISecret)
+	default:
+		apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "auth_type must be 'bearer', 'hmac' or 'ga4'")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to create key for site %s: %v", siteID, err)
+		apierror.Abort(c, http.StatusInternalServerError, apierror.CodeInternal, "Failed to create key")
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"key": key, "secret": plaintext})
+}
+
+// Rotate handles POST /api/sites/:site_id/keys/:key_id/rotate
+func (h *APIKeysHandler) Rotate(c *gin.Context) {
+	siteID := c.Param("site_id")
+
+	id, err := uuid.Parse(c.Param("key_id"))
+	if err != nil {
+		apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid key_id")
+		return
+	}
+
+	grace := apikeys.DefaultRotationGrace
+	var req rotateKeyRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid request body")
+			return
+		}
+	}
+	if req.GraceSeconds != nil {
+		if *req.GraceSeconds < 0 {
+			apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "grace_seconds must not be negative")
+			return
+		}
+		grace = time.Duration(*req.GraceSeconds) * time.Second
+	}
+
+	key, plaintext, err := apikeys.Rotate(h.db, siteID, id, grace)
+	if errors.Is(err, apikeys.ErrNotFound) {
+		apierror.Abort(c, http.StatusNotFound, apierror.CodeNotFound, "Key not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to rotate key %s: %v", id, err)
+		apierror.Abort(c, http.StatusInternalServerError, apierror.CodeInternal, "Failed to rotate key")
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"key": key, "secret": plaintext})
+}
+
+// Revoke handles DELETE /api/sites/:site_id/keys/:key_id
+func (h *APIKeysHandler) Revoke(c *gin.Context) {
+	siteID := c.Param("site_id")
+
+	id, err := uuid.Parse(c.Param("key_id"))
+	if err != nil {
+		apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid key_id")
+		return
+	}
+
+	err = apikeys.Revoke(h.db, siteID, id)
+	if errors.Is(err, apikeys.ErrNotFound) {
+		apierror.Abort(c, http.StatusNotFound, apierror.CodeNotFound, "Key not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to revoke key %s: %v", id, err)
+		apierror.Abort(c, http.StatusInternalServerError, apierror.CodeInternal, "Failed to revoke key")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "revoked"})
+}
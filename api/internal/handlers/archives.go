@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"trackveilapi/internal/apierror"
+	"trackveilapi/internal/archive"
+	"trackveilapi/internal/database"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ArchivesHandler lists the archived ranges of raw hits
+type ArchivesHandler struct {
+	db *database.DB
+}
+
+// NewArchivesHandler creates a new archives handler
+func NewArchivesHandler(db *database.DB) *ArchivesHandler {
+	return &ArchivesHandler{db: db}
+}
+
+// List handles GET /api/sites/:site_id/archives
+func (h *ArchivesHandler) List(c *gin.Context) {
+	siteID := c.Param("site_id")
+
+	archives, err := archive.List(h.db, siteID, time.Time{}, time.Time{})
+	if err != nil {
+		log.Printf("Failed to list archives for site %s: %v", siteID, err)
+		apierror.Abort(c, http.StatusServiceUnavailable, apierror.CodeStorageUnavailable, "Database error")
+		return
+	}
+
+	// Everything before archived_through is archived
+	var through *time.Time
+	if n := len(archives); n > 0 {
+		through = &archives[n-1].RangeEnd
+	}
+	c.JSON(http.StatusOK, gin.H{"archives": archives, "archived_through": through})
+}
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"trackveilapi/internal/apierror"
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/deadletter"
+	"trackveilapi/internal/models"
+	"trackveilapi/internal/storage"
+
+	"github.com/google/uuid"
+)
+
+// deadLetterContext is kept with a dead-lettered request: its metadata and
+// the enrichment done before the database rejected it
+type deadLetterContext struct {
+	ClientIP        string             `json:"client_ip"`
+	UserAgent       string             `json:"user_agent"`
+	At              time.Time          `json:"at"`
+	FingerprintHash string             `json:"fingerprint_hash"`
+	Endpoint        string             `json:"endpoint"`
+	Browser         models.BrowserInfo `json:"browser"`
+	VisitorID       *uuid.UUID         `json:"visitor_id,omitempty"`
+	SessionID       *uuid.UUID         `json:"session_id,omitempty"`
+}
+
+func newDeadLetterContext(hc hitContext, browser models.BrowserInfo) *deadLetterContext {
+	return &deadLetterContext{
+		ClientIP:        hc.ClientIP,
+		UserAgent:       hc.UserAgent,
+		At:              hc.At,
+		FingerprintHash: hc.FingerprintHash,
+		Endpoint:        hc.Endpoint,
+		Browser:         browser,
+	}
+}
+
+// hitContext returns the request metadata to re-ingest the request with
+func (dc *deadLetterContext) hitContext() hitContext {
+	return hitContext{
+		ClientIP:        dc.ClientIP,
+		UserAgent:       dc.UserAgent,
+		At:              dc.At,
+		FingerprintHash: dc.FingerprintHash,
+		Endpoint:        dc.Endpoint,
+	}
+}
+
+// storageError is the response to a failed write: 503 so the client retries,
+// unless the database rejected the hit for its data. That hit is kept as a
+// dead letter and answered 422, since a retry would fail the same way.
+func (h *TrackHandler) storageError(siteID string, req *models.TrackRequest, hc hitContext, dc *deadLetterContext, err error, message string) *hitError {
+	unavailable := &hitError{status: http.StatusServiceUnavailable, code: apierror.CodeStorageUnavailable, message: message, cause: err}
+	if !database.IsPermanent(err) {
+		return unavailable
+	}
+	rejected := &hitError{status: http.StatusUnprocessableEntity, code: apierror.CodeHitRejected, message: "Hit rejected by storage", cause: err}
+	if !h.deadLetters {
+		return rejected
+	}
+
+	payload, perr := json.Marshal(req)
+	context, cerr := json.Marshal(dc)
+	if perr != nil || cerr != nil {
+		return unavailable
+	}
+	l := &models.DeadLetter{
+		SiteID:  siteID,
+		Kind:    deadletter.KindRequest,
+		Source:  dc.Endpoint,
+		Payload: payload,
+		Context: context,
+		Error:   err.Error(),
+	}
+	if err := deadletter.Add(h.db, l); err != nil {
+		hc.logf("Failed to dead-letter hit for site %s: %v", siteID, err)
+		return unavailable
+	}
+	hc.logf("Dead-lettered hit %s for site %s", l.ID, siteID)
+	return rejected
+}
+
+// ReingestDeadLetter stores the hit of a dead letter. A request goes
+// through ingestion again, with its original metadata and time; a page view
+// or event is written as is. A hit rejected again is not dead-lettered a
+// second time: the error is returned, for the caller to record.
+func (h *TrackHandler) ReingestDeadLetter(l *models.DeadLetter) error {
+	if l.Kind != deadletter.KindRequest {
+		return storage.Reinsert(h.db, l)
+	}
+
+	var req models.TrackRequest
+	if err := json.Unmarshal(l.Payload, &req); err != nil {
+		return fmt.Errorf("invalid request: %w", err)
+	}
+	var dc deadLetterContext
+	if len(l.Context) > 0 {
+		if err := json.Unmarshal(l.Context, &dc); err != nil {
+			return fmt.Errorf("invalid context: %w", err)
+		}
+	}
+	if dc.At.IsZero() {
+		dc.At = l.CreatedAt
+	}
+	if req.SiteID == "" {
+		req.SiteID = l.SiteID
+	}
+
+	var domain string
+	err := h.db.QueryRow("SELECT domain FROM sites WHERE id = $1", req.SiteID).Scan(&domain)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errors.New("site not found")
+	}
+	if err != nil {
+		return err
+	}
+
+	reingest := *h
+	reingest.deadLetters = false
+	if _, herr := reingest.record(req.SiteID, &req, dc.hitContext()); herr != nil {
+		if herr.cause != nil {
+			return herr.cause
+		}
+		if len(herr.fields) > 0 {
+			return herr.fields
+		}
+		return errors.New(herr.message)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+
+	"trackveilapi/internal/apierror"
+	"trackveilapi/internal/dedup"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DiagnosticsHandler exposes ingestion health information for a site
+type DiagnosticsHandler struct {
+	dedup *dedup.Deduplicator
+}
+
+// NewDiagnosticsHandler creates a new diagnostics handler
+func NewDiagnosticsHandler(deduplicator *dedup.Deduplicator) *DiagnosticsHandler {
+	return &DiagnosticsHandler{dedup: deduplicator}
+}
+
+// Duplicates handles GET /api/sites/:site_id/diagnostics/duplicates
+func (h *DiagnosticsHandler) Duplicates(c *gin.Context) {
+	siteID := c.Param("site_id")
+
+	from, to, err := parseTimeRange(c)
+	if err != nil {
+		apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, err.Error())
+		return
+	}
+
+	counts, err := h.dedup.Suppressed(siteID, from, to)
+	if err != nil {
+		log.Printf("Failed to load suppressed hits for site %s: %v", siteID, err)
+		apierror.Abort(c, http.StatusServiceUnavailable, apierror.CodeStorageUnavailable, "Database error")
+		return
+	}
+
+	var total int64
+	for _, sc := range counts {
+		total += sc.Count
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"from":  from,
+		"to":    to,
+		"total": total,
+		"days":  counts,
+	})
+}
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"trackveilapi/internal/apierror"
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/domains"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// customDomainSiteKey holds the site resolved from a custom domain Host header
+const customDomainSiteKey = "trackveil.custom_domain_site"
+
+// CustomDomain resolves the site of requests made on a customer's own
+// hostname (e.g. stats.customer.com CNAMEd to the API) from the Host header
+func CustomDomain(resolver *domains.Resolver) gin.HandlerFunc {
+	return customDomain(resolver, false)
+}
+
+// IngestCustomDomain is CustomDomain for ingestion routes. A failed lookup
+// leaves the site to the hit's site_id instead of rejecting the hit, so it
+// can still be spooled while the database is down.
+func IngestCustomDomain(resolver *domains.Resolver) gin.HandlerFunc {
+	return customDomain(resolver, true)
+}
+
+func customDomain(resolver *domains.Resolver, ingest bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		siteID, err := resolver.SiteID(c.Request.Host)
+		if err != nil {
+			log.Printf("Custom domain lookup failed for %q: %v", c.Request.Host, err)
+			if !ingest {
+				apierror.Abort(c, http.StatusServiceUnavailable, apierror.CodeStorageUnavailable, "Database error")
+				return
+			}
+		}
+		if siteID != "" {
+			c.Set(customDomainSiteKey, siteID)
+		}
+		c.Next()
+	}
+}
+
+// customDomainSite returns the site of the request's custom domain, or ""
+func customDomainSite(c *gin.Context) string {
+	return c.GetString(customDomainSiteKey)
+}
+
+// DomainsHandler manages the custom tracking domains of sites
+type DomainsHandler struct {
+	db       *database.DB
+	resolver *domains.Resolver
+}
+
+// NewDomainsHandler creates a new custom domains handler
+func NewDomainsHandler(db *database.DB, resolver *domains.Resolver) *DomainsHandler {
+	return &DomainsHandler{db: db, resolver: resolver}
+}
+
+type createDomainRequest struct {
+	Hostname string `json:"hostname" binding:"required"`
+}
+
+// List handles GET /api/sites/:site_id/domains
+func (h *DomainsHandler) List(c *gin.Context) {
+	siteID := c.Param("site_id")
+
+	list, err := domains.List(h.db, siteID)
+	if err != nil {
+		log.Printf("Failed to list custom domains for site %s: %v", siteID, err)
+		apierror.Abort(c, http.StatusServiceUnavailable, apierror.CodeStorageUnavailable, "Database error")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"domains": list})
+}
+
+// Create handles POST /api/sites/:site_id/domains
+func (h *DomainsHandler) Create(c *gin.Context) {
+	siteID := c.Param("site_id")
+
+	var req createDomainRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid request body")
+		return
+	}
+	hostname := domains.Normalize(req.Hostname)
+	if !domains.ValidHostname(hostname) {
+		apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "hostname must be a fully qualified domain name")
+		return
+	}
+
+	domain, err := domains.Create(h.db, siteID, hostname)
+	if errors.Is(err, domains.ErrTaken) {
+		apierror.Abort(c, http.StatusConflict, apierror.CodeInvalidRequest, "hostname is already registered")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to create custom domain for site %s: %v", siteID, err)
+		apierror.Abort(c, http.StatusInternalServerError, apierror.CodeInternal, "Failed to create custom domain")
+		return
+	}
+	h.resolver.Invalidate(hostname)
+
+	c.JSON(http.StatusCreated, domain)
+}
+
+// Delete handles DELETE /api/sites/:site_id/domains/:domain_id
+func (h *DomainsHandler) Delete(c *gin.Context) {
+	siteID := c.Param("site_id")
+
+	id, err := uuid.Parse(c.Param("domain_id"))
+	if err != nil {
+		apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid domain_id")
+		return
+	}
+
+	hostname, err := domains.Delete(h.db, siteID, id)
+	if errors.Is(err, domains.ErrNotFound) {
+		apierror.Abort(c, http.StatusNotFound, apierror.CodeNotFound, "Custom domain not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to delete custom domain %s: %v", id, err)
+		apierror.Abort(c, http.StatusInternalServerError, apierror.CodeInternal, "Failed to delete custom domain")
+		return
+	}
+	h.resolver.Invalidate(hostname)
+
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
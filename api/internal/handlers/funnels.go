@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"trackveilapi/internal/apierror"
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/funnels"
+	"trackveilapi/internal/models"
+	"trackveilapi/internal/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// FunnelsHandler manages funnel definitions and funnel reports
+type FunnelsHandler struct {
+	db    *database.DB
+	store storage.Store
+}
+
+// NewFunnelsHandler creates a new funnels handler
+func NewFunnelsHandler(db *database.DB, store storage.Store) *FunnelsHandler {
+	return &FunnelsHandler{db: db, store: store}
+}
+
+// List handles GET /api/sites/:site_id/funnels
+func (h *FunnelsHandler) List(c *gin.Context) {
+	siteID := c.Param("site_id")
+
+	list, err := funnels.List(h.db, siteID)
+	if err != nil {
+		log.Printf("Failed to list funnels for site %s: %v", siteID, err)
+		apierror.Abort(c, http.StatusServiceUnavailable, apierror.CodeStorageUnavailable, "Database error")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"funnels": list})
+}
+
+// Create handles POST /api/sites/:site_id/funnels
+func (h *FunnelsHandler) Create(c *gin.Context) {
+	siteID := c.Param("site_id")
+
+	var funnel models.Funnel
+	if err := c.ShouldBindJSON(&funnel); err != nil {
+		apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid request body")
+		return
+	}
+	funnel.SiteID = siteID
+
+	if err := funnels.Validate(&funnel); err != nil {
+		apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, err.Error())
+		return
+	}
+
+	if err := funnels.Create(h.db, &funnel); err != nil {
+		log.Printf("Failed to create funnel for site %s: %v", siteID, err)
+		apierror.Abort(c, http.StatusInternalServerError, apierror.CodeInternal, "Failed to create funnel")
+		return
+	}
+
+	c.JSON(http.StatusCreated, funnel)
+}
+
+// Delete handles DELETE /api/sites/:site_id/funnels/:funnel_id
+func (h *FunnelsHandler) Delete(c *gin.Context) {
+	siteID := c.Param("site_id")
+
+	funnelID, err := uuid.Parse(c.Param("funnel_id"))
+	if err != nil {
+		apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid funnel_id")
+		return
+	}
+
+	found, err := funnels.Delete(h.db, siteID, funnelID)
+	if err != nil {
+		log.Printf("Failed to delete funnel %s: %v", funnelID, err)
+		apierror.Abort(c, http.StatusInternalServerError, apierror.CodeInternal, "Failed to delete funnel")
+		return
+	}
+	if !found {
+		apierror.Abort(c, http.StatusNotFound, apierror.CodeNotFound, "Funnel not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
+
+// Report handles GET /api/sites/:site_id/funnels/:funnel_id/report
+// Query parameters: from, to, breakdown (source or device)
+func (h *FunnelsHandler) Report(c *gin.Context) {
+	siteID := c.Param("site_id")
+
+	// Funnels are evaluated in SQL over the page_views and events tables
+	if h.store.Backend() == storage.BackendClickHouse {
+		apierror.Abort(c, http.StatusNotImplemented, apierror.CodeNotImplemented, "Funnel reports require the postgres or sqlite storage backend")
+		return
+	}
+
+	funnelID, err := uuid.Parse(c.Param("funnel_id"))
+	if err != nil {
+		apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid funnel_id")
+		return
+	}
+
+	from, to, err := parseTimeRange(c)
+	if err != nil {
+		apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, err.Error())
+		return
+	}
+
+	breakdown := c.Query("breakdown")
+	if breakdown != "" && breakdown != funnels.BreakdownSource && breakdown != funnels.BreakdownDevice {
+		apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "breakdown must be 'source' or 'device'")
+		return
+	}
+
+	funnel, err := funnels.Get(h.db, siteID, funnelID)
+	if errors.Is(err, funnels.ErrNotFound) {
+		apierror.Abort(c, http.StatusNotFound, apierror.CodeNotFound, "Funnel not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load funnel %s: %v", funnelID, err)
+		apierror.Abort(c, http.StatusServiceUnavailable, apierror.CodeStorageUnavailable, "Database error")
+		return
+	}
+
+	report, err := funnels.Run(h.db.ReadOnly(), funnel, from, to, breakdown)
+	if err != nil {
+		log.Printf("Failed to run funnel %s: %v", funnelID, err)
+		apierror.Abort(c, http.StatusServiceUnavailable, apierror.CodeStorageUnavailable, "Database error")
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
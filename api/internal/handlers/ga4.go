@@ -0,0 +1,304 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"trackveilapi/internal/apierror"
+	"trackveilapi/internal/apikeys"
+	"trackveilapi/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// ga4PageView is the GA4 event name for page views
+	ga4PageView = "page_view"
+	// maxGA4Events is the Measurement Protocol limit of events per request
+	maxGA4Events = 25
+	// maxGA4BodyBytes is the Measurement Protocol payload size limit
+	maxGA4BodyBytes = 130 << 10
+	// maxGA4Backdate is how far back GA4 accepts timestamp_micros
+	maxGA4Backdate = 72 * time.Hour
+)
+
+// ga4IgnoredEvents are automatically collected GA4 events with no Trackveil equivalent
+var ga4IgnoredEvents = map[string]bool{
+	"session_start":   true,
+	"first_visit":     true,
+	"user_engagement": true,
+}
+
+// ga4Payload is a Measurement Protocol request body
+type ga4Payload struct {
+	ClientID        string      `json:"client_id"`
+	TimestampMicros json.Number `json:"timestamp_micros"`
+	IPOverride      string      `json:"ip_override"`
+	Events          []ga4Event  `json:"events"`
+}
+
+type ga4Event struct {
+	Name            string                 `json:"name"`
+	Params          map[string]interface{} `json:"params"`
+	TimestampMicros json.Number            `json:"timestamp_micros"`
+}
+
+// ga4ValidationMessage mirrors the /debug/mp/collect response format
+type ga4ValidationMessage struct {
+	FieldPath      string `json:"fieldPath,omitempty"`
+	Description    string `json:"description"`
+	ValidationCode string `json:"validationCode"`
+}
+
+// GA4Collect handles POST /mp/collect in the GA4 Measurement Protocol format.
+// measurement_id and api_secret (query parameters) are mapped to a site through
+// a ga4 site key. page_view events become page views, other events custom events.
+func (h *TrackHandler) GA4Collect(c *gin.Context) {
+	h.ga4(c, false)
+}
+
+// GA4DebugCollect handles POST /debug/mp/collect. It validates the payload
+// like GA4's validation server and records nothing.
+func (h *TrackHandler) GA4DebugCollect(c *gin.Context) {
+	h.ga4(c, true)
+}
+
+func (h *TrackHandler) ga4(c *gin.Context, debug bool) {
+	key, err := apikeys.AuthenticateGA4(h.db, c.Query("measurement_id"), c.Query("api_secret"))
+	if errors.Is(err, apikeys.ErrUnauthorized) {
+		apierror.Abort(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid measurement_id or api_secret")
+		return
+	}
+	if err != nil {
+		log.Printf("GA4 api_secret lookup failed: %v", err)
+		apierror.Abort(c, http.StatusServiceUnavailable, apierror.CodeStorageUnavailable, "Database error")
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxGA4BodyBytes+1))
+	if err != nil || len(body) > maxGA4BodyBytes {
+		apierror.Abort(c, http.StatusRequestEntityTooLarge, apierror.CodePayloadTooLarge, "Request body too large")
+		return
+	}
+
+	var payload ga4Payload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		h.ga4Respond(c, debug, []ga4ValidationMessage{{Description: "Unable to parse payload", ValidationCode: "VALUE_INVALID"}})
+		return
+	}
+
+	now := time.Now()
+	hits, messages := translateGA4(&payload, now)
+	if debug {
+		h.ga4Respond(c, true, messages)
+		return
+	}
+
+	hc := hitContext{
+		ClientIP:  c.ClientIP(),
+		UserAgent: c.GetHeader("User-Agent"),
+		// client_id identifies the browser, like the tracker fingerprint
+		FingerprintHash: models.HashFingerprint(payload.ClientID),
+		Endpoint:        c.FullPath(),
+		RequestID:       apierror.RequestID(c),
+	}
+	if ip := net.ParseIP(payload.IPOverride); ip != nil {
+		hc.ClientIP = ip.String()
+	}
+
+	// Events were all validated above. If one fails to store, the sender
+	// retries the request and the events already stored are skipped by
+	// their event IDs.
+	for _, hit := range hits {
+		hit.req.SiteID = key.SiteID
+		hc.At = hit.at
+		if _, herr := h.record(key.SiteID, &hit.req, hc); herr != nil {
+			herr.abort(c)
+			return
+		}
+	}
+
+	// Like GA4, accepted requests get an empty 204
+	c.Status(http.StatusNoContent)
+}
+
+func (h *TrackHandler) ga4Respond(c *gin.Context, debug bool, messages []ga4ValidationMessage) {
+	if debug {
+		if messages == nil {
+			messages = []ga4ValidationMessage{}
+		}
+		c.JSON(http.StatusOK, gin.H{"validationMessages": messages})
+		return
+	}
+	apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, messages[0].Description)
+}
+
+type ga4Hit struct {
+	req models.TrackRequest
+	at  time.Time
+}
+
+// translateGA4 maps Measurement Protocol events onto Trackveil hits. Invalid
+// events are skipped and reported as validation messages.
+func translateGA4(p *ga4Payload, now time.Time) ([]ga4Hit, []ga4ValidationMessage) {
+	var messages []ga4ValidationMessage
+	if p.ClientID == "" {
+		return nil, append(messages, ga4ValidationMessage{FieldPath: "client_id", Description: "client_id is required", ValidationCode: "VALUE_REQUIRED"})
+	}
+	if len(p.Events) == 0 {
+		return nil, append(messages, ga4ValidationMessage{FieldPath: "events", Description: "events is required", ValidationCode: "VALUE_REQUIRED"})
+	}
+	if len(p.Events) > maxGA4Events {
+		return nil, append(messages, ga4ValidationMessage{FieldPath: "events", Description: fmt.Sprintf("at most %d events per request", maxGA4Events), ValidationCode: "EXCEEDED_MAX_ENTITIES"})
+	}
+
+	base, err := ga4Time(p.TimestampMicros, now)
+	if err != nil {
+		return nil, append(messages, ga4ValidationMessage{FieldPath: "timestamp_micros", Description: err.Error(), ValidationCode: "VALUE_INVALID"})
+	}
+
+	var hits []ga4Hit
+	for i, ev := range p.Events {
+		field := fmt.Sprintf("events[%d]", i)
+		if ev.Name == "" {
+			messages = append(messages, ga4ValidationMessage{FieldPath: field + ".name", Description: "event name is required", ValidationCode: "VALUE_REQUIRED"})
+			continue
+		}
+		if ga4IgnoredEvents[ev.Name] {
+			continue
+		}
+
+		at := base
+		if ev.TimestampMicros != "" {
+			if at, err = ga4Time(ev.TimestampMicros, now); err != nil {
+				messages = append(messages, ga4ValidationMessage{FieldPath: field + ".timestamp_micros", Description: err.Error(), ValidationCode: "VALUE_INVALID"})
+				continue
+			}
+		}
+
+		params := ev.Params
+		req := models.TrackRequest{
+			PageURL:   paramString(params, "page_location"),
+			PageTitle: paramString(params, "page_title"),
+			Referrer:  paramString(params, "page_referrer"),
+		}
+		if w, h, ok := parseResolution(paramString(params, "screen_resolution")); ok {
+			req.ScreenWidth, req.ScreenHeight = w, h
+		}
+
+		if ev.Name == ga4PageView {
+			if req.PageURL == "" {
+				messages = append(messages, ga4ValidationMessage{FieldPath: field + ".params.page_location", Description: "page_location is required for page_view", ValidationCode: "VALUE_REQUIRED"})
+				continue
+			}
+		} else {
+			req.EventName = ev.Name
+			req.Props = ga4Props(params)
+		}
+
+		if errs := req.Sanitize(); len(errs) > 0 {
+			for _, fe := range errs {
+				messages = append(messages, ga4ValidationMessage{FieldPath: field + ga4FieldPath(fe.Field), Description: fe.Message, ValidationCode: "VALUE_INVALID"})
+			}
+			continue
+		}
+
+		if ev.TimestampMicros != "" || p.TimestampMicros != "" {
+			req.EventID = ga4EventID(p.ClientID, at, i)
+		}
+		hits = append(hits, ga4Hit{req: req, at: at})
+	}
+
+	return hits, messages
+}
+
+// ga4EventID identifies an event of a request by its client, time and
+// position, so a retried request does not record the events already stored.
+// Events timed on receipt have none: their retries cannot be told apart from
+// new events.
+func ga4EventID(clientID string, at time.Time, index int) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%d", clientID, at.UnixMicro(), index)))
+	return "ga4:" + hex.EncodeToString(sum[:20])
+}
+
+// ga4FieldPath maps a Trackveil request field back to the event field it came from
+func ga4FieldPath(field string) string {
+	switch field {
+	case "page_url":
+		return ".params.page_location"
+	case "page_title":
+		return ".params.page_title"
+	case "referrer":
+		return ".params.page_referrer"
+	case "screen_width", "screen_height":
+		return ".params.screen_resolution"
+	case "event_name":
+		return ".name"
+	default:
+		return ".params"
+	}
+}
+
+// ga4Time converts timestamp_micros, defaulting to now
+func ga4Time(micros json.Number, now time.Time) (time.Time, error) {
+	if micros == "" {
+		return now, nil
+	}
+	v, err := micros.Int64()
+	if err != nil {
+		return time.Time{}, errors.New("timestamp_micros must be an integer")
+	}
+	t := time.UnixMicro(v)
+	if t.After(now.Add(apikeys.MaxClockSkew)) || t.Before(now.Add(-maxGA4Backdate)) {
+		return time.Time{}, errors.New("timestamp_micros must be within the last 72 hours")
+	}
+	return t, nil
+}
+
+// ga4Props keeps event parameters that are not mapped to page view columns
+func ga4Props(params map[string]interface{}) map[string]string {
+	props := make(map[string]interface{}, len(params))
+	for k, v := range params {
+		switch k {
+		case "page_location", "page_title", "page_referrer", "screen_resolution", "engagement_time_msec", "session_id":
+			continue
+		}
+		props[k] = v
+	}
+	return models.StringifyProps(props)
+}
+
+func paramString(params map[string]interface{}, key string) string {
+	switch v := params[key].(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// parseResolution parses "1920x1080"
+func parseResolution(s string) (int, int, bool) {
+	parts := strings.SplitN(s, "x", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	w, err1 := strconv.Atoi(parts[0])
+	h, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil {
+		return 0, 0, false
+	}
+	return w, h, true
+}
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"trackveilapi/internal/apikeys"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestGA4Retry checks that retrying a request whose events were partly
+// stored records each event once
+func TestGA4Retry(t *testing.T) {
+	tt := newTrackTest(t)
+	if _, _, err := apikeys.CreateGA4(tt.db, tt.siteID, "GA4", "G-TEST123", "secret"); err != nil {
+		t.Fatalf("create GA4 key: %v", err)
+	}
+	router := gin.New()
+	router.POST("/mp/collect", tt.handler.GA4Collect)
+
+	ts := time.Now().Add(-time.Hour).UnixMicro()
+	events := `{"name":"signup","params":{"page_location":"https://example.com/"}},
+		{"name":"purchase","params":{"page_location":"https://example.com/"}},
+		{"name":"signup","params":{"page_location":"https://example.com/"}}`
+	firstEvent := events[:strings.Index(events, "},")+1]
+
+	cases := []struct {
+		name   string
+		body   string
+		stored int // events of the site so far
+	}{
+		{"first event stored", `{"client_id":"1.1","timestamp_micros":` + fmt.Sprint(ts) + `,"events":[` + firstEvent + `]}`, 1},
+		{"retry of the whole request", `{"client_id":"1.1","timestamp_micros":` + fmt.Sprint(ts) + `,"events":[` + events + `]}`, 3},
+		{"retried again", `{"client_id":"1.1","timestamp_micros":` + fmt.Sprint(ts) + `,"events":[` + events + `]}`, 3},
+		{"another client", `{"client_id":"2.2","timestamp_micros":` + fmt.Sprint(ts) + `,"events":[` + events + `]}`, 6},
+		{"another time", `{"client_id":"1.1","timestamp_micros":` + fmt.Sprint(ts+1) + `,"events":[` + events + `]}`, 9},
+		{"no timestamp", `{"client_id":"1.1","events":[` + firstEvent + `]}`, 10},
+		{"no timestamp again", `{"client_id":"1.1","events":[` + firstEvent + `]}`, 11},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodPost, "/mp/collect?measurement_id=G-TEST123&api_secret=secret", strings.NewReader(c.body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusNoContent {
+			t.Errorf("%s: got %d %s, want 204", c.name, w.Code, w.Body.String())
+		}
+
+		if err := tt.store.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		var n int
+		if err := tt.db.QueryRow(`SELECT COUNT(*) FROM events WHERE site_id = $1`, tt.siteID).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n != c.stored {
+			t.Errorf("%s: %d events stored, want %d", c.name, n, c.stored)
+		}
+	}
+}
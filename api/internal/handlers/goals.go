@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+
+	"trackveilapi/internal/apierror"
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/goals"
+	"trackveilapi/internal/models"
+	"trackveilapi/internal/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// GoalsHandler manages goal definitions and conversion reports
+type GoalsHandler struct {
+	db        *database.DB
+	store     storage.Store
+	evaluator *goals.Evaluator
+}
+
+// NewGoalsHandler creates a new goals handler
+func NewGoalsHandler(db *database.DB, store storage.Store, evaluator *goals.Evaluator) *GoalsHandler {
+	return &GoalsHandler{db: db, store: store, evaluator: evaluator}
+}
+
+// List handles GET /api/sites/:site_id/goals
+func (h *GoalsHandler) List(c *gin.Context) {
+	siteID := c.Param("site_id")
+
+	list, err := goals.ListGoals(h.db, siteID, false)
+	if err != nil {
+		log.Printf("Failed to list goals for site %s: %v", siteID, err)
+		apierror.Abort(c, http.StatusServiceUnavailable, apierror.CodeStorageUnavailable, "Database error")
+		return
+	}
+	if list == nil {
+		list = []models.Goal{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"goals": list})
+}
+
+// Create handles POST /api/sites/:site_id/goals
+func (h *GoalsHandler) Create(c *gin.Context) {
+	siteID := c.Param("site_id")
+
+	var goal models.Goal
+	if err := c.ShouldBindJSON(&goal); err != nil {
+		apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid request body")
+		return
+	}
+	goal.SiteID = siteID
+
+	if err := goals.Validate(&goal); err != nil {
+		apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, err.Error())
+		return
+	}
+
+	if err := goals.CreateGoal(h.db, &goal); err != nil {
+		log.Printf("Failed to create goal for site %s: %v", siteID, err)
+		apierror.Abort(c, http.StatusInternalServerError, apierror.CodeInternal, "Failed to create goal")
+		return
+	}
+	h.evaluator.Invalidate(siteID)
+
+	c.JSON(http.StatusCreated, goal)
+}
+
+// Delete handles DELETE /api/sites/:site_id/goals/:goal_id
+func (h *GoalsHandler) Delete(c *gin.Context) {
+	siteID := c.Param("site_id")
+
+	goalID, err := uuid.Parse(c.Param("goal_id"))
+	if err != nil {
+		apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid goal_id")
+		return
+	}
+
+	found, err := goals.DeleteGoal(h.db, siteID, goalID)
+	if err != nil {
+		log.Printf("Failed to delete goal %s: %v", goalID, err)
+		apierror.Abort(c, http.StatusInternalServerError, apierror.CodeInternal, "Failed to delete goal")
+		return
+	}
+	if !found {
+		apierror.Abort(c, http.StatusNotFound, apierror.CodeNotFound, "Goal not found")
+		return
+	}
+	h.evaluator.Invalidate(siteID)
+
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
+
+// Report handles GET /api/sites/:site_id/goals/report
+func (h *GoalsHandler) Report(c *gin.Context) {
+	siteID := c.Param("site_id")
+
+	from, to, err := parseTimeRange(c)
+	if err != nil {
+		apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, err.Error())
+		return
+	}
+
+	report, err := goals.BuildReport(h.db.ReadOnly(), h.store, siteID, from, to)
+	if err != nil {
+		log.Printf("Failed to build goals report for site %s: %v", siteID, err)
+		apierror.Abort(c, http.StatusServiceUnavailable, apierror.CodeStorageUnavailable, "Database error")
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"trackveilapi/internal/sinks"
+	"trackveilapi/internal/spool"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MetricsHandler exposes operational metrics in the Prometheus text format
+type MetricsHandler struct {
+	spool    *spool.Spool // nil if spooling is disabled
+	replayer *spool.Replayer
+	sinks    *sinks.Dispatcher // nil if no sink is configured
+}
+
+// NewMetricsHandler creates a new metrics handler
+func NewMetricsHandler(hitSpool *spool.Spool, replayer *spool.Replayer, dispatcher *sinks.Dispatcher) *MetricsHandler {
+	return &MetricsHandler{spool: hitSpool, replayer: replayer, sinks: dispatcher}
+}
+
+// Metrics handles GET /metrics
+func (h *MetricsHandler) Metrics(c *gin.Context) {
+	var b strings.Builder
+	if h.spool != nil {
+		stats := h.spool.Stats()
+		writeMetric(&b, "trackveil_spool_backlog_records", "gauge", "Spooled hits waiting to be replayed.", stats.Records)
+		writeMetric(&b, "trackveil_spool_backlog_bytes", "gauge", "Size of the spool segment files.", stats.Bytes)
+		writeMetric(&b, "trackveil_spool_segments", "gauge", "Spool segment files.", int64(stats.Segments))
+		writeMetric(&b, "trackveil_spool_appended_total", "counter", "Hits spooled while storage was unavailable.", stats.Appended)
+		writeMetric(&b, "trackveil_spool_rejected_total", "counter", "Hits lost because the spool was full.", stats.Rejected)
+		writeMetric(&b, "trackveil_spool_corrupt_total", "counter", "Damaged spool records found.", stats.Corrupt)
+		writeMetric(&b, "trackveil_spool_replayed_total", "counter", "Spooled hits stored by the replayer.", h.replayer.Replayed())
+		writeMetric(&b, "trackveil_spool_dropped_total", "counter", "Spooled hits dropped on replay.", h.replayer.Dropped())
+	}
+	if h.sinks != nil {
+		stats := h.sinks.Stats()
+		writeSinkMetric(&b, "trackveil_sink_queued", "gauge", "Hits waiting in the sink's queue.", stats,
+			func(s sinks.Stats) int64 { return int64(s.Queued) })
+		writeSinkMetric(&b, "trackveil_sink_delivered_total", "counter", "Hits delivered by the sink.", stats,
+			func(s sinks.Stats) int64 { return s.Delivered })
+		writeSinkMetric(&b, "trackveil_sink_dropped_total", "counter", "Hits dropped because the sink's queue was full.", stats,
+			func(s sinks.Stats) int64 { return s.Dropped })
+		writeSinkMetric(&b, "trackveil_sink_failed_total", "counter", "Hits the sink gave up delivering.", stats,
+			func(s sinks.Stats) int64 { return s.Failed })
+	}
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(b.String()))
+}
+
+func writeMetric(b *strings.Builder, name, kind, help string, value int64) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+}
+
+// writeSinkMetric writes a metric with a sample per sink
+func writeSinkMetric(b *strings.Builder, name, kind, help string, stats []sinks.Stats, value func(sinks.Stats) int64) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	for _, s := range stats {
+		fmt.Fprintf(b, "%s{sink=%q} %d\n", name, s.Sink, value(s))
+	}
+}
@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"trackveilapi/internal/apierror"
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultReportDays is the reporting window used when no range is given
+const defaultReportDays = 30
+
+// parseTimeRange reads the from/to query parameters (RFC 3339 or YYYY-MM-DD).
+// It defaults to the last 30 days ending now.
+func parseTimeRange(c *gin.Context) (time.Time, time.Time, error) {
+	to := time.Now().UTC()
+	if v := c.Query("to"); v != "" {
+		t, err := parseTime(v)
+		if err != nil {
+			return time.Time{}, time.Time{}, errors.New("invalid 'to' parameter")
+		}
+		to = t
+	}
+
+	from := to.AddDate(0, 0, -defaultReportDays)
+	if v := c.Query("from"); v != "" {
+		t, err := parseTime(v)
+		if err != nil {
+			return time.Time{}, time.Time{}, errors.New("invalid 'from' parameter")
+		}
+		from = t
+	}
+
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, errors.New("'from' must be before 'to'")
+	}
+
+	return from, to, nil
+}
+
+func parseTime(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", v)
+}
+
+// RequireSite validates the :site_id route parameter and checks that the site exists
+func RequireSite(db *database.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		siteID := c.Param("site_id")
+		if !models.ValidateSiteID(siteID) {
+			apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidSiteID, "Invalid site_id format")
+			return
+		}
+
+		exists, err := siteExists(db, siteID)
+		if err != nil {
+			apierror.Abort(c, http.StatusServiceUnavailable, apierror.CodeStorageUnavailable, "Database error")
+			return
+		}
+		if !exists {
+			apierror.Abort(c, http.StatusNotFound, apierror.CodeSiteNotFound, "Site not found")
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// siteExists reports whether a site with the ID exists
+func siteExists(db *database.DB, siteID string) (bool, error) {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM sites WHERE id = $1)", siteID).Scan(&exists)
+	return exists, err
+}
@@ -0,0 +1,221 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"trackveilapi/internal/apierror"
+	"trackveilapi/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// plausiblePageview is the event name Plausible uses for page views
+	plausiblePageview = "pageview"
+	// maxPlausibleBodyBytes caps the size of a Plausible event payload
+	maxPlausibleBodyBytes = 16 << 10
+)
+
+// plausibleEvent is the payload of Plausible's POST /api/event. The script
+// sends the short keys (n, u, d, r, w, p); the Events API uses the long ones.
+type plausibleEvent struct {
+	Name        string                 `json:"name"`
+	N           string                 `json:"n"`
+	URL         string                 `json:"url"`
+	U           string                 `json:"u"`
+	Domain      string                 `json:"domain"`
+	D           string                 `json:"d"`
+	Referrer    *string                `json:"referrer"`
+	R           *string                `json:"r"`
+	ScreenWidth int                    `json:"screen_width"`
+	W           int                    `json:"w"`
+	Props       map[string]interface{} `json:"props"`
+	P           json.RawMessage        `json:"p"`
+}
+
+// normalize folds the short keys into the long ones
+func (e *plausibleEvent) normalize() error {
+	e.Name = firstNonEmpty(e.Name, e.N)
+	e.URL = firstNonEmpty(e.URL, e.U)
+	e.Domain = firstNonEmpty(e.Domain, e.D)
+	if e.Referrer == nil {
+		e.Referrer = e.R
+	}
+	if e.ScreenWidth == 0 {
+		e.ScreenWidth = e.W
+	}
+
+	// The script sends p as a JSON-encoded string, the Events API as an object
+	if e.Props == nil && len(e.P) > 0 && string(e.P) != "null" {
+		raw := []byte(e.P)
+		var encoded string
+		if json.Unmarshal(raw, &encoded) == nil {
+			raw = []byte(encoded)
+		}
+		if err := json.Unmarshal(raw, &e.Props); err != nil {
+			return fmt.Errorf("invalid props")
+		}
+	}
+
+	return nil
+}
+
+// PlausibleEvent handles POST /api/event in Plausible's format so existing
+// snippets and integrations can switch by changing the script src or proxy target.
+// The domain is mapped to sites by domain; a comma-separated list records the hit for each site.
+func (h *TrackHandler) PlausibleEvent(c *gin.Context) {
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxPlausibleBodyBytes+1))
+	if err != nil || len(body) > maxPlausibleBodyBytes {
+		c.JSON(http.StatusBadRequest, gin.H{"errors": gin.H{"request": "invalid body"}})
+		return
+	}
+
+	var ev plausibleEvent
+	if err := json.Unmarshal(body, &ev); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"errors": gin.H{"request": "invalid JSON"}})
+		return
+	}
+	if err := ev.normalize(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"errors": gin.H{"props": err.Error()}})
+		return
+	}
+
+	switch {
+	case ev.Name == "":
+		c.JSON(http.StatusBadRequest, gin.H{"errors": gin.H{"name": "can't be blank"}})
+		return
+	case ev.URL == "":
+		c.JSON(http.StatusBadRequest, gin.H{"errors": gin.H{"url": "can't be blank"}})
+		return
+	case ev.Domain == "":
+		c.JSON(http.StatusBadRequest, gin.H{"errors": gin.H{"domain": "can't be blank"}})
+		return
+	}
+
+	req := models.TrackRequest{
+		PageURL:     ev.URL,
+		ScreenWidth: ev.ScreenWidth,
+	}
+	if ev.Referrer != nil {
+		req.Referrer = *ev.Referrer
+	}
+	if !strings.EqualFold(ev.Name, plausiblePageview) {
+		req.EventName = ev.Name
+		req.Props = models.StringifyProps(ev.Props)
+	}
+
+	// Plausible is cookieless: visitors are identified by IP and user agent
+	hc := hitContext{
+		ClientIP:  c.ClientIP(),
+		UserAgent: c.GetHeader("User-Agent"),
+		At:        time.Now(),
+		Endpoint:  c.FullPath(),
+		RequestID: apierror.RequestID(c),
+	}
+	hc.FingerprintHash = models.HashFingerprint(hc.ClientIP + "|" + hc.UserAgent)
+
+	var siteIDs []string
+	for _, domain := range strings.Split(ev.Domain, ",") {
+		siteID, siteDomain, err := h.siteForDomain(strings.TrimSpace(domain))
+		if err != nil {
+			hc.logf("Plausible domain lookup failed for %q: %v", domain, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"errors": gin.H{"request": "database error"}})
+			return
+		}
+		if siteID == "" {
+			// Plausible accepts events for unknown domains silently
+			continue
+		}
+		// Checked for every site before any is recorded, like /track
+		if h.enforceOrigin && !originMatches(hitSource(c.Request), siteDomain) {
+			c.JSON(http.StatusForbidden, gin.H{"errors": gin.H{"request": "origin does not match the site's domain"}})
+			return
+		}
+		siteIDs = append(siteIDs, siteID)
+	}
+
+	for _, siteID := range siteIDs {
+		siteReq := req
+		siteReq.SiteID = siteID
+		if _, herr := h.record(siteID, &siteReq, hc); herr != nil {
+			c.JSON(herr.status, gin.H{"errors": plausibleErrors(herr)})
+			return
+		}
+	}
+
+	c.String(http.StatusAccepted, "ok")
+}
+
+// plausibleErrors maps a hit error onto Plausible's errors object,
+// keyed by Plausible's own field names
+func plausibleErrors(herr *hitError) gin.H {
+	if len(herr.fields) == 0 {
+		return gin.H{"request": herr.message}
+	}
+	names := map[string]string{"page_url": "url", "event_name": "name"}
+	errs := gin.H{}
+	for _, fe := range herr.fields {
+		field, ok := names[fe.Field]
+		if !ok {
+			field = fe.Field
+		}
+		errs[field] = fe.Message
+	}
+	return errs
+}
+
+// siteForDomain finds the site registered for a domain, ignoring case and a
+// leading www, and returns its ID and registered domain. The ID is empty
+// when no site, or more than one, matches.
+func (h *TrackHandler) siteForDomain(domain string) (string, string, error) {
+	domain = strings.TrimPrefix(strings.ToLower(domain), "www.")
+	if domain == "" {
+		return "", "", nil
+	}
+
+	rows, err := h.db.Query(`
+		SELECT id, domain FROM sites
+		WHERE lower(domain) = $1 OR lower(domain) = 'www.' || $1
+		LIMIT 2
+	`, domain)
+	if err != nil {
+		return "", "", err
+	}
+	defer rows.Close()
+
+	var ids, siteDomains []string
+	for rows.Next() {
+		var id, siteDomain string
+		if err := rows.Scan(&id, &siteDomain); err != nil {
+			return "", "", err
+		}
+		ids = append(ids, id)
+		siteDomains = append(siteDomains, siteDomain)
+	}
+	if err := rows.Err(); err != nil {
+		return "", "", err
+	}
+
+	if len(ids) != 1 {
+		if len(ids) > 1 {
+			log.Printf("Plausible domain %q matches several sites; ignoring event", domain)
+		}
+		return "", "", nil
+	}
+	return ids[0], siteDomains[0], nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"trackveilapi/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// TestPlausibleEnforceOrigin checks that ENFORCE_SITE_ORIGIN applies to
+// /api/event, for every site of a comma-separated domain list
+func TestPlausibleEnforceOrigin(t *testing.T) {
+	tt := newTrackTest(t)
+	tt.handler.enforceOrigin = true
+	otherSiteID, err := models.GenerateSiteID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tt.db.Exec(`
+		INSERT INTO sites (id, account_id, name, domain)
+		SELECT $1, account_id, 'Other', 'other.org' FROM sites WHERE id = $2
+	`, otherSiteID, tt.siteID); err != nil {
+		t.Fatalf("create site: %v", err)
+	}
+	router := gin.New()
+	router.POST("/api/event", tt.handler.PlausibleEvent)
+
+	cases := []struct {
+		name     string
+		domain   string
+		origin   string
+		wantCode int
+		stored   int // page views of the example.com site so far
+	}{
+		{"matching origin", "example.com", "https://example.com", http.StatusAccepted, 1},
+		{"subdomain origin", "example.com", "https://blog.example.com", http.StatusAccepted, 2},
+		{"no origin", "example.com", "", http.StatusAccepted, 3},
+		{"forged origin", "example.com", "https://attacker.test", http.StatusForbidden, 3},
+		{"one site of several mismatched", "example.com,other.org", "https://example.com", http.StatusForbidden, 3},
+		{"unknown domain", "unknown.test", "https://attacker.test", http.StatusAccepted, 3},
+	}
+	for _, c := range cases {
+		body := `{"n":"pageview","u":"https://example.com/` + uuid.NewString() + `","d":"` + c.domain + `"}`
+		req := httptest.NewRequest(http.MethodPost, "/api/event", strings.NewReader(body))
+		req.Header.Set("Content-Type", "text/plain")
+		if c.origin != "" {
+			req.Header.Set("Origin", c.origin)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != c.wantCode {
+			t.Errorf("%s: got %d %s, want %d", c.name, w.Code, w.Body.String(), c.wantCode)
+		}
+
+		if err := tt.store.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		var n int
+		if err := tt.db.QueryRow(`SELECT COUNT(*) FROM page_views WHERE site_id = $1`, tt.siteID).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n != c.stored {
+			t.Errorf("%s: %d page views stored, want %d", c.name, n, c.stored)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"trackveilapi/internal/apierror"
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/models"
+	"trackveilapi/internal/retention"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// retentionPurgesShown is how many recent purges a site's retention lists
+const retentionPurgesShown = 50
+
+// RetentionHandler manages retention plans and per-site retention
+type RetentionHandler struct {
+	db       *database.DB
+	defaults models.RetentionPolicy
+}
+
+// NewRetentionHandler creates a new retention handler
+func NewRetentionHandler(db *database.DB, defaults models.RetentionPolicy) *RetentionHandler {
+	return &RetentionHandler{db: db, defaults: defaults}
+}
+
+type accountPlanRequest struct {
+	Plan *string `json:"plan"` // null removes the plan
+}
+
+// ListPlans handles GET /api/retention/plans
+func (h *RetentionHandler) ListPlans(c *gin.Context) {
+	plans, err := retention.ListPlans(h.db)
+	if err != nil {
+		log.Printf("Failed to list retention plans: %v", err)
+		apierror.Abort(c, http.StatusServiceUnavailable, apierror.CodeStorageUnavailable, "Database error")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"plans": plans, "defaults": retention.Resolve(models.RetentionPolicy{}, models.RetentionPolicy{}, h.defaults)})
+}
+
+// SavePlan handles PUT /api/retention/plans/:name
+func (h *RetentionHandler) SavePlan(c *gin.Context) {
+	plan := models.RetentionPlan{Name: c.Param("name")}
+	if err := retention.ValidatePlanName(plan.Name); err != nil {
+		apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, err.Error())
+		return
+	}
+	if err := c.ShouldBindJSON(&plan.RetentionPolicy); err != nil {
+		apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid request body")
+		return
+	}
+	if err := retention.Validate(&plan.RetentionPolicy); err != nil {
+		apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, err.Error())
+		return
+	}
+
+	if err := retention.SavePlan(h.db, &plan); err != nil {
+		log.Printf("Failed to save retention plan %s: %v", plan.Name, err)
+		apierror.Abort(c, http.StatusInternalServerError, apierror.CodeInternal, "Failed to save retention plan")
+		return
+	}
+
+	c.JSON(http.StatusOK, plan)
+}
+
+// DeletePlan handles DELETE /api/retention/plans/:name
+func (h *RetentionHandler) DeletePlan(c *gin.Context) {
+	name := c.Param("name")
+
+	err := retention.DeletePlan(h.db, name)
+	if errors.Is(err, retention.ErrPlanNotFound) {
+		apierror.Abort(c, http.StatusNotFound, apierror.CodeNotFound, "Retention plan not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to delete retention plan %s: %v", name, err)
+		apierror.Abort(c, http.StatusInternalServerError, apierror.CodeInternal, "Failed to delete retention plan")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
+
+// SetAccountPlan handles PUT /api/accounts/:account_id/retention
+func (h *RetentionHandler) SetAccountPlan(c *gin.Context) {
+	accountID, err := uuid.Parse(c.Param("account_id"))
+	if err != nil {
+		apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid account_id")
+		return
+	}
+
+	var req accountPlanRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid request body")
+		return
+	}
+
+	err = retention.SetAccountPlan(h.db, accountID, req.Plan)
+	if errors.Is(err, retention.ErrPlanNotFound) {
+		apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Unknown retention plan")
+		return
+	}
+	if errors.Is(err, retention.ErrAccountNotFound) {
+		apierror.Abort(c, http.StatusNotFound, apierror.CodeNotFound, "Account not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to set retention plan of account %s: %v", accountID, err)
+		apierror.Abort(c, http.StatusInternalServerError, apierror.CodeInternal, "Failed to set retention plan")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"account_id": accountID, "plan": req.Plan})
+}
+
+// GetSite handles GET /api/sites/:site_id/retention
+func (h *RetentionHandler) GetSite(c *gin.Context) {
+	h.respondSite(c, c.Param("site_id"))
+}
+
+// UpdateSite handles PUT /api/sites/:site_id/retention
+func (h *RetentionHandler) UpdateSite(c *gin.Context) {
+	siteID := c.Param("site_id")
+
+	var overrides models.RetentionPolicy
+	if err := c.ShouldBindJSON(&overrides); err != nil {
+		apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid request body")
+		return
+	}
+	if err := retention.Validate(&overrides); err != nil {
+		apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, err.Error())
+		return
+	}
+
+	if err := retention.SaveSite(h.db, siteID, &overrides); err != nil {
+		log.Printf("Failed to save retention for site %s: %v", siteID, err)
+		apierror.Abort(c, http.StatusInternalServerError, apierror.CodeInternal, "Failed to save retention")
+		return
+	}
+
+	h.respondSite(c, siteID)
+}
+
+// respondSite returns a site's retention with its recent purges
+func (h *RetentionHandler) respondSite(c *gin.Context, siteID string) {
+	site, err := retention.GetSite(h.db, siteID, h.defaults)
+	if err != nil {
+		log.Printf("Failed to load retention for site %s: %v", siteID, err)
+		apierror.Abort(c, http.StatusServiceUnavailable, apierror.CodeStorageUnavailable, "Database error")
+		return
+	}
+	purges, err := retention.Purges(h.db, siteID, retentionPurgesShown)
+	if err != nil {
+		log.Printf("Failed to load retention purges for site %s: %v", siteID, err)
+		apierror.Abort(c, http.StatusServiceUnavailable, apierror.CodeStorageUnavailable, "Database error")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"retention": site, "purges": purges})
+}
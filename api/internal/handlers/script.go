@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"trackveilapi/internal/apierror"
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/domains"
+	"trackveilapi/internal/models"
+	"trackveilapi/internal/script"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Cache lifetimes of the served tracker
+const (
+	scriptCacheImmutable = "public, max-age=31536000, immutable"
+	scriptCacheShort     = "public, max-age=300"
+)
+
+// ScriptHandler serves tracker.js with per-site settings
+type ScriptHandler struct {
+	db        *database.DB
+	scripts   *script.Server
+	publicURL string // external base URL of the API
+}
+
+// NewScriptHandler creates a new script handler
+func NewScriptHandler(db *database.DB, scripts *script.Server, publicURL string) *ScriptHandler {
+	return &ScriptHandler{db: db, scripts: scripts, publicURL: strings.TrimSuffix(publicURL, "/")}
+}
+
+type trackerSettingsRequest struct {
+	Endpoint      string   `json:"endpoint"`
+	SPAMode       bool     `json:"spa_mode"`
+	PrivacyMode   bool     `json:"privacy_mode"`
+	ExcludedPaths []string `json:"excluded_paths"`
+}
+
+// Tracker handles GET /tracker.js: the tracker without site settings,
+// configured through the data-site-id attribute. On a custom domain it is
+// the site's own script.
+func (h *ScriptHandler) Tracker(c *gin.Context) {
+	var asset *script.Asset
+	var err error
+	if siteID := customDomainSite(c); siteID != "" {
+		asset, err = h.scripts.ForSite(siteID, h.baseURL(c)+"/track")
+	} else {
+		asset, err = h.scripts.Generic(h.baseURL(c) + "/track")
+	}
+	if err != nil {
+		log.Printf("Failed to render tracker: %v", err)
+		apierror.Abort(c, http.StatusInternalServerError, apierror.CodeInternal, "Failed to render tracker")
+		return
+	}
+	asset.Write(c.Writer, c.Request, scriptCacheShort)
+}
+
+// SiteScript handles GET /js/:file, where file is <site_id>.js or the
+// versioned <site_id>.<version>.js (and tracker.js / tracker.<version>.js for
+// the generic script). Versioned URLs of the current version are immutable.
+func (h *ScriptHandler) SiteScript(c *gin.Context) {
+	name, ok := strings.CutSuffix(c.Param("file"), ".js")
+	if !ok {
+		apierror.Abort(c, http.StatusNotFound, apierror.CodeNotFound, "Script not found")
+		return
+	}
+	name, version, _ := strings.Cut(name, ".")
+
+	// A custom domain only serves its own site's script
+	if domainSite := customDomainSite(c); domainSite != "" {
+		if name == "tracker" {
+			name = domainSite
+		} else if name != domainSite {
+			apierror.Abort(c, http.StatusNotFound, apierror.CodeSiteNotFound, "Site not found")
+			return
+		}
+	}
+
+	var asset *script.Asset
+	var err error
+	if name == "tracker" {
+		asset, err = h.scripts.Generic(h.baseURL(c) + "/track")
+	} else {
+		if !models.ValidateSiteID(name) {
+			apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidSiteID, "Invalid site_id format")
+			return
+		}
+		if exists, lookupErr := siteExists(h.db, name); lookupErr != nil {
+			log.Printf("Site lookup failed for %s: %v", name, lookupErr)
+			apierror.Abort(c, http.StatusServiceUnavailable, apierror.CodeStorageUnavailable, "Database error")
+			return
+		} else if !exists {
+			apierror.Abort(c, http.StatusNotFound, apierror.CodeSiteNotFound, "Site not found")
+			return
+		}
+		asset, err = h.scripts.ForSite(name, h.baseURL(c)+"/track")
+	}
+	if err != nil {
+		log.Printf("Failed to render tracker for %s: %v", name, err)
+		apierror.Abort(c, http.StatusServiceUnavailable, apierror.CodeStorageUnavailable, "Failed to render tracker")
+		return
+	}
+
+	// An outdated version is served with the current script, but must not be cached for long
+	cacheControl := scriptCacheShort
+	if version != "" && version == asset.Version {
+		cacheControl = scriptCacheImmutable
+	}
+	asset.Write(c.Writer, c.Request, cacheControl)
+}
+
+// GetSettings handles GET /api/sites/:site_id/tracker
+func (h *ScriptHandler) GetSettings(c *gin.Context) {
+	siteID := c.Param("site_id")
+
+	settings, err := script.GetSettings(h.db, siteID)
+	if err != nil {
+		log.Printf("Failed to load tracker settings for site %s: %v", siteID, err)
+		apierror.Abort(c, http.StatusServiceUnavailable, apierror.CodeStorageUnavailable, "Database error")
+		return
+	}
+
+	h.respondSettings(c, http.StatusOK, settings)
+}
+
+// UpdateSettings handles PUT /api/sites/:site_id/tracker
+func (h *ScriptHandler) UpdateSettings(c *gin.Context) {
+	siteID := c.Param("site_id")
+
+	var req trackerSettingsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid request body")
+		return
+	}
+
+	settings := &models.TrackerSettings{
+		SiteID:        siteID,
+		Endpoint:      req.Endpoint,
+		SPAMode:       req.SPAMode,
+		PrivacyMode:   req.PrivacyMode,
+		ExcludedPaths: req.ExcludedPaths,
+	}
+	if err := script.Validate(settings); err != nil {
+		apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, err.Error())
+		return
+	}
+
+	if err := script.SaveSettings(h.db, settings); err != nil {
+		log.Printf("Failed to save tracker settings for site %s: %v", siteID, err)
+		apierror.Abort(c, http.StatusInternalServerError, apierror.CodeInternal, "Failed to save tracker settings")
+		return
+	}
+	h.scripts.Invalidate(siteID)
+
+	h.respondSettings(c, http.StatusOK, settings)
+}
+
+// respondSettings returns the settings with the current versioned script URL and snippet
+func (h *ScriptHandler) respondSettings(c *gin.Context, status int, settings *models.TrackerSettings) {
+	base := h.baseURL(c)
+	asset, err := h.scripts.ForSite(settings.SiteID, base+"/track")
+	if err != nil {
+		log.Printf("Failed to render tracker for %s: %v", settings.SiteID, err)
+		apierror.Abort(c, http.StatusServiceUnavailable, apierror.CodeStorageUnavailable, "Failed to render tracker")
+		return
+	}
+
+	c.JSON(status, gin.H{
+		"settings":   settings,
+		"script_url": fmt.Sprintf("%s/js/%s.%s.js", base, settings.SiteID, asset.Version),
+		"snippet":    fmt.Sprintf(`<script async src="%s/js/%s.js"></script>`, base, settings.SiteID),
+	})
+}
+
+// baseURL is the external URL of the API. On a custom domain it is always
+// that domain, so hits stay first-party. It never comes from an unverified
+// Host header, since it is embedded in cached scripts.
+func (h *ScriptHandler) baseURL(c *gin.Context) string {
+	if customDomainSite(c) != "" {
+		// The resolver only matched the host because it is registered
+		return "https://" + domains.Normalize(c.Request.Host)
+	}
+	return h.publicURL
+}
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"trackveilapi/internal/domains"
+	"trackveilapi/internal/script"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestScriptBaseURL checks that the endpoint in served scripts and snippets
+// comes from API_PUBLIC_URL or a registered custom domain, whatever the
+// Host and X-Forwarded-Proto headers say
+func TestScriptBaseURL(t *testing.T) {
+	tt := newTrackTest(t)
+	if _, err := domains.Create(tt.db, tt.siteID, "stats.example.com"); err != nil {
+		t.Fatalf("create custom domain: %v", err)
+	}
+
+	h := NewScriptHandler(tt.db, script.NewServer(tt.db), "https://api.example.net/")
+	resolver := domains.NewResolver(tt.db)
+	router := gin.New()
+	router.GET("/tracker.js", CustomDomain(resolver), h.Tracker)
+	router.GET("/js/:file", CustomDomain(resolver), h.SiteScript)
+	router.GET("/api/sites/:site_id/tracker", h.GetSettings)
+
+	cases := []struct {
+		path, host, proto string
+		want              string
+	}{
+		{"/tracker.js", "api.example.net", "", "https://api.example.net/track"},
+		{"/tracker.js", "evil.example.org", "", "https://api.example.net/track"},
+		{"/js/" + tt.siteID + ".js", "evil.example.org", "http", "https://api.example.net/track"},
+		{"/js/tracker.js", "evil.example.org:8080", "", "https://api.example.net/track"},
+		{"/tracker.js", "stats.example.com", "", "https://stats.example.com/track"},
+		{"/js/tracker.js", "Stats.Example.com:443", "http", "https://stats.example.com/track"},
+		{"/js/" + tt.siteID + ".js", "stats.example.com.", "", "https://stats.example.com/track"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, c.path, nil)
+		req.Host = c.host
+		if c.proto != "" {
+			req.Header.Set("X-Forwarded-Proto", c.proto)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s on %s: status %d", c.path, c.host, w.Code)
+			continue
+		}
+		if body := w.Body.String(); !strings.Contains(body, c.want) || strings.Contains(body, "evil") {
+			t.Errorf("%s on %s: script does not use the endpoint %s", c.path, c.host, c.want)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/sites/"+tt.siteID+"/tracker", nil)
+	req.Host = "evil.example.org"
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var resp struct {
+		ScriptURL string `json:"script_url"`
+		Snippet   string `json:"snippet"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("settings: status %d, %v", w.Code, err)
+	}
+	if !strings.HasPrefix(resp.ScriptURL, "https://api.example.net/js/"+tt.siteID+".") {
+		t.Errorf("script_url %q", resp.ScriptURL)
+	}
+	if !strings.Contains(resp.Snippet, `src="https://api.example.net/js/`+tt.siteID+`.js"`) {
+		t.Errorf("snippet %q", resp.Snippet)
+	}
+}
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"trackveilapi/internal/apierror"
+	"trackveilapi/internal/apikeys"
+	"trackveilapi/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// maxServerBodyBytes caps the size of a server-side tracking request
+	maxServerBodyBytes = 64 << 10
+	// maxServerBackdate is how far in the past a server hit may be timestamped
+	maxServerBackdate = 7 * 24 * time.Hour
+)
+
+// ServerTrack handles POST /track/server requests from customer backends.
+// The request is authenticated with a per-site key and may override the
+// client IP, user agent, timestamp and visitor identifier.
+func (h *TrackHandler) ServerTrack(c *gin.Context) {
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxServerBodyBytes+1))
+	if err != nil {
+		apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid request body")
+		return
+	}
+	if len(body) > maxServerBodyBytes {
+		apierror.Abort(c, http.StatusRequestEntityTooLarge, apierror.CodePayloadTooLarge, "Request body too large")
+		return
+	}
+
+	key, err := apikeys.Authenticate(h.db, h.dedup, c.Request, body)
+	if errors.Is(err, apikeys.ErrReplayed) {
+		apierror.Abort(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Request nonce already used")
+		return
+	}
+	if errors.Is(err, apikeys.ErrUnauthorized) {
+		apierror.Abort(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid or missing API key")
+		return
+	}
+	if err != nil {
+		log.Printf("API key lookup failed: %v", err)
+		apierror.Abort(c, http.StatusServiceUnavailable, apierror.CodeStorageUnavailable, "Database error")
+		return
+	}
+
+	var req models.ServerTrackRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid request body")
+		return
+	}
+	if req.SiteID != "" && req.SiteID != key.SiteID {
+		apierror.Abort(c, http.StatusForbidden, apierror.CodeForbidden, "site_id does not match API key")
+		return
+	}
+	if req.PageURL == "" {
+		apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "page_url is required")
+		return
+	}
+
+	now := time.Now()
+	hc := hitContext{
+		ClientIP:  c.ClientIP(),
+		UserAgent: c.GetHeader("User-Agent"),
+		At:        now,
+		Endpoint:  c.FullPath(),
+		RequestID: apierror.RequestID(c),
+	}
+
+	if req.ClientIP != "" {
+		if net.ParseIP(req.ClientIP) == nil {
+			apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid client_ip")
+			return
+		}
+		hc.ClientIP = req.ClientIP
+	}
+	if req.UserAgent != "" {
+		hc.UserAgent = req.UserAgent
+	}
+	if req.Timestamp != nil {
+		if req.Timestamp.After(now.Add(apikeys.MaxClockSkew)) || req.Timestamp.Before(now.Add(-maxServerBackdate)) {
+			apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "timestamp is outside the accepted range")
+			return
+		}
+		hc.At = *req.Timestamp
+	}
+
+	// Visitor identity: explicit visitor_id, then a forwarded tracker
+	// fingerprint, otherwise the client IP and user agent
+	switch {
+	case req.VisitorID != "":
+		hc.FingerprintHash = models.HashFingerprint(req.VisitorID)
+	case req.Fingerprint != "":
+		hc.FingerprintHash = models.HashFingerprint(req.Fingerprint)
+	default:
+		hc.FingerprintHash = models.HashFingerprint(hc.ClientIP + "|" + hc.UserAgent)
+	}
+
+	duplicate, herr := h.record(key.SiteID, &req.TrackRequest, hc)
+	if herr != nil {
+		herr.abort(c)
+		return
+	}
+
+	status := "success"
+	if duplicate {
+		status = "duplicate"
+	}
+	c.JSON(http.StatusOK, gin.H{"status": status})
+}
@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"trackveilapi/internal/apierror"
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/models"
+	"trackveilapi/internal/sinks"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SinksHandler enables streaming sinks per site
+type SinksHandler struct {
+	db         *database.DB
+	dispatcher *sinks.Dispatcher // nil if no sink is configured
+}
+
+// NewSinksHandler creates a new sinks handler
+func NewSinksHandler(db *database.DB, dispatcher *sinks.Dispatcher) *SinksHandler {
+	return &SinksHandler{db: db, dispatcher: dispatcher}
+}
+
+type siteSinkRequest struct {
+	HitTypes   []string `json:"hit_types"`
+	EventNames []string `json:"event_names"`
+}
+
+// List handles GET /api/sites/:site_id/sinks
+func (h *SinksHandler) List(c *gin.Context) {
+	siteID := c.Param("site_id")
+
+	enabled, err := sinks.List(h.db, siteID)
+	if err != nil {
+		log.Printf("Failed to list sinks for site %s: %v", siteID, err)
+		apierror.Abort(c, http.StatusServiceUnavailable, apierror.CodeStorageUnavailable, "Database error")
+		return
+	}
+
+	// Sinks configured on this server; others can be enabled but receive nothing here
+	configured := []string{}
+	if h.dispatcher != nil {
+		configured = h.dispatcher.Sinks()
+	}
+	c.JSON(http.StatusOK, gin.H{"sinks": enabled, "configured": configured})
+}
+
+// Save handles PUT /api/sites/:site_id/sinks/:sink
+func (h *SinksHandler) Save(c *gin.Context) {
+	siteID := c.Param("site_id")
+
+	var req siteSinkRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid request body")
+		return
+	}
+	s := &models.SiteSink{SiteID: siteID, Sink: c.Param("sink"), HitTypes: req.HitTypes, EventNames: req.EventNames}
+	if err := sinks.Validate(s); err != nil {
+		apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, err.Error())
+		return
+	}
+
+	if err := sinks.Save(h.db, s); err != nil {
+		log.Printf("Failed to save sink %s for site %s: %v", s.Sink, siteID, err)
+		apierror.Abort(c, http.StatusInternalServerError, apierror.CodeInternal, "Failed to save sink")
+		return
+	}
+	h.reload()
+
+	c.JSON(http.StatusOK, s)
+}
+
+// Delete handles DELETE /api/sites/:site_id/sinks/:sink
+func (h *SinksHandler) Delete(c *gin.Context) {
+	siteID, sink := c.Param("site_id"), c.Param("sink")
+
+	err := sinks.Delete(h.db, siteID, sink)
+	if errors.Is(err, sinks.ErrNotEnabled) {
+		apierror.Abort(c, http.StatusNotFound, apierror.CodeNotFound, "Sink not enabled")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to delete sink %s for site %s: %v", sink, siteID, err)
+		apierror.Abort(c, http.StatusInternalServerError, apierror.CodeInternal, "Failed to delete sink")
+		return
+	}
+	h.reload()
+
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
+
+// reload applies a change on this instance now; others pick it up on their
+// next reload
+func (h *SinksHandler) reload() {
+	if h.dispatcher == nil {
+		return
+	}
+	if err := h.dispatcher.Reload(); err != nil {
+		log.Printf("Failed to reload site sinks: %v", err)
+	}
+}
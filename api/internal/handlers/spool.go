@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"trackveilapi/internal/apierror"
+	"trackveilapi/internal/models"
+	"trackveilapi/internal/spool"
+
+	"github.com/google/uuid"
+)
+
+// spooledHit is a browser hit queued while storage was unavailable
+type spooledHit struct {
+	// ReplayID is claimed when the hit is replayed, so a record read again
+	// after a crash is not stored twice
+	ReplayID string              `json:"replay_id"`
+	Request  models.TrackRequest `json:"request"`
+	Context  hitContext          `json:"context"`
+	Source   string              `json:"source"` // Origin or Referer, checked on replay
+}
+
+// spoolHit queues a browser hit for replay, reporting whether it was queued
+func (h *TrackHandler) spoolHit(req *models.TrackRequest, hc hitContext, source string) bool {
+	if h.spool == nil {
+		return false
+	}
+	payload, err := json.Marshal(spooledHit{
+		ReplayID: uuid.NewString(),
+		Request:  *req,
+		Context:  hc,
+		Source:   source,
+	})
+	if err == nil {
+		err = h.spool.Append(payload)
+	}
+	if err != nil {
+		hc.logf("Failed to spool hit for site %s: %v", req.SiteID, err)
+		return false
+	}
+	return true
+}
+
+// Replay stores a spooled hit. Hits that would now be rejected, e.g. for a
+// deleted site, are dropped with spool.ErrDrop; other errors leave the hit
+// queued.
+func (h *TrackHandler) Replay(payload []byte) error {
+	var hit spooledHit
+	if err := json.Unmarshal(payload, &hit); err != nil {
+		return fmt.Errorf("%w: invalid spooled hit: %v", spool.ErrDrop, err)
+	}
+	siteID := hit.Request.SiteID
+
+	var domain string
+	err := h.db.QueryRow("SELECT domain FROM sites WHERE id = $1", siteID).Scan(&domain)
+	if err == sql.ErrNoRows {
+		hit.Context.logf("Dropped spooled hit for unknown site %s", siteID)
+		return spool.ErrDrop
+	}
+	if err != nil {
+		return fmt.Errorf("site lookup failed for %s: %w", siteID, err)
+	}
+	if h.enforceOrigin && !originMatches(hit.Source, domain) {
+		hit.Context.logf("Dropped spooled hit for site %s: origin does not match", siteID)
+		return spool.ErrDrop
+	}
+
+	replayID := "spool:" + hit.ReplayID
+	ok, err := h.dedup.Claim(siteID, replayID)
+	if err != nil {
+		return fmt.Errorf("replay ID claim failed for site %s: %w", siteID, err)
+	}
+	if !ok {
+		return nil // replayed before the spool cursor was saved
+	}
+
+	if _, herr := h.record(siteID, &hit.Request, hit.Context); herr != nil {
+		if herr.status == http.StatusServiceUnavailable {
+			h.dedup.Release(siteID, replayID)
+			return fmt.Errorf("failed to replay hit for site %s: %s", siteID, herr.message)
+		}
+		if herr.code != apierror.CodeHitRejected { // otherwise kept as a dead letter
+			hit.Context.logf("Dropped spooled hit for site %s: %s", siteID, herr.message)
+		}
+		return spool.ErrDrop
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"trackveilapi/internal/apierror"
+	"trackveilapi/internal/rollups"
+	"trackveilapi/internal/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultBreakdownLimit = 10
+	maxBreakdownLimit     = 1000
+)
+
+// StatsHandler serves traffic statistics from the storage backend
+type StatsHandler struct {
+	store storage.Store
+}
+
+// NewStatsHandler creates a new stats handler
+func NewStatsHandler(store storage.Store) *StatsHandler {
+	return &StatsHandler{store: store}
+}
+
+// Stats handles GET /api/sites/:site_id/stats
+// Query parameters: from, to, interval (hour or day), filter (dimension:value, repeatable)
+func (h *StatsHandler) Stats(c *gin.Context) {
+	siteID := c.Param("site_id")
+
+	from, to, err := parseTimeRange(c)
+	if err != nil {
+		apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, err.Error())
+		return
+	}
+
+	interval := c.DefaultQuery("interval", rollups.IntervalDay)
+	if interval != rollups.IntervalHour && interval != rollups.IntervalDay {
+		apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "interval must be 'hour' or 'day'")
+		return
+	}
+
+	filter, err := parseFilter(c.QueryArray("filter"))
+	if err != nil {
+		apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, err.Error())
+		return
+	}
+
+	stats, err := h.store.Stats(siteID, from, to, interval, filter)
+	if err != nil {
+		log.Printf("Failed to load stats for site %s: %v", siteID, err)
+		apierror.Abort(c, http.StatusServiceUnavailable, apierror.CodeStorageUnavailable, "Database error")
+		return
+	}
+
+	c.JSON(http.StatusOK, stats)
+}
+
+// Breakdown handles GET /api/sites/:site_id/stats/:dimension
+// Query parameters: from, to, limit
+func (h *StatsHandler) Breakdown(c *gin.Context) {
+	siteID := c.Param("site_id")
+
+	dimension := c.Param("dimension")
+	if !rollups.ValidDimension(dimension) {
+		apierror.Abort(c, http.StatusNotFound, apierror.CodeNotFound, "Unknown dimension")
+		return
+	}
+
+	from, to, err := parseTimeRange(c)
+	if err != nil {
+		apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, err.Error())
+		return
+	}
+
+	limit := defaultBreakdownLimit
+	if v := c.Query("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxBreakdownLimit {
+			apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "limit must be between 1 and 1000")
+			return
+		}
+	}
+
+	breakdown, err := h.store.Breakdown(siteID, dimension, from, to, limit)
+	if err != nil {
+		log.Printf("Failed to load %s breakdown for site %s: %v", dimension, siteID, err)
+		apierror.Abort(c, http.StatusServiceUnavailable, apierror.CodeStorageUnavailable, "Database error")
+		return
+	}
+
+	c.JSON(http.StatusOK, breakdown)
+}
+
+// parseFilter parses dimension:value filters. Visitor sketches can only be
+// merged (a union), so all filters must use the same dimension.
+func parseFilter(params []string) (*rollups.Filter, error) {
+	if len(params) == 0 {
+		return nil, nil
+	}
+
+	filter := &rollups.Filter{}
+	for _, p := range params {
+		dimension, value, ok := strings.Cut(p, ":")
+		if !ok || !rollups.ValidDimension(dimension) {
+			return nil, errors.New("filter must be dimension:value with a known dimension")
+		}
+		if filter.Dimension != "" && filter.Dimension != dimension {
+			return nil, errors.New("filters must all use the same dimension")
+		}
+		filter.Dimension = dimension
+		filter.Values = append(filter.Values, value)
+	}
+	return filter, nil
+}
@@ -1,29 +1,44 @@
 package handlers
 
 import (
-	"crypto/sha256"
 	"database/sql"
-	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
+	"trackveilapi/internal/apierror"
 	"trackveilapi/internal/database"
+	"trackveilapi/internal/dedup"
+	"trackveilapi/internal/goals"
 	"trackveilapi/internal/models"
+	"trackveilapi/internal/sinks"
+	"trackveilapi/internal/spool"
+	"trackveilapi/internal/storage"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
-	"github.com/mssola/user_agent"
 )
 
 // TrackHandler handles incoming tracking requests
 type TrackHandler struct {
-	db *database.DB
+	db            *database.DB
+	store         storage.Store // page views and events
+	goals         *goals.Evaluator
+	dedup         *dedup.Deduplicator
+	enforceOrigin bool              // reject browser hits whose Origin/Referer is not the site's domain
+	spool         *spool.Spool      // browser hits while storage is unavailable, nil to fail them
+	deadLetters   bool              // keep hits the database rejects; off while re-ingesting them
+	sinks         *sinks.Dispatcher // streams stored hits, nil if no sink is configured
 }
 
 // NewTrackHandler creates a new track handler
-func NewTrackHandler(db *database.DB) *TrackHandler {
-	return &TrackHandler{db: db}
+func NewTrackHandler(db *database.DB, store storage.Store, evaluator *goals.Evaluator, deduplicator *dedup.Deduplicator, enforceOrigin bool, hitSpool *spool.Spool, dispatcher *sinks.Dispatcher) *TrackHandler {
+	return &TrackHandler{db: db, store: store, goals: evaluator, dedup: deduplicator, enforceOrigin: enforceOrigin, spool: hitSpool, deadLetters: true, sinks: dispatcher}
 }
 
 // Track handles POST /track requests
@@ -32,12 +47,27 @@ func (h *TrackHandler) Track(c *gin.Context) {
 
 	// Handle both POST (JSON) and GET (query params) for service worker compatibility
 	if c.Request.Method == "GET" {
+		if len(c.Request.URL.RawQuery) > models.MaxTrackBodyBytes {
+			apierror.Abort(c, http.StatusRequestURITooLong, apierror.CodePayloadTooLarge, "Request too large")
+			return
+		}
+
 		// Parse from query parameters (image pixel fallback)
 		req.SiteID = c.Query("site_id")
 		req.PageURL = c.Query("page_url")
 		req.PageTitle = c.Query("page_title")
 		req.Referrer = c.Query("referrer")
 		req.Fingerprint = c.Query("fingerprint")
+		req.EventName = c.Query("event_name")
+		req.EventID = c.Query("event_id")
+
+		// Event properties are sent as a JSON object
+		if props := c.Query("props"); props != "" {
+			if err := json.Unmarshal([]byte(props), &req.Props); err != nil {
+				apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid props")
+				return
+			}
+		}
 
 		// Parse numeric fields
 		if sw := c.Query("screen_width"); sw != "" {
@@ -57,97 +87,311 @@ func (h *TrackHandler) Track(c *gin.Context) {
 		}
 	} else {
 		// Parse from JSON body (normal POST request)
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, models.MaxTrackBodyBytes)
 		if err := c.ShouldBindJSON(&req); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				apierror.Abort(c, http.StatusRequestEntityTooLarge, apierror.CodePayloadTooLarge, "Request body too large")
+				return
+			}
+			apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid request body")
+			return
+		}
+	}
+
+	// On a custom domain the site comes from the Host header
+	if domainSite := customDomainSite(c); domainSite != "" {
+		if req.SiteID == "" {
+			req.SiteID = domainSite
+		} else if req.SiteID != domainSite {
+			apierror.Abort(c, http.StatusForbidden, apierror.CodeForbidden, "site_id does not belong to this domain")
 			return
 		}
 	}
 
 	// Validate site_id format
 	if !models.ValidateSiteID(req.SiteID) {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid site_id format"})
+		apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidSiteID, "Invalid site_id format")
 		return
 	}
 
 	siteID := req.SiteID
 
+	// Browser hits always use the connection's IP, user agent and the current time
+	hc := hitContext{
+		ClientIP:  c.ClientIP(),
+		UserAgent: c.GetHeader("User-Agent"),
+		At:        time.Now(),
+		Endpoint:  c.FullPath(),
+		RequestID: apierror.RequestID(c),
+	}
+
+	// Privacy mode trackers send no fingerprint; identify them like Plausible does
+	if req.Fingerprint != "" {
+		hc.FingerprintHash = models.HashFingerprint(req.Fingerprint)
+	} else {
+		hc.FingerprintHash = models.HashFingerprint(hc.ClientIP + "|" + hc.UserAgent)
+	}
+
 	// Verify site exists
-	var siteExists bool
-	err := h.db.QueryRow("SELECT EXISTS(SELECT 1 FROM sites WHERE id = $1)", siteID).Scan(&siteExists)
+	var domain string
+	err := h.db.QueryRow("SELECT domain FROM sites WHERE id = $1", siteID).Scan(&domain)
+	if err == sql.ErrNoRows {
+		apierror.Abort(c, http.StatusNotFound, apierror.CodeSiteNotFound, "Site not found")
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		hc.logf("Site lookup failed for %s: %v", siteID, err)
+		if h.spoolHit(&req, hc, hitSource(c.Request)) {
+			trackResponse(c, "queued")
+			return
+		}
+		apierror.Abort(c, http.StatusServiceUnavailable, apierror.CodeStorageUnavailable, "Database error")
 		return
 	}
-	if !siteExists {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Site not found"})
+
+	if h.enforceOrigin && !originMatches(hitSource(c.Request), domain) {
+		apierror.Abort(c, http.StatusForbidden, apierror.CodeOriginMismatch, "Origin does not match the site's domain")
 		return
 	}
 
-	// Get client IP
-	clientIP := c.ClientIP()
+	duplicate, herr := h.record(siteID, &req, hc)
+	if herr != nil {
+		if herr.status == http.StatusServiceUnavailable && h.spoolHit(&req, hc, hitSource(c.Request)) {
+			trackResponse(c, "queued")
+			return
+		}
+		herr.abort(c)
+		return
+	}
 
-	// Get user agent
-	userAgentStr := c.GetHeader("User-Agent")
+	// A suppressed retry is still a success
+	if duplicate {
+		trackResponse(c, "duplicate")
+	} else {
+		trackResponse(c, "")
+	}
+}
+
+// trackResponse answers a browser hit with the pixel for GET requests and
+// JSON otherwise. An empty result is a stored hit.
+func trackResponse(c *gin.Context, result string) {
+	if c.Request.Method == "GET" {
+		// For image pixel requests, return a 1x1 transparent GIF
+		if result == "" {
+			result = "ok"
+		}
+		apierror.Pixel(c, result)
+		return
+	}
+	if result == "" {
+		result = "success"
+	}
+	c.JSON(http.StatusOK, gin.H{"status": result})
+}
+
+// hitSource returns where a browser hit comes from: the Origin header,
+// else the Referer, or "" if it sends neither
+func hitSource(r *http.Request) string {
+	source := r.Header.Get("Origin")
+	if source == "" || source == "null" {
+		source = r.Referer()
+	}
+	return source
+}
+
+// originMatches reports whether a browser hit's source is the site's domain
+// or one of its subdomains. Hits with no source (e.g. Referrer-Policy:
+// no-referrer) are allowed.
+func originMatches(source, domain string) bool {
+	if source == "" {
+		return true
+	}
+
+	u, err := url.Parse(source)
+	if err != nil || u.Hostname() == "" {
+		return false
+	}
 
-	// Hash the fingerprint
-	fingerprintHash := hashFingerprint(req.Fingerprint)
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	domain = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(domain)), "www.")
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// hitContext is the request metadata of a hit. Only server-side tracking
+// may set it from the request body; browser hits take it from the connection.
+type hitContext struct {
+	ClientIP        string
+	UserAgent       string
+	At              time.Time
+	FingerprintHash string
+	Endpoint        string // route the hit arrived at, kept with dead letters
+	RequestID       string // of the request that delivered the hit, kept with spooled hits
+}
+
+// logf logs a line about the hit, prefixed with its request ID like the
+// access log ("-" for hits without one, e.g. reingested dead letters)
+func (hc hitContext) logf(format string, args ...interface{}) {
+	id := hc.RequestID
+	if id == "" {
+		id = "-"
+	}
+	log.Printf("%s "+format, append([]interface{}{id}, args...)...)
+}
+
+// hitError is a failure to record a hit, with the response to send
+type hitError struct {
+	status  int
+	code    apierror.Code
+	message string
+	fields  models.ValidationErrors
+	cause   error // of a storage failure
+}
+
+// abort sends the error response, with field-level errors if any
+func (e *hitError) abort(c *gin.Context) {
+	if len(e.fields) == 0 {
+		apierror.Abort(c, e.status, e.code, e.message)
+		return
+	}
+	apierror.AbortWithFields(c, e.status, e.code, e.message, e.fields)
+}
+
+// record stores a hit for an existing site and evaluates goals. It reports
+// whether the hit was suppressed as a duplicate instead of being stored.
+func (h *TrackHandler) record(siteID string, req *models.TrackRequest, hc hitContext) (bool, *hitError) {
+	// Fit the hit to the column limits before touching the database
+	if errs := req.Sanitize(); len(errs) > 0 {
+		return false, &hitError{status: http.StatusBadRequest, code: apierror.CodeInvalidRequest, message: "Invalid request", fields: errs}
+	}
+	hc.UserAgent = models.CleanText(hc.UserAgent, models.MaxUserAgentLength)
+
+	// A client event ID makes retries idempotent
+	claimed := false
+	if req.EventID != "" {
+		ok, err := h.dedup.Claim(siteID, req.EventID)
+		if err != nil {
+			hc.logf("Event ID claim failed for site %s: %v", siteID, err)
+			return false, &hitError{status: http.StatusServiceUnavailable, code: apierror.CodeStorageUnavailable, message: "Database error"}
+		}
+		if !ok {
+			h.dedup.CountSuppressed(siteID, dedup.ReasonEventID, hc.At)
+			return true, nil
+		}
+		claimed = true
+	}
+
+	// Release the claim if the hit is not stored, so a retry can succeed
+	stored := false
+	defer func() {
+		if claimed && !stored {
+			h.dedup.Release(siteID, req.EventID)
+		}
+	}()
 
 	// Parse user agent
-	browserInfo := parseUserAgent(userAgentStr)
+	browserInfo := models.ParseUserAgent(hc.UserAgent)
+	enrichment := newDeadLetterContext(hc, browserInfo)
 
 	// Get or create visitor
-	visitorID, err := h.getOrCreateVisitor(siteID, fingerprintHash)
+	visitorID, err := h.getOrCreateVisitor(siteID, hc.FingerprintHash, hc.At)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get/create visitor"})
-		return
+		hc.logf("Failed to get/create visitor for site %s: %v", siteID, err)
+		return false, h.storageError(siteID, req, hc, enrichment, err, "Failed to get/create visitor")
+	}
+	enrichment.VisitorID = &visitorID
+
+	// Without an event ID, a page view of the same URL by the same visitor
+	// moments ago is treated as a retry or prefetch
+	if !claimed && req.EventName == "" {
+		duplicate, err := h.dedup.IsRecentPageView(siteID, visitorID, req.PageURL, hc.At)
+		if err != nil {
+			hc.logf("Duplicate check failed for site %s: %v", siteID, err)
+		} else if duplicate {
+			h.dedup.CountSuppressed(siteID, dedup.ReasonHeuristic, hc.At)
+			return true, nil
+		}
 	}
 
 	// Get or create session (30 min timeout)
-	sessionID, err := h.getOrCreateSession(siteID, visitorID)
+	sessionID, err := h.getOrCreateSession(siteID, visitorID, hc.At)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get/create session"})
-		return
+		hc.logf("Failed to get/create session for site %s: %v", siteID, err)
+		return false, h.storageError(siteID, req, hc, enrichment, err, "Failed to get/create session")
+	}
+	enrichment.SessionID = &sessionID
+
+	hit := goals.Hit{
+		SiteID:    siteID,
+		VisitorID: visitorID,
+		SessionID: sessionID,
+		PageURL:   req.PageURL,
+		EventName: req.EventName,
+		At:        hc.At,
+	}
+
+	var streamed sinks.Hit
+	if req.EventName != "" {
+		// Record custom event
+		event := &models.Event{
+			SiteID:     siteID,
+			VisitorID:  visitorID,
+			SessionID:  sessionID,
+			EventName:  req.EventName,
+			PageURL:    nullString(req.PageURL),
+			Properties: req.Props,
+			OccurredAt: hc.At,
+		}
+		if err := h.store.InsertEvent(event); err != nil {
+			hc.logf("Failed to create event for site %s: %v", siteID, err)
+			return false, h.storageError(siteID, req, hc, enrichment, err, "Failed to create event")
+		}
+		hit.EventID = &event.ID
+		streamed = sinks.EventHit(event, browserInfo)
+	} else {
+		// Create page view
+		pageView := &models.PageView{
+			SiteID:         siteID,
+			VisitorID:      visitorID,
+			SessionID:      sessionID,
+			PageURL:        req.PageURL,
+			PageTitle:      nullString(req.PageTitle),
+			Referrer:       nullString(req.Referrer),
+			UserAgent:      nullString(hc.UserAgent),
+			IPAddress:      hc.ClientIP,
+			CountryCode:    nil, // TODO: GeoIP lookup in Phase 2
+			BrowserName:    nullString(browserInfo.BrowserName),
+			BrowserVersion: nullString(browserInfo.BrowserVersion),
+			OSName:         nullString(browserInfo.OSName),
+			OSVersion:      nullString(browserInfo.OSVersion),
+			DeviceType:     nullString(browserInfo.DeviceType),
+			ScreenWidth:    nullInt(req.ScreenWidth),
+			ScreenHeight:   nullInt(req.ScreenHeight),
+			ViewedAt:       hc.At,
+			PageLoadTime:   req.LoadTime,
+		}
+		if err := h.store.InsertPageView(pageView); err != nil {
+			hc.logf("Failed to create page view for site %s: %v", siteID, err)
+			return false, h.storageError(siteID, req, hc, enrichment, err, "Failed to create page view")
+		}
+		hit.PageViewID = &pageView.ID
+		streamed = sinks.PageViewHit(pageView)
 	}
 
-	// Create page view
-	err = h.createPageView(models.PageView{
-		SiteID:         siteID,
-		VisitorID:      visitorID,
-		SessionID:      sessionID,
-		PageURL:        req.PageURL,
-		PageTitle:      nullString(req.PageTitle),
-		Referrer:       nullString(req.Referrer),
-		UserAgent:      nullString(userAgentStr),
-		IPAddress:      clientIP,
-		CountryCode:    nil, // TODO: GeoIP lookup in Phase 2
-		BrowserName:    nullString(browserInfo.BrowserName),
-		BrowserVersion: nullString(browserInfo.BrowserVersion),
-		OSName:         nullString(browserInfo.OSName),
-		OSVersion:      nullString(browserInfo.OSVersion),
-		DeviceType:     nullString(browserInfo.DeviceType),
-		ScreenWidth:    nullInt(req.ScreenWidth),
-		ScreenHeight:   nullInt(req.ScreenHeight),
-		ViewedAt:       time.Now(),
-		PageLoadTime:   req.LoadTime,
-	})
+	stored = true
 
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create page view"})
-		return
+	// Stream the hit to the site's sinks; a sink that is not keeping up drops it
+	if h.sinks != nil {
+		streamed.Source = hc.Endpoint
+		h.sinks.Publish(streamed)
 	}
 
-	// Return appropriate response based on request method
-	if c.Request.Method == "GET" {
-		// For image pixel requests, return a 1x1 transparent GIF
-		c.Header("Content-Type", "image/gif")
-		c.Header("Cache-Control", "no-cache, no-store, must-revalidate")
-		// 1x1 transparent GIF (43 bytes)
-		gif := []byte{0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00, 0x00, 0xFF, 0xFF, 0xFF, 0x00, 0x00, 0x00, 0x21, 0xF9, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x2C, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3B}
-		c.Data(http.StatusOK, "image/gif", gif)
-	} else {
-		// For POST requests, return JSON
-		c.JSON(http.StatusOK, gin.H{"status": "success"})
+	// Evaluate conversion goals (the hit is already stored, so failures are only logged)
+	if _, err := h.goals.Evaluate(hit); err != nil {
+		hc.logf("Goal evaluation failed for site %s: %v", siteID, err)
 	}
+
+	return false, nil
 }
 
 // Health check endpoint
@@ -161,14 +405,18 @@ func (h *TrackHandler) Health(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
+	resp := gin.H{
 		"status": "healthy",
 		"time":   time.Now().UTC(),
-	})
+	}
+	if h.spool != nil {
+		resp["spool_backlog"] = h.spool.Stats().Records
+	}
+	c.JSON(http.StatusOK, resp)
 }
 
 // getOrCreateVisitor gets an existing visitor or creates a new one
-func (h *TrackHandler) getOrCreateVisitor(siteID string, fingerprintHash string) (uuid.UUID, error) {
+func (h *TrackHandler) getOrCreateVisitor(siteID string, fingerprintHash string, at time.Time) (uuid.UUID, error) {
 	var visitorID uuid.UUID
 
 	// Try to get existing visitor
@@ -183,7 +431,7 @@ func (h *TrackHandler) getOrCreateVisitor(siteID string, fingerprintHash string)
 		_, err = h.db.Exec(`
 			INSERT INTO visitors (id, site_id, fingerprint_hash, first_seen_at, last_seen_at, total_visits)
 			VALUES ($1, $2, $3, $4, $5, 0)
-		`, visitorID, siteID, fingerprintHash, time.Now(), time.Now())
+		`, visitorID, siteID, fingerprintHash, at, at)
 		if err != nil {
 			return uuid.Nil, err
 		}
@@ -195,20 +443,21 @@ func (h *TrackHandler) getOrCreateVisitor(siteID string, fingerprintHash string)
 }
 
 // getOrCreateSession gets an active session or creates a new one
-func (h *TrackHandler) getOrCreateSession(siteID string, visitorID uuid.UUID) (uuid.UUID, error) {
+func (h *TrackHandler) getOrCreateSession(siteID string, visitorID uuid.UUID, at time.Time) (uuid.UUID, error) {
 	var sessionID uuid.UUID
 
-	// Try to get active session (within last 30 minutes)
-	thirtyMinsAgo := time.Now().Add(-30 * time.Minute)
+	// Try to get active session (within the timeout before the hit)
+	openSince := at.Add(-models.SessionTimeout)
 	err := h.db.QueryRow(`
 		SELECT id FROM sessions 
 		WHERE visitor_id = $1 
 		AND site_id = $2
 		AND last_activity_at > $3
+		AND started_at <= $4
 		AND ended_at IS NULL
 		ORDER BY started_at DESC
 		LIMIT 1
-	`, visitorID, siteID, thirtyMinsAgo).Scan(&sessionID)
+	`, visitorID, siteID, openSince, at).Scan(&sessionID)
 
 	if err == sql.ErrNoRows {
 		// Create new session
@@ -216,7 +465,7 @@ func (h *TrackHandler) getOrCreateSession(siteID string, visitorID uuid.UUID) (u
 		_, err = h.db.Exec(`
 			INSERT INTO sessions (id, visitor_id, site_id, started_at, last_activity_at)
 			VALUES ($1, $2, $3, $4, $5)
-		`, sessionID, visitorID, siteID, time.Now(), time.Now())
+		`, sessionID, visitorID, siteID, at, at)
 		if err != nil {
 			return uuid.Nil, err
 		}
@@ -227,57 +476,6 @@ func (h *TrackHandler) getOrCreateSession(siteID string, visitorID uuid.UUID) (u
 	return sessionID, nil
 }
 
-// createPageView inserts a new page view record
-func (h *TrackHandler) createPageView(pv models.PageView) error {
-	pv.ID = uuid.New()
-
-	_, err := h.db.Exec(`
-		INSERT INTO page_views (
-			id, site_id, visitor_id, session_id, page_url, page_title, referrer,
-			user_agent, ip_address, country_code, browser_name, browser_version,
-			os_name, os_version, device_type, screen_width, screen_height,
-			viewed_at, page_load_time
-		) VALUES (
-			$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19
-		)
-	`,
-		pv.ID, pv.SiteID, pv.VisitorID, pv.SessionID, pv.PageURL, pv.PageTitle,
-		pv.Referrer, pv.UserAgent, pv.IPAddress, pv.CountryCode, pv.BrowserName,
-		pv.BrowserVersion, pv.OSName, pv.OSVersion, pv.DeviceType, pv.ScreenWidth,
-		pv.ScreenHeight, pv.ViewedAt, pv.PageLoadTime,
-	)
-
-	return err
-}
-
-// hashFingerprint creates a SHA-256 hash of the fingerprint
-func hashFingerprint(fingerprint string) string {
-	hash := sha256.Sum256([]byte(fingerprint))
-	return hex.EncodeToString(hash[:])
-}
-
-// parseUserAgent parses the user agent string
-func parseUserAgent(uaString string) models.BrowserInfo {
-	ua := user_agent.New(uaString)
-
-	browserName, browserVersion := ua.Browser()
-	osInfo := ua.OS()
-
-	deviceType := "desktop"
-	if ua.Mobile() {
-		deviceType = "mobile"
-	}
-	// Note: user_agent library doesn't detect tablets well, could enhance in Phase 2
-
-	return models.BrowserInfo{
-		BrowserName:    browserName,
-		BrowserVersion: browserVersion,
-		OSName:         osInfo,
-		OSVersion:      "", // Library doesn't provide OS version easily
-		DeviceType:     deviceType,
-	}
-}
-
 // Helper functions for nullable fields
 func nullString(s string) *string {
 	if s == "" {
@@ -0,0 +1,338 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/dedup"
+	"trackveilapi/internal/domains"
+	"trackveilapi/internal/goals"
+	"trackveilapi/internal/middleware"
+	"trackveilapi/internal/migrate"
+	"trackveilapi/internal/models"
+	"trackveilapi/internal/spool"
+	"trackveilapi/internal/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// TestTrackSpoolsDuringOutage checks that browser hits reach the spool
+// while the database is down, on custom domains too
+func TestTrackSpoolsDuringOutage(t *testing.T) {
+	tt := newTrackTest(t)
+	db, siteID, hitSpool := tt.db, tt.siteID, tt.spool
+	if _, err := domains.Create(db, siteID, "stats.example.com"); err != nil {
+		t.Fatalf("create custom domain: %v", err)
+	}
+
+	resolver := domains.NewResolver(db)
+	router := gin.New()
+	router.POST("/track", IngestCustomDomain(resolver), tt.handler.Track)
+
+	// The custom domain is resolved once before the outage, like a recent hit would
+	if got, err := resolver.SiteID("stats.example.com"); err != nil || got != siteID {
+		t.Fatalf("SiteID = %q, %v; want %q", got, err, siteID)
+	}
+	db.Close()
+
+	otherSiteID, err := models.GenerateSiteID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hit := func(id, path string) string {
+		return `{"site_id":"` + id + `","page_url":"https://example.com` + path + `"}`
+	}
+	cases := []struct {
+		name     string
+		host     string
+		body     string
+		wantCode int
+		spooled  int64
+	}{
+		{"api host", "api.trackveil.test", hit(siteID, "/a"), http.StatusOK, 1},
+		{"unresolved host", "unknown.example.net", hit(siteID, "/b"), http.StatusOK, 2},
+		{"cached custom domain", "stats.example.com", hit(siteID, "/c"), http.StatusOK, 3},
+		// The cached mapping still guards the domain's site
+		{"other site on custom domain", "stats.example.com", hit(otherSiteID, "/d"), http.StatusForbidden, 3},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodPost, "/track", strings.NewReader(c.body))
+		req.Host = c.host
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != c.wantCode {
+			t.Errorf("%s: got %d %s, want %d", c.name, w.Code, w.Body.String(), c.wantCode)
+		}
+		if w.Code == http.StatusOK && !strings.Contains(w.Body.String(), `"queued"`) {
+			t.Errorf("%s: got %s, want the hit queued", c.name, w.Body.String())
+		}
+		if got := hitSpool.Stats().Records; got != c.spooled {
+			t.Errorf("%s: %d spooled hits, want %d", c.name, got, c.spooled)
+		}
+	}
+
+	// The hits are spooled in the order they came in
+	for _, path := range []string{"/a", "/b", "/c"} {
+		payload, err := hitSpool.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var spooled spooledHit
+		if err := json.Unmarshal(payload, &spooled); err != nil {
+			t.Fatal(err)
+		}
+		if r := spooled.Request; r.SiteID != siteID || r.PageURL != "https://example.com"+path {
+			t.Errorf("spooled %s %s, want %s https://example.com%s", r.SiteID, r.PageURL, siteID, path)
+		}
+		if err := hitSpool.Ack(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestTrackEventProps checks that event properties of any scalar type are
+// accepted and stored as strings
+func TestTrackEventProps(t *testing.T) {
+	tt := newTrackTest(t)
+	router := gin.New()
+	router.POST("/track", tt.handler.Track)
+	router.GET("/track", tt.handler.Track)
+
+	post := `{"site_id":"` + tt.siteID + `","page_url":"https://example.com/","event_name":"signup",` +
+		`"props":{"value":10,"ratio":0.5,"plan_pro":true,"plan":"pro","coupon":null}}`
+	req := httptest.NewRequest(http.MethodPost, "/track", strings.NewReader(post))
+	req.Header.Set("Content-Type", "application/json")
+	pixel := httptest.NewRequest(http.MethodGet, "/track?"+url.Values{
+		"site_id":    {tt.siteID},
+		"page_url":   {"https://example.com/"},
+		"event_name": {"pixel_signup"},
+		"props":      {`{"value":10,"plan_pro":true}`},
+	}.Encode(), nil)
+
+	for _, r := range []*http.Request{req, pixel} {
+		r.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) Firefox/120.0")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s /track: got %d %s", r.Method, w.Code, w.Body.String())
+		}
+	}
+	if err := tt.store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]map[string]string{
+		"signup":       {"value": "10", "ratio": "0.5", "plan_pro": "true", "plan": "pro"},
+		"pixel_signup": {"value": "10", "plan_pro": "true"},
+	}
+	for name, props := range want {
+		var stored string
+		if err := tt.db.QueryRow(`SELECT properties FROM events WHERE site_id = $1 AND event_name = $2`,
+			tt.siteID, name).Scan(&stored); err != nil {
+			t.Fatalf("event %s: %v", name, err)
+		}
+		var got map[string]string
+		if err := json.Unmarshal([]byte(stored), &got); err != nil {
+			t.Fatalf("event %s properties %s: %v", name, stored, err)
+		}
+		if !reflect.DeepEqual(got, props) {
+			t.Errorf("event %s properties = %v, want %v", name, got, props)
+		}
+	}
+}
+
+// TestTrackPageURL checks that events need no page_url, and that a hit
+// without either is reported field by field
+func TestTrackPageURL(t *testing.T) {
+	tt := newTrackTest(t)
+	router := gin.New()
+	router.POST("/track", tt.handler.Track)
+
+	cases := []struct {
+		name     string
+		body     string
+		wantCode int
+		wantBody string
+	}{
+		{"event without page_url", `{"site_id":"` + tt.siteID + `","event_name":"signup"}`,
+			http.StatusOK, `"status":"success"`},
+		{"page view without page_url", `{"site_id":"` + tt.siteID + `"}`,
+			http.StatusBadRequest, `"fields":[{"field":"page_url","message":"is required"}]`},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodPost, "/track", strings.NewReader(c.body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != c.wantCode || !strings.Contains(w.Body.String(), c.wantBody) {
+			t.Errorf("%s: got %d %s, want %d with %s", c.name, w.Code, w.Body.String(), c.wantCode, c.wantBody)
+		}
+	}
+}
+
+// TestTrackCustomDomainSiteID checks that site_id may be left out on a
+// custom domain, and is still required elsewhere
+func TestTrackCustomDomainSiteID(t *testing.T) {
+	tt := newTrackTest(t)
+	if _, err := domains.Create(tt.db, tt.siteID, "stats.example.com"); err != nil {
+		t.Fatalf("create custom domain: %v", err)
+	}
+	router := gin.New()
+	router.POST("/track", IngestCustomDomain(domains.NewResolver(tt.db)), tt.handler.Track)
+	router.GET("/track", IngestCustomDomain(domains.NewResolver(tt.db)), tt.handler.Track)
+
+	cases := []struct {
+		name     string
+		method   string
+		host     string
+		body     string
+		wantCode int
+		wantBody string
+	}{
+		{"custom domain", http.MethodPost, "stats.example.com",
+			`{"page_url":"https://example.com/a"}`, http.StatusOK, `"status":"success"`},
+		{"custom domain pixel", http.MethodGet, "stats.example.com",
+			"page_url=" + url.QueryEscape("https://example.com/b"), http.StatusOK, ""},
+		{"API host", http.MethodPost, "api.trackveil.test",
+			`{"page_url":"https://example.com/c"}`, http.StatusBadRequest, `"code":"invalid_site_id"`},
+	}
+	for _, c := range cases {
+		var req *http.Request
+		if c.method == http.MethodGet {
+			req = httptest.NewRequest(http.MethodGet, "/track?"+c.body, nil)
+		} else {
+			req = httptest.NewRequest(http.MethodPost, "/track", strings.NewReader(c.body))
+			req.Header.Set("Content-Type", "application/json")
+		}
+		req.Host = c.host
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != c.wantCode || !strings.Contains(w.Body.String(), c.wantBody) {
+			t.Errorf("%s: got %d %s, want %d with %s", c.name, w.Code, w.Body.String(), c.wantCode, c.wantBody)
+		}
+	}
+	if err := tt.store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := tt.db.QueryRow(`SELECT COUNT(*) FROM page_views WHERE site_id = $1`, tt.siteID).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("%d page views stored, want 2", n)
+	}
+}
+
+// trackTest is a track handler on a new SQLite database with one site
+type trackTest struct {
+	db      *database.DB
+	store   storage.Store
+	spool   *spool.Spool
+	handler *TrackHandler
+	siteID  string
+}
+
+// TestTrackLogsRequestID checks that log lines about a hit start with the
+// ID of the request that delivered it, also when the hit is replayed
+func TestTrackLogsRequestID(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	tt := newTrackTest(t)
+	router := gin.New()
+	router.POST("/track", middleware.RequestID(), tt.handler.Track)
+	tt.db.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/track",
+		strings.NewReader(`{"site_id":"`+tt.siteID+`","page_url":"https://example.com/"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Request-ID", "req-1234")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	if !strings.Contains(logs.String(), "req-1234 Site lookup failed for "+tt.siteID) {
+		t.Errorf("logged %q, want the site lookup failure with the request ID", logs.String())
+	}
+
+	payload, err := tt.spool.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spooled spooledHit
+	if err := json.Unmarshal(payload, &spooled); err != nil {
+		t.Fatal(err)
+	}
+	if spooled.Context.RequestID != "req-1234" {
+		t.Fatalf("spooled request ID %q, want req-1234", spooled.Context.RequestID)
+	}
+
+	// Replayed where the site no longer exists
+	logs.Reset()
+	if err := newTrackTest(t).handler.Replay(payload); !errors.Is(err, spool.ErrDrop) {
+		t.Fatalf("replay: got %v, want %v", err, spool.ErrDrop)
+	}
+	if !strings.Contains(logs.String(), "req-1234 Dropped spooled hit for unknown site "+tt.siteID) {
+		t.Errorf("logged %q, want the dropped hit with the request ID", logs.String())
+	}
+}
+
+func newTrackTest(t *testing.T) *trackTest {
+	gin.SetMode(gin.TestMode)
+	dir := t.TempDir()
+
+	db, err := database.OpenSQLite(filepath.Join(dir, "trackveil.db"))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	m, err := migrate.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(context.Background()); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	siteID, err := models.GenerateSiteID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accountID := uuid.New()
+	if _, err := db.Exec(`INSERT INTO accounts (id, name) VALUES ($1, 'Track')`, accountID); err != nil {
+		t.Fatalf("create account: %v", err)
+	}
+	if _, err := db.Exec(`
+		INSERT INTO sites (id, account_id, name, domain) VALUES ($1, $2, 'Track', 'example.com')
+	`, siteID, accountID); err != nil {
+		t.Fatalf("create site: %v", err)
+	}
+
+	store, err := storage.NewSQLite(db, storage.SQLiteConfig{BatchSize: 100, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hitSpool, err := spool.Open(filepath.Join(dir, "spool"), 1<<20, 16<<20)
+	if err != nil {
+		t.Fatalf("open spool: %v", err)
+	}
+	t.Cleanup(func() { hitSpool.Close() })
+
+	handler := NewTrackHandler(db, store, goals.NewEvaluator(db, store),
+		dedup.New(db, store, time.Minute, time.Hour), false, hitSpool, nil)
+	return &trackTest{db: db, store: store, spool: hitSpool, handler: handler, siteID: siteID}
+}
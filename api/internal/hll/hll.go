@@ -0,0 +1,246 @@
+// Package hll implements HyperLogLog sketches for mergeable unique counts.
+//
+// Sketches use 2^14 registers, for a standard error of about 0.81%. Small
+// sketches are kept sparse, so a page seen by a handful of visitors costs a
+// few bytes rather than 16 KB. Serialized sketches are stored as bytea in the
+// rollup tables and merged to count unique visitors over any range.
+package hll
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/bits"
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// Precision is the number of index bits; the sketch has 2^Precision registers
+	Precision = 14
+
+	registers = 1 << Precision
+
+	// sparseLimit is the number of set registers above which a sketch turns dense
+	sparseLimit = registers / 8
+
+	// maxRank is the highest rank AddHash sets
+	maxRank = 64 - Precision + 1
+
+	formatVersion = 1
+	encSparse     = 0
+	encDense      = 1
+)
+
+var (
+	// ErrInvalid is returned for data that is not a serialized sketch
+	ErrInvalid = errors.New("hll: invalid sketch encoding")
+	// ErrPrecision is returned when merging sketches of different precision
+	ErrPrecision = errors.New("hll: precision mismatch")
+)
+
+// Sketch estimates the number of distinct items added to it
+type Sketch struct {
+	sparse map[uint32]uint8 // used while few registers are set
+	dense  []uint8
+}
+
+// New creates an empty sketch
+func New() *Sketch {
+	return &Sketch{sparse: make(map[uint32]uint8)}
+}
+
+// StdError is the relative standard error of estimates
+func StdError() float64 {
+	return 1.04 / math.Sqrt(registers)
+}
+
+// AddUUID adds a UUID, such as a visitor ID
+func (s *Sketch) AddUUID(id uuid.UUID) {
+	hi := binary.BigEndian.Uint64(id[:8])
+	lo := binary.BigEndian.Uint64(id[8:])
+	s.AddHash(mix(hi ^ mix(lo)))
+}
+
+// AddHash adds an item by its 64-bit hash, which must be uniformly distributed
+func (s *Sketch) AddHash(h uint64) {
+	idx := uint32(h >> (64 - Precision))
+	// The guard bit bounds the rank when the remaining bits are all zero
+	rank := uint8(bits.LeadingZeros64(h<<Precision|1<<(Precision-1))) + 1
+	s.set(idx, rank)
+}
+
+func (s *Sketch) set(idx uint32, rank uint8) {
+	if s.dense != nil {
+		if rank > s.dense[idx] {
+			s.dense[idx] = rank
+		}
+		return
+	}
+	if rank > s.sparse[idx] {
+		s.sparse[idx] = rank
+		if len(s.sparse) > sparseLimit {
+			s.toDense()
+		}
+	}
+}
+
+func (s *Sketch) toDense() {
+	s.dense = make([]uint8, registers)
+	for idx, rank := range s.sparse {
+		s.dense[idx] = rank
+	}
+	s.sparse = nil
+}
+
+// Merge adds the items of other to s
+func (s *Sketch) Merge(other *Sketch) {
+	if other.dense != nil {
+		for idx, rank := range other.dense {
+			if rank > 0 {
+				s.set(uint32(idx), rank)
+			}
+		}
+		return
+	}
+	for idx, rank := range other.sparse {
+		s.set(idx, rank)
+	}
+}
+
+// Estimate returns the estimated number of distinct items
+func (s *Sketch) Estimate() uint64 {
+	zeros := 0
+	sum := 0.0
+	if s.dense != nil {
+		for _, rank := range s.dense {
+			if rank == 0 {
+				zeros++
+			}
+			sum += math.Ldexp(1, -int(rank))
+		}
+	} else {
+		zeros = registers - len(s.sparse)
+		sum = float64(zeros)
+		for _, rank := range s.sparse {
+			sum += math.Ldexp(1, -int(rank))
+		}
+	}
+
+	m := float64(registers)
+	alpha := 0.7213 / (1 + 1.079/m)
+	estimate := alpha * m * m / sum
+
+	// The raw estimate is biased for small cardinalities, where linear
+	// counting of the empty registers is accurate
+	if estimate <= 3*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(math.Round(estimate))
+}
+
+// MarshalBinary encodes the sketch, sparse or dense, whichever is smaller
+func (s *Sketch) MarshalBinary() ([]byte, error) {
+	if s.dense != nil {
+		buf := make([]byte, 3, 3+registers)
+		buf[0], buf[1], buf[2] = formatVersion, Precision, encDense
+		return append(buf, s.dense...), nil
+	}
+
+	indexes := make([]uint32, 0, len(s.sparse))
+	for idx := range s.sparse {
+		indexes = append(indexes, idx)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+
+	buf := []byte{formatVersion, Precision, encSparse}
+	buf = binary.AppendUvarint(buf, uint64(len(indexes)))
+	prev := uint32(0)
+	for _, idx := range indexes {
+		buf = binary.AppendUvarint(buf, uint64(idx-prev))
+		buf = append(buf, s.sparse[idx])
+		prev = idx
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a sketch encoded by MarshalBinary. The sketch is
+// left unchanged if data is invalid.
+func (s *Sketch) UnmarshalBinary(data []byte) error {
+	if len(data) < 3 || data[0] != formatVersion {
+		return ErrInvalid
+	}
+	if data[1] != Precision {
+		return ErrPrecision
+	}
+
+	switch data[2] {
+	case encDense:
+		if len(data) != 3+registers {
+			return ErrInvalid
+		}
+		for _, rank := range data[3:] {
+			if rank > maxRank {
+				return ErrInvalid
+			}
+		}
+		s.sparse = nil
+		s.dense = append([]uint8(nil), data[3:]...)
+		return nil
+
+	case encSparse:
+		data = data[3:]
+		n, size := binary.Uvarint(data)
+		if size <= 0 || n > registers {
+			return ErrInvalid
+		}
+		data = data[size:]
+
+		// Indexes are strictly increasing, so each is set once
+		sparse := make(map[uint32]uint8, n)
+		idx := uint64(0)
+		for i := uint64(0); i < n; i++ {
+			delta, size := binary.Uvarint(data)
+			if size <= 0 || len(data) < size+1 || delta >= registers || (i > 0 && delta == 0) {
+				return ErrInvalid
+			}
+			idx += delta
+			rank := data[size]
+			if idx >= registers || rank == 0 || rank > maxRank {
+				return ErrInvalid
+			}
+			sparse[uint32(idx)] = rank
+			data = data[size+1:]
+		}
+		if len(data) != 0 {
+			return ErrInvalid
+		}
+		s.dense = nil
+		s.sparse = sparse
+		if len(s.sparse) > sparseLimit {
+			s.toDense()
+		}
+		return nil
+	}
+	return ErrInvalid
+}
+
+// Decode parses a serialized sketch
+func Decode(data []byte) (*Sketch, error) {
+	s := New()
+	if err := s.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// mix is the splitmix64 finalizer
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
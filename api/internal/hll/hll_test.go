@@ -0,0 +1,224 @@
+package hll
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// sketchOf returns a sketch of n random visitor IDs drawn from seed
+func sketchOf(seed int64, n int) *Sketch {
+	s := New()
+	addRandom(s, seed, n)
+	return s
+}
+
+func addRandom(s *Sketch, seed int64, n int) {
+	r := rand.New(rand.NewSource(seed))
+	var id uuid.UUID
+	for i := 0; i < n; i++ {
+		r.Read(id[:])
+		s.AddUUID(id)
+	}
+}
+
+func marshal(t *testing.T, s *Sketch) []byte {
+	t.Helper()
+	data, err := s.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		items int
+		dense bool
+	}{
+		{"empty", 0, false},
+		{"one item", 1, false},
+		{"sparse", 1000, false},
+		{"at the sparse limit", sparseLimit, false},
+		{"dense", 100000, true},
+	} {
+		s := New()
+		if c.name == "at the sparse limit" {
+			// Exactly sparseLimit registers set, one item each
+			for idx := uint64(0); idx < sparseLimit; idx++ {
+				s.AddHash(idx<<(64-Precision) | 1<<20)
+			}
+		} else {
+			addRandom(s, 1, c.items)
+		}
+		if dense := s.dense != nil; dense != c.dense {
+			t.Fatalf("%s: dense %v, want %v", c.name, dense, c.dense)
+		}
+
+		data := marshal(t, s)
+		if enc := data[2]; (enc == encDense) != c.dense {
+			t.Errorf("%s: encoding %d, want dense %v", c.name, enc, c.dense)
+		}
+		if c.dense && len(data) != 3+registers {
+			t.Errorf("%s: %d bytes, want %d", c.name, len(data), 3+registers)
+		}
+		if !c.dense && len(data) >= 3+registers {
+			t.Errorf("%s: sparse encoding of %d bytes is no smaller than dense", c.name, len(data))
+		}
+
+		decoded, err := Decode(data)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if got, want := decoded.Estimate(), s.Estimate(); got != want {
+			t.Errorf("%s: decoded estimate %d, want %d", c.name, got, want)
+		}
+		if again := marshal(t, decoded); !bytes.Equal(again, data) {
+			t.Errorf("%s: encoding changed after a round trip", c.name)
+		}
+	}
+}
+
+// TestMerge checks that merged sketches hold the registers of a sketch of
+// all the items, whichever representations are merged
+func TestMerge(t *testing.T) {
+	cases := []struct {
+		name        string
+		into, other int // items, each from its own seed
+	}{
+		{"sparse into dense", 50000, 500},
+		{"dense into sparse", 500, 50000},
+		{"sparse into sparse", 300, 400},
+		{"sparse into sparse turning dense", 1500, 1500},
+		{"dense into dense", 30000, 40000},
+		{"into empty", 0, 700},
+		{"empty into sparse", 700, 0},
+	}
+	for _, c := range cases {
+		s, other := sketchOf(1, c.into), sketchOf(2, c.other)
+		otherData := marshal(t, other)
+		s.Merge(other)
+
+		all := sketchOf(1, c.into)
+		addRandom(all, 2, c.other)
+		if got, want := marshal(t, s), marshal(t, all); !bytes.Equal(got, want) {
+			t.Errorf("%s: merged sketch differs from a sketch of all %d items", c.name, c.into+c.other)
+		}
+		if !bytes.Equal(marshal(t, other), otherData) {
+			t.Errorf("%s: merge changed the merged sketch", c.name)
+		}
+
+		// Merging again, or a subset, changes nothing
+		before := marshal(t, s)
+		s.Merge(other)
+		s.Merge(sketchOf(1, c.into/2))
+		if !bytes.Equal(marshal(t, s), before) {
+			t.Errorf("%s: merging items already counted changed the sketch", c.name)
+		}
+	}
+}
+
+// TestEstimate checks estimates stay within three standard errors
+func TestEstimate(t *testing.T) {
+	for _, n := range []int{10, 1000, 100000} {
+		for seed := int64(1); seed <= 5; seed++ {
+			s := sketchOf(seed, n)
+			// Adding the same items again changes nothing
+			addRandom(s, seed, n)
+			got := float64(s.Estimate())
+			if err := math.Abs(got-float64(n)) / float64(n); err > 3*StdError() {
+				t.Errorf("%d items, seed %d: estimate %.0f, error %.2f%%, want within %.2f%%",
+					n, seed, got, 100*err, 300*StdError())
+			}
+		}
+	}
+	if got := New().Estimate(); got != 0 {
+		t.Errorf("empty sketch estimate %d", got)
+	}
+}
+
+func TestUnmarshalInvalid(t *testing.T) {
+	sparse := marshal(t, sketchOf(1, 1000))
+	dense := marshal(t, sketchOf(1, 100000))
+
+	// Every truncation is rejected
+	for name, data := range map[string][]byte{"sparse": sparse, "dense": dense} {
+		for n := 0; n < len(data); n++ {
+			if err := New().UnmarshalBinary(data[:n]); err == nil {
+				t.Errorf("%s: the first %d of %d bytes decoded", name, n, len(data))
+			}
+		}
+	}
+
+	header := func(enc byte) []byte { return []byte{formatVersion, Precision, enc} }
+	sparseOf := func(entries ...uint64) []byte { // count, then delta and rank pairs
+		data := header(encSparse)
+		for _, e := range entries {
+			data = binary.AppendUvarint(data, e)
+		}
+		return data
+	}
+	cases := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"version", append([]byte{formatVersion + 1}, sparse[1:]...), ErrInvalid},
+		{"precision", append([]byte{formatVersion, Precision - 1}, sparse[2:]...), ErrPrecision},
+		{"encoding", append(header(7), sparse[3:]...), ErrInvalid},
+		{"dense with a byte more", append(append([]byte(nil), dense...), 1), ErrInvalid},
+		{"sparse with a byte more", append(append([]byte(nil), sparse...), 1), ErrInvalid},
+		{"sparse count over registers", sparseOf(registers + 1), ErrInvalid},
+		{"sparse count over entries", sparseOf(2, 5, 1), ErrInvalid},
+		{"sparse index out of range", sparseOf(1, registers, 1), ErrInvalid},
+		{"sparse index overflowing", sparseOf(2, 5, 1, math.MaxUint64-2, 1), ErrInvalid},
+		{"sparse index repeated", sparseOf(2, 5, 1, 0, 2), ErrInvalid},
+		{"sparse rank zero", sparseOf(1, 5, 0), ErrInvalid},
+		{"sparse rank too high", sparseOf(1, 5, maxRank+1), ErrInvalid},
+		{"dense rank too high", func() []byte {
+			d := append([]byte(nil), dense...)
+			d[100] = byte(maxRank + 1)
+			return d
+		}(), ErrInvalid},
+	}
+	for _, c := range cases {
+		s := sketchOf(3, 10)
+		before := marshal(t, s)
+		if err := s.UnmarshalBinary(c.data); !errors.Is(err, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, err, c.want)
+		}
+		if !bytes.Equal(marshal(t, s), before) {
+			t.Errorf("%s: the sketch changed", c.name)
+		}
+		if _, err := Decode(c.data); !errors.Is(err, c.want) {
+			t.Errorf("%s: Decode got %v, want %v", c.name, err, c.want)
+		}
+	}
+
+	// The highest valid values decode, including the rank of a hash with
+	// no bits set after the index
+	highest := New()
+	highest.AddHash(0)
+	if rank := highest.sparse[0]; rank != maxRank {
+		t.Errorf("highest rank set %d, want %d", rank, maxRank)
+	}
+	for name, data := range map[string][]byte{
+		"added":  marshal(t, highest),
+		"sparse": sparseOf(2, 0, 1, registers-1, maxRank),
+		"dense": func() []byte {
+			d := append([]byte(nil), dense...)
+			d[100] = byte(maxRank)
+			return d
+		}(),
+	} {
+		if _, err := Decode(data); err != nil {
+			t.Errorf("%s with the highest index and rank: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"trackveilapi/internal/apierror"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AdminAuth returns a middleware that requires a static bearer token.
+// If no token is configured, every request is rejected so the protected
+// routes stay disabled until an operator sets API_ADMIN_TOKEN.
+func AdminAuth(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token == "" {
+			apierror.Abort(c, http.StatusServiceUnavailable, apierror.CodeAdminDisabled, "Admin API is disabled")
+			return
+		}
+
+		provided := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			apierror.Abort(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Unauthorized")
+			return
+		}
+
+		c.Next()
+	}
+}
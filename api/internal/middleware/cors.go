@@ -3,6 +3,8 @@ package middleware
 import (
 	"time"
 
+	"trackveilapi/internal/apierror"
+
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 )
@@ -11,8 +13,8 @@ import (
 func CORS(allowedOrigins []string) gin.HandlerFunc {
 	config := cors.Config{
 		AllowMethods:     []string{"POST", "GET", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Accept"},
-		ExposeHeaders:    []string{"Content-Length"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", apierror.RequestIDHeader},
+		ExposeHeaders:    []string{"Content-Length", apierror.RequestIDHeader, apierror.ResultHeader},
 		AllowCredentials: false,
 		MaxAge:           12 * time.Hour,
 	}
@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"trackveilapi/internal/apierror"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RateLimit returns a middleware that allows each client IP at most
+// requests per window (fixed window, in memory). A non-positive limit disables it.
+func RateLimit(requests int, window time.Duration) gin.HandlerFunc {
+	if requests <= 0 || window <= 0 {
+		return func(c *gin.Context) { c.Next() }
+	}
+
+	l := &limiter{limit: requests, window: window, clients: make(map[string]*clientWindow)}
+	return func(c *gin.Context) {
+		if ok, retry := l.allow(c.ClientIP(), time.Now()); !ok {
+			c.Header("Retry-After", strconv.Itoa(int(retry.Seconds())+1))
+			apierror.Abort(c, http.StatusTooManyRequests, apierror.CodeRateLimited, "Rate limit exceeded")
+			return
+		}
+		c.Next()
+	}
+}
+
+type clientWindow struct {
+	start time.Time
+	count int
+}
+
+type limiter struct {
+	mu        sync.Mutex
+	limit     int
+	window    time.Duration
+	clients   map[string]*clientWindow
+	lastSweep time.Time
+}
+
+// allow counts a request and reports whether it is within the limit, and if
+// not, how long until the client's window resets
+func (l *limiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Drop expired windows once per window so the map stays bounded
+	if now.Sub(l.lastSweep) > l.window {
+		for k, w := range l.clients {
+			if now.Sub(w.start) >= l.window {
+				delete(l.clients, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	w, ok := l.clients[key]
+	if !ok || now.Sub(w.start) >= l.window {
+		l.clients[key] = &clientWindow{start: now, count: 1}
+		return true, 0
+	}
+	if w.count >= l.limit {
+		return false, w.start.Add(l.window).Sub(now)
+	}
+	w.count++
+	return true, 0
+}
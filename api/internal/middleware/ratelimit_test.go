@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestRateLimitForwardedFor checks that X-Forwarded-For only picks the
+// bucket when a trusted proxy sets it
+func TestRateLimitForwardedFor(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cases := []struct {
+		name       string
+		trusted    []string
+		remote     string
+		forwarded  func(i int) string
+		wantStatus []int
+	}{
+		{"spoofed without trusted proxies", nil, "198.51.100.7:4000",
+			func(i int) string { return "203.0.113." + strconv.Itoa(i) },
+			[]int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests}},
+		{"spoofed by an untrusted peer", []string{"10.0.0.0/8"}, "198.51.100.7:4000",
+			func(i int) string { return "203.0.113." + strconv.Itoa(i) },
+			[]int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests}},
+		{"clients behind a trusted proxy", []string{"10.0.0.0/8"}, "10.1.2.3:4000",
+			func(i int) string { return "203.0.113." + strconv.Itoa(i) },
+			[]int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusOK}},
+		{"one client behind a trusted proxy", []string{"10.0.0.0/8"}, "10.1.2.3:4000",
+			func(i int) string { return "203.0.113.1" },
+			[]int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests}},
+	}
+	for _, c := range cases {
+		router := gin.New()
+		if err := router.SetTrustedProxies(c.trusted); err != nil {
+			t.Fatal(err)
+		}
+		router.POST("/track", RateLimit(2, time.Minute), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+		for i, want := range c.wantStatus {
+			req := httptest.NewRequest(http.MethodPost, "/track", nil)
+			req.RemoteAddr = c.remote
+			req.Header.Set("X-Forwarded-For", c.forwarded(i))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != want {
+				t.Errorf("%s: request %d got %d, want %d", c.name, i+1, w.Code, want)
+			}
+		}
+	}
+}
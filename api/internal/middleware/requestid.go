@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"log"
+	"time"
+
+	"trackveilapi/internal/apierror"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// maxRequestIDLength bounds client-supplied request IDs
+const maxRequestIDLength = 64
+
+// RequestID assigns every request an ID, echoed in the X-Request-ID header.
+// A well-formed ID sent by the client or a proxy is kept, so logs can be
+// correlated across hops.
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(apierror.RequestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.NewString()
+		}
+		apierror.SetRequestID(c, id)
+		c.Header(apierror.RequestIDHeader, id)
+
+		c.Next()
+	}
+}
+
+// Pixel puts a route in pixel mode: errors are answered with the transparent
+// GIF and the error code in X-Trackveil-Result, since an <img> cannot read JSON
+func Pixel() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		apierror.UsePixel(c)
+		c.Next()
+	}
+}
+
+// Logger logs one line per request with its request ID and error code
+func Logger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		path := c.Request.URL.Path
+
+		c.Next()
+
+		code := apierror.ErrorCode(c)
+		if code == "" {
+			code = "-"
+		}
+		log.Printf("%s %s %s %d %s %s %v",
+			apierror.RequestID(c), c.ClientIP(), c.Request.Method, c.Writer.Status(), path, code, time.Since(start))
+	}
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
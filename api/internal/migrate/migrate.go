@@ -0,0 +1,459 @@
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"trackveilapi/internal/database"
+)
+
+// Migrations are NNN_name.sql files per driver, with an optional
+// NNN_name.down.sql that reverts them. Seeds are development data applied
+// on request, never as part of the schema.
+//
+//go:embed postgres/*.sql sqlite/*.sql seeds/*.sql
+var files embed.FS
+
+// lockKey identifies the Postgres advisory lock held while migrating, so
+// instances starting together apply migrations one at a time
+const lockKey int64 = 0x7472_6163_6b76_0001
+
+// ErrUnmanaged is returned for a database that has a schema but no
+// migration history, e.g. one migrated by hand before the runner existed
+var ErrUnmanaged = errors.New("database has tables but no schema_migrations; record the migrations already applied with `trackveil-api migrate baseline <version>`")
+
+// Migration is an embedded schema migration
+type Migration struct {
+	Version  string // file name without .sql, e.g. "005_add_events_and_goals"
+	Up       string
+	Down     string // empty if the migration cannot be rolled back
+	Checksum string // SHA-256 of Up
+}
+
+// Status is the state of a migration in the database
+type Status struct {
+	Version    string
+	Applied    bool
+	AppliedAt  time.Time
+	Modified   bool // applied with a different checksum than the embedded file
+	Unknown    bool // applied, but not embedded in this binary
+	Reversible bool
+}
+
+// Migrator applies the embedded migrations of the database's driver
+type Migrator struct {
+	db         *database.DB
+	migrations []Migration // by version
+}
+
+// applied is a schema_migrations row
+type applied struct {
+	checksum  string
+	appliedAt time.Time
+}
+
+// New creates a migrator for the database
+func New(db *database.DB) (*Migrator, error) {
+	migrations, err := load(db.Driver)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: migrations}, nil
+}
+
+// load reads the embedded migrations of a driver
+func load(driver string) ([]Migration, error) {
+	names, err := fs.Glob(files, driver+"/*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	for _, name := range names {
+		if strings.HasSuffix(name, ".down.sql") {
+			continue
+		}
+		up, err := files.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(up)
+		m := Migration{
+			Version:  strings.TrimSuffix(path.Base(name), ".sql"),
+			Up:       string(up),
+			Checksum: hex.EncodeToString(sum[:]),
+		}
+		if down, err := files.ReadFile(strings.TrimSuffix(name, ".sql") + ".down.sql"); err == nil {
+			m.Down = string(down)
+		}
+		migrations = append(migrations, m)
+	}
+	if len(migrations) == 0 {
+		return nil, fmt.Errorf("no migrations for database driver %q", driver)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Up applies all pending migrations in order, each in its own transaction,
+// and returns the versions applied. It fails without applying anything if
+// an applied migration was changed since.
+func (m *Migrator) Up(ctx context.Context) ([]string, error) {
+	var done []string
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		if err := m.prepare(ctx, conn); err != nil {
+			return err
+		}
+		history, err := m.history(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, mig := range m.migrations {
+			if a, ok := history[mig.Version]; ok && a.checksum != mig.Checksum {
+				return fmt.Errorf("migration %s was changed after it was applied; see `trackveil-api migrate verify`", mig.Version)
+			}
+		}
+
+		for _, mig := range m.migrations {
+			if _, ok := history[mig.Version]; ok {
+				continue
+			}
+			ok, err := m.apply(ctx, conn, mig)
+			if err != nil {
+				return fmt.Errorf("migration %s: %w", mig.Version, err)
+			}
+			if ok {
+				done = append(done, mig.Version)
+			}
+		}
+		return nil
+	})
+	return done, err
+}
+
+// apply runs a migration and records it, unless another instance already
+// did (SQLite has no advisory lock; its write transactions are serialized)
+func (m *Migrator) apply(ctx context.Context, conn *sql.Conn, mig Migration) (bool, error) {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM schema_migrations WHERE version = $1)`, mig.Version).Scan(&exists); err != nil {
+		return false, err
+	}
+	if exists {
+		return false, nil
+	}
+
+	if _, err := tx.ExecContext(ctx, mig.Up); err != nil {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO schema_migrations (version, checksum, applied_at) VALUES ($1, $2, $3)
+	`, mig.Version, mig.Checksum, time.Now()); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// Down rolls back the last steps applied migrations, newest first, and
+// returns the versions rolled back. Nothing is rolled back if one of them
+// has no down migration or is unknown to this binary.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]string, error) {
+	var done []string
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		if err := m.prepare(ctx, conn); err != nil {
+			return err
+		}
+		history, err := m.history(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		versions := make([]string, 0, len(history))
+		for version := range history {
+			versions = append(versions, version)
+		}
+		sort.Sort(sort.Reverse(sort.StringSlice(versions)))
+		if steps < len(versions) {
+			versions = versions[:steps]
+		}
+
+		var rollback []Migration
+		for _, version := range versions {
+			mig, ok := m.find(version)
+			if !ok {
+				return fmt.Errorf("migration %s is not known to this binary", version)
+			}
+			if mig.Down == "" {
+				return fmt.Errorf("migration %s cannot be rolled back", version)
+			}
+			rollback = append(rollback, mig)
+		}
+
+		for _, mig := range rollback {
+			if err := m.revert(ctx, conn, mig); err != nil {
+				return fmt.Errorf("migration %s: %w", mig.Version, err)
+			}
+			done = append(done, mig.Version)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// revert runs a down migration and removes its record
+func (m *Migrator) revert(ctx context.Context, conn *sql.Conn, mig Migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, mig.Down); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version = $1`, mig.Version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Status lists the embedded migrations and any applied ones this binary
+// does not know, by version
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	history := map[string]applied{}
+	managed, err := m.tableExists(ctx, conn, "schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	if managed {
+		if history, err = m.history(ctx, conn); err != nil {
+			return nil, err
+		}
+	} else if unmanaged, err := m.tableExists(ctx, conn, "accounts"); err != nil {
+		return nil, err
+	} else if unmanaged {
+		return nil, ErrUnmanaged
+	}
+
+	var statuses []Status
+	for _, mig := range m.migrations {
+		s := Status{Version: mig.Version, Reversible: mig.Down != ""}
+		if a, ok := history[mig.Version]; ok {
+			s.Applied, s.AppliedAt, s.Modified = true, a.appliedAt, a.checksum != mig.Checksum
+			delete(history, mig.Version)
+		}
+		statuses = append(statuses, s)
+	}
+	for version, a := range history {
+		statuses = append(statuses, Status{Version: version, Applied: true, AppliedAt: a.appliedAt, Unknown: true})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses, nil
+}
+
+// Verify checks that the database schema matches this binary: every
+// migration applied, unchanged since, and none unknown. It returns one
+// problem per migration that does not.
+func (m *Migrator) Verify(ctx context.Context) ([]string, error) {
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	for _, s := range statuses {
+		switch {
+		case s.Unknown:
+			problems = append(problems, fmt.Sprintf("%s: applied, but not known to this binary", s.Version))
+		case s.Modified:
+			problems = append(problems, fmt.Sprintf("%s: changed after it was applied (checksum mismatch)", s.Version))
+		case !s.Applied:
+			problems = append(problems, fmt.Sprintf("%s: pending", s.Version))
+		}
+	}
+	return problems, nil
+}
+
+// Baseline records the migrations up to and including version as applied
+// without running them, for databases migrated by hand. version may be the
+// full version or its number (e.g. "014").
+func (m *Migrator) Baseline(ctx context.Context, version string) ([]string, error) {
+	target, ok := m.find(version)
+	if !ok {
+		return nil, fmt.Errorf("unknown migration %q", version)
+	}
+
+	var done []string
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		if err := m.createTable(ctx, conn); err != nil {
+			return err
+		}
+		history, err := m.history(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		for _, mig := range m.migrations {
+			if mig.Version > target.Version {
+				break
+			}
+			if _, ok := history[mig.Version]; ok {
+				continue
+			}
+			if _, err := tx.ExecContext(ctx, `
+				INSERT INTO schema_migrations (version, checksum, applied_at) VALUES ($1, $2, $3)
+			`, mig.Version, mig.Checksum, time.Now()); err != nil {
+				return err
+			}
+			done = append(done, mig.Version)
+		}
+		return tx.Commit()
+	})
+	return done, err
+}
+
+// Seed applies the development data in seeds/ in one transaction. The
+// schema must be up to date.
+func (m *Migrator) Seed(ctx context.Context) error {
+	names, err := fs.Glob(files, "seeds/*.sql")
+	if err != nil {
+		return err
+	}
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, name := range names {
+		script, err := files.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, string(script)); err != nil {
+			return fmt.Errorf("%s: %w", path.Base(name), err)
+		}
+	}
+	return tx.Commit()
+}
+
+// find returns the migration with the given version or version number
+func (m *Migrator) find(version string) (Migration, bool) {
+	for _, mig := range m.migrations {
+		if mig.Version == version || strings.HasPrefix(mig.Version, version+"_") {
+			return mig, true
+		}
+	}
+	return Migration{}, false
+}
+
+// locked runs fn on one connection, holding the migration lock on Postgres
+func (m *Migrator) locked(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if !m.db.SQLite() {
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, lockKey); err != nil {
+			return fmt.Errorf("failed to take the migration lock: %w", err)
+		}
+		// Session-level, so released even if ctx is cancelled meanwhile
+		defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, lockKey)
+	}
+	return fn(conn)
+}
+
+// prepare creates schema_migrations, refusing databases with an unrecorded
+// schema
+func (m *Migrator) prepare(ctx context.Context, conn *sql.Conn) error {
+	managed, err := m.tableExists(ctx, conn, "schema_migrations")
+	if err != nil {
+		return err
+	}
+	if !managed {
+		unmanaged, err := m.tableExists(ctx, conn, "accounts")
+		if err != nil {
+			return err
+		}
+		if unmanaged {
+			return ErrUnmanaged
+		}
+	}
+	return m.createTable(ctx, conn)
+}
+
+func (m *Migrator) createTable(ctx context.Context, conn *sql.Conn) error {
+	appliedAt := "TIMESTAMP WITH TIME ZONE"
+	if m.db.SQLite() {
+		appliedAt = "TIMESTAMP"
+	}
+	_, err := conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version VARCHAR(255) PRIMARY KEY,
+			checksum VARCHAR(64) NOT NULL, -- SHA-256 of the migration file
+			applied_at `+appliedAt+` NOT NULL
+		)
+	`)
+	return err
+}
+
+func (m *Migrator) tableExists(ctx context.Context, conn *sql.Conn, table string) (bool, error) {
+	query := `SELECT to_regclass($1) IS NOT NULL`
+	if m.db.SQLite() {
+		query = `SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = $1)`
+	}
+	var exists bool
+	err := conn.QueryRowContext(ctx, query, table).Scan(&exists)
+	return exists, err
+}
+
+// history returns the applied migrations by version
+func (m *Migrator) history(ctx context.Context, conn *sql.Conn) (map[string]applied, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT version, checksum, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := map[string]applied{}
+	for rows.Next() {
+		var version string
+		var a applied
+		if err := rows.Scan(&version, &a.checksum, &a.appliedAt); err != nil {
+			return nil, err
+		}
+		history[version] = a
+	}
+	return history, rows.Err()
+}
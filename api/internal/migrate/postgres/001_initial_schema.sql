@@ -174,4 +174,3 @@ $$ language 'plpgsql';
 
 CREATE TRIGGER update_session_on_page_view AFTER INSERT ON page_views
     FOR EACH ROW EXECUTE FUNCTION update_session_last_activity();
-
@@ -0,0 +1,78 @@
+-- Custom events, conversion goals and recorded conversions
+-- Goals are evaluated by the API when hits are recorded
+
+-- Events table
+-- Custom events sent with trackveil.track(name, props)
+CREATE TABLE events (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    site_id VARCHAR(32) NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+    visitor_id UUID NOT NULL REFERENCES visitors(id) ON DELETE CASCADE,
+    session_id UUID NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+    event_name VARCHAR(100) NOT NULL,
+    page_url TEXT,
+    properties JSONB,
+    occurred_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_events_site_occurred_at ON events(site_id, occurred_at DESC);
+CREATE INDEX idx_events_site_name ON events(site_id, event_name);
+CREATE INDEX idx_events_session_id ON events(session_id);
+
+-- Function to update session last_activity_at from events
+CREATE OR REPLACE FUNCTION update_session_last_activity_from_event()
+RETURNS TRIGGER AS $$
+BEGIN
+    UPDATE sessions
+    SET last_activity_at = NEW.occurred_at
+    WHERE id = NEW.session_id;
+    RETURN NEW;
+END;
+$$ language 'plpgsql';
+
+CREATE TRIGGER update_session_on_event AFTER INSERT ON events
+    FOR EACH ROW EXECUTE FUNCTION update_session_last_activity_from_event();
+
+-- Goals table
+-- Conversion definitions per site:
+--   page_path  - page URL path matches page_path (* is a wildcard)
+--   event      - custom event with the given event_name
+--   engagement - session reaches min_page_views and/or min_duration_seconds
+CREATE TABLE goals (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    site_id VARCHAR(32) NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    goal_type VARCHAR(20) NOT NULL CHECK (goal_type IN ('page_path', 'event', 'engagement')),
+    page_path VARCHAR(500),
+    event_name VARCHAR(100),
+    min_page_views INTEGER,
+    min_duration_seconds INTEGER,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(site_id, name)
+);
+
+CREATE INDEX idx_goals_site_id ON goals(site_id) WHERE active;
+
+CREATE TRIGGER update_goals_updated_at BEFORE UPDATE ON goals
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+-- Conversions table
+-- At most one conversion per goal per session. The triggering hit is kept
+-- as a plain reference (no foreign key) so hit tables can be partitioned.
+CREATE TABLE conversions (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    goal_id UUID NOT NULL REFERENCES goals(id) ON DELETE CASCADE,
+    site_id VARCHAR(32) NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+    visitor_id UUID NOT NULL REFERENCES visitors(id) ON DELETE CASCADE,
+    session_id UUID NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+    page_view_id UUID,
+    event_id UUID,
+    source VARCHAR(255) NOT NULL DEFAULT 'Direct', -- attributed traffic source of the session
+    converted_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(goal_id, session_id)
+);
+
+CREATE INDEX idx_conversions_site_converted_at ON conversions(site_id, converted_at DESC);
+CREATE INDEX idx_conversions_goal_converted_at ON conversions(goal_id, converted_at DESC);
+CREATE INDEX idx_conversions_visitor_id ON conversions(visitor_id);
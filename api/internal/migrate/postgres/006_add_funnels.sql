@@ -0,0 +1,23 @@
+-- Funnel definitions
+-- Ordered steps evaluated over page_views and events by the funnel report API
+
+-- Funnels table
+-- steps is a JSON array of {"name", "type": "page_path"|"event", "value"}
+-- mode is 'session' (all steps in one session) or 'window' (within
+-- window_seconds of the first step, across sessions)
+CREATE TABLE funnels (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    site_id VARCHAR(32) NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    steps JSONB NOT NULL,
+    mode VARCHAR(10) NOT NULL DEFAULT 'session' CHECK (mode IN ('session', 'window')),
+    window_seconds INTEGER,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(site_id, name)
+);
+
+CREATE INDEX idx_funnels_site_id ON funnels(site_id);
+
+CREATE TRIGGER update_funnels_updated_at BEFORE UPDATE ON funnels
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
@@ -0,0 +1,53 @@
+-- Per-site secret keys for server-to-server tracking
+-- Keys are shown once on creation. The API identifies a key by its public
+-- key_id and verifies the secret against secret_hash (bearer) or signs with
+-- signing_secret (HMAC keys only).
+
+CREATE TABLE site_api_keys (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    site_id VARCHAR(32) NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    key_id VARCHAR(16) NOT NULL UNIQUE,          -- public identifier, part of the key
+    auth_type VARCHAR(10) NOT NULL CHECK (auth_type IN ('bearer', 'hmac')),
+    secret_hash VARCHAR(64) NOT NULL,            -- SHA-256 of the secret
+    signing_secret VARCHAR(64),                  -- HMAC keys only
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP WITH TIME ZONE,         -- set when the key is rotated out
+    revoked_at TIMESTAMP WITH TIME ZONE,
+    last_used_at TIMESTAMP WITH TIME ZONE,
+    rotated_from UUID REFERENCES site_api_keys(id) ON DELETE SET NULL
+);
+
+CREATE INDEX idx_site_api_keys_site_id ON site_api_keys(site_id);
+
+-- Server hits may be back-dated, so activity timestamps only move forward
+CREATE OR REPLACE FUNCTION update_visitor_last_seen()
+RETURNS TRIGGER AS $$
+BEGIN
+    UPDATE visitors 
+    SET last_seen_at = GREATEST(last_seen_at, NEW.viewed_at),
+        total_visits = total_visits + 1
+    WHERE id = NEW.visitor_id;
+    RETURN NEW;
+END;
+$$ language 'plpgsql';
+
+CREATE OR REPLACE FUNCTION update_session_last_activity()
+RETURNS TRIGGER AS $$
+BEGIN
+    UPDATE sessions 
+    SET last_activity_at = GREATEST(last_activity_at, NEW.viewed_at)
+    WHERE id = NEW.session_id;
+    RETURN NEW;
+END;
+$$ language 'plpgsql';
+
+CREATE OR REPLACE FUNCTION update_session_last_activity_from_event()
+RETURNS TRIGGER AS $$
+BEGIN
+    UPDATE sessions
+    SET last_activity_at = GREATEST(last_activity_at, NEW.occurred_at)
+    WHERE id = NEW.session_id;
+    RETURN NEW;
+END;
+$$ language 'plpgsql';
@@ -0,0 +1,15 @@
+-- GA4 Measurement Protocol api_secrets as site keys
+-- For ga4 keys, key_id holds the measurement_id and secret_hash the
+-- SHA-256 of the api_secret. A measurement_id can have several secrets
+-- (rotation), so key_id is only unique for generated keys.
+
+ALTER TABLE site_api_keys DROP CONSTRAINT site_api_keys_auth_type_check;
+ALTER TABLE site_api_keys ADD CONSTRAINT site_api_keys_auth_type_check
+    CHECK (auth_type IN ('bearer', 'hmac', 'ga4'));
+
+-- Measurement IDs (G-XXXXXXXXXX) can be longer than generated key IDs
+ALTER TABLE site_api_keys ALTER COLUMN key_id TYPE VARCHAR(32);
+
+ALTER TABLE site_api_keys DROP CONSTRAINT site_api_keys_key_id_key;
+CREATE UNIQUE INDEX idx_site_api_keys_key_id ON site_api_keys(key_id) WHERE auth_type <> 'ga4';
+CREATE INDEX idx_site_api_keys_ga4 ON site_api_keys(key_id, secret_hash) WHERE auth_type = 'ga4';
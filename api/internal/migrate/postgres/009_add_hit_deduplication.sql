@@ -0,0 +1,24 @@
+-- Duplicate hit suppression
+-- Client event IDs are unique per site while they are retained (the API
+-- purges them after DEDUP_EVENT_ID_RETENTION_HOURS). Suppressed duplicates
+-- are counted per site and day for diagnostics.
+
+CREATE TABLE hit_event_ids (
+    site_id VARCHAR(32) NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+    event_id VARCHAR(64) NOT NULL,
+    received_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (site_id, event_id)
+);
+
+CREATE INDEX idx_hit_event_ids_received_at ON hit_event_ids(received_at);
+
+CREATE TABLE suppressed_hits (
+    site_id VARCHAR(32) NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+    day DATE NOT NULL,
+    reason VARCHAR(20) NOT NULL, -- event_id, heuristic
+    count BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (site_id, day, reason)
+);
+
+-- Supports the same-visitor same-URL duplicate check
+CREATE INDEX idx_page_views_visitor_viewed_at ON page_views(visitor_id, viewed_at DESC);
@@ -0,0 +1,16 @@
+-- Tracker settings
+-- Per-site settings injected into tracker.js when the API serves it.
+-- Sites without a row use the defaults (API endpoint, no SPA or privacy mode).
+
+CREATE TABLE site_tracker_settings (
+    site_id VARCHAR(32) PRIMARY KEY REFERENCES sites(id) ON DELETE CASCADE,
+    endpoint TEXT, -- tracking endpoint override, e.g. a first-party proxy
+    spa_mode BOOLEAN NOT NULL DEFAULT false, -- track history navigation as page views
+    privacy_mode BOOLEAN NOT NULL DEFAULT false, -- no stored or canvas fingerprint
+    excluded_paths TEXT[] NOT NULL DEFAULT '{}', -- path patterns, * matches anything
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TRIGGER update_site_tracker_settings_updated_at BEFORE UPDATE ON site_tracker_settings
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
@@ -0,0 +1,12 @@
+-- Custom tracking domains
+-- Customer-owned hostnames (e.g. stats.customer.com, CNAMEd to the API) on
+-- which tracking and script requests resolve the site from the Host header.
+
+CREATE TABLE site_custom_domains (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    site_id VARCHAR(32) NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+    hostname VARCHAR(253) NOT NULL UNIQUE, -- lowercase, no port
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_site_custom_domains_site_id ON site_custom_domains(site_id);
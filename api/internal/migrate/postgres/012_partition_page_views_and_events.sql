@@ -0,0 +1,165 @@
+-- Monthly partitioning of page_views and events
+-- Both tables become range-partitioned by month on their timestamp, with a
+-- default partition for hits outside the existing partitions. Existing rows
+-- are copied into monthly partitions. The API creates partitions ahead of
+-- time and detaches (or drops) expired ones (see PARTITION_* settings).
+--
+-- The primary keys become (id, viewed_at) and (id, occurred_at), because
+-- unique constraints on a partitioned table must include the partition key.
+-- Nothing references page_views or events by foreign key.
+
+-- Creates the monthly partition of a table containing the given day, if it
+-- does not exist yet, and returns its name (e.g. page_views_y2026m01). Rows
+-- already in the table's default partition for that month are moved into it.
+CREATE OR REPLACE FUNCTION create_monthly_partition(parent TEXT, month DATE)
+RETURNS TEXT AS $$
+DECLARE
+    from_ts TIMESTAMP WITH TIME ZONE := date_trunc('month', month)::timestamp AT TIME ZONE 'UTC';
+    to_ts TIMESTAMP WITH TIME ZONE := (date_trunc('month', month) + INTERVAL '1 month')::timestamp AT TIME ZONE 'UTC';
+    partition_name TEXT := format('%s_y%sm%s', parent, to_char(month, 'YYYY'), to_char(month, 'MM'));
+    key_column TEXT;
+BEGIN
+    IF to_regclass(partition_name) IS NOT NULL THEN
+        RETURN partition_name;
+    END IF;
+
+    SELECT a.attname INTO key_column
+    FROM pg_partitioned_table p
+    JOIN pg_attribute a ON a.attrelid = p.partrelid AND a.attnum = p.partattrs[0]
+    WHERE p.partrelid = parent::regclass;
+
+    -- Created standalone and attached, so rows can first be moved out of the
+    -- default partition (attaching validates that it holds none for the month)
+    EXECUTE format('CREATE TABLE %I (LIKE %I INCLUDING DEFAULTS INCLUDING CONSTRAINTS)',
+        partition_name, parent);
+    EXECUTE format(
+        'WITH moved AS (DELETE FROM %I WHERE %I >= $1 AND %I < $2 RETURNING *) INSERT INTO %I SELECT * FROM moved',
+        parent || '_default', key_column, key_column, partition_name)
+        USING from_ts, to_ts;
+    EXECUTE format('ALTER TABLE %I ATTACH PARTITION %I FOR VALUES FROM (%L) TO (%L)',
+        parent, partition_name, from_ts, to_ts);
+
+    RETURN partition_name;
+END;
+$$ language 'plpgsql';
+
+-- Page views
+
+ALTER TABLE page_views RENAME TO page_views_unpartitioned;
+
+CREATE TABLE page_views (
+    id UUID NOT NULL DEFAULT uuid_generate_v4(),
+    site_id VARCHAR(32) NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+    visitor_id UUID NOT NULL REFERENCES visitors(id) ON DELETE CASCADE,
+    session_id UUID NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+
+    -- Page information
+    page_url TEXT NOT NULL,
+    page_title VARCHAR(500),
+    referrer TEXT,
+
+    -- Technical information
+    user_agent TEXT,
+    ip_address INET,
+    country_code VARCHAR(2), -- ISO 3166-1 alpha-2
+
+    -- Browser/device information (parsed from user agent)
+    browser_name VARCHAR(50),
+    browser_version VARCHAR(50),
+    os_name VARCHAR(50),
+    os_version VARCHAR(50),
+    device_type VARCHAR(20), -- desktop, mobile, tablet
+
+    -- Screen information
+    screen_width INTEGER,
+    screen_height INTEGER,
+
+    -- Timing (partition key)
+    viewed_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    -- Performance metrics (optional, can be null)
+    page_load_time INTEGER -- milliseconds
+) PARTITION BY RANGE (viewed_at);
+
+CREATE TABLE page_views_default PARTITION OF page_views DEFAULT;
+
+-- Partitions for every month with data, through three months ahead
+SELECT create_monthly_partition('page_views', month::date)
+FROM generate_series(
+    date_trunc('month', COALESCE((SELECT MIN(viewed_at) FROM page_views_unpartitioned), CURRENT_TIMESTAMP) AT TIME ZONE 'UTC'),
+    date_trunc('month', CURRENT_TIMESTAMP AT TIME ZONE 'UTC') + INTERVAL '3 months',
+    INTERVAL '1 month'
+) AS month;
+
+-- Copied before indexes and triggers exist: faster, and the visitor and
+-- session counters must not be updated again
+INSERT INTO page_views (
+    id, site_id, visitor_id, session_id, page_url, page_title, referrer,
+    user_agent, ip_address, country_code, browser_name, browser_version,
+    os_name, os_version, device_type, screen_width, screen_height,
+    viewed_at, page_load_time
+)
+SELECT
+    id, site_id, visitor_id, session_id, page_url, page_title, referrer,
+    user_agent, ip_address, country_code, browser_name, browser_version,
+    os_name, os_version, device_type, screen_width, screen_height,
+    COALESCE(viewed_at, CURRENT_TIMESTAMP), page_load_time
+FROM page_views_unpartitioned;
+
+DROP TABLE page_views_unpartitioned;
+
+ALTER TABLE page_views ADD PRIMARY KEY (id, viewed_at);
+
+CREATE INDEX idx_page_views_site_id ON page_views(site_id);
+CREATE INDEX idx_page_views_visitor_id ON page_views(visitor_id);
+CREATE INDEX idx_page_views_session_id ON page_views(session_id);
+CREATE INDEX idx_page_views_viewed_at ON page_views(viewed_at DESC);
+CREATE INDEX idx_page_views_site_viewed_at ON page_views(site_id, viewed_at DESC);
+CREATE INDEX idx_page_views_page_url ON page_views(site_id, page_url);
+CREATE INDEX idx_page_views_country_code ON page_views(site_id, country_code);
+CREATE INDEX idx_page_views_visitor_viewed_at ON page_views(visitor_id, viewed_at DESC);
+
+CREATE TRIGGER update_visitor_on_page_view AFTER INSERT ON page_views
+    FOR EACH ROW EXECUTE FUNCTION update_visitor_last_seen();
+
+CREATE TRIGGER update_session_on_page_view AFTER INSERT ON page_views
+    FOR EACH ROW EXECUTE FUNCTION update_session_last_activity();
+
+-- Events
+
+ALTER TABLE events RENAME TO events_unpartitioned;
+
+CREATE TABLE events (
+    id UUID NOT NULL DEFAULT uuid_generate_v4(),
+    site_id VARCHAR(32) NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+    visitor_id UUID NOT NULL REFERENCES visitors(id) ON DELETE CASCADE,
+    session_id UUID NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+    event_name VARCHAR(100) NOT NULL,
+    page_url TEXT,
+    properties JSONB,
+    occurred_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP -- partition key
+) PARTITION BY RANGE (occurred_at);
+
+CREATE TABLE events_default PARTITION OF events DEFAULT;
+
+SELECT create_monthly_partition('events', month::date)
+FROM generate_series(
+    date_trunc('month', COALESCE((SELECT MIN(occurred_at) FROM events_unpartitioned), CURRENT_TIMESTAMP) AT TIME ZONE 'UTC'),
+    date_trunc('month', CURRENT_TIMESTAMP AT TIME ZONE 'UTC') + INTERVAL '3 months',
+    INTERVAL '1 month'
+) AS month;
+
+INSERT INTO events (id, site_id, visitor_id, session_id, event_name, page_url, properties, occurred_at)
+SELECT id, site_id, visitor_id, session_id, event_name, page_url, properties, COALESCE(occurred_at, CURRENT_TIMESTAMP)
+FROM events_unpartitioned;
+
+DROP TABLE events_unpartitioned;
+
+ALTER TABLE events ADD PRIMARY KEY (id, occurred_at);
+
+CREATE INDEX idx_events_site_occurred_at ON events(site_id, occurred_at DESC);
+CREATE INDEX idx_events_site_name ON events(site_id, event_name);
+CREATE INDEX idx_events_session_id ON events(session_id);
+
+CREATE TRIGGER update_session_on_event AFTER INSERT ON events
+    FOR EACH ROW EXECUTE FUNCTION update_session_last_activity_from_event();
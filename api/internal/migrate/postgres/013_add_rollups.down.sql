@@ -0,0 +1,9 @@
+-- Removes the rollups; stats are no longer available until they are re-added
+
+DROP TRIGGER mark_rollup_dirty_on_page_view ON page_views;
+DROP FUNCTION mark_rollup_dirty_hours();
+
+DROP TABLE rollup_dirty_hours;
+DROP TABLE rollup_state;
+DROP TABLE rollups_daily;
+DROP TABLE rollups_hourly;
@@ -0,0 +1,69 @@
+-- Pre-aggregated page view rollups for reporting
+-- The API aggregates raw page views into hourly and daily (UTC) rollups per
+-- site and dimension value: page, source, browser, os, device, country and
+-- campaign, plus a 'total' row per bucket. Visitors are distinct within each
+-- bucket. Hours that receive hits after they were aggregated (backdated or
+-- replayed hits) are marked dirty and recomputed.
+
+CREATE TABLE rollups_hourly (
+    site_id VARCHAR(32) NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+    bucket TIMESTAMP WITH TIME ZONE NOT NULL, -- start of the hour
+    dimension VARCHAR(20) NOT NULL, -- total, page, source, browser, os, device, country, campaign
+    value VARCHAR(500) NOT NULL DEFAULT '', -- empty for total
+    label VARCHAR(500), -- display name, e.g. the page title
+    page_views BIGINT NOT NULL DEFAULT 0,
+    visitors BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (site_id, bucket, dimension, value)
+);
+
+CREATE INDEX idx_rollups_hourly_bucket ON rollups_hourly(bucket);
+
+CREATE TABLE rollups_daily (
+    site_id VARCHAR(32) NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+    bucket DATE NOT NULL, -- UTC day
+    dimension VARCHAR(20) NOT NULL,
+    value VARCHAR(500) NOT NULL DEFAULT '',
+    label VARCHAR(500),
+    page_views BIGINT NOT NULL DEFAULT 0,
+    visitors BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (site_id, bucket, dimension, value)
+);
+
+CREATE INDEX idx_rollups_daily_bucket ON rollups_daily(bucket);
+
+-- Aggregation progress: every hour before completed_through is aggregated
+CREATE TABLE rollup_state (
+    name VARCHAR(50) PRIMARY KEY,
+    completed_through TIMESTAMP WITH TIME ZONE NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TRIGGER update_rollup_state_updated_at BEFORE UPDATE ON rollup_state
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+-- Site hours that received page views after they were aggregated
+CREATE TABLE rollup_dirty_hours (
+    site_id VARCHAR(32) NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+    hour TIMESTAMP WITH TIME ZONE NOT NULL,
+    marked_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (site_id, hour)
+);
+
+-- Marks the hours of inserted page views that are already aggregated. Runs
+-- once per statement, so the common case (hits for the current hour) only
+-- costs one lookup.
+CREATE OR REPLACE FUNCTION mark_rollup_dirty_hours()
+RETURNS TRIGGER AS $$
+BEGIN
+    INSERT INTO rollup_dirty_hours (site_id, hour)
+    SELECT DISTINCT n.site_id, date_trunc('hour', n.viewed_at AT TIME ZONE 'UTC') AT TIME ZONE 'UTC'
+    FROM new_page_views n
+    WHERE n.viewed_at < (SELECT completed_through FROM rollup_state WHERE name = 'hourly')
+    ON CONFLICT DO NOTHING;
+    RETURN NULL;
+END;
+$$ language 'plpgsql';
+
+CREATE TRIGGER mark_rollup_dirty_on_page_view AFTER INSERT ON page_views
+    REFERENCING NEW TABLE AS new_page_views
+    FOR EACH STATEMENT EXECUTE FUNCTION mark_rollup_dirty_hours();
@@ -0,0 +1,4 @@
+-- Removes the visitor sketches; the rollups keep their visitor counts
+
+ALTER TABLE rollups_hourly DROP COLUMN visitors_sketch;
+ALTER TABLE rollups_daily DROP COLUMN visitors_sketch;
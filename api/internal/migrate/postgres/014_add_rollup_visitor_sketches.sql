@@ -0,0 +1,13 @@
+-- HyperLogLog sketches of visitor IDs in the rollups
+-- Each rollup row keeps a serialized sketch (see api/internal/hll) of the
+-- visitors counted in it. Sketches of any buckets and dimension values can
+-- be merged to count unique visitors over a range with ~0.8% standard error.
+--
+-- Existing rollups have no sketches, so they are cleared along with the
+-- aggregation progress; the API rebuilds them from page_views.
+
+ALTER TABLE rollups_hourly ADD COLUMN visitors_sketch BYTEA;
+ALTER TABLE rollups_daily ADD COLUMN visitors_sketch BYTEA;
+
+TRUNCATE rollups_hourly, rollups_daily, rollup_dirty_hours;
+DELETE FROM rollup_state WHERE name = 'hourly';
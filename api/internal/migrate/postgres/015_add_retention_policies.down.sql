@@ -0,0 +1,9 @@
+-- Removes retention policies and the purge audit log; purged data is not restored
+
+DROP INDEX idx_visitors_site_last_seen;
+DROP INDEX idx_sessions_site_last_activity;
+
+DROP TABLE retention_purges;
+DROP TABLE site_retention;
+ALTER TABLE accounts DROP COLUMN retention_plan;
+DROP TABLE retention_plans;
@@ -0,0 +1,50 @@
+-- Data retention policies
+-- Days of raw hits, visitor records and rollups to keep (0 keeps forever).
+-- A site's overrides take precedence over its account's plan, which takes
+-- precedence over the server defaults (RETENTION_* settings); NULL inherits.
+-- The API purges expired data in the background and logs every purge in
+-- retention_purges.
+
+CREATE TABLE retention_plans (
+    name VARCHAR(50) PRIMARY KEY,
+    raw_hit_days INTEGER CHECK (raw_hit_days >= 0), -- page views, events and sessions
+    visitor_days INTEGER CHECK (visitor_days >= 0), -- visitors, with their remaining sessions and hits
+    rollup_days INTEGER CHECK (rollup_days >= 0), -- hourly and daily rollups
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TRIGGER update_retention_plans_updated_at BEFORE UPDATE ON retention_plans
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+ALTER TABLE accounts ADD COLUMN retention_plan VARCHAR(50)
+    REFERENCES retention_plans(name) ON UPDATE CASCADE ON DELETE SET NULL;
+
+CREATE TABLE site_retention (
+    site_id VARCHAR(32) PRIMARY KEY REFERENCES sites(id) ON DELETE CASCADE,
+    raw_hit_days INTEGER CHECK (raw_hit_days >= 0),
+    visitor_days INTEGER CHECK (visitor_days >= 0),
+    rollup_days INTEGER CHECK (rollup_days >= 0),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TRIGGER update_site_retention_updated_at BEFORE UPDATE ON site_retention
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+-- Audit log of purged data. No foreign key, so records outlive the site;
+-- site_id is NULL for monthly partitions dropped as a whole.
+CREATE TABLE retention_purges (
+    id UUID PRIMARY KEY,
+    site_id VARCHAR(32),
+    target VARCHAR(63) NOT NULL, -- table, or the dropped partition
+    cutoff TIMESTAMP WITH TIME ZONE NOT NULL, -- data before this was removed
+    rows_removed BIGINT NOT NULL,
+    purged_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_retention_purges_site_purged_at ON retention_purges(site_id, purged_at DESC);
+
+-- Supports purging sessions and visitors by last activity
+CREATE INDEX idx_sessions_site_last_activity ON sessions(site_id, last_activity_at);
+CREATE INDEX idx_visitors_site_last_seen ON visitors(site_id, last_seen_at);
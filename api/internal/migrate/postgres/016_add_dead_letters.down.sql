@@ -0,0 +1,3 @@
+-- Removes the dead letters; rejected hits kept there are lost
+
+DROP TABLE dead_letters;
@@ -0,0 +1,20 @@
+-- Dead letters: hits the database rejected for a reason a retry will not
+-- fix (constraint violations, invalid data), kept with the payload, the
+-- enrichment context and the error until they are re-ingested or discarded
+-- with `trackveil-api deadletter`. No foreign key, so letters outlive the site.
+
+CREATE TABLE dead_letters (
+    id UUID PRIMARY KEY,
+    site_id VARCHAR(32) NOT NULL,
+    kind VARCHAR(20) NOT NULL, -- request, page_view or event
+    source VARCHAR(50) NOT NULL, -- endpoint or storage backend that rejected it
+    payload JSONB NOT NULL,
+    context JSONB,
+    error TEXT NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0, -- failed re-ingestions
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_dead_letters_site_created_at ON dead_letters(site_id, created_at DESC);
+CREATE INDEX idx_dead_letters_created_at ON dead_letters(created_at DESC);
@@ -0,0 +1,3 @@
+-- Removes the sites' sink settings; sinks stop receiving hits
+
+DROP TABLE site_sinks;
@@ -0,0 +1,16 @@
+-- Streaming sinks
+-- A row enables a sink (configured on the server) for a site; accepted hits
+-- of the site are streamed to it, optionally filtered by type and event name.
+
+CREATE TABLE site_sinks (
+    site_id VARCHAR(32) NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+    sink VARCHAR(20) NOT NULL, -- ndjson, webhook or nats
+    hit_types TEXT[] NOT NULL DEFAULT '{}', -- page_view and/or event; empty for both
+    event_names TEXT[] NOT NULL DEFAULT '{}', -- events streamed; empty for all
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (site_id, sink)
+);
+
+CREATE TRIGGER update_site_sinks_updated_at BEFORE UPDATE ON site_sinks
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
@@ -0,0 +1,4 @@
+-- Removes the archive records; the archived files are left in place but are
+-- archived again, and retention limited to archived hits stops purging
+
+DROP TABLE hit_archives;
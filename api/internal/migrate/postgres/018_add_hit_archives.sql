@@ -0,0 +1,21 @@
+-- Hit archives: closed ranges of a site's raw hits exported to Parquet, with
+-- the sessions and visitors they reference, in a local directory or an S3
+-- bucket. location is the key of the range's manifest. No foreign key, so
+-- the record outlives the site, like its files.
+
+CREATE TABLE hit_archives (
+    id UUID PRIMARY KEY,
+    site_id VARCHAR(32) NOT NULL,
+    range_start TIMESTAMP WITH TIME ZONE NOT NULL,
+    range_end TIMESTAMP WITH TIME ZONE NOT NULL, -- exclusive
+    location TEXT NOT NULL,
+    page_views BIGINT NOT NULL DEFAULT 0,
+    events BIGINT NOT NULL DEFAULT 0,
+    sessions BIGINT NOT NULL DEFAULT 0,
+    visitors BIGINT NOT NULL DEFAULT 0,
+    bytes BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (site_id, range_start)
+);
+
+CREATE INDEX idx_hit_archives_site_range_end ON hit_archives(site_id, range_end DESC);
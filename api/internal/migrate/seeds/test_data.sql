@@ -0,0 +1,28 @@
+-- Development and test data
+-- A test account, a user who can log in to the dashboard (test@example.com,
+-- password "password123") and a site. Applied with `trackveil-api migrate
+-- seed`; rows that already exist are left alone.
+
+INSERT INTO accounts (id, name)
+VALUES ('00000000-0000-0000-0000-000000000001', 'Test Account')
+ON CONFLICT (id) DO NOTHING;
+
+-- Hash generated with: password_hash('password123', PASSWORD_DEFAULT)
+INSERT INTO users (id, account_id, email, name, password_hash)
+VALUES (
+    '00000000-0000-0000-0000-000000000002',
+    '00000000-0000-0000-0000-000000000001',
+    'test@example.com',
+    'Test User',
+    '$2y$12$kLXtqjDycOWPBQY1Z5gqdedJ173eRLWZFOKilDtSf62X7KvW/9PkC'
+)
+ON CONFLICT (id) DO NOTHING;
+
+INSERT INTO sites (id, account_id, name, domain)
+VALUES (
+    'a1b2c3d4e5f6g7h8i9j0k1l2m3n4o5p6',
+    '00000000-0000-0000-0000-000000000001',
+    'Test Site',
+    'example.com'
+)
+ON CONFLICT (id) DO NOTHING;
@@ -0,0 +1,21 @@
+-- Removes the whole schema and all data
+
+DROP TABLE rollup_dirty_hours;
+DROP TABLE rollup_state;
+DROP TABLE rollups_daily;
+DROP TABLE rollups_hourly;
+DROP TABLE site_custom_domains;
+DROP TABLE site_tracker_settings;
+DROP TABLE suppressed_hits;
+DROP TABLE hit_event_ids;
+DROP TABLE site_api_keys;
+DROP TABLE funnels;
+DROP TABLE conversions;
+DROP TABLE goals;
+DROP TABLE events;
+DROP TABLE page_views;
+DROP TABLE sessions;
+DROP TABLE visitors;
+DROP TABLE sites;
+DROP TABLE users;
+DROP TABLE accounts;
@@ -0,0 +1,310 @@
+-- Trackveil SQLite schema
+-- The Postgres schema (postgres/001-014) for single-file
+-- installs. Differences from Postgres:
+--   * UUIDs are TEXT, JSONB and TEXT[] are JSON text, BYTEA is BLOB
+--   * timestamps are UTC text in the API's format ('YYYY-MM-DD HH:MM:SS.SSS'),
+--     so they compare correctly as text
+--   * page_views and events are not partitioned
+--   * visitor and session activity is updated by the API's SQLite store
+--     when hits are received, not by triggers on page_views and events
+
+-- Accounts
+CREATE TABLE accounts (
+    id TEXT PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    updated_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now'))
+);
+
+CREATE INDEX idx_accounts_created_at ON accounts(created_at);
+
+-- Users
+CREATE TABLE users (
+    id TEXT PRIMARY KEY,
+    account_id TEXT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+    email VARCHAR(255) NOT NULL UNIQUE,
+    name VARCHAR(255),
+    password_hash VARCHAR(255),
+    email_verified BOOLEAN DEFAULT FALSE,
+    verification_token VARCHAR(64),
+    last_login_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    updated_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now'))
+);
+
+CREATE INDEX idx_users_account_id ON users(account_id);
+
+-- Sites
+CREATE TABLE sites (
+    id VARCHAR(32) PRIMARY KEY,
+    account_id TEXT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    domain VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    updated_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    UNIQUE(account_id, domain)
+);
+
+CREATE INDEX idx_sites_domain ON sites(domain);
+
+-- Visitors
+CREATE TABLE visitors (
+    id TEXT PRIMARY KEY,
+    site_id VARCHAR(32) NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+    fingerprint_hash VARCHAR(64) NOT NULL,
+    first_seen_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    last_seen_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    total_visits INTEGER DEFAULT 1,
+    UNIQUE(site_id, fingerprint_hash)
+);
+
+CREATE INDEX idx_visitors_last_seen_at ON visitors(last_seen_at);
+
+-- Sessions
+CREATE TABLE sessions (
+    id TEXT PRIMARY KEY,
+    visitor_id TEXT NOT NULL REFERENCES visitors(id) ON DELETE CASCADE,
+    site_id VARCHAR(32) NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+    started_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    last_activity_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    ended_at TIMESTAMP
+);
+
+CREATE INDEX idx_sessions_visitor_id ON sessions(visitor_id, started_at DESC);
+CREATE INDEX idx_sessions_site_id ON sessions(site_id);
+
+-- Page views
+CREATE TABLE page_views (
+    id TEXT PRIMARY KEY,
+    site_id VARCHAR(32) NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+    visitor_id TEXT NOT NULL REFERENCES visitors(id) ON DELETE CASCADE,
+    session_id TEXT NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+    page_url TEXT NOT NULL,
+    page_title VARCHAR(500),
+    referrer TEXT,
+    user_agent TEXT,
+    ip_address TEXT,
+    country_code VARCHAR(2),
+    browser_name VARCHAR(50),
+    browser_version VARCHAR(50),
+    os_name VARCHAR(50),
+    os_version VARCHAR(50),
+    device_type VARCHAR(20),
+    screen_width INTEGER,
+    screen_height INTEGER,
+    viewed_at TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    page_load_time INTEGER
+);
+
+CREATE INDEX idx_page_views_viewed_at ON page_views(viewed_at);
+CREATE INDEX idx_page_views_site_viewed_at ON page_views(site_id, viewed_at);
+CREATE INDEX idx_page_views_session_id ON page_views(session_id, viewed_at);
+CREATE INDEX idx_page_views_visitor_viewed_at ON page_views(visitor_id, viewed_at);
+
+-- Custom events
+CREATE TABLE events (
+    id TEXT PRIMARY KEY,
+    site_id VARCHAR(32) NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+    visitor_id TEXT NOT NULL REFERENCES visitors(id) ON DELETE CASCADE,
+    session_id TEXT NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+    event_name VARCHAR(100) NOT NULL,
+    page_url TEXT,
+    properties TEXT, -- JSON object
+    occurred_at TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now'))
+);
+
+CREATE INDEX idx_events_site_occurred_at ON events(site_id, occurred_at);
+CREATE INDEX idx_events_site_name ON events(site_id, event_name);
+CREATE INDEX idx_events_session_id ON events(session_id);
+
+-- Goals
+CREATE TABLE goals (
+    id TEXT PRIMARY KEY,
+    site_id VARCHAR(32) NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    goal_type VARCHAR(20) NOT NULL CHECK (goal_type IN ('page_path', 'event', 'engagement')),
+    page_path VARCHAR(500),
+    event_name VARCHAR(100),
+    min_page_views INTEGER,
+    min_duration_seconds INTEGER,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    updated_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    UNIQUE(site_id, name)
+);
+
+-- Conversions, at most one per goal per session
+CREATE TABLE conversions (
+    id TEXT PRIMARY KEY,
+    goal_id TEXT NOT NULL REFERENCES goals(id) ON DELETE CASCADE,
+    site_id VARCHAR(32) NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+    visitor_id TEXT NOT NULL REFERENCES visitors(id) ON DELETE CASCADE,
+    session_id TEXT NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+    page_view_id TEXT,
+    event_id TEXT,
+    source VARCHAR(255) NOT NULL DEFAULT 'Direct',
+    converted_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    UNIQUE(goal_id, session_id)
+);
+
+CREATE INDEX idx_conversions_site_converted_at ON conversions(site_id, converted_at);
+CREATE INDEX idx_conversions_goal_converted_at ON conversions(goal_id, converted_at);
+
+-- Funnels; steps is a JSON array
+CREATE TABLE funnels (
+    id TEXT PRIMARY KEY,
+    site_id VARCHAR(32) NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    steps TEXT NOT NULL,
+    mode VARCHAR(10) NOT NULL DEFAULT 'session' CHECK (mode IN ('session', 'window')),
+    window_seconds INTEGER,
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    updated_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    UNIQUE(site_id, name)
+);
+
+-- Site keys for server-to-server tracking and GA4 api_secrets
+CREATE TABLE site_api_keys (
+    id TEXT PRIMARY KEY,
+    site_id VARCHAR(32) NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    key_id VARCHAR(32) NOT NULL,
+    auth_type VARCHAR(10) NOT NULL CHECK (auth_type IN ('bearer', 'hmac', 'ga4')),
+    secret_hash VARCHAR(64) NOT NULL,
+    signing_secret VARCHAR(64),
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    expires_at TIMESTAMP,
+    revoked_at TIMESTAMP,
+    last_used_at TIMESTAMP,
+    rotated_from TEXT REFERENCES site_api_keys(id) ON DELETE SET NULL
+);
+
+CREATE INDEX idx_site_api_keys_site_id ON site_api_keys(site_id);
+CREATE UNIQUE INDEX idx_site_api_keys_key_id ON site_api_keys(key_id) WHERE auth_type <> 'ga4';
+CREATE INDEX idx_site_api_keys_ga4 ON site_api_keys(key_id, secret_hash) WHERE auth_type = 'ga4';
+
+-- Duplicate hit suppression
+CREATE TABLE hit_event_ids (
+    site_id VARCHAR(32) NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+    event_id VARCHAR(64) NOT NULL,
+    received_at TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    PRIMARY KEY (site_id, event_id)
+);
+
+CREATE INDEX idx_hit_event_ids_received_at ON hit_event_ids(received_at);
+
+CREATE TABLE suppressed_hits (
+    site_id VARCHAR(32) NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+    day DATE NOT NULL, -- 'YYYY-MM-DD'
+    reason VARCHAR(20) NOT NULL,
+    count BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (site_id, day, reason)
+);
+
+-- Tracker settings; excluded_paths is a JSON array
+CREATE TABLE site_tracker_settings (
+    site_id VARCHAR(32) PRIMARY KEY REFERENCES sites(id) ON DELETE CASCADE,
+    endpoint TEXT,
+    spa_mode BOOLEAN NOT NULL DEFAULT FALSE,
+    privacy_mode BOOLEAN NOT NULL DEFAULT FALSE,
+    excluded_paths TEXT NOT NULL DEFAULT '[]',
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    updated_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now'))
+);
+
+-- Custom tracking domains
+CREATE TABLE site_custom_domains (
+    id TEXT PRIMARY KEY,
+    site_id VARCHAR(32) NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+    hostname VARCHAR(253) NOT NULL UNIQUE,
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now'))
+);
+
+CREATE INDEX idx_site_custom_domains_site_id ON site_custom_domains(site_id);
+
+-- Reporting rollups
+CREATE TABLE rollups_hourly (
+    site_id VARCHAR(32) NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+    bucket TIMESTAMP NOT NULL,
+    dimension VARCHAR(20) NOT NULL,
+    value VARCHAR(500) NOT NULL DEFAULT '',
+    label VARCHAR(500),
+    page_views BIGINT NOT NULL DEFAULT 0,
+    visitors BIGINT NOT NULL DEFAULT 0,
+    visitors_sketch BLOB,
+    PRIMARY KEY (site_id, bucket, dimension, value)
+);
+
+CREATE INDEX idx_rollups_hourly_bucket ON rollups_hourly(bucket);
+
+CREATE TABLE rollups_daily (
+    site_id VARCHAR(32) NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+    bucket DATE NOT NULL, -- 'YYYY-MM-DD'
+    dimension VARCHAR(20) NOT NULL,
+    value VARCHAR(500) NOT NULL DEFAULT '',
+    label VARCHAR(500),
+    page_views BIGINT NOT NULL DEFAULT 0,
+    visitors BIGINT NOT NULL DEFAULT 0,
+    visitors_sketch BLOB,
+    PRIMARY KEY (site_id, bucket, dimension, value)
+);
+
+CREATE INDEX idx_rollups_daily_bucket ON rollups_daily(bucket);
+
+CREATE TABLE rollup_state (
+    name VARCHAR(50) PRIMARY KEY,
+    completed_through TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now'))
+);
+
+CREATE TABLE rollup_dirty_hours (
+    site_id VARCHAR(32) NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+    hour TIMESTAMP NOT NULL,
+    marked_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    PRIMARY KEY (site_id, hour)
+);
+
+-- Marks the hours of inserted page views that are already aggregated
+CREATE TRIGGER mark_rollup_dirty_on_page_view AFTER INSERT ON page_views
+FOR EACH ROW WHEN NEW.viewed_at < (SELECT completed_through FROM rollup_state WHERE name = 'hourly')
+BEGIN
+    INSERT INTO rollup_dirty_hours (site_id, hour)
+    VALUES (NEW.site_id, strftime('%Y-%m-%d %H:00:00.000', NEW.viewed_at))
+    ON CONFLICT DO NOTHING;
+END;
+
+-- updated_at columns
+CREATE TRIGGER update_accounts_updated_at AFTER UPDATE ON accounts FOR EACH ROW
+BEGIN
+    UPDATE accounts SET updated_at = strftime('%Y-%m-%d %H:%M:%f', 'now') WHERE id = NEW.id;
+END;
+
+CREATE TRIGGER update_users_updated_at AFTER UPDATE ON users FOR EACH ROW
+BEGIN
+    UPDATE users SET updated_at = strftime('%Y-%m-%d %H:%M:%f', 'now') WHERE id = NEW.id;
+END;
+
+CREATE TRIGGER update_sites_updated_at AFTER UPDATE ON sites FOR EACH ROW
+BEGIN
+    UPDATE sites SET updated_at = strftime('%Y-%m-%d %H:%M:%f', 'now') WHERE id = NEW.id;
+END;
+
+CREATE TRIGGER update_goals_updated_at AFTER UPDATE ON goals FOR EACH ROW
+BEGIN
+    UPDATE goals SET updated_at = strftime('%Y-%m-%d %H:%M:%f', 'now') WHERE id = NEW.id;
+END;
+
+CREATE TRIGGER update_funnels_updated_at AFTER UPDATE ON funnels FOR EACH ROW
+BEGIN
+    UPDATE funnels SET updated_at = strftime('%Y-%m-%d %H:%M:%f', 'now') WHERE id = NEW.id;
+END;
+
+CREATE TRIGGER update_site_tracker_settings_updated_at AFTER UPDATE ON site_tracker_settings FOR EACH ROW
+BEGIN
+    UPDATE site_tracker_settings SET updated_at = strftime('%Y-%m-%d %H:%M:%f', 'now') WHERE site_id = NEW.site_id;
+END;
+
+CREATE TRIGGER update_rollup_state_updated_at AFTER UPDATE ON rollup_state FOR EACH ROW
+BEGIN
+    UPDATE rollup_state SET updated_at = strftime('%Y-%m-%d %H:%M:%f', 'now') WHERE name = NEW.name;
+END;
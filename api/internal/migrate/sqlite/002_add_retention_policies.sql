@@ -0,0 +1,46 @@
+-- Data retention policies (postgres/015)
+
+CREATE TABLE retention_plans (
+    name VARCHAR(50) PRIMARY KEY,
+    raw_hit_days INTEGER CHECK (raw_hit_days >= 0),
+    visitor_days INTEGER CHECK (visitor_days >= 0),
+    rollup_days INTEGER CHECK (rollup_days >= 0),
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    updated_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now'))
+);
+
+CREATE TRIGGER update_retention_plans_updated_at AFTER UPDATE ON retention_plans FOR EACH ROW
+BEGIN
+    UPDATE retention_plans SET updated_at = strftime('%Y-%m-%d %H:%M:%f', 'now') WHERE name = NEW.name;
+END;
+
+ALTER TABLE accounts ADD COLUMN retention_plan VARCHAR(50)
+    REFERENCES retention_plans(name) ON UPDATE CASCADE ON DELETE SET NULL;
+
+CREATE TABLE site_retention (
+    site_id VARCHAR(32) PRIMARY KEY REFERENCES sites(id) ON DELETE CASCADE,
+    raw_hit_days INTEGER CHECK (raw_hit_days >= 0),
+    visitor_days INTEGER CHECK (visitor_days >= 0),
+    rollup_days INTEGER CHECK (rollup_days >= 0),
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    updated_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now'))
+);
+
+CREATE TRIGGER update_site_retention_updated_at AFTER UPDATE ON site_retention FOR EACH ROW
+BEGIN
+    UPDATE site_retention SET updated_at = strftime('%Y-%m-%d %H:%M:%f', 'now') WHERE site_id = NEW.site_id;
+END;
+
+CREATE TABLE retention_purges (
+    id TEXT PRIMARY KEY,
+    site_id VARCHAR(32),
+    target VARCHAR(63) NOT NULL,
+    cutoff TIMESTAMP NOT NULL,
+    rows_removed BIGINT NOT NULL,
+    purged_at TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now'))
+);
+
+CREATE INDEX idx_retention_purges_site_purged_at ON retention_purges(site_id, purged_at DESC);
+
+CREATE INDEX idx_sessions_site_last_activity ON sessions(site_id, last_activity_at);
+CREATE INDEX idx_visitors_site_last_seen ON visitors(site_id, last_seen_at);
@@ -0,0 +1,3 @@
+-- Removes the dead letters
+
+DROP TABLE dead_letters;
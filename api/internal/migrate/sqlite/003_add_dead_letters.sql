@@ -0,0 +1,17 @@
+-- Dead letters (postgres/016)
+
+CREATE TABLE dead_letters (
+    id TEXT PRIMARY KEY,
+    site_id VARCHAR(32) NOT NULL,
+    kind VARCHAR(20) NOT NULL,
+    source VARCHAR(50) NOT NULL,
+    payload TEXT NOT NULL,
+    context TEXT,
+    error TEXT NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    updated_at TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now'))
+);
+
+CREATE INDEX idx_dead_letters_site_created_at ON dead_letters(site_id, created_at DESC);
+CREATE INDEX idx_dead_letters_created_at ON dead_letters(created_at DESC);
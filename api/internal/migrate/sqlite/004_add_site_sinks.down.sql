@@ -0,0 +1,3 @@
+-- Removes the sites' sink settings
+
+DROP TABLE site_sinks;
@@ -0,0 +1,16 @@
+-- Streaming sinks (postgres/017)
+
+CREATE TABLE site_sinks (
+    site_id VARCHAR(32) NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+    sink VARCHAR(20) NOT NULL,
+    hit_types TEXT NOT NULL DEFAULT '[]',
+    event_names TEXT NOT NULL DEFAULT '[]',
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    updated_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    PRIMARY KEY (site_id, sink)
+);
+
+CREATE TRIGGER update_site_sinks_updated_at AFTER UPDATE ON site_sinks FOR EACH ROW
+BEGIN
+    UPDATE site_sinks SET updated_at = strftime('%Y-%m-%d %H:%M:%f', 'now') WHERE site_id = NEW.site_id AND sink = NEW.sink;
+END;
@@ -0,0 +1,3 @@
+-- Removes the archive records
+
+DROP TABLE hit_archives;
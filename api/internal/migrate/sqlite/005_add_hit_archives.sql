@@ -0,0 +1,18 @@
+-- Hit archives (postgres/018)
+
+CREATE TABLE hit_archives (
+    id TEXT PRIMARY KEY,
+    site_id VARCHAR(32) NOT NULL,
+    range_start TIMESTAMP NOT NULL,
+    range_end TIMESTAMP NOT NULL,
+    location TEXT NOT NULL,
+    page_views BIGINT NOT NULL DEFAULT 0,
+    events BIGINT NOT NULL DEFAULT 0,
+    sessions BIGINT NOT NULL DEFAULT 0,
+    visitors BIGINT NOT NULL DEFAULT 0,
+    bytes BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    UNIQUE (site_id, range_start)
+);
+
+CREATE INDEX idx_hit_archives_site_range_end ON hit_archives(site_id, range_end DESC);
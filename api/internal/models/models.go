@@ -1,6 +1,7 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/google/uuid"
@@ -8,14 +9,56 @@ import (
 
 // TrackRequest represents the incoming tracking data from the JS snippet
 type TrackRequest struct {
-	SiteID       string `json:"site_id" binding:"required"`
-	PageURL      string `json:"page_url" binding:"required"`
+	SiteID       string `json:"site_id"`  // may be omitted on a custom domain; checked by the handler
+	PageURL      string `json:"page_url"` // required unless EventName is set; checked by Sanitize
 	PageTitle    string `json:"page_title"`
 	Referrer     string `json:"referrer"`
 	ScreenWidth  int    `json:"screen_width"`
 	ScreenHeight int    `json:"screen_height"`
-	Fingerprint  string `json:"fingerprint" binding:"required"` // Client-side generated fingerprint
-	LoadTime     *int   `json:"load_time"`                      // Optional page load time in ms
+	Fingerprint  string `json:"fingerprint"` // Client-side generated fingerprint; absent in privacy mode
+	LoadTime     *int   `json:"load_time"`   // Optional page load time in ms
+
+	// Optional custom event; when set the hit is recorded as an event instead of a page view
+	EventName string `json:"event_name"`
+	Props     Props  `json:"props"`
+
+	// Optional client-generated ID; retries of the same hit are recorded once
+	EventID string `json:"event_id"`
+}
+
+// Props are the properties of a custom event. Any JSON scalar is accepted
+// as a value and stored as a string, e.g. {"value": 10} as "10".
+type Props map[string]string
+
+// UnmarshalJSON implements json.Unmarshaler
+func (p *Props) UnmarshalJSON(data []byte) error {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*p = StringifyProps(raw)
+	return nil
+}
+
+// StringifyProps converts scalar property values to strings; null values
+// are left out
+func StringifyProps(props map[string]interface{}) map[string]string {
+	if len(props) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(props))
+	for k, v := range props {
+		switch val := v.(type) {
+		case nil:
+			continue
+		case string:
+			out[k] = val
+		default:
+			b, _ := json.Marshal(val)
+			out[k] = string(b)
+		}
+	}
+	return out
 }
 
 // Visitor represents a unique visitor
@@ -61,6 +104,18 @@ type PageView struct {
 	PageLoadTime   *int
 }
 
+// Event represents a custom event sent with trackveil.track()
+type Event struct {
+	ID         uuid.UUID
+	SiteID     string // 32-character alphanumeric hash
+	VisitorID  uuid.UUID
+	SessionID  uuid.UUID
+	EventName  string
+	PageURL    *string
+	Properties map[string]string
+	OccurredAt time.Time
+}
+
 // BrowserInfo contains parsed user agent information
 type BrowserInfo struct {
 	BrowserName    string
@@ -72,7 +127,7 @@ type BrowserInfo struct {
 
 // Site represents a tracked website
 type Site struct {
-	ID        string    // 32-character alphanumeric hash
+	ID        string // 32-character alphanumeric hash
 	AccountID uuid.UUID
 	Name      string
 	Domain    string
@@ -97,3 +152,190 @@ type User struct {
 	CreatedAt time.Time
 	UpdatedAt time.Time
 }
+
+// Goal types
+const (
+	GoalTypePagePath   = "page_path"
+	GoalTypeEvent      = "event"
+	GoalTypeEngagement = "engagement"
+)
+
+// Goal is a conversion definition for a site
+type Goal struct {
+	ID                 uuid.UUID `json:"id"`
+	SiteID             string    `json:"site_id"`
+	Name               string    `json:"name" binding:"required"`
+	GoalType           string    `json:"goal_type" binding:"required"`
+	PagePath           *string   `json:"page_path,omitempty"`            // page_path goals, * is a wildcard
+	EventName          *string   `json:"event_name,omitempty"`           // event goals
+	MinPageViews       *int      `json:"min_page_views,omitempty"`       // engagement goals
+	MinDurationSeconds *int      `json:"min_duration_seconds,omitempty"` // engagement goals
+	Active             bool      `json:"active"`
+	CreatedAt          time.Time `json:"created_at"`
+	UpdatedAt          time.Time `json:"updated_at"`
+}
+
+// Conversion records a goal being reached within a session
+type Conversion struct {
+	ID          uuid.UUID
+	GoalID      uuid.UUID
+	SiteID      string
+	VisitorID   uuid.UUID
+	SessionID   uuid.UUID
+	PageViewID  *uuid.UUID
+	EventID     *uuid.UUID
+	Source      string
+	ConvertedAt time.Time
+}
+
+// Funnel step types and modes
+const (
+	StepTypePagePath = "page_path"
+	StepTypeEvent    = "event"
+
+	FunnelModeSession = "session" // all steps within one session
+	FunnelModeWindow  = "window"  // all steps within WindowSeconds of the first step
+)
+
+// Funnel is an ordered sequence of steps for a site
+type Funnel struct {
+	ID            uuid.UUID    `json:"id"`
+	SiteID        string       `json:"site_id"`
+	Name          string       `json:"name" binding:"required"`
+	Steps         []FunnelStep `json:"steps" binding:"required"`
+	Mode          string       `json:"mode"`
+	WindowSeconds *int         `json:"window_seconds,omitempty"`
+	CreatedAt     time.Time    `json:"created_at"`
+	UpdatedAt     time.Time    `json:"updated_at"`
+}
+
+// FunnelStep matches a page path pattern (* is a wildcard) or a custom event name
+type FunnelStep struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// API key authentication types
+const (
+	AuthTypeBearer = "bearer"
+	AuthTypeHMAC   = "hmac"
+	AuthTypeGA4    = "ga4" // GA4 Measurement Protocol api_secret, key_id is the measurement_id
+)
+
+// SiteAPIKey is a per-site secret key for server-side tracking
+type SiteAPIKey struct {
+	ID            uuid.UUID  `json:"id"`
+	SiteID        string     `json:"site_id"`
+	Name          string     `json:"name"`
+	KeyID         string     `json:"key_id"`
+	AuthType      string     `json:"auth_type"`
+	SecretHash    string     `json:"-"`
+	SigningSecret *string    `json:"-"`
+	CreatedAt     time.Time  `json:"created_at"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	RevokedAt     *time.Time `json:"revoked_at,omitempty"`
+	LastUsedAt    *time.Time `json:"last_used_at,omitempty"`
+	RotatedFrom   *uuid.UUID `json:"rotated_from,omitempty"`
+}
+
+// TrackerSettings are per-site options injected into the served tracker.js
+type TrackerSettings struct {
+	SiteID        string     `json:"site_id"`
+	Endpoint      string     `json:"endpoint"`       // tracking endpoint override; empty uses the API
+	SPAMode       bool       `json:"spa_mode"`       // track history navigation as page views
+	PrivacyMode   bool       `json:"privacy_mode"`   // no stored or canvas fingerprint
+	ExcludedPaths []string   `json:"excluded_paths"` // path patterns, * matches anything
+	UpdatedAt     *time.Time `json:"updated_at,omitempty"`
+}
+
+// CustomDomain is a customer-owned hostname that serves a site's tracking endpoints
+type CustomDomain struct {
+	ID        uuid.UUID `json:"id"`
+	SiteID    string    `json:"site_id"`
+	Hostname  string    `json:"hostname"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// RetentionPolicy is how many days of each kind of data are kept; 0 keeps
+// it forever. In plans and site overrides, nil inherits (site, then the
+// account's plan, then the server defaults).
+type RetentionPolicy struct {
+	RawHitDays  *int `json:"raw_hit_days"` // page views, events and sessions
+	VisitorDays *int `json:"visitor_days"` // visitors, with their remaining sessions and hits
+	RollupDays  *int `json:"rollup_days"`  // hourly and daily rollups
+}
+
+// RetentionPlan is a named retention policy assigned to accounts
+type RetentionPlan struct {
+	Name string `json:"name"`
+	RetentionPolicy
+}
+
+// SiteRetention is a site's retention overrides and the policy in effect
+type SiteRetention struct {
+	SiteID    string          `json:"site_id"`
+	Plan      *string         `json:"plan"` // of the site's account
+	Overrides RetentionPolicy `json:"overrides"`
+	Effective RetentionPolicy `json:"effective"` // fully resolved
+}
+
+// RetentionPurge records data removed by the retention purger
+type RetentionPurge struct {
+	ID          uuid.UUID `json:"id"`
+	SiteID      *string   `json:"site_id"` // nil for a dropped partition
+	Target      string    `json:"target"`  // table, or the dropped partition
+	Cutoff      time.Time `json:"cutoff"`  // data before this was removed
+	RowsRemoved int64     `json:"rows_removed"`
+	PurgedAt    time.Time `json:"purged_at"`
+}
+
+// DeadLetter is a hit the database rejected for a reason a retry will not
+// fix, kept to be inspected, fixed and re-ingested or discarded
+type DeadLetter struct {
+	ID        uuid.UUID       `json:"id"`
+	SiteID    string          `json:"site_id"`
+	Kind      string          `json:"kind"`              // request, page_view or event
+	Source    string          `json:"source"`            // endpoint or storage backend that rejected it
+	Payload   json.RawMessage `json:"payload"`           // the request, or the enriched row
+	Context   json.RawMessage `json:"context,omitempty"` // request metadata and enrichment
+	Error     string          `json:"error"`
+	Attempts  int             `json:"attempts"` // failed re-ingestions
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+// SiteSink enables a streaming sink for a site, optionally for some hits only
+type SiteSink struct {
+	SiteID     string     `json:"site_id"`
+	Sink       string     `json:"sink"`        // ndjson, webhook or nats
+	HitTypes   []string   `json:"hit_types"`   // page_view and/or event; empty for both
+	EventNames []string   `json:"event_names"` // events streamed; empty for all
+	UpdatedAt  *time.Time `json:"updated_at,omitempty"`
+}
+
+// HitArchive is a closed range of a site's raw hits archived to Parquet
+type HitArchive struct {
+	ID         uuid.UUID `json:"id"`
+	SiteID     string    `json:"site_id"`
+	RangeStart time.Time `json:"range_start"`
+	RangeEnd   time.Time `json:"range_end"` // exclusive
+	Location   string    `json:"location"`  // key of the manifest
+	PageViews  int64     `json:"page_views"`
+	Events     int64     `json:"events"`
+	Sessions   int64     `json:"sessions"`
+	Visitors   int64     `json:"visitors"`
+	Bytes      int64     `json:"bytes"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// ServerTrackRequest is a server-to-server hit. Only this request type may
+// override the client IP, user agent, timestamp and visitor identifier.
+// It is decoded without binding validation: site_id and fingerprint are optional.
+type ServerTrackRequest struct {
+	TrackRequest
+	ClientIP  string     `json:"client_ip"`
+	UserAgent string     `json:"user_agent"`
+	Timestamp *time.Time `json:"timestamp"`
+	VisitorID string     `json:"visitor_id"` // hashed like a browser fingerprint
+}
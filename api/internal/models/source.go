@@ -0,0 +1,58 @@
+package models
+
+import (
+	"net/url"
+	"strings"
+)
+
+// DirectSource is the traffic source used when a visit has no referrer
+const DirectSource = "Direct"
+
+// PagePath extracts the normalized path from a page URL, or "" if the URL is invalid
+func PagePath(pageURL string) string {
+	u, err := url.Parse(pageURL)
+	if err != nil {
+		return ""
+	}
+	return NormalizePath(u.Path)
+}
+
+// NormalizePath ensures a leading slash and drops a trailing one
+func NormalizePath(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	if len(p) > 1 {
+		p = strings.TrimSuffix(p, "/")
+	}
+	return p
+}
+
+// TrafficSource attributes a landing page view to a traffic source.
+// A utm_source campaign parameter wins, then the referrer host (unless it is
+// the site itself), otherwise the visit is direct.
+func TrafficSource(pageURL, referrer string) string {
+	page, _ := url.Parse(pageURL)
+
+	if page != nil {
+		if utm := strings.TrimSpace(page.Query().Get("utm_source")); utm != "" {
+			return strings.ToLower(utm)
+		}
+	}
+
+	if referrer == "" {
+		return DirectSource
+	}
+
+	ref, err := url.Parse(referrer)
+	if err != nil || ref.Host == "" {
+		return DirectSource
+	}
+
+	host := strings.TrimPrefix(strings.ToLower(ref.Hostname()), "www.")
+	if page != nil && host == strings.TrimPrefix(strings.ToLower(page.Hostname()), "www.") {
+		return DirectSource
+	}
+
+	return host
+}
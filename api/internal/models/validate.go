@@ -0,0 +1,207 @@
+package models
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Column limits of the tracking tables. PostgreSQL VARCHAR(n) counts
+// characters, not bytes, so these are rune counts.
+const (
+	MaxPageTitleLength   = 500 // page_views.page_title
+	MaxBrowserNameLength = 50  // page_views.browser_name, browser_version, os_name, os_version
+	MaxDeviceTypeLength  = 20  // page_views.device_type
+	MaxEventNameLength   = 100 // events.event_name
+)
+
+// Limits for fields stored in TEXT or JSONB columns
+const (
+	MaxURLLength         = 4096
+	MaxUserAgentLength   = 1024
+	MaxFingerprintLength = 512
+	MaxEventIDLength     = 64
+	MaxProps             = 30
+	MaxPropKeyLength     = 100
+	MaxPropValueLength   = 500
+	MaxScreenDimension   = 100000
+	MaxLoadTime          = 10 * 60 * 1000 // ms
+)
+
+// MaxTrackBodyBytes caps POST /track bodies and GET /track query strings
+const MaxTrackBodyBytes = 16 << 10
+
+// FieldError is a validation failure of a single request field
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors lists the invalid fields of a request
+type ValidationErrors []FieldError
+
+func (v ValidationErrors) Error() string {
+	parts := make([]string, len(v))
+	for i, fe := range v {
+		parts[i] = fe.Field + ": " + fe.Message
+	}
+	return strings.Join(parts, "; ")
+}
+
+func (v *ValidationErrors) add(field, format string, args ...interface{}) {
+	*v = append(*v, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// Sanitize cleans a tracking request in place so it fits the database
+// columns, and reports the fields that cannot be stored. Free text (titles,
+// referrers, property values) is truncated; identifiers and URLs are rejected.
+func (r *TrackRequest) Sanitize() ValidationErrors {
+	var errs ValidationErrors
+
+	r.PageURL = CleanText(r.PageURL, 0)
+	switch {
+	case r.PageURL == "" && r.EventName == "":
+		errs.add("page_url", "is required")
+	case r.PageURL != "":
+		if utf8.RuneCountInString(r.PageURL) > MaxURLLength {
+			errs.add("page_url", "must be at most %d characters", MaxURLLength)
+		} else if !IsHTTPURL(r.PageURL) {
+			errs.add("page_url", "must be an http or https URL")
+		}
+	}
+
+	r.PageTitle = CleanText(r.PageTitle, MaxPageTitleLength)
+	r.Referrer = CleanText(r.Referrer, MaxURLLength)
+
+	if len(r.Fingerprint) > MaxFingerprintLength {
+		errs.add("fingerprint", "must be at most %d bytes", MaxFingerprintLength)
+	}
+
+	if r.ScreenWidth < 0 || r.ScreenWidth > MaxScreenDimension {
+		errs.add("screen_width", "must be between 0 and %d", MaxScreenDimension)
+	}
+	if r.ScreenHeight < 0 || r.ScreenHeight > MaxScreenDimension {
+		errs.add("screen_height", "must be between 0 and %d", MaxScreenDimension)
+	}
+	if r.LoadTime != nil && (*r.LoadTime < 0 || *r.LoadTime > MaxLoadTime) {
+		errs.add("load_time", "must be between 0 and %d", MaxLoadTime)
+	}
+
+	if r.EventID != "" && !validEventID(r.EventID) {
+		errs.add("event_id", "must be at most %d printable ASCII characters", MaxEventIDLength)
+	}
+
+	if r.EventName != "" {
+		r.EventName = CleanText(r.EventName, 0)
+		if r.EventName == "" {
+			errs.add("event_name", "must not be blank")
+		} else if utf8.RuneCountInString(r.EventName) > MaxEventNameLength {
+			errs.add("event_name", "must be at most %d characters", MaxEventNameLength)
+		}
+	}
+
+	if len(r.Props) > MaxProps {
+		errs.add("props", "must have at most %d properties", MaxProps)
+	} else if len(r.Props) > 0 {
+		errs = append(errs, r.sanitizeProps()...)
+	}
+
+	return errs
+}
+
+// sanitizeProps cleans property keys and values, in key order so errors are stable
+func (r *TrackRequest) sanitizeProps() ValidationErrors {
+	var errs ValidationErrors
+
+	keys := make([]string, 0, len(r.Props))
+	for k := range r.Props {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	props := make(map[string]string, len(keys))
+	for _, k := range keys {
+		key := CleanText(k, 0)
+		if key == "" {
+			continue
+		}
+		if utf8.RuneCountInString(key) > MaxPropKeyLength {
+			errs.add("props", "property names must be at most %d characters", MaxPropKeyLength)
+			continue
+		}
+		props[key] = CleanText(r.Props[k], MaxPropValueLength)
+	}
+	r.Props = props
+
+	return errs
+}
+
+// Sanitize truncates parsed user agent fields to their column limits
+func (b *BrowserInfo) Sanitize() {
+	b.BrowserName = CleanText(b.BrowserName, MaxBrowserNameLength)
+	b.BrowserVersion = CleanText(b.BrowserVersion, MaxBrowserNameLength)
+	b.OSName = CleanText(b.OSName, MaxBrowserNameLength)
+	b.OSVersion = CleanText(b.OSVersion, MaxBrowserNameLength)
+	b.DeviceType = CleanText(b.DeviceType, MaxDeviceTypeLength)
+}
+
+// CleanText drops invalid UTF-8, replaces control characters with spaces,
+// trims surrounding space and truncates to max characters (0 means no limit)
+func CleanText(s string, max int) string {
+	s = strings.ToValidUTF8(s, "")
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			if unicode.IsSpace(r) {
+				return ' '
+			}
+			return -1
+		}
+		return r
+	}, s)
+	s = strings.TrimSpace(s)
+	if max > 0 {
+		s = Truncate(s, max)
+	}
+	return s
+}
+
+// Truncate shortens s to at most n characters without splitting a UTF-8 sequence
+func Truncate(s string, n int) string {
+	if n < 0 || len(s) <= n {
+		return s
+	}
+	i := 0
+	for pos := range s {
+		if i == n {
+			return s[:pos]
+		}
+		i++
+	}
+	return s
+}
+
+// IsHTTPURL reports whether s is an absolute http or https URL with a host
+func IsHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	scheme := strings.ToLower(u.Scheme)
+	return scheme == "http" || scheme == "https"
+}
+
+// validEventID checks the format of a client-generated event ID
+func validEventID(id string) bool {
+	if len(id) > MaxEventIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
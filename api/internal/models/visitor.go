@@ -0,0 +1,43 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/mssola/user_agent"
+)
+
+// SessionTimeout is how long a session stays open after its last hit
+const SessionTimeout = 30 * time.Minute
+
+// HashFingerprint creates a SHA-256 hash of the fingerprint
+func HashFingerprint(fingerprint string) string {
+	hash := sha256.Sum256([]byte(fingerprint))
+	return hex.EncodeToString(hash[:])
+}
+
+// ParseUserAgent parses the user agent string
+func ParseUserAgent(uaString string) BrowserInfo {
+	ua := user_agent.New(uaString)
+
+	browserName, browserVersion := ua.Browser()
+	osInfo := ua.OS()
+
+	deviceType := "desktop"
+	if ua.Mobile() {
+		deviceType = "mobile"
+	}
+	// Note: user_agent library doesn't detect tablets well, could enhance in Phase 2
+
+	info := BrowserInfo{
+		BrowserName:    browserName,
+		BrowserVersion: browserVersion,
+		OSName:         osInfo,
+		OSVersion:      "", // Library doesn't provide OS version easily
+		DeviceType:     deviceType,
+	}
+	info.Sanitize()
+
+	return info
+}
@@ -0,0 +1,339 @@
+// Package parquet writes and reads Parquet files with a flat schema of
+// required and optional columns, as hit archives use. Files are written
+// with parquet-go, gzip compressed; Read reads back any flat file.
+package parquet
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	pq "github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/format"
+)
+
+// Type is the type of a column's values
+type Type int
+
+// Column types and the Go values they hold
+const (
+	String    Type = iota // string; BYTE_ARRAY annotated UTF8
+	Int32                 // int32
+	Int64                 // int64
+	Bool                  // bool
+	Timestamp             // time.Time; INT64 microseconds since the epoch, UTC
+)
+
+func (t Type) String() string {
+	switch t {
+	case String:
+		return "string"
+	case Int32:
+		return "int32"
+	case Int64:
+		return "int64"
+	case Bool:
+		return "bool"
+	case Timestamp:
+		return "timestamp"
+	}
+	return fmt.Sprintf("Type(%d)", int(t))
+}
+
+// Column is a column of a flat schema. Optional columns accept nil values.
+type Column struct {
+	Name     string
+	Type     Type
+	Optional bool
+}
+
+// Table is a file read back: its schema and rows, each row holding a value
+// per column
+type Table struct {
+	Columns []Column
+	Rows    [][]interface{}
+}
+
+// Index returns the position of a column, or -1
+func (t *Table) Index(name string) int {
+	for i, c := range t.Columns {
+		if c.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// group is a root node keeping the columns in schema order; pq.Group
+// orders them by name
+type group struct {
+	pq.Group
+	names []string
+}
+
+func (g group) Fields() []pq.Field {
+	byName := make(map[string]pq.Field, len(g.names))
+	for _, f := range g.Group.Fields() {
+		byName[f.Name()] = f
+	}
+	fields := make([]pq.Field, len(g.names))
+	for i, name := range g.names {
+		fields[i] = byName[name]
+	}
+	return fields
+}
+
+// node returns the parquet-go node of a column
+func node(c Column) pq.Node {
+	var n pq.Node
+	switch c.Type {
+	case String:
+		n = pq.String()
+	case Int32:
+		n = pq.Int(32)
+	case Int64:
+		n = pq.Int(64)
+	case Bool:
+		n = pq.Leaf(pq.BooleanType)
+	case Timestamp:
+		n = pq.Timestamp(pq.Microsecond)
+	default:
+		return nil
+	}
+	if c.Optional {
+		return pq.Optional(n)
+	}
+	return n
+}
+
+// Writer writes rows to a Parquet file
+type Writer struct {
+	w      *pq.Writer
+	schema []Column
+}
+
+// NewWriter starts a file on w. Rows are buffered and written rowGroupSize
+// at a time; Close writes the rest and the footer.
+func NewWriter(w io.Writer, schema []Column, rowGroupSize int) (*Writer, error) {
+	if len(schema) == 0 {
+		return nil, errors.New("parquet: empty schema")
+	}
+	if rowGroupSize < 1 {
+		rowGroupSize = 1
+	}
+	root := group{Group: pq.Group{}, names: make([]string, len(schema))}
+	for i, c := range schema {
+		if _, dup := root.Group[c.Name]; dup {
+			return nil, fmt.Errorf("parquet: duplicate column %s", c.Name)
+		}
+		n := node(c)
+		if n == nil {
+			return nil, fmt.Errorf("parquet: column %s has unsupported type %s", c.Name, c.Type)
+		}
+		root.Group[c.Name] = n
+		root.names[i] = c.Name
+	}
+	pw := pq.NewWriter(w,
+		pq.NewSchema("schema", root),
+		pq.Compression(&pq.Gzip),
+		pq.MaxRowsPerRowGroup(int64(rowGroupSize)),
+		pq.CreatedBy("trackveil-api", "", ""),
+	)
+	return &Writer{w: pw, schema: schema}, nil
+}
+
+// Write adds a row, with a value of the column's type, or nil for an
+// optional column, per column
+func (w *Writer) Write(row []interface{}) error {
+	if len(row) != len(w.schema) {
+		return fmt.Errorf("parquet: row has %d values for %d columns", len(row), len(w.schema))
+	}
+	values := make(pq.Row, len(row))
+	for i, v := range row {
+		c := w.schema[i]
+		if err := check(c, v); err != nil {
+			return err
+		}
+		if v == nil {
+			values[i] = pq.NullValue().Level(0, 0, i)
+			continue
+		}
+		var pv pq.Value
+		switch v := v.(type) {
+		case string:
+			pv = pq.ByteArrayValue([]byte(v))
+		case int32:
+			pv = pq.Int32Value(v)
+		case int64:
+			pv = pq.Int64Value(v)
+		case bool:
+			pv = pq.BooleanValue(v)
+		case time.Time:
+			pv = pq.Int64Value(v.UnixMicro())
+		}
+		def := 0
+		if c.Optional {
+			def = 1
+		}
+		values[i] = pv.Level(0, def, i)
+	}
+	if _, err := w.w.WriteRows([]pq.Row{values}); err != nil {
+		return fmt.Errorf("parquet: %w", err)
+	}
+	return nil
+}
+
+// Close writes the buffered rows and the footer. It does not close the
+// underlying writer.
+func (w *Writer) Close() error {
+	if err := w.w.Close(); err != nil {
+		return fmt.Errorf("parquet: %w", err)
+	}
+	return nil
+}
+
+func check(c Column, v interface{}) error {
+	if v == nil {
+		if !c.Optional {
+			return fmt.Errorf("parquet: column %s is required", c.Name)
+		}
+		return nil
+	}
+	ok := false
+	switch c.Type {
+	case String:
+		_, ok = v.(string)
+	case Int32:
+		_, ok = v.(int32)
+	case Int64:
+		_, ok = v.(int64)
+	case Bool:
+		_, ok = v.(bool)
+	case Timestamp:
+		_, ok = v.(time.Time)
+	}
+	if !ok {
+		return fmt.Errorf("parquet: column %s holds %s values, not %T", c.Name, c.Type, v)
+	}
+	return nil
+}
+
+// Read reads a whole file
+func Read(data []byte) (*Table, error) {
+	f, err := pq.OpenFile(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("parquet: %w", err)
+	}
+	table := &Table{}
+	var units []time.Duration // per column, for timestamps
+	for _, field := range f.Schema().Fields() {
+		c, unit, err := column(field)
+		if err != nil {
+			return nil, err
+		}
+		table.Columns = append(table.Columns, c)
+		units = append(units, unit)
+	}
+	if len(table.Columns) == 0 {
+		return nil, errors.New("parquet: empty schema")
+	}
+
+	// Values read share the reader's buffers, so each batch is converted
+	// before the next is read
+	r := pq.NewReader(f)
+	defer r.Close()
+	batch := make([]pq.Row, 128)
+	for {
+		n, err := r.ReadRows(batch)
+		for _, values := range batch[:n] {
+			row := make([]interface{}, len(table.Columns))
+			for _, v := range values {
+				i := v.Column()
+				if i < 0 || i >= len(row) {
+					return nil, errors.New("parquet: value outside the schema")
+				}
+				row[i] = value(table.Columns[i].Type, units[i], v)
+			}
+			table.Rows = append(table.Rows, row)
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parquet: %w", err)
+		}
+	}
+	if int64(len(table.Rows)) != f.NumRows() {
+		return nil, fmt.Errorf("parquet: read %d of %d rows", len(table.Rows), f.NumRows())
+	}
+	return table, nil
+}
+
+// column maps a field of a file's schema onto a column, with the unit of
+// its values if they are timestamps
+func column(field pq.Field) (Column, time.Duration, error) {
+	c := Column{Name: field.Name(), Optional: field.Optional()}
+	if !field.Leaf() {
+		return c, 0, errors.New("parquet: nested schemas are not supported")
+	}
+	if field.Repeated() {
+		return c, 0, fmt.Errorf("parquet: column %s is repeated", c.Name)
+	}
+
+	typ := field.Type()
+	var ts *format.TimestampType
+	if lt := typ.LogicalType(); lt != nil {
+		ts = lt.Timestamp
+	}
+	switch kind := typ.Kind(); {
+	case kind == pq.ByteArray:
+		c.Type = String
+	case kind == pq.Int32:
+		c.Type = Int32
+	case kind == pq.Int64 && ts != nil:
+		c.Type = Timestamp
+		switch {
+		case ts.Unit.Millis != nil:
+			return c, time.Millisecond, nil
+		case ts.Unit.Micros != nil:
+			return c, time.Microsecond, nil
+		}
+		return c, time.Nanosecond, nil
+	case kind == pq.Int64:
+		c.Type = Int64
+	case kind == pq.Boolean:
+		c.Type = Bool
+	default:
+		return c, 0, fmt.Errorf("parquet: column %s has unsupported type %s", c.Name, kind)
+	}
+	return c, 0, nil
+}
+
+// value converts a value read to the Go type of its column
+func value(t Type, unit time.Duration, v pq.Value) interface{} {
+	if v.IsNull() {
+		return nil
+	}
+	switch t {
+	case String:
+		return string(v.ByteArray())
+	case Int32:
+		return v.Int32()
+	case Int64:
+		return v.Int64()
+	case Bool:
+		return v.Boolean()
+	case Timestamp:
+		n := v.Int64()
+		switch unit {
+		case time.Millisecond:
+			return time.UnixMilli(n).UTC()
+		case time.Microsecond:
+			return time.UnixMicro(n).UTC()
+		}
+		return time.Unix(0, n).UTC()
+	}
+	return nil
+}
@@ -0,0 +1,293 @@
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	pq "github.com/parquet-go/parquet-go"
+)
+
+// schema has a required and an optional column of every type
+var schema = []Column{
+	{Name: "string", Type: String},
+	{Name: "int32", Type: Int32},
+	{Name: "int64", Type: Int64},
+	{Name: "bool", Type: Bool},
+	{Name: "timestamp", Type: Timestamp},
+	{Name: "opt_string", Type: String, Optional: true},
+	{Name: "opt_int32", Type: Int32, Optional: true},
+	{Name: "opt_int64", Type: Int64, Optional: true},
+	{Name: "opt_bool", Type: Bool, Optional: true},
+	{Name: "opt_timestamp", Type: Timestamp, Optional: true},
+}
+
+// rows returns n rows of varied values, with nulls in runs and alone
+func rows(n int) [][]interface{} {
+	at := time.Date(2026, 10, 19, 12, 30, 45, 123456000, time.UTC)
+	strs := []string{"", "https://example.com/pricing?ref=hn", "naïve café 🍪", strings.Repeat("x", 1000)}
+	out := make([][]interface{}, n)
+	for i := range out {
+		row := []interface{}{
+			strs[i%len(strs)],
+			int32(i*7919) - 50000,
+			int64(i)*1e12 - 3e12,
+			i%3 == 0,
+			at.Add(time.Duration(i-n/2) * 36 * time.Hour),
+		}
+		for c := range row {
+			var v interface{} = row[c]
+			if i%5 == 1 || i%11 >= 8 || c == i%5 {
+				v = nil
+			}
+			row = append(row, v)
+		}
+		out[i] = row
+	}
+	// Values at the edges of their types
+	if n > 0 {
+		out[0] = []interface{}{"", int32(-1 << 31), int64(-1 << 63), false, time.UnixMicro(0).UTC(),
+			"a", int32(1<<31 - 1), int64(1<<63 - 1), true, time.UnixMicro(-1).UTC()}
+	}
+	return out
+}
+
+func write(t *testing.T, rowGroupSize int, rows [][]interface{}) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, schema, rowGroupSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range rows {
+		if err := w.Write(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// TestRoundTrip checks that Read, which restores use, returns every value
+// written, across row groups and with nulls in any pattern
+func TestRoundTrip(t *testing.T) {
+	for _, c := range []struct{ rows, rowGroupSize int }{
+		{0, 10},
+		{1, 10},
+		{9, 10},  // bools fill more than a byte
+		{25, 10}, // a partial last row group
+		{30, 10},
+		{1000, 300},
+	} {
+		want := rows(c.rows)
+		table, err := Read(write(t, c.rowGroupSize, want))
+		if err != nil {
+			t.Fatalf("%d rows: %v", c.rows, err)
+		}
+		if !reflect.DeepEqual(table.Columns, schema) {
+			t.Errorf("%d rows: columns %v, want %v", c.rows, table.Columns, schema)
+		}
+		if len(table.Rows) != len(want) {
+			t.Fatalf("%d rows: read %d", c.rows, len(table.Rows))
+		}
+		for i := range want {
+			if !reflect.DeepEqual(table.Rows[i], want[i]) {
+				t.Errorf("%d rows: row %d is\n%v, want\n%v", c.rows, i, table.Rows[i], want[i])
+			}
+		}
+	}
+}
+
+// TestTimestampPrecision checks that timestamps are stored to the
+// microsecond in UTC
+func TestTimestampPrecision(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, []Column{{Name: "at", Type: Timestamp}}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2026, 10, 19, 14, 0, 0, 999999999, time.FixedZone("CEST", 2*60*60))
+	if err := w.Write([]interface{}{at}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	table, err := Read(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := time.Date(2026, 10, 19, 12, 0, 0, 999999000, time.UTC)
+	if got := table.Rows[0][0]; got != want {
+		t.Errorf("read %v, want %v", got, want)
+	}
+}
+
+// TestRowGroups checks that rows are split into row groups of the given
+// size, in order
+func TestRowGroups(t *testing.T) {
+	data := write(t, 10, rows(25))
+	f, err := pq.OpenFile(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups := f.RowGroups()
+	if len(groups) != 3 {
+		t.Fatalf("%d row groups, want 3", len(groups))
+	}
+	for i, want := range []int64{10, 10, 5} {
+		if n := groups[i].NumRows(); n != want {
+			t.Errorf("row group %d has %d rows, want %d", i, n, want)
+		}
+	}
+	if s := f.Metadata().CreatedBy; !strings.HasPrefix(s, "trackveil-api") {
+		t.Errorf("created_by %q", s)
+	}
+}
+
+// TestReader checks that a generic Parquet reader sees the schema in order,
+// with string and UTC timestamp annotations, and the same values
+func TestReader(t *testing.T) {
+	want := rows(250)
+	data := write(t, 100, want)
+	f, err := pq.OpenFile(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.NumRows() != int64(len(want)) {
+		t.Errorf("%d rows, want %d", f.NumRows(), len(want))
+	}
+
+	fields := f.Schema().Fields()
+	if len(fields) != len(schema) {
+		t.Fatalf("%d fields, want %d", len(fields), len(schema))
+	}
+	for i, field := range fields {
+		c := schema[i]
+		if field.Name() != c.Name || field.Optional() != c.Optional {
+			t.Errorf("field %d is %s, optional %v; want %s, optional %v", i, field.Name(), field.Optional(), c.Name, c.Optional)
+		}
+		lt := field.Type().LogicalType()
+		switch c.Type {
+		case String:
+			if lt == nil || lt.UTF8 == nil {
+				t.Errorf("field %s has logical type %v, want a string", c.Name, lt)
+			}
+		case Timestamp:
+			if lt == nil || lt.Timestamp == nil || !lt.Timestamp.IsAdjustedToUTC || lt.Timestamp.Unit.Micros == nil {
+				t.Errorf("field %s has logical type %v, want UTC microsecond timestamps", c.Name, lt)
+			}
+		}
+	}
+
+	r := pq.NewReader(f)
+	defer r.Close()
+	// Values read share the reader's buffers, so each batch is converted
+	// before the next is read
+	var got [][]interface{}
+	batch := make([]pq.Row, 16)
+	for {
+		n, err := r.ReadRows(batch)
+		for _, row := range batch[:n] {
+			values := make([]interface{}, len(schema))
+			for _, v := range row {
+				values[v.Column()] = value(schema[v.Column()].Type, time.Microsecond, v)
+			}
+			got = append(got, values)
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(got) != len(want) {
+		t.Fatalf("read %d rows, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Errorf("row %d is\n%v, want\n%v", i, got[i], want[i])
+		}
+	}
+}
+
+// TestReadCorrupt checks that damaged files are refused rather than read
+// wrongly
+func TestReadCorrupt(t *testing.T) {
+	data := write(t, 10, rows(25))
+	footerLen := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+
+	corrupt := map[string][]byte{
+		"empty":             {},
+		"magic only":        []byte("PAR1PAR1"),
+		"truncated":         data[:len(data)-1],
+		"no leading magic":  append([]byte("PAR0"), data[4:]...),
+		"no trailing magic": append(append([]byte(nil), data[:len(data)-4]...), "PAR0"...),
+		"footer too long": func() []byte {
+			d := append([]byte(nil), data...)
+			binary.LittleEndian.PutUint32(d[len(d)-8:], uint32(len(d)))
+			return d
+		}(),
+		"footer cut": append(append(append([]byte("PAR1"), data[len(data)-8-footerLen/2:len(data)-8]...),
+			data[len(data)-8:len(data)-4]...), "PAR1"...),
+		"page cut": func() []byte {
+			// The chunks lose their last bytes; the footer stays whole
+			d := append([]byte(nil), data[:len(data)-8-footerLen-20]...)
+			d = append(d, make([]byte, 20)...)
+			return append(d, data[len(data)-8-footerLen:]...)
+		}(),
+	}
+	for name, d := range corrupt {
+		if table, err := Read(d); err == nil {
+			t.Errorf("%s: read %d rows, want an error", name, len(table.Rows))
+		}
+	}
+
+	// Any single truncation fails cleanly, without panicking
+	for n := 0; n < len(data); n += 7 {
+		if _, err := Read(data[:n]); err == nil {
+			t.Errorf("read the first %d of %d bytes", n, len(data))
+		}
+	}
+}
+
+// TestWriteInvalid checks that rows not matching the schema are refused
+func TestWriteInvalid(t *testing.T) {
+	if _, err := NewWriter(io.Discard, nil, 10); err == nil {
+		t.Error("NewWriter accepted an empty schema")
+	}
+	w, err := NewWriter(io.Discard, schema, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := rows(1)[0]
+	for _, c := range []struct {
+		name  string
+		index int
+		value interface{}
+	}{
+		{"required string nil", 0, nil},
+		{"required timestamp nil", 4, nil},
+		{"int as int32", 1, 7},
+		{"int32 as int64", 2, int32(7)},
+		{"string as bytes", 5, []byte("x")},
+		{"timestamp as pointer", 9, &time.Time{}},
+	} {
+		row := append([]interface{}(nil), valid...)
+		row[c.index] = c.value
+		if err := w.Write(row); err == nil {
+			t.Errorf("%s: written", c.name)
+		}
+	}
+	if err := w.Write(valid[:3]); err == nil {
+		t.Error("short row written")
+	}
+}
@@ -0,0 +1,247 @@
+package partitions
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"time"
+
+	"trackveilapi/internal/database"
+)
+
+// Tables are the hit tables partitioned by month
+var Tables = []string{"page_views", "events"}
+
+// Maintainer creates future monthly partitions and removes expired ones
+type Maintainer struct {
+	db        *database.DB
+	ahead     int  // months to create beyond the current one
+	retention int  // months kept, including the current one; 0 keeps all
+	drop      bool // drop expired partitions instead of only detaching them
+}
+
+// Result summarizes one maintenance pass
+type Result struct {
+	Created  []string
+	Detached []string
+	Dropped  []string
+}
+
+// New creates a partition maintainer
+func New(db *database.DB, monthsAhead, retentionMonths int, drop bool) *Maintainer {
+	return &Maintainer{db: db, ahead: monthsAhead, retention: retentionMonths, drop: drop}
+}
+
+// Maintain ensures partitions exist from the current month through the
+// configured months ahead, and detaches (or drops) partitions that ended
+// before the retention window
+func (m *Maintainer) Maintain(now time.Time) (*Result, error) {
+	res := &Result{}
+	current := monthStart(now)
+
+	for _, table := range Tables {
+		for i := 0; i <= m.ahead; i++ {
+			created, err := m.ensure(table, current.AddDate(0, i, 0))
+			if err != nil {
+				return res, err
+			}
+			if created != "" {
+				res.Created = append(res.Created, created)
+			}
+		}
+
+		if m.retention <= 0 {
+			continue
+		}
+		cutoff := current.AddDate(0, -(m.retention - 1), 0)
+
+		partitions, err := attached(m.db, table)
+		if err != nil {
+			return res, err
+		}
+		for name, month := range partitions {
+			if !month.Before(cutoff) {
+				continue
+			}
+			if _, err := m.db.Exec(fmt.Sprintf(`ALTER TABLE %s DETACH PARTITION %s`, table, name)); err != nil {
+				return res, fmt.Errorf("failed to detach %s: %w", name, err)
+			}
+			res.Detached = append(res.Detached, name)
+
+			if m.drop {
+				if _, err := m.db.Exec(fmt.Sprintf(`DROP TABLE %s`, name)); err != nil {
+					return res, fmt.Errorf("failed to drop %s: %w", name, err)
+				}
+				res.Dropped = append(res.Dropped, name)
+			}
+		}
+	}
+
+	return res, nil
+}
+
+// Run maintains partitions immediately and then every interval until ctx is cancelled
+func (m *Maintainer) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		res, err := m.Maintain(time.Now())
+		if err != nil {
+			log.Printf("Partition maintenance failed: %v", err)
+		}
+		if res != nil {
+			for _, name := range res.Created {
+				log.Printf("Created partition %s", name)
+			}
+			for _, name := range res.Detached {
+				log.Printf("Detached expired partition %s", name)
+			}
+			for _, name := range res.Dropped {
+				log.Printf("Dropped expired partition %s", name)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ensure creates the partition of a table for a month, returning its name
+// if it was created
+func (m *Maintainer) ensure(table string, month time.Time) (string, error) {
+	name := partitionName(table, month)
+
+	var exists bool
+	if err := m.db.QueryRow(`SELECT to_regclass($1) IS NOT NULL`, name).Scan(&exists); err != nil {
+		return "", err
+	}
+	if exists {
+		return "", nil
+	}
+
+	if _, err := m.db.Exec(`SELECT create_monthly_partition($1, $2)`, table, month.Format("2006-01-02")); err != nil {
+		return "", fmt.Errorf("failed to create %s: %w", name, err)
+	}
+	return name, nil
+}
+
+// DroppedPartition is a monthly partition removed by DropEnded
+type DroppedPartition struct {
+	Name string
+	End  time.Time // end of the month it covered
+	Rows int64
+}
+
+// DropEnded drops the monthly partitions of a table whose month ended at or
+// before cutoff. Detaching waits at most lockTimeout for the table lock, so
+// a busy table is left for a later call instead of stalling hit inserts.
+func DropEnded(db *database.DB, table string, cutoff time.Time, lockTimeout time.Duration) ([]DroppedPartition, error) {
+	partitions, err := attached(db, table)
+	if err != nil {
+		return nil, err
+	}
+
+	var dropped []DroppedPartition
+	for name, month := range partitions {
+		end := month.AddDate(0, 1, 0)
+		if end.After(cutoff) {
+			continue
+		}
+
+		// Counted before detaching, which locks the whole table
+		p := DroppedPartition{Name: name, End: end}
+		if err := db.QueryRow(fmt.Sprintf(`SELECT COUNT(*) FROM %s`, name)).Scan(&p.Rows); err != nil {
+			return dropped, err
+		}
+		if err := detachAndDrop(db, table, name, lockTimeout); err != nil {
+			return dropped, fmt.Errorf("failed to drop %s: %w", name, err)
+		}
+		dropped = append(dropped, p)
+	}
+	return dropped, nil
+}
+
+// detachAndDrop removes a partition in one transaction
+func detachAndDrop(db *database.DB, table, name string, lockTimeout time.Duration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(fmt.Sprintf(`SET LOCAL lock_timeout = %d`, lockTimeout.Milliseconds())); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(fmt.Sprintf(`ALTER TABLE %s DETACH PARTITION %s`, table, name)); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(fmt.Sprintf(`DROP TABLE %s`, name)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// attached returns the monthly partitions currently attached to a table, by
+// name, with the month each covers. The default partition is not included.
+func attached(db *database.DB, table string) (map[string]time.Time, error) {
+	rows, err := db.Query(`
+		SELECT c.relname
+		FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		WHERE i.inhparent = $1::regclass
+	`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	partitions := make(map[string]time.Time)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		if month, ok := parseMonth(table, name); ok {
+			partitions[name] = month
+		}
+	}
+	return partitions, rows.Err()
+}
+
+// partitionSuffix matches the _yYYYYmMM suffix of monthly partitions
+var partitionSuffix = regexp.MustCompile(`^_y(\d{4})m(\d{2})$`)
+
+// partitionName is the name create_monthly_partition gives a month's partition
+func partitionName(table string, month time.Time) string {
+	return fmt.Sprintf("%s_y%04dm%02d", table, month.Year(), int(month.Month()))
+}
+
+// parseMonth returns the month of a partition named by partitionName
+func parseMonth(table, name string) (time.Time, bool) {
+	if len(name) <= len(table) || name[:len(table)] != table {
+		return time.Time{}, false
+	}
+	match := partitionSuffix.FindStringSubmatch(name[len(table):])
+	if match == nil {
+		return time.Time{}, false
+	}
+	year, _ := strconv.Atoi(match[1])
+	month, _ := strconv.Atoi(match[2])
+	if month < 1 || month > 12 {
+		return time.Time{}, false
+	}
+	return time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC), true
+}
+
+// monthStart is the first instant of t's month in UTC, matching the
+// partition bounds
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
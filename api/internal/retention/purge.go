@@ -0,0 +1,259 @@
+package retention
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"trackveilapi/internal/archive"
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/models"
+	"trackveilapi/internal/partitions"
+)
+
+// partitionLockTimeout is how long dropping a partition waits for the table lock
+const partitionLockTimeout = 5 * time.Second
+
+// target is a table purged per site, with the statement deleting one batch
+// ($1 site, $2 cutoff, $3 batch size)
+type target struct {
+	table    string
+	period   func(p models.RetentionPolicy) *int
+	daily    bool // cutoff passed as a date
+	archived bool // kept until archived with ArchivedOnly
+	query    string
+}
+
+func rawHits(p models.RetentionPolicy) *int  { return p.RawHitDays }
+func visitors(p models.RetentionPolicy) *int { return p.VisitorDays }
+func rollups(p models.RetentionPolicy) *int  { return p.RollupDays }
+
+// targets in purge order. Deleting sessions and visitors cascades to their
+// remaining hits and conversions.
+var targets = []target{
+	{"page_views", rawHits, false, true, `
+		DELETE FROM page_views WHERE (id, viewed_at) IN (
+			SELECT id, viewed_at FROM page_views WHERE site_id = $1 AND viewed_at < $2 LIMIT $3
+		)`},
+	{"events", rawHits, false, true, `
+		DELETE FROM events WHERE (id, occurred_at) IN (
+			SELECT id, occurred_at FROM events WHERE site_id = $1 AND occurred_at < $2 LIMIT $3
+		)`},
+	{"sessions", rawHits, false, true, `
+		DELETE FROM sessions WHERE id IN (
+			SELECT id FROM sessions WHERE site_id = $1 AND last_activity_at < $2 LIMIT $3
+		)`},
+	{"visitors", visitors, false, true, `
+		DELETE FROM visitors WHERE id IN (
+			SELECT id FROM visitors WHERE site_id = $1 AND last_seen_at < $2 LIMIT $3
+		)`},
+	{"rollups_hourly", rollups, false, false, `
+		DELETE FROM rollups_hourly WHERE site_id = $1 AND (bucket, dimension, value) IN (
+			SELECT bucket, dimension, value FROM rollups_hourly WHERE site_id = $1 AND bucket < $2 LIMIT $3
+		)`},
+	{"rollups_daily", rollups, true, false, `
+		DELETE FROM rollups_daily WHERE site_id = $1 AND (bucket, dimension, value) IN (
+			SELECT bucket, dimension, value FROM rollups_daily WHERE site_id = $1 AND bucket < $2 LIMIT $3
+		)`},
+}
+
+// Purger deletes data past the retention period of its site
+type Purger struct {
+	db           *database.DB
+	defaults     models.RetentionPolicy
+	batchSize    int
+	archivedOnly bool
+}
+
+// NewPurger creates a retention purger. Rows are deleted batchSize at a
+// time, each batch in its own statement, so locks stay short.
+func NewPurger(db *database.DB, defaults models.RetentionPolicy, batchSize int) *Purger {
+	return &Purger{db: db, defaults: defaults, batchSize: batchSize}
+}
+
+// ArchivedOnly limits the purge of raw hits, sessions and visitors to what
+// is archived: the hits before the end of a site's last archived range, and
+// the sessions and visitors active only before it. Sites without archives
+// keep them. Partitions are not dropped; expired rows are deleted instead.
+func (p *Purger) ArchivedOnly() {
+	p.archivedOnly = true
+}
+
+// sitePolicy is the policy in effect for a site
+type sitePolicy struct {
+	siteID string
+	policy models.RetentionPolicy
+}
+
+// Purge removes the data of every site that is older than its retention
+// period allows, and returns what was removed. Each removal is recorded in
+// retention_purges.
+func (p *Purger) Purge(ctx context.Context, now time.Time) ([]models.RetentionPurge, error) {
+	sites, err := p.policies()
+	if err != nil {
+		return nil, err
+	}
+
+	var purged []models.RetentionPurge
+	if !p.db.SQLite() && !p.archivedOnly {
+		purged = p.dropPartitions(sites, now)
+	}
+
+	for _, site := range sites {
+		var archived time.Time
+		hasArchive := false
+		if p.archivedOnly {
+			if archived, hasArchive, err = archive.ArchivedThrough(p.db, site.siteID); err != nil {
+				return purged, err
+			}
+		}
+
+		for _, t := range targets {
+			days := *t.period(site.policy)
+			if days == 0 {
+				continue
+			}
+			cutoff := now.AddDate(0, 0, -days)
+			if p.archivedOnly && t.archived {
+				if !hasArchive {
+					continue
+				}
+				if archived.Before(cutoff) {
+					cutoff = archived
+				}
+			}
+
+			n, err := p.purgeTable(ctx, site.siteID, t, cutoff)
+			if n > 0 {
+				siteID := site.siteID
+				purged = append(purged, p.record(&siteID, t.table, cutoff, n, now))
+			}
+			if err != nil {
+				return purged, err
+			}
+		}
+	}
+	return purged, nil
+}
+
+// policies returns the policy in effect for every site
+func (p *Purger) policies() ([]sitePolicy, error) {
+	rows, err := p.db.Query(`
+		SELECT s.id, r.raw_hit_days, r.visitor_days, r.rollup_days,
+			pl.raw_hit_days, pl.visitor_days, pl.rollup_days
+		FROM sites s
+		JOIN accounts a ON a.id = s.account_id
+		LEFT JOIN site_retention r ON r.site_id = s.id
+		LEFT JOIN retention_plans pl ON pl.name = a.retention_plan
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sites []sitePolicy
+	for rows.Next() {
+		var siteID string
+		var site, plan models.RetentionPolicy
+		if err := rows.Scan(&siteID, &site.RawHitDays, &site.VisitorDays, &site.RollupDays,
+			&plan.RawHitDays, &plan.VisitorDays, &plan.RollupDays); err != nil {
+			return nil, err
+		}
+		sites = append(sites, sitePolicy{siteID: siteID, policy: Resolve(site, plan, p.defaults)})
+	}
+	return sites, rows.Err()
+}
+
+// dropPartitions drops the monthly hit partitions that only hold hits past
+// every site's raw hit retention, which is much cheaper than deleting them.
+// Failures are logged; the rows are then deleted in batches instead.
+func (p *Purger) dropPartitions(sites []sitePolicy, now time.Time) []models.RetentionPurge {
+	if len(sites) == 0 {
+		return nil
+	}
+	var cutoff time.Time
+	for i, site := range sites {
+		days := *site.policy.RawHitDays
+		if days == 0 {
+			return nil // kept forever by at least one site
+		}
+		if siteCutoff := now.AddDate(0, 0, -days); i == 0 || siteCutoff.Before(cutoff) {
+			cutoff = siteCutoff
+		}
+	}
+
+	var purged []models.RetentionPurge
+	for _, table := range partitions.Tables {
+		dropped, err := partitions.DropEnded(p.db, table, cutoff, partitionLockTimeout)
+		for _, d := range dropped {
+			purged = append(purged, p.record(nil, d.Name, d.End, d.Rows, now))
+		}
+		if err != nil {
+			log.Printf("Retention: could not drop expired %s partitions, deleting rows instead: %v", table, err)
+		}
+	}
+	return purged
+}
+
+// purgeTable deletes a site's rows before cutoff from a table in batches
+func (p *Purger) purgeTable(ctx context.Context, siteID string, t target, cutoff time.Time) (int64, error) {
+	var arg interface{} = cutoff
+	if t.daily {
+		arg = cutoff.UTC().Format("2006-01-02")
+	}
+
+	var total int64
+	for ctx.Err() == nil {
+		res, err := p.db.ExecContext(ctx, t.query, siteID, arg, p.batchSize)
+		if err != nil {
+			return total, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return total, err
+		}
+		total += n
+		if n < int64(p.batchSize) {
+			break
+		}
+	}
+	return total, ctx.Err()
+}
+
+// record logs a purge in the audit table; a failure to do so is only logged
+func (p *Purger) record(siteID *string, target string, cutoff time.Time, rows int64, at time.Time) models.RetentionPurge {
+	purge := models.RetentionPurge{SiteID: siteID, Target: target, Cutoff: cutoff, RowsRemoved: rows, PurgedAt: at}
+	id, err := record(p.db, siteID, target, cutoff, rows, at)
+	if err != nil {
+		log.Printf("Failed to record retention purge of %d rows from %s: %v", rows, target, err)
+	}
+	purge.ID = id
+	return purge
+}
+
+// Run purges expired data immediately and then every interval until ctx is cancelled
+func (p *Purger) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := p.Purge(ctx, time.Now())
+		for _, purge := range purged {
+			site := "all sites"
+			if purge.SiteID != nil {
+				site = "site " + *purge.SiteID
+			}
+			log.Printf("Retention: removed %d rows from %s for %s (before %s)",
+				purge.RowsRemoved, purge.Target, site, purge.Cutoff.UTC().Format(time.RFC3339))
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Retention purge failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package retention
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/models"
+
+	"github.com/google/uuid"
+)
+
+// MaxDays bounds a retention period (100 years)
+const MaxDays = 36500
+
+// Errors returned by the retention settings functions
+var (
+	ErrPlanNotFound    = errors.New("retention plan not found")
+	ErrAccountNotFound = errors.New("account not found")
+)
+
+// planName is a valid retention plan name
+var planName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,49}$`)
+
+// Validate checks the periods of a policy
+func Validate(p *models.RetentionPolicy) error {
+	periods := []struct {
+		name string
+		days *int
+	}{
+		{"raw_hit_days", p.RawHitDays},
+		{"visitor_days", p.VisitorDays},
+		{"rollup_days", p.RollupDays},
+	}
+	for _, period := range periods {
+		if period.days != nil && (*period.days < 0 || *period.days > MaxDays) {
+			return fmt.Errorf("%s must be between 0 (keep forever) and %d", period.name, MaxDays)
+		}
+	}
+	return nil
+}
+
+// ValidatePlanName checks a retention plan name
+func ValidatePlanName(name string) error {
+	if !planName.MatchString(name) {
+		return errors.New("plan name must be 1-50 lowercase letters, digits, - or _")
+	}
+	return nil
+}
+
+// Resolve returns the policy in effect for a site: each period from the
+// site's overrides, else the plan, else the defaults
+func Resolve(site, plan, defaults models.RetentionPolicy) models.RetentionPolicy {
+	pick := func(periods ...*int) *int {
+		for _, days := range periods {
+			if days != nil {
+				return days
+			}
+		}
+		zero := 0
+		return &zero
+	}
+	return models.RetentionPolicy{
+		RawHitDays:  pick(site.RawHitDays, plan.RawHitDays, defaults.RawHitDays),
+		VisitorDays: pick(site.VisitorDays, plan.VisitorDays, defaults.VisitorDays),
+		RollupDays:  pick(site.RollupDays, plan.RollupDays, defaults.RollupDays),
+	}
+}
+
+// ListPlans returns all retention plans by name
+func ListPlans(db *database.DB) ([]models.RetentionPlan, error) {
+	rows, err := db.Query(`
+		SELECT name, raw_hit_days, visitor_days, rollup_days
+		FROM retention_plans
+		ORDER BY name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	plans := []models.RetentionPlan{}
+	for rows.Next() {
+		var p models.RetentionPlan
+		if err := rows.Scan(&p.Name, &p.RawHitDays, &p.VisitorDays, &p.RollupDays); err != nil {
+			return nil, err
+		}
+		plans = append(plans, p)
+	}
+	return plans, rows.Err()
+}
+
+// SavePlan creates or replaces a retention plan
+func SavePlan(db *database.DB, p *models.RetentionPlan) error {
+	_, err := db.Exec(`
+		INSERT INTO retention_plans (name, raw_hit_days, visitor_days, rollup_days)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (name) DO UPDATE SET
+			raw_hit_days = EXCLUDED.raw_hit_days,
+			visitor_days = EXCLUDED.visitor_days,
+			rollup_days = EXCLUDED.rollup_days
+	`, p.Name, p.RawHitDays, p.VisitorDays, p.RollupDays)
+	return err
+}
+
+// DeletePlan deletes a retention plan; its accounts fall back to the defaults
+func DeletePlan(db *database.DB, name string) error {
+	res, err := db.Exec(`DELETE FROM retention_plans WHERE name = $1`, name)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrPlanNotFound
+	}
+	return nil
+}
+
+// SetAccountPlan assigns a retention plan to an account, or removes it if
+// plan is nil
+func SetAccountPlan(db *database.DB, accountID uuid.UUID, plan *string) error {
+	if plan != nil {
+		var exists bool
+		if err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM retention_plans WHERE name = $1)`, *plan).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return ErrPlanNotFound
+		}
+	}
+
+	res, err := db.Exec(`UPDATE accounts SET retention_plan = $2 WHERE id = $1`, accountID, plan)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrAccountNotFound
+	}
+	return nil
+}
+
+// GetSite returns a site's retention overrides, its account's plan and the
+// policy in effect
+func GetSite(db *database.DB, siteID string, defaults models.RetentionPolicy) (*models.SiteRetention, error) {
+	s := models.SiteRetention{SiteID: siteID}
+	var plan models.RetentionPolicy
+
+	err := db.QueryRow(`
+		SELECT a.retention_plan, r.raw_hit_days, r.visitor_days, r.rollup_days,
+			p.raw_hit_days, p.visitor_days, p.rollup_days
+		FROM sites s
+		JOIN accounts a ON a.id = s.account_id
+		LEFT JOIN site_retention r ON r.site_id = s.id
+		LEFT JOIN retention_plans p ON p.name = a.retention_plan
+		WHERE s.id = $1
+	`, siteID).Scan(&s.Plan, &s.Overrides.RawHitDays, &s.Overrides.VisitorDays, &s.Overrides.RollupDays,
+		&plan.RawHitDays, &plan.VisitorDays, &plan.RollupDays)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Effective = Resolve(s.Overrides, plan, defaults)
+	return &s, nil
+}
+
+// SaveSite replaces a site's retention overrides
+func SaveSite(db *database.DB, siteID string, overrides *models.RetentionPolicy) error {
+	_, err := db.Exec(`
+		INSERT INTO site_retention (site_id, raw_hit_days, visitor_days, rollup_days)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (site_id) DO UPDATE SET
+			raw_hit_days = EXCLUDED.raw_hit_days,
+			visitor_days = EXCLUDED.visitor_days,
+			rollup_days = EXCLUDED.rollup_days
+	`, siteID, overrides.RawHitDays, overrides.VisitorDays, overrides.RollupDays)
+	return err
+}
+
+// Purges returns a site's most recent purge records
+func Purges(db *database.DB, siteID string, limit int) ([]models.RetentionPurge, error) {
+	rows, err := db.Query(`
+		SELECT id, site_id, target, cutoff, rows_removed, purged_at
+		FROM retention_purges
+		WHERE site_id = $1
+		ORDER BY purged_at DESC
+		LIMIT $2
+	`, siteID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	purges := []models.RetentionPurge{}
+	for rows.Next() {
+		var p models.RetentionPurge
+		if err := rows.Scan(&p.ID, &p.SiteID, &p.Target, &p.Cutoff, &p.RowsRemoved, &p.PurgedAt); err != nil {
+			return nil, err
+		}
+		purges = append(purges, p)
+	}
+	return purges, rows.Err()
+}
+
+// record adds a purge to the audit log and returns its ID
+func record(db *database.DB, siteID *string, target string, cutoff time.Time, rows int64, at time.Time) (uuid.UUID, error) {
+	id := uuid.New()
+	_, err := db.Exec(`
+		INSERT INTO retention_purges (id, site_id, target, cutoff, rows_removed, purged_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, id, siteID, target, cutoff, rows, at)
+	return id, err
+}
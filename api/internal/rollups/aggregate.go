@@ -0,0 +1,435 @@
+package rollups
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/hll"
+	"trackveilapi/internal/models"
+
+	"github.com/google/uuid"
+)
+
+// Dimensions of the rollups. DimensionTotal has one row per bucket with an
+// empty value.
+const (
+	DimensionTotal    = "total"
+	DimensionPage     = "page"
+	DimensionSource   = "source"
+	DimensionBrowser  = "browser"
+	DimensionOS       = "os"
+	DimensionDevice   = "device"
+	DimensionCountry  = "country"
+	DimensionCampaign = "campaign"
+)
+
+// Dimensions lists the breakdown dimensions (everything but the total)
+var Dimensions = []string{
+	DimensionPage, DimensionSource, DimensionBrowser, DimensionOS,
+	DimensionDevice, DimensionCountry, DimensionCampaign,
+}
+
+const (
+	// stateName is the rollup_state row of the hourly watermark
+	stateName = "hourly"
+	// finalizeLag is how long after an hour ends it is still recomputed on
+	// every run, before late hits are only picked up as dirty hours
+	finalizeLag = time.Hour
+	// dirtyBatchSize bounds the dirty site hours recomputed per run
+	dirtyBatchSize = 500
+	// maxValueLength is the length of the value and label columns
+	maxValueLength = 500
+	// unknownValue is used for missing browser, OS, device and country
+	unknownValue = "Unknown"
+)
+
+// Aggregator keeps the hourly and daily rollups up to date
+type Aggregator struct {
+	db *database.DB
+}
+
+// NewAggregator creates a rollup aggregator
+func NewAggregator(db *database.DB) *Aggregator {
+	return &Aggregator{db: db}
+}
+
+// Run aggregates immediately and then every interval until ctx is cancelled
+func (a *Aggregator) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := a.Aggregate(ctx, time.Now()); err != nil {
+			log.Printf("Rollup aggregation failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Aggregate catches up on every hour since the watermark, refreshes the
+// hours and days that are still open, and recomputes dirty site hours.
+// Hours ending more than finalizeLag ago are finalized and the watermark
+// moves past them; hits arriving for them later mark them dirty.
+func (a *Aggregator) Aggregate(ctx context.Context, now time.Time) error {
+	current := now.UTC().Truncate(time.Hour)
+	final := current.Add(-finalizeLag)
+
+	start, err := a.watermark(final)
+	if err != nil {
+		return err
+	}
+
+	// Catch up, finalizing one hour at a time (and each day as it completes)
+	for h := start; h.Before(final); h = h.Add(time.Hour) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := a.recompute(hourly, h, ""); err != nil {
+			return err
+		}
+		if next := h.Add(time.Hour); next.Equal(dayStart(next)) {
+			if err := a.recompute(daily, dayStart(h), ""); err != nil {
+				return err
+			}
+		}
+		if err := a.setWatermark(h.Add(time.Hour)); err != nil {
+			return err
+		}
+	}
+	if start.Equal(final) {
+		// Nothing to catch up on; record the watermark so late hits are marked dirty
+		if err := a.setWatermark(final); err != nil {
+			return err
+		}
+	}
+
+	// Open hours and days
+	for h := final; !h.After(current); h = h.Add(time.Hour) {
+		if err := a.recompute(hourly, h, ""); err != nil {
+			return err
+		}
+	}
+	if err := a.recompute(daily, dayStart(final), ""); err != nil {
+		return err
+	}
+	if !dayStart(current).Equal(dayStart(final)) {
+		if err := a.recompute(daily, dayStart(current), ""); err != nil {
+			return err
+		}
+	}
+
+	return a.recomputeDirty(ctx)
+}
+
+// recomputeDirty recomputes site hours (and their days) that received hits
+// after they were finalized
+func (a *Aggregator) recomputeDirty(ctx context.Context) error {
+	rows, err := a.db.Query(`
+		DELETE FROM rollup_dirty_hours
+		WHERE (site_id, hour) IN (
+			SELECT site_id, hour FROM rollup_dirty_hours
+			ORDER BY hour
+			LIMIT $1
+		)
+		RETURNING site_id, hour
+	`, dirtyBatchSize)
+	if err != nil {
+		return err
+	}
+
+	var hours []siteBucket
+	for rows.Next() {
+		var d siteBucket
+		if err := rows.Scan(&d.siteID, &d.bucket); err != nil {
+			rows.Close()
+			return err
+		}
+		hours = append(hours, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	days := make(map[siteBucket]bool)
+	for i, d := range hours {
+		err := ctx.Err()
+		if err == nil {
+			err = a.recompute(hourly, d.bucket.UTC(), d.siteID)
+		}
+		if err != nil {
+			// Put the remaining hours back so the next run retries them
+			a.markDirty(hours[i:])
+			return err
+		}
+		days[siteBucket{d.siteID, dayStart(d.bucket)}] = true
+	}
+
+	for d := range days {
+		if err := a.recompute(daily, d.bucket, d.siteID); err != nil {
+			return err
+		}
+	}
+	if len(hours) > 0 {
+		log.Printf("Recomputed %d late site hours in rollups", len(hours))
+	}
+	return nil
+}
+
+// siteBucket is one site's rollup bucket
+type siteBucket struct {
+	siteID string
+	bucket time.Time
+}
+
+// markDirty re-marks site hours for recomputation
+func (a *Aggregator) markDirty(hours []siteBucket) {
+	for _, d := range hours {
+		if _, err := a.db.Exec(`
+			INSERT INTO rollup_dirty_hours (site_id, hour) VALUES ($1, $2)
+			ON CONFLICT DO NOTHING
+		`, d.siteID, d.bucket); err != nil {
+			log.Printf("Failed to re-mark rollup hour %s for site %s: %v", d.bucket, d.siteID, err)
+		}
+	}
+}
+
+// watermark returns the first hour not yet finalized. Without one, the
+// aggregation starts at the earliest page view.
+func (a *Aggregator) watermark(final time.Time) (time.Time, error) {
+	var through time.Time
+	err := a.db.QueryRow(`SELECT completed_through FROM rollup_state WHERE name = $1`, stateName).Scan(&through)
+	if err == nil {
+		return through.UTC(), nil
+	}
+	if err != sql.ErrNoRows {
+		return time.Time{}, err
+	}
+
+	// Not MIN(viewed_at): SQLite returns aggregates as text, not timestamps
+	var earliest time.Time
+	err = a.db.QueryRow(`SELECT viewed_at FROM page_views ORDER BY viewed_at LIMIT 1`).Scan(&earliest)
+	if err == sql.ErrNoRows {
+		return final, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	if earliest.After(final) {
+		return final, nil
+	}
+	return earliest.UTC().Truncate(time.Hour), nil
+}
+
+func (a *Aggregator) setWatermark(through time.Time) error {
+	_, err := a.db.Exec(`
+		INSERT INTO rollup_state (name, completed_through) VALUES ($1, $2)
+		ON CONFLICT (name) DO UPDATE SET completed_through = EXCLUDED.completed_through
+	`, stateName, through)
+	return err
+}
+
+// granularity is an hourly or daily rollup table
+type granularity struct {
+	table string
+	daily bool
+}
+
+var (
+	hourly = granularity{table: "rollups_hourly"}
+	daily  = granularity{table: "rollups_daily", daily: true}
+)
+
+// end returns the end of the bucket starting at start
+func (g granularity) end(start time.Time) time.Time {
+	if g.daily {
+		return start.AddDate(0, 0, 1)
+	}
+	return start.Add(time.Hour)
+}
+
+// bucketArg is the query parameter for a bucket. Days are passed as dates,
+// so the session time zone cannot shift them.
+func (g granularity) bucketArg(bucket time.Time) interface{} {
+	if g.daily {
+		return bucket.Format("2006-01-02")
+	}
+	return bucket
+}
+
+// row is one aggregated dimension value
+type row struct {
+	label     string
+	pageViews int64
+	visitors  *hll.Sketch
+}
+
+type rowKey struct {
+	dimension string
+	value     string
+}
+
+// recompute replaces the rollup rows of one bucket, for one site or all sites
+func (a *Aggregator) recompute(g granularity, bucket time.Time, siteID string) error {
+	query := `
+		SELECT site_id, visitor_id, page_url, page_title, referrer,
+			browser_name, os_name, device_type, country_code
+		FROM page_views
+		WHERE viewed_at >= $1 AND viewed_at < $2`
+	args := []interface{}{bucket, g.end(bucket)}
+	if siteID != "" {
+		query += ` AND site_id = $3`
+		args = append(args, siteID)
+	}
+
+	rows, err := a.db.Query(query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to read page views for %s %s: %w", g.table, bucket.Format(time.RFC3339), err)
+	}
+	defer rows.Close()
+
+	sites := make(map[string]map[rowKey]*row)
+	for rows.Next() {
+		var site, pageURL string
+		var visitorID uuid.UUID
+		var title, referrer, browser, osName, device, country sql.NullString
+		if err := rows.Scan(&site, &visitorID, &pageURL, &title, &referrer, &browser, &osName, &device, &country); err != nil {
+			return err
+		}
+
+		agg := sites[site]
+		if agg == nil {
+			agg = make(map[rowKey]*row)
+			sites[site] = agg
+		}
+		add := func(dimension, value, label string) {
+			key := rowKey{dimension, value}
+			r := agg[key]
+			if r == nil {
+				r = &row{visitors: hll.New()}
+				agg[key] = r
+			}
+			r.pageViews++
+			r.visitors.AddUUID(visitorID)
+			if label != "" {
+				r.label = label
+			}
+		}
+
+		add(DimensionTotal, "", "")
+		values := DimensionValues(pageURL, referrer.String, browser.String, osName.String, device.String, country.String)
+		for dimension, value := range values {
+			label := ""
+			if dimension == DimensionPage {
+				label = title.String
+			}
+			add(dimension, value, label)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	return a.write(g, bucket, siteID, sites)
+}
+
+// write replaces the bucket's rows in one transaction
+func (a *Aggregator) write(g granularity, bucket time.Time, siteID string, sites map[string]map[rowKey]*row) error {
+	bucketArg := g.bucketArg(bucket)
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if siteID != "" {
+		_, err = tx.Exec(`DELETE FROM `+g.table+` WHERE bucket = $1 AND site_id = $2`, bucketArg, siteID)
+	} else {
+		_, err = tx.Exec(`DELETE FROM `+g.table+` WHERE bucket = $1`, bucketArg)
+	}
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO ` + g.table + ` (site_id, bucket, dimension, value, label, page_views, visitors, visitors_sketch)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for site, agg := range sites {
+		for key, r := range agg {
+			var label *string
+			if r.label != "" {
+				l := models.Truncate(r.label, maxValueLength)
+				label = &l
+			}
+			sketch, err := r.visitors.MarshalBinary()
+			if err != nil {
+				return err
+			}
+			if _, err := stmt.Exec(site, bucketArg, key.dimension, key.value, label, r.pageViews, r.visitors.Estimate(), sketch); err != nil {
+				return fmt.Errorf("failed to write %s rollup: %w", g.table, err)
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// DimensionValues returns the value of each breakdown dimension for a page
+// view. Campaign is left out for page views without a utm_campaign.
+func DimensionValues(pageURL, referrer, browser, osName, device, country string) map[string]string {
+	values := map[string]string{
+		DimensionPage:    models.PagePath(pageURL),
+		DimensionSource:  models.TrafficSource(pageURL, referrer),
+		DimensionBrowser: orUnknown(browser),
+		DimensionOS:      orUnknown(osName),
+		DimensionDevice:  orUnknown(device),
+		DimensionCountry: orUnknown(country),
+	}
+	if campaign := campaignOf(pageURL); campaign != "" {
+		values[DimensionCampaign] = campaign
+	}
+	for dimension, value := range values {
+		values[dimension] = models.Truncate(value, maxValueLength)
+	}
+	return values
+}
+
+// campaignOf returns the lowercased utm_campaign of a page URL
+func campaignOf(pageURL string) string {
+	u, err := url.Parse(pageURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(u.Query().Get("utm_campaign")))
+}
+
+func orUnknown(s string) string {
+	if s == "" {
+		return unknownValue
+	}
+	return s
+}
+
+// dayStart is the start of t's UTC day
+func dayStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,331 @@
+package rollups
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/hll"
+)
+
+// Series intervals
+const (
+	IntervalHour = "hour"
+	IntervalDay  = "day"
+)
+
+// Stats is page views and visitors over a time range, with a time series
+type Stats struct {
+	From          time.Time `json:"from"`
+	To            time.Time `json:"to"`
+	Interval      string    `json:"interval"`
+	Filter        *Filter   `json:"filter,omitempty"`
+	PageViews     int64     `json:"page_views"`
+	Visitors      int64     `json:"visitors"`       // unique over the whole range
+	VisitorsError float64   `json:"visitors_error"` // relative standard error of visitor counts
+	Series        []Point   `json:"series"`
+}
+
+// Point is one hour or day of the series
+type Point struct {
+	Bucket    time.Time `json:"bucket"`
+	PageViews int64     `json:"page_views"`
+	Visitors  int64     `json:"visitors"`
+}
+
+// Breakdown is the top values of a dimension over a time range
+type Breakdown struct {
+	Dimension     string    `json:"dimension"`
+	From          time.Time `json:"from"`
+	To            time.Time `json:"to"`
+	VisitorsError float64   `json:"visitors_error"`
+	Rows          []Row     `json:"rows"`
+}
+
+// Row is one dimension value
+type Row struct {
+	Value     string `json:"value"`
+	Label     string `json:"label,omitempty"`
+	PageViews int64  `json:"page_views"`
+	Visitors  int64  `json:"visitors"` // unique over the whole range
+}
+
+// Filter restricts stats to page views with any of the values of one
+// dimension. Visitors are counted once even if they match several values.
+type Filter struct {
+	Dimension string   `json:"dimension"`
+	Values    []string `json:"values"`
+}
+
+// ValidDimension reports whether name is a breakdown dimension
+func ValidDimension(name string) bool {
+	for _, d := range Dimensions {
+		if d == name {
+			return true
+		}
+	}
+	return false
+}
+
+// GetStats returns totals and a series from the rollups, optionally
+// filtered. The range is widened to whole UTC hours or days to match the
+// interval.
+func GetStats(db *database.DB, siteID string, from, to time.Time, interval string, filter *Filter) (*Stats, error) {
+	g, err := granularityOf(interval)
+	if err != nil {
+		return nil, err
+	}
+	from, to = g.snap(from, to)
+
+	dimension, values := DimensionTotal, []string{""}
+	if filter != nil {
+		if !ValidDimension(filter.Dimension) {
+			return nil, fmt.Errorf("unknown dimension %q", filter.Dimension)
+		}
+		if len(filter.Values) == 0 {
+			return nil, fmt.Errorf("filter on %s has no values", filter.Dimension)
+		}
+		dimension, values = filter.Dimension, filter.Values
+	}
+
+	args := []interface{}{siteID, dimension, g.bucketArg(from), g.bucketArg(to)}
+	for _, v := range values {
+		args = append(args, v)
+	}
+	rows, err := db.Query(`
+		SELECT bucket, page_views, visitors, visitors_sketch
+		FROM `+g.table+`
+		WHERE site_id = $1 AND dimension = $2 AND bucket >= $3 AND bucket < $4
+			AND value IN (`+database.Placeholders(5, len(values))+`)
+		ORDER BY bucket
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := &Stats{
+		From:          from,
+		To:            to,
+		Interval:      interval,
+		Filter:        filter,
+		VisitorsError: hll.StdError(),
+		Series:        []Point{},
+	}
+	total := hll.New()
+
+	// Rows of one bucket (one per filter value) are merged into a point
+	var point *Point
+	var pointSketch *hll.Sketch
+	var pointRows int
+	flush := func() {
+		if point == nil {
+			return
+		}
+		if pointRows > 1 {
+			point.Visitors = int64(pointSketch.Estimate())
+		}
+		stats.Series = append(stats.Series, *point)
+		point = nil
+	}
+
+	for rows.Next() {
+		var bucket time.Time
+		var pageViews, visitors int64
+		var data []byte
+		if err := rows.Scan(&bucket, &pageViews, &visitors, &data); err != nil {
+			return nil, err
+		}
+		bucket = g.parseBucket(bucket)
+		sketch, err := hll.Decode(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid visitor sketch for %s: %w", bucket.Format(time.RFC3339), err)
+		}
+
+		if point == nil || !point.Bucket.Equal(bucket) {
+			flush()
+			point = &Point{Bucket: bucket, Visitors: visitors}
+			pointSketch = hll.New()
+			pointRows = 0
+		}
+		point.PageViews += pageViews
+		pointSketch.Merge(sketch)
+		pointRows++
+
+		stats.PageViews += pageViews
+		total.Merge(sketch)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	flush()
+
+	stats.Visitors = int64(total.Estimate())
+	stats.Series = fillGaps(g, stats.Series, from, to)
+	return stats, nil
+}
+
+// Snap widens a range to whole UTC hours or days, as GetStats does for the interval
+func Snap(interval string, from, to time.Time) (time.Time, time.Time, error) {
+	g, err := granularityOf(interval)
+	if err != nil {
+		return from, to, err
+	}
+	from, to = g.snap(from, to)
+	return from, to, nil
+}
+
+// FillGaps adds empty points to a series for buckets without page views
+func FillGaps(interval string, series []Point, from, to time.Time) ([]Point, error) {
+	g, err := granularityOf(interval)
+	if err != nil {
+		return nil, err
+	}
+	return fillGaps(g, series, from, to), nil
+}
+
+func granularityOf(interval string) (granularity, error) {
+	switch interval {
+	case IntervalHour:
+		return hourly, nil
+	case IntervalDay:
+		return daily, nil
+	}
+	return granularity{}, fmt.Errorf("unknown interval %q", interval)
+}
+
+// UniqueVisitors returns the unique visitors of a site in [from, to), from
+// hourly rollups with the range widened to whole hours
+func UniqueVisitors(db *database.DB, siteID string, from, to time.Time) (int64, error) {
+	stats, err := GetStats(db, siteID, from, to, IntervalHour, nil)
+	if err != nil {
+		return 0, err
+	}
+	return stats.Visitors, nil
+}
+
+// GetBreakdown returns the values of a dimension with the most page views.
+// Daily rollups are used when the range is made of whole UTC days, hourly
+// rollups (with the range widened to whole hours) otherwise.
+func GetBreakdown(db *database.DB, siteID, dimension string, from, to time.Time, limit int) (*Breakdown, error) {
+	if !ValidDimension(dimension) {
+		return nil, fmt.Errorf("unknown dimension %q", dimension)
+	}
+
+	g := hourly
+	if from.Equal(dayStart(from)) && to.Equal(dayStart(to)) {
+		g = daily
+	}
+	from, to = g.snap(from, to)
+
+	rows, err := db.Query(`
+		WITH top AS (
+			SELECT value, SUM(page_views) AS views
+			FROM `+g.table+`
+			WHERE site_id = $1 AND dimension = $2 AND bucket >= $3 AND bucket < $4
+			GROUP BY value
+			ORDER BY views DESC, value
+			LIMIT $5
+		)
+		SELECT r.value, r.label, r.page_views, r.visitors_sketch
+		FROM `+g.table+` r
+		JOIN top ON top.value = r.value
+		WHERE r.site_id = $1 AND r.dimension = $2 AND r.bucket >= $3 AND r.bucket < $4
+		ORDER BY top.views DESC, r.value, r.bucket
+	`, siteID, dimension, g.bucketArg(from), g.bucketArg(to), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	breakdown := &Breakdown{
+		Dimension:     dimension,
+		From:          from,
+		To:            to,
+		VisitorsError: hll.StdError(),
+		Rows:          []Row{},
+	}
+
+	var current *Row
+	var sketch *hll.Sketch
+	flush := func() {
+		if current != nil {
+			current.Visitors = int64(sketch.Estimate())
+			breakdown.Rows = append(breakdown.Rows, *current)
+		}
+	}
+
+	for rows.Next() {
+		var value string
+		var label sql.NullString
+		var pageViews int64
+		var data []byte
+		if err := rows.Scan(&value, &label, &pageViews, &data); err != nil {
+			return nil, err
+		}
+		s, err := hll.Decode(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid visitor sketch for %s %q: %w", dimension, value, err)
+		}
+
+		if current == nil || current.Value != value {
+			flush()
+			current = &Row{Value: value}
+			sketch = hll.New()
+		}
+		if label.Valid {
+			current.Label = label.String // latest bucket's label wins
+		}
+		current.PageViews += pageViews
+		sketch.Merge(s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	flush()
+
+	return breakdown, nil
+}
+
+// fillGaps adds empty points for buckets without page views, which have no rollup rows
+func fillGaps(g granularity, series []Point, from, to time.Time) []Point {
+	filled := make([]Point, 0, len(series))
+	next := from
+	for _, p := range series {
+		for ; next.Before(p.Bucket); next = g.end(next) {
+			filled = append(filled, Point{Bucket: next})
+		}
+		filled = append(filled, p)
+		next = g.end(p.Bucket)
+	}
+	for ; next.Before(to); next = g.end(next) {
+		filled = append(filled, Point{Bucket: next})
+	}
+	return filled
+}
+
+// snap widens a range to whole buckets
+func (g granularity) snap(from, to time.Time) (time.Time, time.Time) {
+	if g.daily {
+		start, end := dayStart(from), dayStart(to)
+		if end.Before(to) {
+			end = end.AddDate(0, 0, 1)
+		}
+		return start, end
+	}
+	start, end := from.UTC().Truncate(time.Hour), to.UTC().Truncate(time.Hour)
+	if end.Before(to) {
+		end = end.Add(time.Hour)
+	}
+	return start, end
+}
+
+// parseBucket normalizes a scanned bucket to UTC. Dates are scanned as
+// midnight in UTC already, so this only matters for hours.
+func (g granularity) parseBucket(t time.Time) time.Time {
+	if g.daily {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	return t.UTC()
+}
@@ -0,0 +1,261 @@
+package script
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/models"
+
+	"github.com/andybalholm/brotli"
+)
+
+// trackerJS is a copy of tracker/tracker.min.js (refresh with `make tracker`)
+//
+//go:embed tracker.min.js
+var trackerJS []byte
+
+const (
+	// settingsTTL is how long site settings are cached before being reloaded
+	settingsTTL = time.Minute
+	// maxAssets bounds the cache of rendered scripts
+	maxAssets = 1024
+)
+
+// Config is the JSON object passed to the tracker as TRACKVEIL_CONFIG
+type Config struct {
+	SiteID   string   `json:"site_id,omitempty"`
+	Endpoint string   `json:"endpoint"`
+	SPA      bool     `json:"spa,omitempty"`
+	Privacy  bool     `json:"privacy,omitempty"`
+	Exclude  []string `json:"exclude,omitempty"`
+}
+
+// Asset is a rendered tracker script with its pre-compressed variants
+type Asset struct {
+	Version string // short content hash, used in versioned URLs
+	Body    []byte
+	Gzip    []byte
+	Brotli  []byte
+	etag    string
+}
+
+// Server renders tracker scripts with site settings and caches the results
+type Server struct {
+	db *database.DB
+
+	mu       sync.Mutex
+	settings map[string]cachedSettings
+	assets   map[string]*Asset // by content hash
+}
+
+type cachedSettings struct {
+	settings *models.TrackerSettings
+	loadedAt time.Time
+}
+
+// NewServer creates a tracker script server
+func NewServer(db *database.DB) *Server {
+	return &Server{
+		db:       db,
+		settings: make(map[string]cachedSettings),
+		assets:   make(map[string]*Asset),
+	}
+}
+
+// Generic returns the tracker without site settings; it reads the site ID
+// from the script tag's data-site-id attribute
+func (s *Server) Generic(endpoint string) (*Asset, error) {
+	return s.render(Config{Endpoint: endpoint})
+}
+
+// ForSite returns the tracker with a site's settings. The endpoint is used
+// unless the site overrides it.
+func (s *Server) ForSite(siteID, endpoint string) (*Asset, error) {
+	settings, err := s.siteSettings(siteID)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := Config{
+		SiteID:   siteID,
+		Endpoint: endpoint,
+		SPA:      settings.SPAMode,
+		Privacy:  settings.PrivacyMode,
+		Exclude:  settings.ExcludedPaths,
+	}
+	if settings.Endpoint != "" {
+		cfg.Endpoint = settings.Endpoint
+	}
+	return s.render(cfg)
+}
+
+// Invalidate drops the cached settings of a site
+func (s *Server) Invalidate(siteID string) {
+	s.mu.Lock()
+	delete(s.settings, siteID)
+	s.mu.Unlock()
+}
+
+func (s *Server) siteSettings(siteID string) (*models.TrackerSettings, error) {
+	s.mu.Lock()
+	cached, ok := s.settings[siteID]
+	s.mu.Unlock()
+	if ok && time.Since(cached.loadedAt) < settingsTTL {
+		return cached.settings, nil
+	}
+
+	settings, err := GetSettings(s.db, siteID)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.settings[siteID] = cachedSettings{settings: settings, loadedAt: time.Now()}
+	s.mu.Unlock()
+	return settings, nil
+}
+
+// render wraps the tracker in a function that receives the config. Scripts
+// are cached by content, so compression only happens when settings change.
+func (s *Server) render(cfg Config) (*Asset, error) {
+	configJSON, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("(function(TRACKVEIL_CONFIG){\n")
+	buf.Write(bytes.TrimSpace(trackerJS))
+	buf.WriteString("\n})(")
+	buf.Write(configJSON)
+	buf.WriteString(");\n")
+	body := buf.Bytes()
+
+	sum := sha256.Sum256(body)
+	hash := hex.EncodeToString(sum[:])
+
+	s.mu.Lock()
+	asset, ok := s.assets[hash]
+	s.mu.Unlock()
+	if ok {
+		return asset, nil
+	}
+
+	asset, err = newAsset(body, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	if len(s.assets) >= maxAssets {
+		s.assets = make(map[string]*Asset)
+	}
+	s.assets[hash] = asset
+	s.mu.Unlock()
+	return asset, nil
+}
+
+func newAsset(body []byte, hash string) (*Asset, error) {
+	var gz bytes.Buffer
+	gw, _ := gzip.NewWriterLevel(&gz, gzip.BestCompression)
+	if _, err := gw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+
+	var br bytes.Buffer
+	bw := brotli.NewWriterLevel(&br, brotli.BestCompression)
+	if _, err := bw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := bw.Close(); err != nil {
+		return nil, err
+	}
+
+	return &Asset{
+		Version: hash[:12],
+		Body:    body,
+		Gzip:    gz.Bytes(),
+		Brotli:  br.Bytes(),
+		etag:    hash[:32],
+	}, nil
+}
+
+// Write sends the asset in the best encoding the client accepts, or 304 if
+// the client's copy is current. Each encoding has its own strong ETag.
+func (a *Asset) Write(w http.ResponseWriter, r *http.Request, cacheControl string) {
+	body, encoding := a.Body, ""
+	switch {
+	case acceptsEncoding(r, "br"):
+		body, encoding = a.Brotli, "br"
+	case acceptsEncoding(r, "gzip"):
+		body, encoding = a.Gzip, "gzip"
+	}
+
+	etag := `"` + a.etag + `"`
+	if encoding != "" {
+		etag = `"` + a.etag + "-" + encoding + `"`
+	}
+
+	h := w.Header()
+	h.Set("ETag", etag)
+	h.Set("Cache-Control", cacheControl)
+	h.Set("Vary", "Accept-Encoding")
+	h.Set("X-Content-Type-Options", "nosniff")
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	h.Set("Content-Type", "application/javascript; charset=utf-8")
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	if encoding != "" {
+		h.Set("Content-Encoding", encoding)
+	}
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(body)
+	}
+}
+
+// acceptsEncoding reports whether Accept-Encoding lists the coding with a non-zero q
+func acceptsEncoding(r *http.Request, coding string) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(name), coding) {
+			continue
+		}
+		params = strings.ReplaceAll(params, " ", "")
+		if q, ok := strings.CutPrefix(params, "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// etagMatches implements the weak comparison If-None-Match uses
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
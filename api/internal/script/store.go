@@ -0,0 +1,95 @@
+package script
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/models"
+)
+
+const (
+	// MaxExcludedPaths is the maximum number of excluded path patterns per site
+	MaxExcludedPaths = 50
+	// maxPathLength bounds a single excluded path pattern
+	maxPathLength = 200
+)
+
+// Validate checks and normalizes tracker settings
+func Validate(s *models.TrackerSettings) error {
+	s.Endpoint = strings.TrimSpace(s.Endpoint)
+	if s.Endpoint != "" && (len(s.Endpoint) > models.MaxURLLength || !models.IsHTTPURL(s.Endpoint)) {
+		return errors.New("endpoint must be an http or https URL")
+	}
+
+	if len(s.ExcludedPaths) > MaxExcludedPaths {
+		return fmt.Errorf("at most %d excluded paths are allowed", MaxExcludedPaths)
+	}
+	seen := make(map[string]bool, len(s.ExcludedPaths))
+	paths := make([]string, 0, len(s.ExcludedPaths))
+	for _, p := range s.ExcludedPaths {
+		p = models.CleanText(p, 0)
+		if p == "" || seen[p] {
+			continue
+		}
+		if !strings.HasPrefix(p, "/") && !strings.HasPrefix(p, "*") {
+			return fmt.Errorf("excluded path %q must start with / or *", p)
+		}
+		if len(p) > maxPathLength {
+			return fmt.Errorf("excluded paths must be at most %d characters", maxPathLength)
+		}
+		seen[p] = true
+		paths = append(paths, p)
+	}
+	s.ExcludedPaths = paths
+
+	return nil
+}
+
+// GetSettings loads the tracker settings of a site, or the defaults if it has none
+func GetSettings(db *database.DB, siteID string) (*models.TrackerSettings, error) {
+	s := models.TrackerSettings{SiteID: siteID, ExcludedPaths: []string{}}
+	var endpoint sql.NullString
+
+	err := db.QueryRow(`
+		SELECT endpoint, spa_mode, privacy_mode, excluded_paths, updated_at
+		FROM site_tracker_settings
+		WHERE site_id = $1
+	`, siteID).Scan(&endpoint, &s.SPAMode, &s.PrivacyMode, db.Array(&s.ExcludedPaths), &s.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return &s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.Endpoint = endpoint.String
+	if s.ExcludedPaths == nil {
+		s.ExcludedPaths = []string{}
+	}
+	return &s, nil
+}
+
+// SaveSettings creates or replaces the tracker settings of a site
+func SaveSettings(db *database.DB, s *models.TrackerSettings) error {
+	var endpoint *string
+	if s.Endpoint != "" {
+		endpoint = &s.Endpoint
+	}
+
+	// updated_at is set here too: on SQLite the trigger runs after RETURNING
+	return db.QueryRow(`
+		INSERT INTO site_tracker_settings (site_id, endpoint, spa_mode, privacy_mode, excluded_paths, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (site_id) DO UPDATE SET
+			endpoint = EXCLUDED.endpoint,
+			spa_mode = EXCLUDED.spa_mode,
+			privacy_mode = EXCLUDED.privacy_mode,
+			excluded_paths = EXCLUDED.excluded_paths,
+			updated_at = EXCLUDED.updated_at
+		RETURNING updated_at
+	`, s.SiteID, endpoint, s.SPAMode, s.PrivacyMode, db.Array(&s.ExcludedPaths), time.Now()).Scan(&s.UpdatedAt)
+}
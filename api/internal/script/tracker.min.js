@@ -0,0 +1 @@
+!function(){"use strict";const l="undefined"!=typeof TRACKVEIL_CONFIG?TRACKVEIL_CONFIG:{},t=l.endpoint||"https://api.trackveil.net/track",e="tv_fp";function n(t,e){false}function o(){const t=[navigator.userAgent,navigator.language,screen.width+"x"+screen.height,screen.colorDepth,(new Date).getTimezoneOffset(),!!window.sessionStorage,!!window.localStorage,navigator.platform,navigator.hardwareConcurrency||"unknown",navigator.deviceMemory||"unknown"];try{const e=document.createElement("canvas"),n=e.getContext("2d");n&&(n.textBaseline="top",n.font="14px Arial",n.fillText("Trackveil",2,2),t.push(e.toDataURL()))}catch(t){}const e=t.join("|");let n=0;for(let t=0;t<e.length;t++){n=(n<<5)-n+e.charCodeAt(t),n&=n}return"fp_"+Math.abs(n).toString(36)+"_"+Date.now().toString(36)}function r(){if(l.privacy)return null;try{let t=localStorage.getItem(e);return t||(t=o(),localStorage.setItem(e,t)),t}catch(t){return o()}}function u(){const t=l.exclude||[],e=window.location.pathname;for(let n=0;n<t.length;n++)if(new RegExp("^"+t[n].split("*").map(function(t){return t.replace(/[.+?^${}()|[\]\\]/g,"\\$&")}).join(".*")+"$").test(e))return!0;return!1}function i(){if(!window.performance||!window.performance.timing)return null;const t=window.performance.timing,e=t.loadEventEnd-t.navigationStart;return 0===t.loadEventEnd||e<0||e>6e4?null:e}function c(){try{const t=new Uint8Array(16);window.crypto.getRandomValues(t);let e="";for(let n=0;n<t.length;n++)e+=(t[n]<16?"0":"")+t[n].toString(16);return e}catch(t){return Date.now().toString(36)+Math.random().toString(36).slice(2)}}function a(t){return{site_id:t,page_url:window.location.href,page_title:document.title,referrer:document.referrer,screen_width:screen.width,screen_height:screen.height,fingerprint:r(),load_time:i(),event_id:c()}}function s(e){try{n();var o=new Image(1,1),r=[];for(var i in e)if(e.hasOwnProperty(i)&&null!=e[i]){var a="object"==typeof e[i]?JSON.stringify(e[i]):String(e[i]);r.push(encodeURIComponent(i)+"="+encodeURIComponent(a))}return o.src=t+"?"+r.join("&"),o.onload=function(){n(),o=null},o.onerror=function(){n(),o=null},void n()}catch(t){n()}try{fetch(t,{method:"POST",headers:{"Content-Type":"application/json"},body:JSON.stringify(e),keepalive:!0,credentials:"omit",cache:"no-store",mode:"cors"}).catch(function(t){n()})}catch(t){n()}}!function(){const t=function(){if(l.site_id)return l.site_id;const t=document.currentScript||document.querySelector("script[data-site-id]");if(!t)return n(),null;const e=t.getAttribute("data-site-id");return e||(n(),null)}();function e(){u()?n():s(a(t))}t&&(window.trackveil={track:function(e,o){!function(t,e,o){if(!e)return void n();if(u())return void n();const r=a(t);r.event_name=String(e),o&&"object"==typeof o&&(r.props=o),s(r)}(t,e,o)}},"complete"===document.readyState?setTimeout(e,100):window.addEventListener("load",function(){setTimeout(e,100)}),l.spa&&function(){let t=window.location.href;const n=function(){window.location.href!==t&&(t=window.location.href,e())},o=history.pushState;history.pushState=function(){o.apply(this,arguments),n()},window.addEventListener("popstate",n)}(),document.addEventListener("visibilitychange",function(){document.visibilityState}))}()}();
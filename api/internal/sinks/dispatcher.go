@@ -0,0 +1,277 @@
+package sinks
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/models"
+)
+
+const (
+	// closeTimeout is how long Close waits for queued hits to be delivered
+	// before canceling the deliveries in progress
+	closeTimeout = 10 * time.Second
+	// dropLogInterval limits the logging of hits dropped by a full queue
+	dropLogInterval = time.Minute
+)
+
+// Options tune the delivery of every sink
+type Options struct {
+	QueueSize     int           // hits queued per sink; a full queue drops them
+	BatchSize     int           // hits written at once
+	FlushInterval time.Duration // longest a hit waits for a batch to fill
+}
+
+// Stats are the delivery counters of a sink
+type Stats struct {
+	Sink      string
+	Queued    int
+	Delivered int64
+	Dropped   int64 // the queue was full
+	Failed    int64 // given up by the sink
+}
+
+// Dispatcher hands stored hits to the sinks enabled for their site
+type Dispatcher struct {
+	db      *database.DB
+	outlets []*outlet
+
+	mu     sync.RWMutex
+	rules  map[string][]models.SiteSink // by site
+	closed bool
+
+	ctx    context.Context // canceled when Close runs out of time
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// outlet is the queue and delivery goroutine of a sink
+type outlet struct {
+	sink  Sink
+	queue chan Hit
+	opts  Options
+
+	delivered atomic.Int64
+	dropped   atomic.Int64
+	failed    atomic.Int64
+	lastDrop  atomic.Int64 // unix time of the last logged drop
+}
+
+// NewDispatcher starts delivering to the given sinks. Call Reload to load the
+// sites' sinks, and Close to deliver the queued hits and close the sinks.
+func NewDispatcher(db *database.DB, opts Options, sinks ...Sink) *Dispatcher {
+	if opts.QueueSize < 1 {
+		opts.QueueSize = 1
+	}
+	if opts.BatchSize < 1 {
+		opts.BatchSize = 1
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = time.Second
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Dispatcher{db: db, rules: map[string][]models.SiteSink{}, ctx: ctx, cancel: cancel}
+	for _, s := range sinks {
+		o := &outlet{sink: s, queue: make(chan Hit, opts.QueueSize), opts: opts}
+		d.outlets = append(d.outlets, o)
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			o.deliver(ctx)
+		}()
+	}
+	return d
+}
+
+// Sinks returns the names of the configured sinks
+func (d *Dispatcher) Sinks() []string {
+	names := make([]string, len(d.outlets))
+	for i, o := range d.outlets {
+		names[i] = o.sink.Name()
+	}
+	return names
+}
+
+// Publish queues a stored hit for the sinks enabled for its site. It never
+// blocks: a sink whose queue is full drops the hit.
+func (d *Dispatcher) Publish(h Hit) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return
+	}
+
+	for i := range d.rules[h.SiteID] {
+		rule := &d.rules[h.SiteID][i]
+		if !matches(rule, &h) {
+			continue
+		}
+		for _, o := range d.outlets {
+			if o.sink.Name() == rule.Sink {
+				o.enqueue(h)
+			}
+		}
+	}
+}
+
+// Reload loads the sinks enabled for each site
+func (d *Dispatcher) Reload() error {
+	all, err := ListAll(d.db)
+	if err != nil {
+		return err
+	}
+	rules := map[string][]models.SiteSink{}
+	for _, s := range all {
+		rules[s.SiteID] = append(rules[s.SiteID], s)
+	}
+
+	d.mu.Lock()
+	d.rules = rules
+	d.mu.Unlock()
+	return nil
+}
+
+// Run reloads the sites' sinks on an interval, picking up changes made
+// through other instances, until ctx is canceled
+func (d *Dispatcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := d.Reload(); err != nil {
+				log.Printf("Failed to reload site sinks: %v", err)
+			}
+		}
+	}
+}
+
+// Stats returns the counters of each sink
+func (d *Dispatcher) Stats() []Stats {
+	stats := make([]Stats, len(d.outlets))
+	for i, o := range d.outlets {
+		stats[i] = Stats{
+			Sink:      o.sink.Name(),
+			Queued:    len(o.queue),
+			Delivered: o.delivered.Load(),
+			Dropped:   o.dropped.Load(),
+			Failed:    o.failed.Load(),
+		}
+	}
+	return stats
+}
+
+// Close stops accepting hits, delivers those queued and closes the sinks.
+// Deliveries still running after closeTimeout are canceled.
+func (d *Dispatcher) Close() error {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return nil
+	}
+	d.closed = true
+	for _, o := range d.outlets {
+		close(o.queue)
+	}
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(closeTimeout):
+		log.Printf("Sinks did not deliver their queued hits within %s; canceling", closeTimeout)
+		d.cancel()
+		<-done
+	}
+	d.cancel()
+
+	var firstErr error
+	for _, o := range d.outlets {
+		if err := o.sink.Close(); err != nil {
+			log.Printf("Failed to close sink %s: %v", o.sink.Name(), err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// enqueue queues a hit, or drops it if the queue is full
+func (o *outlet) enqueue(h Hit) {
+	select {
+	case o.queue <- h:
+		return
+	default:
+	}
+
+	o.dropped.Add(1)
+	now := time.Now().Unix()
+	last := o.lastDrop.Load()
+	if now-last >= int64(dropLogInterval/time.Second) && o.lastDrop.CompareAndSwap(last, now) {
+		log.Printf("Sink %s is not keeping up; dropping hits (%d so far)", o.sink.Name(), o.dropped.Load())
+	}
+}
+
+// deliver writes the queued hits in batches until the queue is closed and
+// drained
+func (o *outlet) deliver(ctx context.Context) {
+	ticker := time.NewTicker(o.opts.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]Hit, 0, o.opts.BatchSize)
+	for {
+		select {
+		case h, ok := <-o.queue:
+			if !ok {
+				o.write(ctx, batch)
+				o.flush()
+				return
+			}
+			batch = append(batch, h)
+			if len(batch) < o.opts.BatchSize {
+				continue
+			}
+		case <-ticker.C:
+			o.flush()
+		}
+		o.write(ctx, batch)
+		batch = batch[:0]
+	}
+}
+
+// write hands a batch to the sink, counting it delivered or failed
+func (o *outlet) write(ctx context.Context, batch []Hit) {
+	if len(batch) == 0 {
+		return
+	}
+	if err := o.sink.Write(ctx, batch); err != nil {
+		o.failed.Add(int64(len(batch)))
+		log.Printf("Sink %s failed to deliver %d hits: %v", o.sink.Name(), len(batch), err)
+		return
+	}
+	o.delivered.Add(int64(len(batch)))
+}
+
+// flush gives an idle sink its turn
+func (o *outlet) flush() {
+	f, ok := o.sink.(flusher)
+	if !ok {
+		return
+	}
+	if err := f.Flush(); err != nil {
+		log.Printf("Sink %s failed to flush: %v", o.sink.Name(), err)
+	}
+}
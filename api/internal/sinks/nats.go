@@ -0,0 +1,239 @@
+package sinks
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	natsDefaultPort = "4222"
+	// natsRetries is how many times a batch is published again, on a new
+	// connection, after a connection error
+	natsRetries = 2
+	natsBackoff = time.Second
+)
+
+// NATSSink publishes each hit to <subject>.<site_id> on a NATS server. It
+// speaks the core NATS text protocol: a batch is published, then confirmed
+// with a PING the server answers once it has processed it. A batch retried
+// after a connection error may be published twice.
+type NATSSink struct {
+	addr    string
+	useTLS  bool
+	host    string // TLS server name
+	user    string
+	pass    string
+	token   string
+	subject string
+	timeout time.Duration
+
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// natsInfo is the part of the server's INFO message the sink uses
+type natsInfo struct {
+	TLSRequired bool `json:"tls_required"`
+}
+
+// NewNATSSink publishes to the server at rawURL: nats://[user:pass@]host[:port],
+// nats://token@host, or tls:// for TLS. The connection is made on the first
+// write.
+func NewNATSSink(rawURL, subject string, timeout time.Duration) (*NATSSink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "nats" && u.Scheme != "tls" {
+		return nil, fmt.Errorf("unsupported NATS URL scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("NATS URL has no host")
+	}
+	if subject == "" || strings.ContainsAny(subject, " \t\r\n*>") {
+		return nil, fmt.Errorf("invalid NATS subject %q", subject)
+	}
+
+	s := &NATSSink{
+		addr:    u.Host,
+		useTLS:  u.Scheme == "tls",
+		host:    u.Hostname(),
+		subject: strings.TrimSuffix(subject, "."),
+		timeout: timeout,
+	}
+	if u.Port() == "" {
+		s.addr = net.JoinHostPort(u.Hostname(), natsDefaultPort)
+	}
+	if u.User != nil {
+		if pass, ok := u.User.Password(); ok {
+			s.user, s.pass = u.User.Username(), pass
+		} else {
+			s.token = u.User.Username()
+		}
+	}
+	return s, nil
+}
+
+// Name implements Sink
+func (s *NATSSink) Name() string { return NATS }
+
+// Write implements Sink
+func (s *NATSSink) Write(ctx context.Context, hits []Hit) error {
+	for attempt := 0; ; attempt++ {
+		err := s.publish(hits)
+		if err == nil {
+			return nil
+		}
+		s.disconnect()
+		if attempt >= natsRetries {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(natsBackoff):
+		}
+	}
+}
+
+// Close implements Sink
+func (s *NATSSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// publish sends a batch and waits for the server to confirm it
+func (s *NATSSink) publish(hits []Hit) error {
+	if s.conn == nil {
+		if err := s.connect(); err != nil {
+			return err
+		}
+	}
+	s.conn.SetDeadline(time.Now().Add(s.timeout))
+
+	for i := range hits {
+		payload, err := json.Marshal(&hits[i])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(s.w, "PUB %s.%s %d\r\n", s.subject, hits[i].SiteID, len(payload))
+		s.w.Write(payload)
+		s.w.WriteString("\r\n")
+	}
+	return s.ping()
+}
+
+// connect opens a connection and authenticates
+func (s *NATSSink) connect() error {
+	conn, err := net.DialTimeout("tcp", s.addr, s.timeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(s.timeout))
+	r := bufio.NewReader(conn)
+
+	line, err := readLine(r)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return fmt.Errorf("unexpected NATS greeting %q", line)
+	}
+	var info natsInfo
+	if err := json.Unmarshal([]byte(line[len("INFO "):]), &info); err != nil {
+		conn.Close()
+		return fmt.Errorf("invalid NATS INFO: %w", err)
+	}
+
+	if s.useTLS || info.TLSRequired {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: s.host})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return err
+		}
+		conn, r = tlsConn, bufio.NewReader(tlsConn)
+	}
+
+	connect, err := json.Marshal(map[string]interface{}{
+		"verbose":      false,
+		"pedantic":     false,
+		"tls_required": s.useTLS || info.TLSRequired,
+		"name":         "trackveil-api",
+		"lang":         "go",
+		"version":      "1",
+		"protocol":     0,
+		"user":         s.user,
+		"pass":         s.pass,
+		"auth_token":   s.token,
+	})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	s.conn, s.r, s.w = conn, r, bufio.NewWriter(conn)
+	fmt.Fprintf(s.w, "CONNECT %s\r\n", connect)
+	if err := s.ping(); err != nil {
+		s.disconnect()
+		return err
+	}
+	return nil
+}
+
+// ping flushes what was written and waits for the PONG, answering the
+// server's own PINGs and failing on -ERR
+func (s *NATSSink) ping() error {
+	s.w.WriteString("PING\r\n")
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	for {
+		line, err := readLine(s.r)
+		if err != nil {
+			return err
+		}
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			s.w.WriteString("PONG\r\n")
+			if err := s.w.Flush(); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("NATS: %s", strings.TrimSpace(line[len("-ERR"):]))
+		}
+		// +OK and INFO updates need nothing
+	}
+}
+
+func (s *NATSSink) disconnect() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,144 @@
+package sinks
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// ndjsonActive is the file being written; rotated files are renamed to
+	// hits-<first write>-<rotation>.ndjson and never written again
+	ndjsonActive     = "hits.ndjson"
+	ndjsonTimeFormat = "20060102T150405Z"
+)
+
+// NDJSONSink writes hits as newline-delimited JSON to a directory, rotating
+// the file when it reaches a size or an age
+type NDJSONSink struct {
+	dir         string
+	rotateBytes int64
+	rotateAfter time.Duration
+
+	mu     sync.Mutex
+	f      *os.File
+	w      *bufio.Writer
+	size   int64
+	opened time.Time
+}
+
+// NewNDJSONSink writes to dir, which is created if needed. A file left active
+// by a previous run is rotated first.
+func NewNDJSONSink(dir string, rotateBytes int64, rotateAfter time.Duration) (*NDJSONSink, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &NDJSONSink{dir: dir, rotateBytes: rotateBytes, rotateAfter: rotateAfter}
+
+	active := filepath.Join(dir, ndjsonActive)
+	if info, err := os.Stat(active); err == nil {
+		if info.Size() == 0 {
+			return s, os.Remove(active)
+		}
+		if err := s.archive(info.ModTime(), info.ModTime()); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Name implements Sink
+func (s *NDJSONSink) Name() string { return NDJSON }
+
+// Write implements Sink. Lines are flushed to the file after every batch.
+func (s *NDJSONSink) Write(ctx context.Context, hits []Hit) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.rotateIfDue(time.Now()); err != nil {
+		return err
+	}
+	if s.f == nil {
+		f, err := os.OpenFile(filepath.Join(s.dir, ndjsonActive), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+		s.f, s.w, s.size, s.opened = f, bufio.NewWriter(f), 0, time.Now()
+	}
+
+	for i := range hits {
+		line, err := json.Marshal(&hits[i])
+		if err != nil {
+			return err
+		}
+		line = append(line, '\n')
+		if _, err := s.w.Write(line); err != nil {
+			return err
+		}
+		s.size += int64(len(line))
+	}
+	return s.w.Flush()
+}
+
+// Flush implements flusher: an active file past its age is rotated even
+// when no hits arrive
+func (s *NDJSONSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rotateIfDue(time.Now())
+}
+
+// Close implements Sink, rotating the active file
+func (s *NDJSONSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rotate(time.Now())
+}
+
+func (s *NDJSONSink) rotateIfDue(now time.Time) error {
+	if s.f == nil {
+		return nil
+	}
+	if s.size < s.rotateBytes && now.Sub(s.opened) < s.rotateAfter {
+		return nil
+	}
+	return s.rotate(now)
+}
+
+// rotate closes the active file and renames it for consumers
+func (s *NDJSONSink) rotate(now time.Time) error {
+	if s.f == nil {
+		return nil
+	}
+	f, opened := s.f, s.opened
+	s.f, s.w = nil, nil
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return s.archive(opened, now)
+}
+
+// archive renames the active file, with a counter if the name is taken
+func (s *NDJSONSink) archive(from, to time.Time) error {
+	base := fmt.Sprintf("hits-%s-%s", from.UTC().Format(ndjsonTimeFormat), to.UTC().Format(ndjsonTimeFormat))
+	name := base + ".ndjson"
+	for i := 1; ; i++ {
+		if _, err := os.Stat(filepath.Join(s.dir, name)); os.IsNotExist(err) {
+			break
+		}
+		name = fmt.Sprintf("%s-%d.ndjson", base, i)
+	}
+	return os.Rename(filepath.Join(s.dir, ndjsonActive), filepath.Join(s.dir, name))
+}
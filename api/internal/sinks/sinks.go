@@ -0,0 +1,134 @@
+// Package sinks streams accepted hits to external pipelines as they are
+// stored: rotated NDJSON files, signed webhook batches and NATS subjects.
+// Sinks are configured per server and enabled per site. Each sink has its own
+// bounded queue and delivery goroutine, so a slow or failing sink drops its
+// own hits instead of stalling ingestion or the other sinks.
+package sinks
+
+import (
+	"context"
+	"time"
+
+	"trackveilapi/internal/models"
+
+	"github.com/google/uuid"
+)
+
+// Sink names
+const (
+	NDJSON  = "ndjson"
+	Webhook = "webhook"
+	NATS    = "nats"
+)
+
+// Names are the known sinks, in the order they are listed
+var Names = []string{NDJSON, Webhook, NATS}
+
+// Hit types
+const (
+	TypePageView = "page_view"
+	TypeEvent    = "event"
+)
+
+// Hit is the record streamed for a stored page view or event. Delivery is at
+// least once: consumers deduplicate by ID.
+type Hit struct {
+	Type      string    `json:"type"` // page_view or event
+	ID        uuid.UUID `json:"id"`
+	SiteID    string    `json:"site_id"`
+	VisitorID uuid.UUID `json:"visitor_id"`
+	SessionID uuid.UUID `json:"session_id"`
+	At        time.Time `json:"at"`
+
+	URL       string            `json:"url,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Referrer  string            `json:"referrer,omitempty"`
+	EventName string            `json:"event_name,omitempty"`
+	Props     map[string]string `json:"props,omitempty"`
+
+	Browser        string `json:"browser,omitempty"`
+	BrowserVersion string `json:"browser_version,omitempty"`
+	OS             string `json:"os,omitempty"`
+	OSVersion      string `json:"os_version,omitempty"`
+	DeviceType     string `json:"device_type,omitempty"`
+	ScreenWidth    int    `json:"screen_width,omitempty"`
+	ScreenHeight   int    `json:"screen_height,omitempty"`
+	LoadTime       int    `json:"load_time,omitempty"` // ms
+
+	Source string `json:"source,omitempty"` // ingestion endpoint
+}
+
+// PageViewHit returns the record of a stored page view. The IP address and
+// raw user agent are not streamed.
+func PageViewHit(pv *models.PageView) Hit {
+	return Hit{
+		Type:           TypePageView,
+		ID:             pv.ID,
+		SiteID:         pv.SiteID,
+		VisitorID:      pv.VisitorID,
+		SessionID:      pv.SessionID,
+		At:             pv.ViewedAt.UTC(),
+		URL:            pv.PageURL,
+		Title:          deref(pv.PageTitle),
+		Referrer:       deref(pv.Referrer),
+		Browser:        deref(pv.BrowserName),
+		BrowserVersion: deref(pv.BrowserVersion),
+		OS:             deref(pv.OSName),
+		OSVersion:      deref(pv.OSVersion),
+		DeviceType:     deref(pv.DeviceType),
+		ScreenWidth:    derefInt(pv.ScreenWidth),
+		ScreenHeight:   derefInt(pv.ScreenHeight),
+		LoadTime:       derefInt(pv.PageLoadTime),
+	}
+}
+
+// EventHit returns the record of a stored custom event
+func EventHit(ev *models.Event, browser models.BrowserInfo) Hit {
+	return Hit{
+		Type:           TypeEvent,
+		ID:             ev.ID,
+		SiteID:         ev.SiteID,
+		VisitorID:      ev.VisitorID,
+		SessionID:      ev.SessionID,
+		At:             ev.OccurredAt.UTC(),
+		URL:            deref(ev.PageURL),
+		EventName:      ev.EventName,
+		Props:          ev.Properties,
+		Browser:        browser.BrowserName,
+		BrowserVersion: browser.BrowserVersion,
+		OS:             browser.OSName,
+		OSVersion:      browser.OSVersion,
+		DeviceType:     browser.DeviceType,
+	}
+}
+
+// Sink delivers hits to an external system. Write is only called from the
+// sink's delivery goroutine; it retries as the sink sees fit and returns an
+// error once the batch is given up. ctx is canceled when a shutdown runs out
+// of time.
+type Sink interface {
+	Name() string
+	Write(ctx context.Context, hits []Hit) error
+	Close() error
+}
+
+// flusher is implemented by sinks with work to do while idle, such as
+// rotating a file that has reached its age; Flush is called on every flush
+// interval, from the delivery goroutine
+type flusher interface {
+	Flush() error
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func derefInt(i *int) int {
+	if i == nil {
+		return 0
+	}
+	return *i
+}
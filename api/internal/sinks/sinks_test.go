@@ -0,0 +1,229 @@
+package sinks_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"trackveilapi/internal/sinks"
+
+	"github.com/google/uuid"
+)
+
+func testHits(siteID string, n int) []sinks.Hit {
+	hits := make([]sinks.Hit, n)
+	for i := range hits {
+		hits[i] = sinks.Hit{
+			Type:      sinks.TypePageView,
+			ID:        uuid.New(),
+			SiteID:    siteID,
+			VisitorID: uuid.New(),
+			SessionID: uuid.New(),
+			At:        time.Now().UTC(),
+			URL:       fmt.Sprintf("https://example.com/%d", i),
+		}
+	}
+	return hits
+}
+
+func TestNDJSONRotation(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := sinks.NewNDJSONSink(dir, 1, time.Hour) // every batch fills a file
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := sink.Write(context.Background(), testHits("site", 2)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "hits-*.ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("got %d rotated files, want 3", len(files))
+	}
+	lines := 0
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var h sinks.Hit
+			if err := json.Unmarshal([]byte(line), &h); err != nil {
+				t.Fatalf("invalid line %q: %v", line, err)
+			}
+			lines++
+		}
+	}
+	if lines != 6 {
+		t.Errorf("got %d lines, want 6", lines)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "hits.ndjson")); !os.IsNotExist(err) {
+		t.Errorf("active file left after Close: %v", err)
+	}
+}
+
+func TestWebhookSignsAndRetries(t *testing.T) {
+	const secret = "s3cret"
+	var attempts atomic.Int32
+	deliveries := make(chan string, 3)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		want := "sha256=" + sinks.Sign([]byte(secret), r.Header.Get(sinks.WebhookTimestampHeader), body)
+		if r.Header.Get(sinks.WebhookSignatureHeader) != want {
+			t.Errorf("bad signature %q", r.Header.Get(sinks.WebhookSignatureHeader))
+		}
+		deliveries <- r.Header.Get(sinks.WebhookDeliveryHeader)
+		if attempts.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var payload struct {
+			Hits []sinks.Hit `json:"hits"`
+		}
+		if err := json.Unmarshal(body, &payload); err != nil || len(payload.Hits) != 2 {
+			t.Errorf("bad payload %s", body)
+		}
+	}))
+	defer server.Close()
+
+	sink := sinks.NewWebhookSink(server.URL, secret, time.Second, 1)
+	if err := sink.Write(context.Background(), testHits("site", 2)); err != nil {
+		t.Fatal(err)
+	}
+	if n := attempts.Load(); n != 2 {
+		t.Fatalf("got %d attempts, want 2", n)
+	}
+	if first, second := <-deliveries, <-deliveries; first != second {
+		t.Errorf("delivery ID changed on retry: %s, %s", first, second)
+	}
+
+	// A client error is not retried
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	attempts.Store(0)
+	if err := sink.Write(context.Background(), testHits("site", 1)); err == nil {
+		t.Fatal("want an error for 400")
+	}
+	if n := attempts.Load(); n != 1 {
+		t.Errorf("got %d attempts for 400, want 1", n)
+	}
+}
+
+// TestNATSPublish publishes to a local server, e.g.
+// TEST_NATS_URL=nats://localhost:4222, and reads the hits back
+func TestNATSPublish(t *testing.T) {
+	rawURL := os.Getenv("TEST_NATS_URL")
+	if rawURL == "" {
+		t.Skip("TEST_NATS_URL is not set")
+	}
+	subject := "trackveil.test." + strings.ReplaceAll(uuid.NewString(), "-", "")
+	msgs := subscribe(t, rawURL, subject+".>")
+
+	sink, err := sinks.NewNATSSink(rawURL, subject, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	hits := testHits("site1", 3)
+	if err := sink.Write(context.Background(), hits); err != nil {
+		t.Fatal(err)
+	}
+	for i := range hits {
+		select {
+		case msg := <-msgs:
+			if msg.subject != subject+".site1" {
+				t.Errorf("got subject %q", msg.subject)
+			}
+			var h sinks.Hit
+			if err := json.Unmarshal(msg.data, &h); err != nil || h.ID != hits[i].ID {
+				t.Errorf("got %s, want hit %s", msg.data, hits[i].ID)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d of %d hits", i, len(hits))
+		}
+	}
+}
+
+type natsMsg struct {
+	subject string
+	data    []byte
+}
+
+// subscribe reads the messages of a subject with the raw protocol
+func subscribe(t *testing.T, rawURL, subject string) <-chan natsMsg {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.DialTimeout("tcp", u.Host, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	r := bufio.NewReader(conn)
+	if _, err := r.ReadString('\n'); err != nil { // INFO
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "CONNECT {\"verbose\":false}\r\nSUB %s 1\r\nPING\r\n", subject)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, "PONG") {
+			break
+		}
+	}
+
+	msgs := make(chan natsMsg, 16)
+	go func() {
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			switch fields[0] {
+			case "PING":
+				fmt.Fprint(conn, "PONG\r\n")
+			case "MSG": // MSG <subject> <sid> <size>
+				var size int
+				fmt.Sscan(fields[len(fields)-1], &size)
+				data := make([]byte, size+2)
+				if _, err := io.ReadFull(r, data); err != nil {
+					return
+				}
+				msgs <- natsMsg{subject: fields[1], data: data[:size]}
+			}
+		}
+	}()
+	return msgs
+}
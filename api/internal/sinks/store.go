@@ -0,0 +1,146 @@
+package sinks
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/models"
+)
+
+// maxEventNames caps the event names of a site sink's filter
+const maxEventNames = 100
+
+// ErrNotEnabled is returned when removing a sink a site does not use
+var ErrNotEnabled = errors.New("sink not enabled for the site")
+
+// Validate checks a site sink and normalizes its filters
+func Validate(s *models.SiteSink) error {
+	if !known(s.Sink) {
+		return fmt.Errorf("unknown sink %q", s.Sink)
+	}
+
+	types := []string{}
+	seen := map[string]bool{}
+	for _, t := range s.HitTypes {
+		if t != TypePageView && t != TypeEvent {
+			return fmt.Errorf("hit types must be %q or %q", TypePageView, TypeEvent)
+		}
+		if !seen[t] {
+			seen[t] = true
+			types = append(types, t)
+		}
+	}
+	s.HitTypes = types
+
+	if len(s.EventNames) > maxEventNames {
+		return fmt.Errorf("at most %d event names", maxEventNames)
+	}
+	names := []string{}
+	seen = map[string]bool{}
+	for _, name := range s.EventNames {
+		if name == "" || len(name) > models.MaxEventNameLength {
+			return fmt.Errorf("event names must be 1 to %d characters", models.MaxEventNameLength)
+		}
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	s.EventNames = names
+
+	return nil
+}
+
+// List returns the sinks enabled for a site
+func List(db *database.DB, siteID string) ([]models.SiteSink, error) {
+	return list(db, `WHERE site_id = $1`, siteID)
+}
+
+// ListAll returns the sinks enabled for every site
+func ListAll(db *database.DB) ([]models.SiteSink, error) {
+	return list(db, ``)
+}
+
+func list(db *database.DB, where string, args ...interface{}) ([]models.SiteSink, error) {
+	rows, err := db.Query(`
+		SELECT site_id, sink, hit_types, event_names, updated_at
+		FROM site_sinks `+where+`
+		ORDER BY site_id, sink
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sinks := []models.SiteSink{}
+	for rows.Next() {
+		var s models.SiteSink
+		if err := rows.Scan(&s.SiteID, &s.Sink, db.Array(&s.HitTypes), db.Array(&s.EventNames), &s.UpdatedAt); err != nil {
+			return nil, err
+		}
+		if s.HitTypes == nil {
+			s.HitTypes = []string{}
+		}
+		if s.EventNames == nil {
+			s.EventNames = []string{}
+		}
+		sinks = append(sinks, s)
+	}
+	return sinks, rows.Err()
+}
+
+// Save enables a sink for a site or replaces its filters
+func Save(db *database.DB, s *models.SiteSink) error {
+	// updated_at is set here too: on SQLite the trigger runs after RETURNING
+	return db.QueryRow(`
+		INSERT INTO site_sinks (site_id, sink, hit_types, event_names, updated_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (site_id, sink) DO UPDATE SET
+			hit_types = EXCLUDED.hit_types,
+			event_names = EXCLUDED.event_names,
+			updated_at = EXCLUDED.updated_at
+		RETURNING updated_at
+	`, s.SiteID, s.Sink, db.Array(&s.HitTypes), db.Array(&s.EventNames), time.Now()).Scan(&s.UpdatedAt)
+}
+
+// Delete disables a sink for a site
+func Delete(db *database.DB, siteID, sink string) error {
+	result, err := db.Exec(`DELETE FROM site_sinks WHERE site_id = $1 AND sink = $2`, siteID, sink)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotEnabled
+	}
+	return nil
+}
+
+// matches reports whether a site sink streams a hit
+func matches(s *models.SiteSink, h *Hit) bool {
+	if len(s.HitTypes) > 0 && !contains(s.HitTypes, h.Type) {
+		return false
+	}
+	if h.Type == TypeEvent && len(s.EventNames) > 0 && !contains(s.EventNames, h.EventName) {
+		return false
+	}
+	return true
+}
+
+func known(name string) bool {
+	return contains(Names, name)
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
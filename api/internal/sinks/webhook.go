@@ -0,0 +1,129 @@
+package sinks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Webhook headers. The signature is the hex HMAC-SHA256, keyed with the
+// secret, of the timestamp, a dot and the body; receivers should also reject
+// old timestamps. The delivery ID is the same on every attempt of a batch.
+const (
+	WebhookSignatureHeader = "X-Trackveil-Signature"
+	WebhookTimestampHeader = "X-Trackveil-Timestamp"
+	WebhookDeliveryHeader  = "X-Trackveil-Delivery"
+)
+
+const (
+	webhookFirstBackoff = time.Second
+	webhookMaxBackoff   = 30 * time.Second
+)
+
+// WebhookSink posts batches of hits as {"hits": [...]} to a URL
+type WebhookSink struct {
+	url     string
+	secret  []byte
+	client  *http.Client
+	retries int // after the first attempt
+}
+
+// NewWebhookSink posts to url, signing with secret. A batch is retried with
+// backoff on network errors, 408, 429 and 5xx responses; other responses
+// give it up.
+func NewWebhookSink(url, secret string, timeout time.Duration, retries int) *WebhookSink {
+	return &WebhookSink{
+		url:     url,
+		secret:  []byte(secret),
+		client:  &http.Client{Timeout: timeout},
+		retries: retries,
+	}
+}
+
+// Name implements Sink
+func (s *WebhookSink) Name() string { return Webhook }
+
+// Write implements Sink
+func (s *WebhookSink) Write(ctx context.Context, hits []Hit) error {
+	body, err := json.Marshal(struct {
+		Hits []Hit `json:"hits"`
+	}{hits})
+	if err != nil {
+		return err
+	}
+	delivery := uuid.NewString()
+
+	backoff := webhookFirstBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := s.post(ctx, body, delivery)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= s.retries {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > webhookMaxBackoff {
+			backoff = webhookMaxBackoff
+		}
+	}
+}
+
+// Close implements Sink
+func (s *WebhookSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// post makes one attempt, reporting whether a failure is worth retrying
+func (s *WebhookSink) post(ctx context.Context, body []byte, delivery string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Trackveil-Webhook")
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookDeliveryHeader, delivery)
+	req.Header.Set(WebhookSignatureHeader, "sha256="+Sign(s.secret, timestamp, body))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode == http.StatusRequestTimeout ||
+		resp.StatusCode == http.StatusTooManyRequests ||
+		resp.StatusCode >= 500
+	return retry, fmt.Errorf("webhook answered %s", resp.Status)
+}
+
+// Sign returns the hex signature of a webhook body sent at timestamp
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
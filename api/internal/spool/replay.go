@@ -0,0 +1,101 @@
+package spool
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// ErrDrop is returned by a replay handler for a record that can never be
+// stored, e.g. for a deleted site. The record is removed from the spool.
+var ErrDrop = errors.New("record dropped")
+
+// Replayer drains a spool back into storage once it is healthy again
+type Replayer struct {
+	spool  *Spool
+	health func() error
+	handle func(payload []byte) error
+
+	replayed atomic.Int64
+	dropped  atomic.Int64
+}
+
+// NewReplayer creates a replayer. Records are only replayed while health
+// returns nil. handle stores a record: on success or ErrDrop the record is
+// removed, on any other error the drain stops and is retried later.
+func NewReplayer(s *Spool, health func() error, handle func(payload []byte) error) *Replayer {
+	return &Replayer{spool: s, health: health, handle: handle}
+}
+
+// Replayed returns the number of records stored since the replayer was created
+func (r *Replayer) Replayed() int64 {
+	return r.replayed.Load()
+}
+
+// Dropped returns the number of records removed without being stored
+func (r *Replayer) Dropped() int64 {
+	return r.dropped.Load()
+}
+
+// Drain replays records in order until the spool is empty, ctx is
+// cancelled or a record fails. It returns the number of records replayed.
+func (r *Replayer) Drain(ctx context.Context) (int64, error) {
+	var n int64
+	for ctx.Err() == nil {
+		payload, err := r.spool.Next()
+		if err != nil {
+			return n, err
+		}
+		if payload == nil {
+			return n, nil
+		}
+
+		if err := r.handle(payload); errors.Is(err, ErrDrop) {
+			r.dropped.Add(1)
+		} else if err != nil {
+			return n, err
+		} else {
+			r.replayed.Add(1)
+			n++
+		}
+		if err := r.spool.Ack(); err != nil {
+			return n, err
+		}
+	}
+	return n, ctx.Err()
+}
+
+// Run drains the spool every interval while storage is healthy, until ctx
+// is cancelled
+func (r *Replayer) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		backlog := r.spool.Stats().Records
+		if backlog == 0 {
+			continue
+		}
+		if err := r.health(); err != nil {
+			log.Printf("Spool replay waiting for storage (%d records queued): %v", backlog, err)
+			continue
+		}
+
+		n, err := r.Drain(ctx)
+		if err != nil && !errors.Is(err, context.Canceled) {
+			log.Printf("Spool replay stopped after %d records: %v", n, err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("Replayed %d spooled hits", n)
+		}
+	}
+}
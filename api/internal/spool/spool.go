@@ -0,0 +1,406 @@
+// Package spool is a durable on-disk queue for hits that could not be
+// stored while the database was unavailable. Records are appended to
+// segment files with a checksum each and read back in order.
+package spool
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// headerSize is the length and CRC-32C checksum before each record
+	headerSize = 8
+	// MaxRecordBytes bounds a single record
+	MaxRecordBytes = 1 << 20
+
+	segmentPrefix = "segment-"
+	segmentSuffix = ".log"
+	cursorFile    = "cursor"
+)
+
+// Errors returned by Append
+var (
+	ErrFull     = errors.New("spool is full")
+	ErrTooLarge = errors.New("record is too large for the spool")
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Stats describes the spool's backlog and activity since it was opened
+type Stats struct {
+	Records  int64 // not yet acknowledged
+	Bytes    int64 // on disk, including acknowledged records of the oldest segment
+	Segments int
+
+	Appended int64 // records appended
+	Rejected int64 // records refused because the spool was full
+	Corrupt  int64 // damaged records found; the rest of their segment is skipped
+}
+
+// segment is a segment file, numbered in append order
+type segment struct {
+	seq     int64
+	size    int64
+	end     int64 // of the readable records; short of size if damaged
+	records int64 // not yet acknowledged
+}
+
+// cursor is the position of the next record to read
+type cursor struct {
+	Segment int64 `json:"segment"`
+	Offset  int64 `json:"offset"`
+}
+
+// Spool is a FIFO queue of records in segment files. Appends go to the
+// newest segment, which is sealed once it reaches the segment size; reads
+// start at the cursor, and segments are deleted once read to the end.
+type Spool struct {
+	dir          string
+	segmentBytes int64
+	maxBytes     int64
+
+	mu       sync.Mutex
+	segments []*segment // oldest first; the last is appended to
+	active   *os.File
+	read     cursor
+	reading  *os.File // segment at the cursor
+	pending  int64    // length of the record returned by Next
+	stats    Stats
+}
+
+// Open opens the spool in dir, creating the directory if needed. Segments
+// are sealed at segmentBytes and appends are refused beyond maxBytes. A
+// record torn by a crash at the end of the newest segment is discarded.
+func Open(dir string, segmentBytes, maxBytes int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+	s := &Spool{dir: dir, segmentBytes: segmentBytes, maxBytes: maxBytes}
+
+	if data, err := os.ReadFile(filepath.Join(dir, cursorFile)); err == nil {
+		if err := json.Unmarshal(data, &s.read); err != nil {
+			return nil, fmt.Errorf("invalid spool cursor: %w", err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var seqs []int64
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	for i, seq := range seqs {
+		if seq < s.read.Segment {
+			// Read to the end before a crash kept it from being deleted
+			os.Remove(s.segmentPath(seq))
+			continue
+		}
+		from := int64(0)
+		if seq == s.read.Segment {
+			from = s.read.Offset
+		}
+		seg, err := s.scan(seq, from, i == len(seqs)-1)
+		if err != nil {
+			return nil, err
+		}
+		s.segments = append(s.segments, seg)
+	}
+
+	if len(s.segments) == 0 {
+		if err := s.rotate(); err != nil {
+			return nil, err
+		}
+	} else {
+		last := s.segments[len(s.segments)-1]
+		s.active, err = os.OpenFile(s.segmentPath(last.seq), os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s.read.Segment != s.segments[0].seq {
+		s.read = cursor{Segment: s.segments[0].seq}
+	}
+	return s, nil
+}
+
+// scan counts the valid records of a segment from offset on. The newest
+// segment is truncated after its last valid record.
+func (s *Spool) scan(seq, offset int64, newest bool) (*segment, error) {
+	f, err := os.OpenFile(s.segmentPath(seq), os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	seg := &segment{seq: seq, size: info.Size()}
+	for offset < seg.size {
+		n, err := readRecord(f, offset, nil)
+		if err != nil {
+			s.stats.Corrupt++
+			if newest {
+				log.Printf("Spool: discarding %d bytes after the last valid record of segment %d: %v", seg.size-offset, seq, err)
+				if err := f.Truncate(offset); err != nil {
+					return nil, err
+				}
+				seg.size = offset
+			} else {
+				log.Printf("Spool: segment %d is unreadable after offset %d: %v", seq, offset, err)
+			}
+			break
+		}
+		seg.records++
+		offset += n
+	}
+	seg.end = offset
+	s.stats.Records += seg.records
+	s.stats.Bytes += seg.size
+	return seg, nil
+}
+
+// readRecord reads the record at offset into buf if not nil, and returns
+// its length on disk
+func readRecord(f *os.File, offset int64, buf *[]byte) (int64, error) {
+	var header [headerSize]byte
+	if _, err := f.ReadAt(header[:], offset); err != nil {
+		if errors.Is(err, io.EOF) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	length := binary.LittleEndian.Uint32(header[:4])
+	if length > MaxRecordBytes {
+		return 0, fmt.Errorf("record length %d out of range", length)
+	}
+	payload := make([]byte, length)
+	if _, err := f.ReadAt(payload, offset+headerSize); err != nil {
+		if errors.Is(err, io.EOF) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	if crc32.Checksum(payload, castagnoli) != binary.LittleEndian.Uint32(header[4:]) {
+		return 0, errors.New("checksum mismatch")
+	}
+	if buf != nil {
+		*buf = payload
+	}
+	return headerSize + int64(length), nil
+}
+
+func (s *Spool) segmentPath(seq int64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%s%016d%s", segmentPrefix, seq, segmentSuffix))
+}
+
+// rotate seals the active segment and starts a new one
+func (s *Spool) rotate() error {
+	seq := int64(1)
+	if n := len(s.segments); n > 0 {
+		seq = s.segments[n-1].seq + 1
+	}
+	f, err := os.OpenFile(s.segmentPath(seq), os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create spool segment: %w", err)
+	}
+	if s.active != nil {
+		s.active.Close()
+	}
+	s.active = f
+	s.segments = append(s.segments, &segment{seq: seq})
+	s.stats.Segments = len(s.segments)
+	return nil
+}
+
+// Append durably adds a record to the end of the spool
+func (s *Spool) Append(payload []byte) error {
+	if len(payload) > MaxRecordBytes {
+		return ErrTooLarge
+	}
+	size := headerSize + int64(len(payload))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stats.Bytes+size > s.maxBytes {
+		s.stats.Rejected++
+		return ErrFull
+	}
+	seg := s.segments[len(s.segments)-1]
+	if seg.size > 0 && seg.size+size > s.segmentBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+		seg = s.segments[len(s.segments)-1]
+	}
+
+	record := make([]byte, size)
+	binary.LittleEndian.PutUint32(record[:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.Checksum(payload, castagnoli))
+	copy(record[headerSize:], payload)
+
+	if _, err := s.active.Write(record); err != nil {
+		// Drop the partial record so later appends stay readable
+		s.active.Truncate(seg.size)
+		return fmt.Errorf("failed to write to spool: %w", err)
+	}
+	if err := s.active.Sync(); err != nil {
+		return fmt.Errorf("failed to sync spool: %w", err)
+	}
+
+	seg.size += size
+	seg.end = seg.size
+	seg.records++
+	s.stats.Records++
+	s.stats.Bytes += size
+	s.stats.Appended++
+	return nil
+}
+
+// Next returns the oldest record that has not been acknowledged, without
+// removing it, or nil if the spool is empty. Records that fail their
+// checksum are skipped with the rest of their segment.
+func (s *Spool) Next() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		seg := s.segments[0]
+		if s.read.Offset < seg.end {
+			if s.reading == nil {
+				f, err := os.Open(s.segmentPath(seg.seq))
+				if err != nil {
+					return nil, err
+				}
+				s.reading = f
+			}
+			var payload []byte
+			if n, err := readRecord(s.reading, s.read.Offset, &payload); err == nil {
+				s.pending = n
+				return payload, nil
+			} else if len(s.segments) == 1 {
+				// Appends continue in a new segment past the damage
+				if err := s.rotate(); err != nil {
+					return nil, err
+				}
+				log.Printf("Spool: skipping the rest of segment %d: %v", seg.seq, err)
+			} else {
+				log.Printf("Spool: skipping the rest of segment %d: %v", seg.seq, err)
+			}
+			s.stats.Corrupt++
+			s.stats.Records -= seg.records
+			seg.records = 0
+			seg.end = s.read.Offset
+		}
+
+		if len(s.segments) == 1 {
+			return nil, nil
+		}
+		if err := s.dropOldest(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Ack removes the record returned by Next
+func (s *Spool) Ack() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seg := s.segments[0]
+	if s.pending == 0 {
+		return errors.New("no record to acknowledge")
+	}
+	s.read.Offset += s.pending
+	s.pending = 0
+	seg.records--
+	s.stats.Records--
+
+	if s.read.Offset >= seg.end && len(s.segments) > 1 {
+		return s.dropOldest()
+	}
+	return s.saveCursor()
+}
+
+// dropOldest deletes the oldest segment, which has been read to the end
+func (s *Spool) dropOldest() error {
+	seg := s.segments[0]
+	if s.reading != nil {
+		s.reading.Close()
+		s.reading = nil
+	}
+	s.segments = s.segments[1:]
+	s.read = cursor{Segment: s.segments[0].seq}
+	if err := s.saveCursor(); err != nil {
+		return err
+	}
+	if err := os.Remove(s.segmentPath(seg.seq)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	s.stats.Bytes -= seg.size
+	s.stats.Segments = len(s.segments)
+	return nil
+}
+
+// saveCursor records the read position, replacing the cursor file
+// atomically. It is not synced: after a crash, records read since the last
+// sync are read again.
+func (s *Spool) saveCursor() error {
+	data, err := json.Marshal(s.read)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(s.dir, cursorFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, cursorFile))
+}
+
+// Stats returns the backlog and activity counters
+func (s *Spool) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := s.stats
+	stats.Segments = len(s.segments)
+	return stats
+}
+
+// Close closes the segment files
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reading != nil {
+		s.reading.Close()
+		s.reading = nil
+	}
+	return s.active.Close()
+}
@@ -0,0 +1,370 @@
+package spool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// recordSize is the size on disk of the records appended by the tests, so
+// segments of segmentSize hold five
+const (
+	recordSize  = headerSize + 10 // len("record-000")
+	segmentSize = 5*recordSize + recordSize/2
+)
+
+func record(i int) []byte {
+	return []byte(fmt.Sprintf("record-%03d", i))
+}
+
+func open(t *testing.T, dir string) *Spool {
+	t.Helper()
+	s, err := Open(dir, segmentSize, 1<<20)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	return s
+}
+
+func appendRecords(t *testing.T, s *Spool, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		if err := s.Append(record(i)); err != nil {
+			t.Fatalf("append %d: %v", i, err)
+		}
+	}
+}
+
+// drain reads and acknowledges up to n records, or all if n < 0
+func drain(t *testing.T, s *Spool, n int) []string {
+	t.Helper()
+	var got []string
+	for n != 0 {
+		payload, err := s.Next()
+		if err != nil {
+			t.Fatalf("next: %v", err)
+		}
+		if payload == nil {
+			break
+		}
+		got = append(got, string(payload))
+		if err := s.Ack(); err != nil {
+			t.Fatalf("ack: %v", err)
+		}
+		n--
+	}
+	return got
+}
+
+func records(from, to int) []string {
+	var out []string
+	for i := from; i < to; i++ {
+		out = append(out, string(record(i)))
+	}
+	return out
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, segmentPrefix+"*"+segmentSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// TestSpoolRotation checks that records come back in order across segments,
+// which are deleted once read
+func TestSpoolRotation(t *testing.T) {
+	dir := t.TempDir()
+	s := open(t, dir)
+	defer s.Close()
+
+	appendRecords(t, s, 0, 12)
+	stats := s.Stats()
+	if stats.Records != 12 || stats.Appended != 12 || stats.Segments != 3 || stats.Bytes != 12*recordSize {
+		t.Errorf("stats %+v, want 12 records in 3 segments of %d bytes", stats, 12*recordSize)
+	}
+	if n := len(segmentFiles(t, dir)); n != 3 {
+		t.Errorf("%d segment files, want 3", n)
+	}
+
+	// Next returns the same record until it is acknowledged
+	for i := 0; i < 2; i++ {
+		if payload, err := s.Next(); err != nil || string(payload) != "record-000" {
+			t.Fatalf("next = %q, %v; want record-000", payload, err)
+		}
+	}
+	if got := drain(t, s, 7); !reflect.DeepEqual(got, records(0, 7)) {
+		t.Errorf("read %v, want %v", got, records(0, 7))
+	}
+	stats = s.Stats()
+	if stats.Records != 5 || stats.Segments != 2 || stats.Bytes != 7*recordSize {
+		t.Errorf("stats %+v after reading 7, want 5 records in 2 segments of %d bytes", stats, 7*recordSize)
+	}
+	if n := len(segmentFiles(t, dir)); n != 2 {
+		t.Errorf("%d segment files after the first was read, want 2", n)
+	}
+
+	// Reading to the end keeps the newest segment for appends
+	if got := drain(t, s, -1); !reflect.DeepEqual(got, records(7, 12)) {
+		t.Errorf("read %v, want %v", got, records(7, 12))
+	}
+	appendRecords(t, s, 12, 14)
+	if got := drain(t, s, -1); !reflect.DeepEqual(got, records(12, 14)) {
+		t.Errorf("read %v, want %v", got, records(12, 14))
+	}
+	if err := s.Ack(); err == nil {
+		t.Error("acknowledged a record that was not read")
+	}
+}
+
+// TestSpoolReopen checks that a reopened spool resumes at its cursor
+func TestSpoolReopen(t *testing.T) {
+	dir := t.TempDir()
+	s := open(t, dir)
+	appendRecords(t, s, 0, 12)
+	first, err := os.ReadFile(s.segmentPath(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	drain(t, s, 7)
+
+	// A record read but not acknowledged is read again
+	if payload, err := s.Next(); err != nil || string(payload) != "record-007" {
+		t.Fatalf("next = %q, %v; want record-007", payload, err)
+	}
+	s.Close()
+
+	// As if a crash came between saving the cursor and deleting the segment
+	if err := os.WriteFile(s.segmentPath(1), first, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s = open(t, dir)
+	defer s.Close()
+	if n := len(segmentFiles(t, dir)); n != 2 {
+		t.Errorf("%d segment files, want the one read deleted", n)
+	}
+	if stats := s.Stats(); stats.Records != 5 || stats.Corrupt != 0 {
+		t.Errorf("stats %+v, want 5 records", stats)
+	}
+	appendRecords(t, s, 12, 13)
+	if got := drain(t, s, -1); !reflect.DeepEqual(got, records(7, 13)) {
+		t.Errorf("read %v after reopening, want %v", got, records(7, 13))
+	}
+}
+
+// TestSpoolTornTail checks that a record cut short by a crash is discarded
+// on open, and the records before it are read once
+func TestSpoolTornTail(t *testing.T) {
+	for _, cut := range []int{1, recordSize - headerSize, recordSize - 1} {
+		dir := t.TempDir()
+		s := open(t, dir)
+		appendRecords(t, s, 0, 8)
+		if got := drain(t, s, 6); !reflect.DeepEqual(got, records(0, 6)) {
+			t.Fatalf("read %v, want %v", got, records(0, 6))
+		}
+		s.Close()
+
+		path := s.segmentPath(2)
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Truncate(path, info.Size()-int64(cut)); err != nil {
+			t.Fatal(err)
+		}
+
+		s = open(t, dir)
+		if stats := s.Stats(); stats.Records != 1 || stats.Corrupt != 1 {
+			t.Errorf("cut %d: stats %+v, want 1 record and the torn one counted corrupt", cut, stats)
+		}
+		if info, err := os.Stat(path); err != nil {
+			t.Fatal(err)
+		} else if info.Size() != 2*recordSize {
+			t.Errorf("cut %d: segment of %d bytes, want it truncated to its last record", cut, info.Size())
+		}
+		// Appends continue right after the last whole record
+		appendRecords(t, s, 8, 10)
+		want := append(records(6, 7), records(8, 10)...)
+		if got := drain(t, s, -1); !reflect.DeepEqual(got, want) {
+			t.Errorf("cut %d: read %v, want %v", cut, got, want)
+		}
+		s.Close()
+
+		// Nothing is read again once acknowledged
+		s = open(t, dir)
+		if got := drain(t, s, -1); len(got) != 0 {
+			t.Errorf("cut %d: read %v again", cut, got)
+		}
+		s.Close()
+	}
+}
+
+// TestSpoolChecksum checks that damaged records are detected by their
+// CRC-32C, and the rest of their segment skipped
+func TestSpoolChecksum(t *testing.T) {
+	flip := func(t *testing.T, path string, offset int64) {
+		t.Helper()
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data[offset] ^= 0x20
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	payloadByte := int64(headerSize + 3) // in record 0 of a segment
+
+	t.Run("sealed segment on open", func(t *testing.T) {
+		dir := t.TempDir()
+		s := open(t, dir)
+		appendRecords(t, s, 0, 12)
+		s.Close()
+		flip(t, s.segmentPath(1), 2*recordSize+payloadByte)
+
+		s = open(t, dir)
+		defer s.Close()
+		if stats := s.Stats(); stats.Records != 9 || stats.Corrupt != 1 {
+			t.Errorf("stats %+v, want 9 readable records and 1 corrupt", stats)
+		}
+		want := append(records(0, 2), records(5, 12)...)
+		if got := drain(t, s, -1); !reflect.DeepEqual(got, want) {
+			t.Errorf("read %v, want %v", got, want)
+		}
+	})
+
+	t.Run("sealed segment while reading", func(t *testing.T) {
+		dir := t.TempDir()
+		s := open(t, dir)
+		defer s.Close()
+		appendRecords(t, s, 0, 12)
+		drain(t, s, 1)
+		flip(t, s.segmentPath(1), 3*recordSize+payloadByte)
+
+		want := append(records(1, 3), records(5, 12)...)
+		if got := drain(t, s, -1); !reflect.DeepEqual(got, want) {
+			t.Errorf("read %v, want %v", got, want)
+		}
+		if stats := s.Stats(); stats.Records != 0 || stats.Corrupt != 1 {
+			t.Errorf("stats %+v, want no records and 1 corrupt", stats)
+		}
+	})
+
+	t.Run("newest segment on open", func(t *testing.T) {
+		dir := t.TempDir()
+		s := open(t, dir)
+		appendRecords(t, s, 0, 4)
+		s.Close()
+		// A torn write can leave a whole header with the wrong payload
+		flip(t, s.segmentPath(1), 3*recordSize+payloadByte)
+
+		s = open(t, dir)
+		defer s.Close()
+		appendRecords(t, s, 4, 6)
+		want := append(records(0, 3), records(4, 6)...)
+		if got := drain(t, s, -1); !reflect.DeepEqual(got, want) {
+			t.Errorf("read %v, want %v", got, want)
+		}
+	})
+
+	t.Run("newest segment while reading", func(t *testing.T) {
+		dir := t.TempDir()
+		s := open(t, dir)
+		defer s.Close()
+		appendRecords(t, s, 0, 3)
+		flip(t, s.segmentPath(1), recordSize+payloadByte)
+
+		if got := drain(t, s, -1); !reflect.DeepEqual(got, records(0, 1)) {
+			t.Errorf("read %v, want %v", got, records(0, 1))
+		}
+		// Appends go to a new segment past the damage
+		appendRecords(t, s, 3, 5)
+		if got := drain(t, s, -1); !reflect.DeepEqual(got, records(3, 5)) {
+			t.Errorf("read %v after the damage, want %v", got, records(3, 5))
+		}
+	})
+}
+
+// TestSpoolLimits checks that appends beyond the spool size are refused
+// until read segments free space
+func TestSpoolLimits(t *testing.T) {
+	s, err := Open(t.TempDir(), segmentSize, 10*recordSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.Append(make([]byte, MaxRecordBytes+1)); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("append of an oversized record: %v, want ErrTooLarge", err)
+	}
+	appendRecords(t, s, 0, 10)
+	if err := s.Append(record(10)); !errors.Is(err, ErrFull) {
+		t.Fatalf("append to a full spool: %v, want ErrFull", err)
+	}
+	if stats := s.Stats(); stats.Rejected != 1 || stats.Records != 10 {
+		t.Errorf("stats %+v, want 10 records and 1 rejected", stats)
+	}
+
+	// Acknowledged records free their space once their segment is deleted
+	drain(t, s, 4)
+	if err := s.Append(record(10)); !errors.Is(err, ErrFull) {
+		t.Errorf("append before a segment was freed: %v, want ErrFull", err)
+	}
+	drain(t, s, 1)
+	appendRecords(t, s, 11, 16)
+	if got := drain(t, s, -1); !reflect.DeepEqual(got, append(records(5, 10), records(11, 16)...)) {
+		t.Errorf("read %v", got)
+	}
+}
+
+// TestReplayer checks that a failed record stops the drain and is retried,
+// and that dropped records are removed
+func TestReplayer(t *testing.T) {
+	s := open(t, t.TempDir())
+	defer s.Close()
+	appendRecords(t, s, 0, 12)
+
+	var stored []string
+	failures := map[string]error{
+		"record-003": errors.New("storage unavailable"),
+		"record-008": ErrDrop,
+	}
+	r := NewReplayer(s, func() error { return nil }, func(payload []byte) error {
+		if err := failures[string(payload)]; err != nil {
+			if err != ErrDrop {
+				delete(failures, string(payload)) // only fails once
+			}
+			return err
+		}
+		stored = append(stored, string(payload))
+		return nil
+	})
+
+	n, err := r.Drain(context.Background())
+	if err == nil || n != 3 {
+		t.Fatalf("first drain = %d, %v; want 3 and the storage error", n, err)
+	}
+	if n, err := r.Drain(context.Background()); err != nil || n != 8 {
+		t.Fatalf("second drain = %d, %v; want 8", n, err)
+	}
+	want := append(records(0, 8), records(9, 12)...)
+	if !reflect.DeepEqual(stored, want) {
+		t.Errorf("stored %v, want %v", stored, want)
+	}
+	if r.Replayed() != 11 || r.Dropped() != 1 || s.Stats().Records != 0 {
+		t.Errorf("replayed %d, dropped %d, %d left; want 11, 1, 0", r.Replayed(), r.Dropped(), s.Stats().Records)
+	}
+
+	appendRecords(t, s, 12, 13)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if n, err := r.Drain(ctx); !errors.Is(err, context.Canceled) || n != 0 || s.Stats().Records != 1 {
+		t.Errorf("cancelled drain = %d, %v with %d left; want nothing replayed", n, err, s.Stats().Records)
+	}
+}
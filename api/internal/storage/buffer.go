@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"trackveilapi/internal/models"
+
+	"github.com/google/uuid"
+)
+
+// bufferedPageView is a buffered page view and its insert arguments
+type bufferedPageView struct {
+	pv   models.PageView
+	args []interface{}
+}
+
+// bufferedEvent is a buffered event and its insert arguments
+type bufferedEvent struct {
+	ev   models.Event
+	args []interface{}
+}
+
+// ErrBufferFull is returned for hits a store cannot take because
+// maxPendingBatches batches are already waiting to be written. The hit is
+// not stored, so the client is answered 503 and browser hits are spooled.
+var ErrBufferFull = errors.New("hit buffer is full; the database is not accepting writes")
+
+// hitBuffer holds the hits of a database store until they are written in a
+// batch. Buffered page views, including the batch being written, are
+// visible to the store's page view lookups.
+type hitBuffer struct {
+	name      string // for logs
+	batchSize int
+
+	mu        sync.Mutex
+	pageViews []bufferedPageView
+	events    []bufferedEvent
+	flushing  []bufferedPageView // being written, still visible to lookups
+	writing   int                // hits in the batch being written
+
+	flushMu sync.Mutex // one flush at a time
+	full    chan struct{}
+}
+
+func newHitBuffer(name string, batchSize int) *hitBuffer {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	return &hitBuffer{name: name, batchSize: batchSize, full: make(chan struct{}, 1)}
+}
+
+func (b *hitBuffer) addPageView(pv *models.PageView) {
+	b.mu.Lock()
+	b.pageViews = append(b.pageViews, bufferedPageView{pv: *pv, args: pageViewArgs(pv)})
+	buffered := len(b.pageViews) + len(b.events)
+	b.mu.Unlock()
+	b.notifyIfFull(buffered)
+}
+
+func (b *hitBuffer) addEvent(ev *models.Event, args []interface{}) {
+	b.mu.Lock()
+	b.events = append(b.events, bufferedEvent{ev: *ev, args: args})
+	buffered := len(b.pageViews) + len(b.events)
+	b.mu.Unlock()
+	b.notifyIfFull(buffered)
+}
+
+// check returns ErrBufferFull once maxPendingBatches batches are waiting.
+// Hits are refused up front rather than dropped later, since their clients
+// have already been answered by then.
+func (b *hitBuffer) check() error {
+	b.mu.Lock()
+	pending := b.writing + len(b.pageViews) + len(b.events)
+	b.mu.Unlock()
+	if pending >= maxPendingBatches*b.batchSize {
+		return ErrBufferFull
+	}
+	return nil
+}
+
+// notifyIfFull wakes the flush loop when a batch is ready
+func (b *hitBuffer) notifyIfFull(buffered int) {
+	if buffered < b.batchSize {
+		return
+	}
+	select {
+	case b.full <- struct{}{}:
+	default:
+	}
+}
+
+// flush hands the buffered hits to write. If the batch cannot be written it
+// stays buffered, ahead of hits added since, for the next flush; check
+// stops new hits once maxPendingBatches are waiting.
+func (b *hitBuffer) flush(write func(pageViews []bufferedPageView, events []bufferedEvent) error) error {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	b.mu.Lock()
+	pageViews, events := b.pageViews, b.events
+	b.pageViews, b.events = nil, nil
+	b.flushing = pageViews
+	b.writing = len(pageViews) + len(events)
+	b.mu.Unlock()
+
+	var err error
+	if len(pageViews) > 0 || len(events) > 0 {
+		err = write(pageViews, events)
+	}
+
+	b.mu.Lock()
+	b.flushing, b.writing = nil, 0
+	if err != nil {
+		b.pageViews = append(pageViews, b.pageViews...)
+		b.events = append(events, b.events...)
+	}
+	b.mu.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("failed to write %d page views and %d events: %w", len(pageViews), len(events), err)
+	}
+	return nil
+}
+
+// recentPageView reports whether a buffered page view matches
+// Store.RecentPageView
+func (b *hitBuffer) recentPageView(siteID string, visitorID uuid.UUID, pageURL string, from, to time.Time) bool {
+	found := false
+	b.each(func(pv *models.PageView) {
+		if pv.SiteID == siteID && pv.VisitorID == visitorID && pv.PageURL == pageURL && pv.ViewedAt.After(from) && !pv.ViewedAt.After(to) {
+			found = true
+		}
+	})
+	return found
+}
+
+// addToSummary counts a session's buffered page views into a summary read
+// from the database, whose landing page was viewed at first
+func (b *hitBuffer) addToSummary(summary *SessionSummary, first time.Time, siteID string, sessionID uuid.UUID) {
+	b.each(func(pv *models.PageView) {
+		if pv.SiteID != siteID || pv.SessionID != sessionID {
+			return
+		}
+		summary.PageViews++
+		if summary.LandingURL == "" || pv.ViewedAt.Before(first) {
+			summary.LandingURL, summary.LandingReferrer = pv.PageURL, deref(pv.Referrer)
+			first = pv.ViewedAt
+		}
+	})
+}
+
+// each calls fn for every page view not yet written
+func (b *hitBuffer) each(fn func(pv *models.PageView)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i := range b.flushing {
+		fn(&b.flushing[i].pv)
+	}
+	for i := range b.pageViews {
+		fn(&b.pageViews[i].pv)
+	}
+}
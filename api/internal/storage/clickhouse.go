@@ -0,0 +1,720 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/hll"
+	"trackveilapi/internal/models"
+	"trackveilapi/internal/rollups"
+
+	"github.com/google/uuid"
+)
+
+//go:embed clickhouse.sql
+var clickhouseSchema string
+
+const (
+	// maxPendingBatches bounds the hits kept for retry while storage is not
+	// accepting writes, in batches. ClickHouse drops the oldest hits beyond
+	// it; the Postgres and SQLite buffers refuse new ones.
+	maxPendingBatches = 100
+	// clickhouseTimeout bounds each request to ClickHouse
+	clickhouseTimeout = 30 * time.Second
+	// visitorPrecision is the HyperLogLog precision of unique visitor
+	// counts, matching the rollups' sketches
+	visitorPrecision = hll.Precision
+)
+
+// ClickHouseConfig configures the ClickHouse store
+type ClickHouseConfig struct {
+	URL           string // HTTP interface, e.g. http://localhost:8123
+	Database      string // must already exist
+	User          string
+	Password      string
+	BatchSize     int           // buffered hits that trigger a flush
+	FlushInterval time.Duration // how often buffered hits are flushed
+}
+
+// ClickHouseStore keeps hits in ClickHouse MergeTree tables, written in
+// batches over the HTTP interface. Analytics are computed from the raw hits.
+// Visitor and session activity, which Postgres triggers maintain for the
+// Postgres store, is updated in Postgres as hits are buffered.
+type ClickHouseStore struct {
+	cfg      ClickHouseConfig
+	endpoint *url.URL
+	client   *http.Client
+	db       *database.DB // nil skips visitor and session activity updates
+
+	mu        sync.Mutex
+	pageViews []chPageView // buffered
+	events    []chEvent    // buffered
+	flushing  []chPageView // being written, still visible to lookups
+
+	flushMu sync.Mutex // one flush at a time
+	full    chan struct{}
+}
+
+// NewClickHouse connects to ClickHouse and applies the schema
+func NewClickHouse(cfg ClickHouseConfig, db *database.DB) (*ClickHouseStore, error) {
+	endpoint, err := url.Parse(cfg.URL)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid ClickHouse URL %q", cfg.URL)
+	}
+	if cfg.BatchSize < 1 {
+		cfg.BatchSize = 1
+	}
+
+	s := &ClickHouseStore{
+		cfg:      cfg,
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: clickhouseTimeout},
+		db:       db,
+		full:     make(chan struct{}, 1),
+	}
+	if err := s.migrate(); err != nil {
+		return nil, fmt.Errorf("failed to apply ClickHouse schema: %w", err)
+	}
+	return s, nil
+}
+
+// migrate applies the embedded schema, one statement per request
+func (s *ClickHouseStore) migrate() error {
+	var lines []string
+	for _, line := range strings.Split(clickhouseSchema, "\n") {
+		if i := strings.Index(line, "--"); i >= 0 {
+			line = line[:i]
+		}
+		lines = append(lines, line)
+	}
+	for _, stmt := range strings.Split(strings.Join(lines, "\n"), ";") {
+		if strings.TrimSpace(stmt) == "" {
+			continue
+		}
+		if err := s.exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Backend implements Store
+func (s *ClickHouseStore) Backend() string {
+	return BackendClickHouse
+}
+
+// Run flushes buffered hits every flush interval, and as soon as a batch
+// fills up, until ctx is cancelled
+func (s *ClickHouseStore) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.full:
+		}
+		if err := s.Flush(); err != nil {
+			log.Printf("ClickHouse flush failed: %v", err)
+		}
+	}
+}
+
+// chTime is a timestamp in ClickHouse's DateTime64(3) text format
+type chTime time.Time
+
+func (t chTime) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + time.Time(t).UTC().Format("2006-01-02 15:04:05.000") + `"`), nil
+}
+
+// chPageView is a page_views row
+type chPageView struct {
+	ID             uuid.UUID `json:"id"`
+	SiteID         string    `json:"site_id"`
+	VisitorID      uuid.UUID `json:"visitor_id"`
+	SessionID      uuid.UUID `json:"session_id"`
+	PageURL        string    `json:"page_url"`
+	PageTitle      *string   `json:"page_title"`
+	Referrer       *string   `json:"referrer"`
+	UserAgent      *string   `json:"user_agent"`
+	IPAddress      string    `json:"ip_address"`
+	CountryCode    *string   `json:"country_code"`
+	BrowserName    *string   `json:"browser_name"`
+	BrowserVersion *string   `json:"browser_version"`
+	OSName         *string   `json:"os_name"`
+	OSVersion      *string   `json:"os_version"`
+	DeviceType     *string   `json:"device_type"`
+	ScreenWidth    *int      `json:"screen_width"`
+	ScreenHeight   *int      `json:"screen_height"`
+	PageLoadTime   *int      `json:"page_load_time"`
+	ViewedAt       chTime    `json:"viewed_at"`
+
+	Page     string `json:"page"`
+	Source   string `json:"source"`
+	Browser  string `json:"browser"`
+	OS       string `json:"os"`
+	Device   string `json:"device"`
+	Country  string `json:"country"`
+	Campaign string `json:"campaign"`
+}
+
+// chEvent is an events row
+type chEvent struct {
+	ID         uuid.UUID `json:"id"`
+	SiteID     string    `json:"site_id"`
+	VisitorID  uuid.UUID `json:"visitor_id"`
+	SessionID  uuid.UUID `json:"session_id"`
+	EventName  string    `json:"event_name"`
+	PageURL    *string   `json:"page_url"`
+	Properties string    `json:"properties"`
+	OccurredAt chTime    `json:"occurred_at"`
+}
+
+// InsertPageView implements Store
+func (s *ClickHouseStore) InsertPageView(pv *models.PageView) error {
+	if pv.ID == uuid.Nil {
+		pv.ID = uuid.New()
+	}
+
+	if s.db != nil {
+		if err := touchVisitor(s.db, pv.VisitorID, pv.ViewedAt); err != nil {
+			return err
+		}
+		if err := touchSession(s.db, pv.SessionID, pv.ViewedAt); err != nil {
+			return err
+		}
+	}
+
+	values := rollups.DimensionValues(pv.PageURL, deref(pv.Referrer), deref(pv.BrowserName),
+		deref(pv.OSName), deref(pv.DeviceType), deref(pv.CountryCode))
+	row := chPageView{
+		ID:             pv.ID,
+		SiteID:         pv.SiteID,
+		VisitorID:      pv.VisitorID,
+		SessionID:      pv.SessionID,
+		PageURL:        pv.PageURL,
+		PageTitle:      pv.PageTitle,
+		Referrer:       pv.Referrer,
+		UserAgent:      pv.UserAgent,
+		IPAddress:      pv.IPAddress,
+		CountryCode:    pv.CountryCode,
+		BrowserName:    pv.BrowserName,
+		BrowserVersion: pv.BrowserVersion,
+		OSName:         pv.OSName,
+		OSVersion:      pv.OSVersion,
+		DeviceType:     pv.DeviceType,
+		ScreenWidth:    pv.ScreenWidth,
+		ScreenHeight:   pv.ScreenHeight,
+		PageLoadTime:   pv.PageLoadTime,
+		ViewedAt:       chTime(pv.ViewedAt),
+		Page:           values[rollups.DimensionPage],
+		Source:         values[rollups.DimensionSource],
+		Browser:        values[rollups.DimensionBrowser],
+		OS:             values[rollups.DimensionOS],
+		Device:         values[rollups.DimensionDevice],
+		Country:        values[rollups.DimensionCountry],
+		Campaign:       values[rollups.DimensionCampaign],
+	}
+
+	s.mu.Lock()
+	s.pageViews = append(s.pageViews, row)
+	buffered := len(s.pageViews) + len(s.events)
+	s.mu.Unlock()
+	s.notifyIfFull(buffered)
+	return nil
+}
+
+// InsertEvent implements Store
+func (s *ClickHouseStore) InsertEvent(ev *models.Event) error {
+	if ev.ID == uuid.Nil {
+		ev.ID = uuid.New()
+	}
+
+	var props string
+	if len(ev.Properties) > 0 {
+		data, err := json.Marshal(ev.Properties)
+		if err != nil {
+			return err
+		}
+		props = string(data)
+	}
+
+	if s.db != nil {
+		if err := touchSession(s.db, ev.SessionID, ev.OccurredAt); err != nil {
+			return err
+		}
+	}
+
+	row := chEvent{
+		ID:         ev.ID,
+		SiteID:     ev.SiteID,
+		VisitorID:  ev.VisitorID,
+		SessionID:  ev.SessionID,
+		EventName:  ev.EventName,
+		PageURL:    ev.PageURL,
+		Properties: props,
+		OccurredAt: chTime(ev.OccurredAt),
+	}
+
+	s.mu.Lock()
+	s.events = append(s.events, row)
+	buffered := len(s.pageViews) + len(s.events)
+	s.mu.Unlock()
+	s.notifyIfFull(buffered)
+	return nil
+}
+
+// notifyIfFull wakes Run when a batch is ready
+func (s *ClickHouseStore) notifyIfFull(buffered int) {
+	if buffered < s.cfg.BatchSize {
+		return
+	}
+	select {
+	case s.full <- struct{}{}:
+	default:
+	}
+}
+
+// Flush implements Store. Hits that fail to write stay buffered for the next flush.
+func (s *ClickHouseStore) Flush() error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	s.mu.Lock()
+	pageViews, events := s.pageViews, s.events
+	s.pageViews, s.events = nil, nil
+	s.flushing = pageViews
+	s.mu.Unlock()
+
+	var errs []string
+	var failedPageViews []chPageView
+	var failedEvents []chEvent
+	if len(pageViews) > 0 {
+		if err := insertRows(s, "page_views", pageViews); err != nil {
+			errs = append(errs, fmt.Sprintf("%d page views: %v", len(pageViews), err))
+			failedPageViews = pageViews
+		}
+	}
+	if len(events) > 0 {
+		if err := insertRows(s, "events", events); err != nil {
+			errs = append(errs, fmt.Sprintf("%d events: %v", len(events), err))
+			failedEvents = events
+		}
+	}
+
+	limit := maxPendingBatches * s.cfg.BatchSize
+	s.mu.Lock()
+	s.flushing = nil
+	var dropped int
+	s.pageViews, dropped = requeue(failedPageViews, s.pageViews, limit)
+	if dropped > 0 {
+		log.Printf("Dropped %d buffered page views; ClickHouse is not accepting writes", dropped)
+	}
+	s.events, dropped = requeue(failedEvents, s.events, limit)
+	if dropped > 0 {
+		log.Printf("Dropped %d buffered events; ClickHouse is not accepting writes", dropped)
+	}
+	s.mu.Unlock()
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to write %s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// requeue puts failed rows back ahead of rows buffered since, keeping at
+// most limit rows (the newest). It returns the rows and how many were dropped.
+func requeue[T any](failed, buffered []T, limit int) ([]T, int) {
+	if len(failed) == 0 {
+		return buffered, 0
+	}
+	rows := append(failed, buffered...)
+	if len(rows) <= limit {
+		return rows, 0
+	}
+	return rows[len(rows)-limit:], len(rows) - limit
+}
+
+// Close implements Store
+func (s *ClickHouseStore) Close() error {
+	return s.Flush()
+}
+
+// insertRows writes rows to a table in one INSERT
+func insertRows[T any](s *ClickHouseStore, table string, rows []T) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, row := range rows {
+		if err := enc.Encode(row); err != nil {
+			return err
+		}
+	}
+
+	resp, err := s.do("INSERT INTO "+table+" FORMAT JSONEachRow", nil, &body)
+	if err != nil {
+		return err
+	}
+	return resp.Close()
+}
+
+// RecentPageView implements Store
+func (s *ClickHouseStore) RecentPageView(siteID string, visitorID uuid.UUID, pageURL string, from, to time.Time) (bool, error) {
+	found := false
+	s.eachBuffered(func(pv *chPageView) {
+		at := time.Time(pv.ViewedAt)
+		if pv.SiteID == siteID && pv.VisitorID == visitorID && pv.PageURL == pageURL && at.After(from) && !at.After(to) {
+			found = true
+		}
+	})
+	if found {
+		return true, nil
+	}
+
+	var row struct {
+		Count int64 `json:"n"`
+	}
+	err := s.queryRow(`
+		SELECT count() AS n FROM page_views
+		WHERE site_id = {site:String} AND visitor_id = {visitor:UUID} AND page_url = {url:String}
+			AND viewed_at > fromUnixTimestamp64Milli({from:Int64}, 'UTC')
+			AND viewed_at <= fromUnixTimestamp64Milli({to:Int64}, 'UTC')
+	`, map[string]string{
+		"site":    siteID,
+		"visitor": visitorID.String(),
+		"url":     pageURL,
+		"from":    millis(from),
+		"to":      millis(to),
+	}, &row)
+	if err != nil {
+		return false, fmt.Errorf("failed to check for recent page view: %w", err)
+	}
+	return row.Count > 0, nil
+}
+
+// SessionSummary implements Store
+func (s *ClickHouseStore) SessionSummary(siteID string, sessionID uuid.UUID) (*SessionSummary, error) {
+	var row struct {
+		PageViews int    `json:"page_views"`
+		URL       string `json:"landing_url"`
+		Referrer  string `json:"landing_referrer"`
+		First     int64  `json:"first"`
+	}
+	err := s.queryRow(`
+		SELECT count() AS page_views,
+			argMin(page_url, viewed_at) AS landing_url,
+			argMin(ifNull(referrer, ''), viewed_at) AS landing_referrer,
+			toUnixTimestamp64Milli(min(viewed_at)) AS first
+		FROM page_views
+		WHERE site_id = {site:String} AND session_id = {session:UUID}
+	`, map[string]string{"site": siteID, "session": sessionID.String()}, &row)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load session page views: %w", err)
+	}
+
+	summary := &SessionSummary{PageViews: row.PageViews}
+	var first time.Time
+	if row.PageViews > 0 {
+		summary.LandingURL, summary.LandingReferrer = row.URL, row.Referrer
+		first = time.UnixMilli(row.First)
+	}
+
+	s.eachBuffered(func(pv *chPageView) {
+		if pv.SiteID != siteID || pv.SessionID != sessionID {
+			return
+		}
+		summary.PageViews++
+		if at := time.Time(pv.ViewedAt); summary.LandingURL == "" || at.Before(first) {
+			summary.LandingURL, summary.LandingReferrer = pv.PageURL, deref(pv.Referrer)
+			first = at
+		}
+	})
+	return summary, nil
+}
+
+// eachBuffered calls fn for every page view not yet written to ClickHouse
+func (s *ClickHouseStore) eachBuffered(fn func(pv *chPageView)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.flushing {
+		fn(&s.flushing[i])
+	}
+	for i := range s.pageViews {
+		fn(&s.pageViews[i])
+	}
+}
+
+// Stats implements Store
+func (s *ClickHouseStore) Stats(siteID string, from, to time.Time, interval string, filter *rollups.Filter) (*rollups.Stats, error) {
+	if err := checkStatsArgs(interval, filter); err != nil {
+		return nil, err
+	}
+	from, to, _ = rollups.Snap(interval, from, to)
+	where, params := hitFilter(siteID, from, to, filter)
+
+	bucket := "toStartOfHour(viewed_at)"
+	if interval == rollups.IntervalDay {
+		bucket = "toStartOfDay(viewed_at)"
+	}
+
+	stats := &rollups.Stats{
+		From:          from,
+		To:            to,
+		Interval:      interval,
+		Filter:        filter,
+		VisitorsError: hll.StdError(),
+		Series:        []rollups.Point{},
+	}
+
+	var total struct {
+		PageViews int64 `json:"page_views"`
+		Visitors  int64 `json:"visitors"`
+	}
+	if err := s.queryRow(`
+		SELECT count() AS page_views, `+visitorsExpr+` AS visitors
+		FROM page_views WHERE `+where, params, &total); err != nil {
+		return nil, err
+	}
+	stats.PageViews, stats.Visitors = total.PageViews, total.Visitors
+
+	err := s.query(`
+		SELECT toUnixTimestamp(`+bucket+`) AS bucket, count() AS page_views, `+visitorsExpr+` AS visitors
+		FROM page_views WHERE `+where+`
+		GROUP BY bucket
+		ORDER BY bucket
+	`, params, func(line []byte) error {
+		var p struct {
+			Bucket    int64 `json:"bucket"`
+			PageViews int64 `json:"page_views"`
+			Visitors  int64 `json:"visitors"`
+		}
+		if err := json.Unmarshal(line, &p); err != nil {
+			return err
+		}
+		stats.Series = append(stats.Series, rollups.Point{
+			Bucket:    time.Unix(p.Bucket, 0).UTC(),
+			PageViews: p.PageViews,
+			Visitors:  p.Visitors,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stats.Series, err = rollups.FillGaps(interval, stats.Series, from, to)
+	return stats, err
+}
+
+// Breakdown implements Store. The range is widened to whole hours.
+func (s *ClickHouseStore) Breakdown(siteID, dimension string, from, to time.Time, limit int) (*rollups.Breakdown, error) {
+	if !rollups.ValidDimension(dimension) {
+		return nil, fmt.Errorf("unknown dimension %q", dimension)
+	}
+	from, to, _ = rollups.Snap(rollups.IntervalHour, from, to)
+	where, params := hitFilter(siteID, from, to, nil)
+	if dimension == rollups.DimensionCampaign {
+		where += ` AND campaign != ''`
+	}
+	params["limit"] = strconv.Itoa(limit)
+
+	label := `CAST(NULL, 'Nullable(String)')`
+	if dimension == rollups.DimensionPage {
+		label = `argMax(page_title, viewed_at)` // latest non-empty title
+	}
+
+	breakdown := &rollups.Breakdown{
+		Dimension:     dimension,
+		From:          from,
+		To:            to,
+		VisitorsError: hll.StdError(),
+		Rows:          []rollups.Row{},
+	}
+	err := s.query(`
+		SELECT `+dimension+` AS value, `+label+` AS label,
+			count() AS page_views, `+visitorsExpr+` AS visitors
+		FROM page_views WHERE `+where+`
+		GROUP BY value
+		ORDER BY page_views DESC, value
+		LIMIT {limit:UInt32}
+	`, params, func(line []byte) error {
+		var r struct {
+			Value     string  `json:"value"`
+			Label     *string `json:"label"`
+			PageViews int64   `json:"page_views"`
+			Visitors  int64   `json:"visitors"`
+		}
+		if err := json.Unmarshal(line, &r); err != nil {
+			return err
+		}
+		breakdown.Rows = append(breakdown.Rows, rollups.Row{
+			Value:     r.Value,
+			Label:     deref(r.Label),
+			PageViews: r.PageViews,
+			Visitors:  r.Visitors,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return breakdown, nil
+}
+
+// UniqueVisitors implements Store
+func (s *ClickHouseStore) UniqueVisitors(siteID string, from, to time.Time) (int64, error) {
+	from, to, _ = rollups.Snap(rollups.IntervalHour, from, to)
+	where, params := hitFilter(siteID, from, to, nil)
+
+	var row struct {
+		Visitors int64 `json:"visitors"`
+	}
+	if err := s.queryRow(`SELECT `+visitorsExpr+` AS visitors FROM page_views WHERE `+where, params, &row); err != nil {
+		return 0, err
+	}
+	return row.Visitors, nil
+}
+
+// visitorsExpr counts unique visitors: exactly for small sets, then with a
+// HyperLogLog of the same precision as the rollups
+var visitorsExpr = fmt.Sprintf("uniqCombined(%d)(visitor_id)", visitorPrecision)
+
+// hitFilter is the WHERE clause and parameters selecting a site's page views
+// in [from, to), optionally filtered on the values of a dimension. The
+// dimension must be valid; it is used as a column name.
+func hitFilter(siteID string, from, to time.Time, filter *rollups.Filter) (string, map[string]string) {
+	where := `site_id = {site:String}
+		AND viewed_at >= fromUnixTimestamp64Milli({from:Int64}, 'UTC')
+		AND viewed_at < fromUnixTimestamp64Milli({to:Int64}, 'UTC')`
+	params := map[string]string{"site": siteID, "from": millis(from), "to": millis(to)}
+
+	if filter != nil {
+		where += ` AND ` + filter.Dimension + ` IN {values:Array(String)}`
+		if filter.Dimension == rollups.DimensionCampaign {
+			where += ` AND campaign != ''`
+		}
+		params["values"] = arrayParam(filter.Values)
+	}
+	return where, params
+}
+
+// queryRow runs a query returning one row and decodes it into dest
+func (s *ClickHouseStore) queryRow(query string, params map[string]string, dest interface{}) error {
+	found := false
+	err := s.query(query, params, func(line []byte) error {
+		found = true
+		return json.Unmarshal(line, dest)
+	})
+	if err == nil && !found {
+		err = fmt.Errorf("clickhouse: query returned no rows")
+	}
+	return err
+}
+
+// query runs a query and calls fn with each row as a JSON object
+func (s *ClickHouseStore) query(query string, params map[string]string, fn func(line []byte) error) error {
+	resp, err := s.do(query+" FORMAT JSONEachRow", params, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+
+	scanner := bufio.NewScanner(resp)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if err := fn(line); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// exec runs a statement without results
+func (s *ClickHouseStore) exec(query string) error {
+	resp, err := s.do(query, nil, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Close()
+}
+
+// do sends a request to the HTTP interface. The query is sent as the body,
+// or in the URL when body carries insert data. Parameters are bound to
+// {name:Type} placeholders by ClickHouse.
+func (s *ClickHouseStore) do(query string, params map[string]string, body io.Reader) (io.ReadCloser, error) {
+	u := *s.endpoint
+	q := u.Query()
+	for name, value := range params {
+		q.Set("param_"+name, value)
+	}
+	// Counts are read as JSON numbers
+	q.Set("output_format_json_quote_64bit_integers", "0")
+	if body == nil {
+		body = strings.NewReader(query)
+	} else {
+		q.Set("query", query)
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodPost, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if s.cfg.Database != "" {
+		req.Header.Set("X-ClickHouse-Database", s.cfg.Database)
+	}
+	if s.cfg.User != "" {
+		req.Header.Set("X-ClickHouse-User", s.cfg.User)
+		req.Header.Set("X-ClickHouse-Key", s.cfg.Password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("clickhouse: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("clickhouse: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp.Body, nil
+}
+
+// arrayParam formats an Array(String) query parameter
+func arrayParam(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		v = strings.ReplaceAll(v, `\`, `\\`)
+		quoted[i] = `'` + strings.ReplaceAll(v, `'`, `\'`) + `'`
+	}
+	return "[" + strings.Join(quoted, ",") + "]"
+}
+
+func millis(t time.Time) string {
+	return strconv.FormatInt(t.UnixMilli(), 10)
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -0,0 +1,50 @@
+-- ClickHouse schema for page views and events (STORAGE_BACKEND=clickhouse)
+-- Applied by the API at startup; every statement is idempotent. Breakdown
+-- dimensions are derived when hits are written, with the same rules as the
+-- Postgres rollups, so reports match across backends.
+
+CREATE TABLE IF NOT EXISTS page_views (
+    id UUID,
+    site_id LowCardinality(String),
+    visitor_id UUID,
+    session_id UUID,
+    page_url String,
+    page_title Nullable(String),
+    referrer Nullable(String),
+    user_agent Nullable(String),
+    ip_address String,
+    country_code Nullable(String),
+    browser_name Nullable(String),
+    browser_version Nullable(String),
+    os_name Nullable(String),
+    os_version Nullable(String),
+    device_type Nullable(String),
+    screen_width Nullable(Int32),
+    screen_height Nullable(Int32),
+    page_load_time Nullable(Int32),
+    viewed_at DateTime64(3, 'UTC'),
+
+    -- Breakdown dimensions
+    page String,
+    source LowCardinality(String),
+    browser LowCardinality(String),
+    os LowCardinality(String),
+    device LowCardinality(String),
+    country LowCardinality(String),
+    campaign String -- empty without utm_campaign
+) ENGINE = MergeTree
+PARTITION BY toYYYYMM(viewed_at)
+ORDER BY (site_id, toStartOfHour(viewed_at), visitor_id, viewed_at);
+
+CREATE TABLE IF NOT EXISTS events (
+    id UUID,
+    site_id LowCardinality(String),
+    visitor_id UUID,
+    session_id UUID,
+    event_name LowCardinality(String),
+    page_url Nullable(String),
+    properties String, -- JSON object, empty without properties
+    occurred_at DateTime64(3, 'UTC')
+) ENGINE = MergeTree
+PARTITION BY toYYYYMM(occurred_at)
+ORDER BY (site_id, event_name, occurred_at);
@@ -0,0 +1,54 @@
+package storage_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"trackveilapi/internal/models"
+	"trackveilapi/internal/storage"
+	"trackveilapi/internal/storage/storagetest"
+
+	"github.com/google/uuid"
+)
+
+// TestClickHouseConformance runs the conformance suite against a local
+// server, e.g. TEST_CLICKHOUSE_URL=http://localhost:8123. Visitor and session
+// activity is not kept in Postgres here.
+func TestClickHouseConformance(t *testing.T) {
+	url := os.Getenv("TEST_CLICKHOUSE_URL")
+	if url == "" {
+		t.Skip("TEST_CLICKHOUSE_URL is not set")
+	}
+	database := os.Getenv("TEST_CLICKHOUSE_DATABASE")
+	if database == "" {
+		database = "default"
+	}
+
+	store, err := storage.NewClickHouse(storage.ClickHouseConfig{
+		URL:           url,
+		Database:      database,
+		User:          os.Getenv("TEST_CLICKHOUSE_USER"),
+		Password:      os.Getenv("TEST_CLICKHOUSE_PASSWORD"),
+		BatchSize:     1000,
+		FlushInterval: time.Second,
+	}, nil)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer store.Close()
+
+	siteID, err := models.GenerateSiteID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storagetest.Run(t, storagetest.Harness{
+		Store:  store,
+		SiteID: siteID,
+		NewSession: func(t *testing.T) (uuid.UUID, uuid.UUID) {
+			return uuid.New(), uuid.New()
+		},
+		Settle: func(t *testing.T) {},
+	})
+}
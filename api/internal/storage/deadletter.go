@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/deadletter"
+	"trackveilapi/internal/models"
+
+	"github.com/google/uuid"
+)
+
+// rejectedHit is a buffered hit the database rejected
+type rejectedHit struct {
+	letter models.DeadLetter
+	row    interface{} // *models.PageView or *models.Event
+}
+
+func rejectedPageView(pv *models.PageView, err error) rejectedHit {
+	return rejectedHit{
+		letter: models.DeadLetter{ID: pv.ID, SiteID: pv.SiteID, Kind: deadletter.KindPageView, Error: err.Error()},
+		row:    pv,
+	}
+}
+
+func rejectedEvent(ev *models.Event, err error) rejectedHit {
+	return rejectedHit{
+		letter: models.DeadLetter{ID: ev.ID, SiteID: ev.SiteID, Kind: deadletter.KindEvent, Error: err.Error()},
+		row:    ev,
+	}
+}
+
+// deadLetter keeps rejected hits as dead letters, with the hit's ID so a
+// hit rejected again replaces its letter. Hits that cannot be kept are
+// logged and dropped.
+func deadLetter(db *database.DB, backend string, rejected []rejectedHit) {
+	for _, hit := range rejected {
+		l := hit.letter
+		l.Source = backend
+		payload, err := json.Marshal(hit.row)
+		if err == nil {
+			l.Payload = payload
+			err = deadletter.Add(db, &l)
+		}
+		if err != nil {
+			log.Printf("Dropped %s %s for site %s (%s): %v", l.Kind, l.ID, l.SiteID, l.Error, err)
+			continue
+		}
+		log.Printf("Dead-lettered %s %s for site %s: %s", l.Kind, l.ID, l.SiteID, l.Error)
+	}
+}
+
+// Reinsert writes the page view or event of a dead letter straight to the
+// page_views or events table of a Postgres or SQLite database
+func Reinsert(db *database.DB, l *models.DeadLetter) error {
+	switch l.Kind {
+	case deadletter.KindPageView:
+		var pv models.PageView
+		if err := json.Unmarshal(l.Payload, &pv); err != nil {
+			return fmt.Errorf("invalid page view: %w", err)
+		}
+		if pv.ID == uuid.Nil {
+			pv.ID = l.ID
+		}
+		_, err := db.Exec(insertPageViewSQL, pageViewArgs(&pv)...)
+		return err
+
+	case deadletter.KindEvent:
+		var ev models.Event
+		if err := json.Unmarshal(l.Payload, &ev); err != nil {
+			return fmt.Errorf("invalid event: %w", err)
+		}
+		if ev.ID == uuid.Nil {
+			ev.ID = l.ID
+		}
+		args, err := eventArgs(&ev)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(insertEventSQL, args...)
+		return err
+	}
+	return fmt.Errorf("cannot reinsert a %s dead letter", l.Kind)
+}
@@ -0,0 +1,362 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/models"
+	"trackveilapi/internal/rollups"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// postgresWriteTimeout bounds writing one batch of buffered hits
+const postgresWriteTimeout = 30 * time.Second
+
+// How the Postgres store writes hits
+const (
+	PostgresWriteInsert = "insert" // one INSERT per hit, as it arrives
+	PostgresWriteBatch  = "batch"  // buffered, INSERTs pipelined in one round trip
+	PostgresWriteCopy   = "copy"   // buffered, one COPY per table
+)
+
+// PostgresConfig configures the Postgres store
+type PostgresConfig struct {
+	WriteMode     string        // PostgresWriteInsert (default), PostgresWriteBatch or PostgresWriteCopy
+	BatchSize     int           // buffered hits that trigger a flush
+	FlushInterval time.Duration // how often buffered hits are flushed
+}
+
+// PostgresStore keeps hits in the partitioned page_views and events tables.
+// Triggers keep visitor and session activity current, and analytics are
+// read from the rollups the aggregator builds. With the batch and copy
+// write modes hits are buffered; session activity is then updated as they
+// are buffered, so engagement goals see them right away.
+type PostgresStore struct {
+	db     *database.DB
+	cfg    PostgresConfig
+	buffer *hitBuffer // nil with PostgresWriteInsert
+}
+
+// NewPostgres creates a Postgres store. The database stays owned by the caller.
+func NewPostgres(db *database.DB, cfg PostgresConfig) (*PostgresStore, error) {
+	s := &PostgresStore{db: db, cfg: cfg}
+	switch cfg.WriteMode {
+	case "", PostgresWriteInsert:
+	case PostgresWriteBatch, PostgresWriteCopy:
+		s.buffer = newHitBuffer("Postgres", cfg.BatchSize)
+	default:
+		return nil, fmt.Errorf("unknown Postgres write mode %q", cfg.WriteMode)
+	}
+	return s, nil
+}
+
+// Backend implements Store
+func (s *PostgresStore) Backend() string {
+	return BackendPostgres
+}
+
+// InsertPageView implements Store
+func (s *PostgresStore) InsertPageView(pv *models.PageView) error {
+	if pv.ID == uuid.Nil {
+		pv.ID = uuid.New()
+	}
+	if s.buffer == nil {
+		_, err := s.db.Exec(insertPageViewSQL, pageViewArgs(pv)...)
+		return err
+	}
+
+	if err := s.buffer.check(); err != nil {
+		return err
+	}
+	if err := touchSession(s.db, pv.SessionID, pv.ViewedAt); err != nil {
+		return err
+	}
+	s.buffer.addPageView(pv)
+	return nil
+}
+
+// InsertEvent implements Store
+func (s *PostgresStore) InsertEvent(ev *models.Event) error {
+	if ev.ID == uuid.Nil {
+		ev.ID = uuid.New()
+	}
+	args, err := eventArgs(ev)
+	if err != nil {
+		return err
+	}
+	if s.buffer == nil {
+		_, err = s.db.Exec(insertEventSQL, args...)
+		return err
+	}
+
+	if err := s.buffer.check(); err != nil {
+		return err
+	}
+	if err := touchSession(s.db, ev.SessionID, ev.OccurredAt); err != nil {
+		return err
+	}
+	s.buffer.addEvent(ev, args)
+	return nil
+}
+
+// RecentPageView implements Store
+func (s *PostgresStore) RecentPageView(siteID string, visitorID uuid.UUID, pageURL string, from, to time.Time) (bool, error) {
+	if s.buffer != nil && s.buffer.recentPageView(siteID, visitorID, pageURL, from, to) {
+		return true, nil
+	}
+	return recentPageView(s.db, siteID, visitorID, pageURL, from, to)
+}
+
+// SessionSummary implements Store
+func (s *PostgresStore) SessionSummary(siteID string, sessionID uuid.UUID) (*SessionSummary, error) {
+	summary, first, err := sessionSummary(s.db, siteID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if s.buffer != nil {
+		s.buffer.addToSummary(summary, first, siteID, sessionID)
+	}
+	return summary, nil
+}
+
+// Stats implements Store
+func (s *PostgresStore) Stats(siteID string, from, to time.Time, interval string, filter *rollups.Filter) (*rollups.Stats, error) {
+	return rollups.GetStats(s.db.ReadOnly(), siteID, from, to, interval, filter)
+}
+
+// Breakdown implements Store
+func (s *PostgresStore) Breakdown(siteID, dimension string, from, to time.Time, limit int) (*rollups.Breakdown, error) {
+	return rollups.GetBreakdown(s.db.ReadOnly(), siteID, dimension, from, to, limit)
+}
+
+// UniqueVisitors implements Store
+func (s *PostgresStore) UniqueVisitors(siteID string, from, to time.Time) (int64, error) {
+	return rollups.UniqueVisitors(s.db.ReadOnly(), siteID, from, to)
+}
+
+// Run flushes buffered hits every flush interval, and as soon as a batch
+// fills up, until ctx is cancelled. It returns at once if hits are not
+// buffered.
+func (s *PostgresStore) Run(ctx context.Context) {
+	if s.buffer == nil {
+		return
+	}
+	ticker := time.NewTicker(s.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.buffer.full:
+		}
+		if err := s.Flush(); err != nil {
+			log.Printf("Postgres flush failed: %v", err)
+		}
+	}
+}
+
+// Flush implements Store. If the batch cannot be written it stays buffered
+// for the next flush. A batch the database rejects for its data (e.g. a hit
+// of a site deleted meanwhile) is written hit by hit, and the rejected hits
+// moved to the dead letters.
+func (s *PostgresStore) Flush() error {
+	if s.buffer == nil {
+		return nil
+	}
+	return s.buffer.flush(s.write)
+}
+
+// write inserts a batch with COPY or pipelined INSERTs; either way all of
+// it is written, or none
+func (s *PostgresStore) write(pageViews []bufferedPageView, events []bufferedEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresWriteTimeout)
+	defer cancel()
+
+	var err error
+	if s.cfg.WriteMode == PostgresWriteCopy {
+		err = s.copy(ctx, pageViews, events)
+	} else {
+		err = s.pipeline(ctx, pageViews, events)
+	}
+	if !database.IsPermanent(err) {
+		return err
+	}
+	return s.writeEach(ctx, pageViews, events)
+}
+
+// copy writes a batch with one COPY per table, in one transaction
+func (s *PostgresStore) copy(ctx context.Context, pageViews []bufferedPageView, events []bufferedEvent) error {
+	tx, err := s.db.Pool().Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if len(pageViews) > 0 {
+		rows := make([][]interface{}, len(pageViews))
+		for i, row := range pageViews {
+			rows[i] = row.args
+		}
+		if _, err := tx.CopyFrom(ctx, pgx.Identifier{"page_views"}, pageViewColumns, pgx.CopyFromRows(rows)); err != nil {
+			return err
+		}
+	}
+	if len(events) > 0 {
+		rows := make([][]interface{}, len(events))
+		for i, row := range events {
+			rows[i] = row.args
+		}
+		if _, err := tx.CopyFrom(ctx, pgx.Identifier{"events"}, eventColumns, pgx.CopyFromRows(rows)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// pipeline writes a batch with INSERTs sent in one round trip
+func (s *PostgresStore) pipeline(ctx context.Context, pageViews []bufferedPageView, events []bufferedEvent) error {
+	queries := make([]database.Query, 0, len(pageViews)+len(events))
+	for _, row := range pageViews {
+		queries = append(queries, database.Query{SQL: insertPageViewSQL, Args: row.args})
+	}
+	for _, row := range events {
+		queries = append(queries, database.Query{SQL: insertEventSQL, Args: row.args})
+	}
+	return s.db.SendBatch(ctx, queries)
+}
+
+// writeEach inserts a batch hit by hit, moving hits the database rejects
+// to the dead letters
+func (s *PostgresStore) writeEach(ctx context.Context, pageViews []bufferedPageView, events []bufferedEvent) error {
+	var rejected []rejectedHit
+	for _, row := range pageViews {
+		if _, err := s.db.ExecContext(ctx, insertPageViewSQL, row.args...); err != nil {
+			if !database.IsPermanent(err) {
+				return err
+			}
+			rejected = append(rejected, rejectedPageView(&row.pv, err))
+		}
+	}
+	for _, row := range events {
+		if _, err := s.db.ExecContext(ctx, insertEventSQL, row.args...); err != nil {
+			if !database.IsPermanent(err) {
+				return err
+			}
+			rejected = append(rejected, rejectedEvent(&row.ev, err))
+		}
+	}
+	deadLetter(s.db, BackendPostgres, rejected)
+	return nil
+}
+
+// Close implements Store
+func (s *PostgresStore) Close() error {
+	return s.Flush()
+}
+
+// The page_views and events tables are the same in Postgres and SQLite
+
+const insertPageViewSQL = `
+	INSERT INTO page_views (
+		id, site_id, visitor_id, session_id, page_url, page_title, referrer,
+		user_agent, ip_address, country_code, browser_name, browser_version,
+		os_name, os_version, device_type, screen_width, screen_height,
+		viewed_at, page_load_time
+	) VALUES (
+		$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19
+	)`
+
+const insertEventSQL = `
+	INSERT INTO events (id, site_id, visitor_id, session_id, event_name, page_url, properties, occurred_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+
+// Columns of the page_views and events tables, in the order of
+// pageViewArgs and eventArgs
+var (
+	pageViewColumns = []string{
+		"id", "site_id", "visitor_id", "session_id", "page_url", "page_title", "referrer",
+		"user_agent", "ip_address", "country_code", "browser_name", "browser_version",
+		"os_name", "os_version", "device_type", "screen_width", "screen_height",
+		"viewed_at", "page_load_time",
+	}
+	eventColumns = []string{
+		"id", "site_id", "visitor_id", "session_id", "event_name", "page_url", "properties", "occurred_at",
+	}
+)
+
+func pageViewArgs(pv *models.PageView) []interface{} {
+	return []interface{}{
+		pv.ID, pv.SiteID, pv.VisitorID, pv.SessionID, pv.PageURL, pv.PageTitle,
+		pv.Referrer, pv.UserAgent, pv.IPAddress, pv.CountryCode, pv.BrowserName,
+		pv.BrowserVersion, pv.OSName, pv.OSVersion, pv.DeviceType, pv.ScreenWidth,
+		pv.ScreenHeight, pv.ViewedAt, pv.PageLoadTime,
+	}
+}
+
+func eventArgs(ev *models.Event) ([]interface{}, error) {
+	var props interface{}
+	if len(ev.Properties) > 0 {
+		data, err := json.Marshal(ev.Properties)
+		if err != nil {
+			return nil, err
+		}
+		props = string(data) // as text, so it is not sent as bytea
+	}
+	return []interface{}{
+		ev.ID, ev.SiteID, ev.VisitorID, ev.SessionID, ev.EventName, ev.PageURL, props, ev.OccurredAt,
+	}, nil
+}
+
+// recentPageView reports whether the page_views table has a view of pageURL
+// by the visitor in (from, to]
+func recentPageView(db *database.DB, siteID string, visitorID uuid.UUID, pageURL string, from, to time.Time) (bool, error) {
+	var exists bool
+	err := db.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM page_views
+			WHERE site_id = $1 AND visitor_id = $2 AND page_url = $3
+			AND viewed_at > $4 AND viewed_at <= $5
+		)
+	`, siteID, visitorID, pageURL, from, to).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("failed to check for recent page view: %w", err)
+	}
+	return exists, nil
+}
+
+// sessionSummary summarizes a session from the page_views table, also
+// returning when its landing page was viewed
+func sessionSummary(db *database.DB, siteID string, sessionID uuid.UUID) (*SessionSummary, time.Time, error) {
+	summary := &SessionSummary{}
+	if err := db.QueryRow(`
+		SELECT COUNT(*) FROM page_views WHERE site_id = $1 AND session_id = $2
+	`, siteID, sessionID).Scan(&summary.PageViews); err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to count session page views: %w", err)
+	}
+	if summary.PageViews == 0 {
+		return summary, time.Time{}, nil
+	}
+
+	var referrer sql.NullString
+	var first time.Time
+	err := db.QueryRow(`
+		SELECT page_url, referrer, viewed_at FROM page_views
+		WHERE site_id = $1 AND session_id = $2
+		ORDER BY viewed_at ASC
+		LIMIT 1
+	`, siteID, sessionID).Scan(&summary.LandingURL, &referrer, &first)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, time.Time{}, fmt.Errorf("failed to load landing page: %w", err)
+	}
+	summary.LandingReferrer = referrer.String
+	return summary, first, nil
+}
@@ -0,0 +1,155 @@
+package storage_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/models"
+	"trackveilapi/internal/rollups"
+	"trackveilapi/internal/storage"
+	"trackveilapi/internal/storage/storagetest"
+
+	"github.com/google/uuid"
+)
+
+// postgresWriteModes are the write modes every Postgres test runs with
+var postgresWriteModes = []string{storage.PostgresWriteInsert, storage.PostgresWriteBatch, storage.PostgresWriteCopy}
+
+// TestPostgresConformance runs the conformance suite against a migrated
+// local database, e.g. TEST_POSTGRES_DSN="host=localhost dbname=trackveil_test sslmode=disable",
+// once per write mode
+func TestPostgresConformance(t *testing.T) {
+	db := connectPostgres(t)
+
+	for _, mode := range postgresWriteModes {
+		t.Run(mode, func(t *testing.T) {
+			siteID := createPostgresSite(t, db)
+			store, err := storage.NewPostgres(db, storage.PostgresConfig{WriteMode: mode, BatchSize: 100, FlushInterval: time.Second})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			storagetest.Run(t, storagetest.Harness{
+				Store:  store,
+				SiteID: siteID,
+				NewSession: func(t *testing.T) (uuid.UUID, uuid.UUID) {
+					return createPostgresSession(t, db, siteID)
+				},
+				Settle: func(t *testing.T) {
+					if err := store.Flush(); err != nil {
+						t.Fatalf("flush: %v", err)
+					}
+					if err := rollups.NewAggregator(db).Aggregate(context.Background(), time.Now()); err != nil {
+						t.Fatalf("aggregate rollups: %v", err)
+					}
+				},
+			})
+		})
+	}
+}
+
+// BenchmarkPostgresWrite measures writing page views with each write mode,
+// e.g. go test -run '^$' -bench PostgresWrite ./internal/storage
+func BenchmarkPostgresWrite(b *testing.B) {
+	db := connectPostgres(b)
+	siteID := createPostgresSite(b, db)
+	visitorID, sessionID := createPostgresSession(b, db, siteID)
+
+	for _, mode := range postgresWriteModes {
+		for _, batchSize := range []int{100, 1000} {
+			if mode == storage.PostgresWriteInsert && batchSize != 100 {
+				continue // not batched
+			}
+			b.Run(fmt.Sprintf("%s/batch=%d", mode, batchSize), func(b *testing.B) {
+				store, err := storage.NewPostgres(db, storage.PostgresConfig{WriteMode: mode, BatchSize: batchSize, FlushInterval: time.Hour})
+				if err != nil {
+					b.Fatal(err)
+				}
+				now := time.Now()
+				browser := "Firefox"
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					pv := &models.PageView{
+						SiteID:      siteID,
+						VisitorID:   visitorID,
+						SessionID:   sessionID,
+						PageURL:     fmt.Sprintf("https://example.com/bench/%d", i%50),
+						IPAddress:   "192.0.2.1",
+						BrowserName: &browser,
+						ViewedAt:    now,
+					}
+					if err := store.InsertPageView(pv); err != nil {
+						b.Fatal(err)
+					}
+					if (i+1)%batchSize == 0 {
+						if err := store.Flush(); err != nil {
+							b.Fatal(err)
+						}
+					}
+				}
+				if err := store.Flush(); err != nil {
+					b.Fatal(err)
+				}
+			})
+		}
+	}
+}
+
+// connectPostgres connects to TEST_POSTGRES_DSN, skipping without it
+func connectPostgres(tb testing.TB) *database.DB {
+	dsn := os.Getenv("TEST_POSTGRES_DSN")
+	if dsn == "" {
+		tb.Skip("TEST_POSTGRES_DSN is not set")
+	}
+
+	db, err := database.Connect(dsn)
+	if err != nil {
+		tb.Fatalf("connect: %v", err)
+	}
+	tb.Cleanup(func() { db.Close() })
+	return db
+}
+
+// createPostgresSite creates a site in its own account, deleted with its
+// hits when the test ends
+func createPostgresSite(tb testing.TB, db *database.DB) string {
+	siteID, err := models.GenerateSiteID()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var accountID uuid.UUID
+	if err := db.QueryRow(`INSERT INTO accounts (name) VALUES ('Storage conformance') RETURNING id`).Scan(&accountID); err != nil {
+		tb.Fatalf("create account: %v", err)
+	}
+	tb.Cleanup(func() {
+		db.Exec(`DELETE FROM accounts WHERE id = $1`, accountID)
+	})
+	if _, err := db.Exec(`
+		INSERT INTO sites (id, account_id, name, domain) VALUES ($1, $2, 'Conformance', 'example.com')
+	`, siteID, accountID); err != nil {
+		tb.Fatalf("create site: %v", err)
+	}
+	return siteID
+}
+
+// createPostgresSession creates a visitor and a session of a site
+func createPostgresSession(tb testing.TB, db *database.DB, siteID string) (uuid.UUID, uuid.UUID) {
+	visitorID, sessionID := uuid.New(), uuid.New()
+	if _, err := db.Exec(`
+		INSERT INTO visitors (id, site_id, fingerprint_hash) VALUES ($1, $2, $3)
+	`, visitorID, siteID, visitorID.String()); err != nil {
+		tb.Fatalf("create visitor: %v", err)
+	}
+	if _, err := db.Exec(`
+		INSERT INTO sessions (id, visitor_id, site_id) VALUES ($1, $2, $3)
+	`, sessionID, visitorID, siteID); err != nil {
+		tb.Fatalf("create session: %v", err)
+	}
+	return visitorID, sessionID
+}
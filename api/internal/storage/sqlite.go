@@ -0,0 +1,198 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/models"
+	"trackveilapi/internal/rollups"
+
+	"github.com/google/uuid"
+)
+
+// SQLiteConfig configures the SQLite store
+type SQLiteConfig struct {
+	BatchSize     int           // buffered hits that trigger a flush
+	FlushInterval time.Duration // how often buffered hits are flushed
+}
+
+// SQLiteStore keeps hits in the page_views and events tables of a SQLite
+// database (see database.OpenSQLite). Hits are buffered and written in one
+// transaction per batch. Visitor and session activity, which Postgres
+// triggers maintain, is updated as hits are buffered, so session lookups and
+// engagement goals see them right away. Analytics are read from the rollups
+// the aggregator builds, as for Postgres.
+type SQLiteStore struct {
+	db     *database.DB
+	cfg    SQLiteConfig
+	buffer *hitBuffer
+}
+
+// NewSQLite creates a SQLite store. The database must be a SQLite database
+// and stays owned by the caller.
+func NewSQLite(db *database.DB, cfg SQLiteConfig) (*SQLiteStore, error) {
+	if !db.SQLite() {
+		return nil, errors.New("the sqlite storage backend needs a SQLite database")
+	}
+	return &SQLiteStore{db: db, cfg: cfg, buffer: newHitBuffer("SQLite", cfg.BatchSize)}, nil
+}
+
+// Backend implements Store
+func (s *SQLiteStore) Backend() string {
+	return BackendSQLite
+}
+
+// Run flushes buffered hits every flush interval, and as soon as a batch
+// fills up, until ctx is cancelled
+func (s *SQLiteStore) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.buffer.full:
+		}
+		if err := s.Flush(); err != nil {
+			log.Printf("SQLite flush failed: %v", err)
+		}
+	}
+}
+
+// InsertPageView implements Store
+func (s *SQLiteStore) InsertPageView(pv *models.PageView) error {
+	if pv.ID == uuid.Nil {
+		pv.ID = uuid.New()
+	}
+
+	if err := s.buffer.check(); err != nil {
+		return err
+	}
+	if err := touchVisitor(s.db, pv.VisitorID, pv.ViewedAt); err != nil {
+		return err
+	}
+	if err := touchSession(s.db, pv.SessionID, pv.ViewedAt); err != nil {
+		return err
+	}
+
+	s.buffer.addPageView(pv)
+	return nil
+}
+
+// InsertEvent implements Store
+func (s *SQLiteStore) InsertEvent(ev *models.Event) error {
+	if ev.ID == uuid.Nil {
+		ev.ID = uuid.New()
+	}
+
+	args, err := eventArgs(ev)
+	if err != nil {
+		return err
+	}
+	if err := s.buffer.check(); err != nil {
+		return err
+	}
+	if err := touchSession(s.db, ev.SessionID, ev.OccurredAt); err != nil {
+		return err
+	}
+
+	s.buffer.addEvent(ev, args)
+	return nil
+}
+
+// Flush implements Store. If the batch cannot be written it stays buffered
+// for the next flush; hits the database rejects for their data (e.g. of a
+// site deleted meanwhile) are moved to the dead letters.
+func (s *SQLiteStore) Flush() error {
+	return s.buffer.flush(s.write)
+}
+
+// write inserts a batch in one transaction
+func (s *SQLiteStore) write(pageViews []bufferedPageView, events []bufferedEvent) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Only a rejected statement is rolled back; the rest of the batch is
+	// kept and the rejected hits are dead-lettered once it is committed
+	var rejected []rejectedHit
+
+	pvStmt, err := tx.Prepare(insertPageViewSQL)
+	if err != nil {
+		return err
+	}
+	defer pvStmt.Close()
+	for _, row := range pageViews {
+		if _, err := pvStmt.Exec(row.args...); err != nil {
+			if !database.IsPermanent(err) {
+				return err
+			}
+			rejected = append(rejected, rejectedPageView(&row.pv, err))
+		}
+	}
+
+	evStmt, err := tx.Prepare(insertEventSQL)
+	if err != nil {
+		return err
+	}
+	defer evStmt.Close()
+	for _, row := range events {
+		if _, err := evStmt.Exec(row.args...); err != nil {
+			if !database.IsPermanent(err) {
+				return err
+			}
+			rejected = append(rejected, rejectedEvent(&row.ev, err))
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	deadLetter(s.db, BackendSQLite, rejected)
+	return nil
+}
+
+// Close implements Store
+func (s *SQLiteStore) Close() error {
+	return s.Flush()
+}
+
+// RecentPageView implements Store
+func (s *SQLiteStore) RecentPageView(siteID string, visitorID uuid.UUID, pageURL string, from, to time.Time) (bool, error) {
+	if s.buffer.recentPageView(siteID, visitorID, pageURL, from, to) {
+		return true, nil
+	}
+	return recentPageView(s.db, siteID, visitorID, pageURL, from, to)
+}
+
+// SessionSummary implements Store
+func (s *SQLiteStore) SessionSummary(siteID string, sessionID uuid.UUID) (*SessionSummary, error) {
+	summary, first, err := sessionSummary(s.db, siteID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	s.buffer.addToSummary(summary, first, siteID, sessionID)
+	return summary, nil
+}
+
+// Stats implements Store
+func (s *SQLiteStore) Stats(siteID string, from, to time.Time, interval string, filter *rollups.Filter) (*rollups.Stats, error) {
+	return rollups.GetStats(s.db, siteID, from, to, interval, filter)
+}
+
+// Breakdown implements Store
+func (s *SQLiteStore) Breakdown(siteID, dimension string, from, to time.Time, limit int) (*rollups.Breakdown, error) {
+	return rollups.GetBreakdown(s.db, siteID, dimension, from, to, limit)
+}
+
+// UniqueVisitors implements Store
+func (s *SQLiteStore) UniqueVisitors(siteID string, from, to time.Time) (int64, error) {
+	return rollups.UniqueVisitors(s.db, siteID, from, to)
+}
@@ -0,0 +1,143 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/migrate"
+	"trackveilapi/internal/models"
+	"trackveilapi/internal/rollups"
+	"trackveilapi/internal/storage"
+	"trackveilapi/internal/storage/storagetest"
+
+	"github.com/google/uuid"
+)
+
+// TestSQLiteConformance runs the conformance suite against a new database file
+func TestSQLiteConformance(t *testing.T) {
+	db, siteID := newSQLiteSite(t)
+
+	// Batches never fill up, so hits stay buffered until flushed
+	store, err := storage.NewSQLite(db, storage.SQLiteConfig{BatchSize: 1000, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	storagetest.Run(t, storagetest.Harness{
+		Store:  store,
+		SiteID: siteID,
+		NewSession: func(t *testing.T) (uuid.UUID, uuid.UUID) {
+			return newSQLiteSession(t, db, siteID)
+		},
+		Settle: func(t *testing.T) {
+			if err := rollups.NewAggregator(db).Aggregate(context.Background(), time.Now()); err != nil {
+				t.Fatalf("aggregate rollups: %v", err)
+			}
+		},
+	})
+}
+
+// TestSQLiteBufferFull checks that hits are refused, not dropped, while
+// batches cannot be written
+func TestSQLiteBufferFull(t *testing.T) {
+	db, siteID := newSQLiteSite(t)
+	visitorID, sessionID := newSQLiteSession(t, db, siteID)
+	store, err := storage.NewSQLite(db, storage.SQLiteConfig{BatchSize: 1, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	// Batches fail while the table is away
+	if _, err := db.Exec(`ALTER TABLE page_views RENAME TO page_views_away`); err != nil {
+		t.Fatal(err)
+	}
+	accepted := 0
+	at := time.Now().UTC().Add(-time.Hour)
+	for i := 0; i < 200; i++ {
+		err := store.InsertPageView(&models.PageView{
+			SiteID: siteID, VisitorID: visitorID, SessionID: sessionID,
+			PageURL: "https://example.com/", ViewedAt: at.Add(time.Duration(i) * time.Second),
+		})
+		if errors.Is(err, storage.ErrBufferFull) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("insert %d: %v", i, err)
+		}
+		accepted++
+		if store.Flush() == nil {
+			t.Fatalf("flush %d succeeded without the table", i)
+		}
+	}
+	if accepted == 0 || accepted == 200 {
+		t.Fatalf("accepted %d page views; want the buffer to fill up", accepted)
+	}
+
+	// Every accepted hit is written once the table is back
+	if _, err := db.Exec(`ALTER TABLE page_views_away RENAME TO page_views`); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	var stored int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM page_views WHERE site_id = $1`, siteID).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored != accepted {
+		t.Errorf("stored %d page views, want the %d accepted", stored, accepted)
+	}
+}
+
+// newSQLiteSite creates a migrated database file with a site
+func newSQLiteSite(t *testing.T) (*database.DB, string) {
+	db, err := database.OpenSQLite(filepath.Join(t.TempDir(), "trackveil.db"))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	m, err := migrate.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(context.Background()); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	siteID, err := models.GenerateSiteID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accountID := uuid.New()
+	if _, err := db.Exec(`INSERT INTO accounts (id, name) VALUES ($1, 'Storage conformance')`, accountID); err != nil {
+		t.Fatalf("create account: %v", err)
+	}
+	if _, err := db.Exec(`
+		INSERT INTO sites (id, account_id, name, domain) VALUES ($1, $2, 'Conformance', 'example.com')
+	`, siteID, accountID); err != nil {
+		t.Fatalf("create site: %v", err)
+	}
+	return db, siteID
+}
+
+// newSQLiteSession creates a visitor and a session of a site
+func newSQLiteSession(t *testing.T, db *database.DB, siteID string) (uuid.UUID, uuid.UUID) {
+	visitorID, sessionID := uuid.New(), uuid.New()
+	if _, err := db.Exec(`
+		INSERT INTO visitors (id, site_id, fingerprint_hash) VALUES ($1, $2, $3)
+	`, visitorID, siteID, visitorID.String()); err != nil {
+		t.Fatalf("create visitor: %v", err)
+	}
+	if _, err := db.Exec(`
+		INSERT INTO sessions (id, visitor_id, site_id) VALUES ($1, $2, $3)
+	`, sessionID, visitorID, siteID); err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	return visitorID, sessionID
+}
@@ -0,0 +1,118 @@
+// Package storage is where page views and events are written and where hit
+// analytics are read from. Sites, visitors, sessions, goals and conversions
+// always live in the database (Postgres or SQLite); the hits themselves live
+// in the configured backend.
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/models"
+	"trackveilapi/internal/rollups"
+
+	"github.com/google/uuid"
+)
+
+// Backends
+const (
+	BackendPostgres   = "postgres"
+	BackendSQLite     = "sqlite"
+	BackendClickHouse = "clickhouse"
+)
+
+// Store writes hits and reads analytics. Implementations may buffer writes;
+// buffered hits are visible to RecentPageView and SessionSummary right away
+// and to the analytics reads once flushed (and, for Postgres and SQLite,
+// aggregated).
+type Store interface {
+	// Backend is the name of the backend: BackendPostgres, BackendSQLite or BackendClickHouse
+	Backend() string
+
+	// InsertPageView stores a page view, assigning its ID if unset
+	InsertPageView(pv *models.PageView) error
+	// InsertEvent stores a custom event, assigning its ID if unset
+	InsertEvent(ev *models.Event) error
+
+	// RecentPageView reports whether the visitor viewed pageURL in (from, to]
+	RecentPageView(siteID string, visitorID uuid.UUID, pageURL string, from, to time.Time) (bool, error)
+	// SessionSummary returns the page view count and landing page of a session
+	SessionSummary(siteID string, sessionID uuid.UUID) (*SessionSummary, error)
+
+	// Stats returns totals and a series, with the range widened to whole
+	// UTC hours or days to match the interval
+	Stats(siteID string, from, to time.Time, interval string, filter *rollups.Filter) (*rollups.Stats, error)
+	// Breakdown returns the values of a dimension with the most page views
+	Breakdown(siteID, dimension string, from, to time.Time, limit int) (*rollups.Breakdown, error)
+	// UniqueVisitors returns the unique visitors of a site in [from, to),
+	// widened to whole hours
+	UniqueVisitors(siteID string, from, to time.Time) (int64, error)
+
+	// Flush writes buffered hits
+	Flush() error
+	// Close flushes buffered hits and releases the backend's resources
+	Close() error
+}
+
+// SessionSummary is what goal evaluation needs from a session's page views
+type SessionSummary struct {
+	PageViews       int
+	LandingURL      string // empty for sessions without page views
+	LandingReferrer string
+}
+
+// Source attributes the session to the traffic source of its landing page
+func (s *SessionSummary) Source() string {
+	if s.LandingURL == "" {
+		return models.DirectSource
+	}
+	return models.TrafficSource(s.LandingURL, s.LandingReferrer)
+}
+
+// ValidBackend reports whether name is a storage backend
+func ValidBackend(name string) bool {
+	return name == BackendPostgres || name == BackendSQLite || name == BackendClickHouse
+}
+
+// touchVisitor counts a page view towards a visitor and moves its last
+// activity forward, for backends without the Postgres triggers
+func touchVisitor(db *database.DB, visitorID uuid.UUID, at time.Time) error {
+	if _, err := db.Exec(`
+		UPDATE visitors
+		SET last_seen_at = CASE WHEN last_seen_at > $2 THEN last_seen_at ELSE $2 END,
+			total_visits = total_visits + 1
+		WHERE id = $1
+	`, visitorID, at); err != nil {
+		return fmt.Errorf("failed to update visitor activity: %w", err)
+	}
+	return nil
+}
+
+// touchSession moves a session's last activity forward, for backends
+// without the Postgres triggers
+func touchSession(db *database.DB, sessionID uuid.UUID, at time.Time) error {
+	if _, err := db.Exec(`
+		UPDATE sessions
+		SET last_activity_at = CASE WHEN last_activity_at > $2 THEN last_activity_at ELSE $2 END
+		WHERE id = $1
+	`, sessionID, at); err != nil {
+		return fmt.Errorf("failed to update session activity: %w", err)
+	}
+	return nil
+}
+
+// checkStatsArgs validates the Stats arguments for backends that do not
+// read rollups
+func checkStatsArgs(interval string, filter *rollups.Filter) error {
+	if interval != rollups.IntervalHour && interval != rollups.IntervalDay {
+		return fmt.Errorf("unknown interval %q", interval)
+	}
+	if filter != nil && !rollups.ValidDimension(filter.Dimension) {
+		return fmt.Errorf("unknown dimension %q", filter.Dimension)
+	}
+	if filter != nil && len(filter.Values) == 0 {
+		return fmt.Errorf("filter on %s has no values", filter.Dimension)
+	}
+	return nil
+}
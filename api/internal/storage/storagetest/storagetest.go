@@ -0,0 +1,254 @@
+// Package storagetest is the conformance suite every storage backend must
+// pass. Backend tests run it against a local instance.
+package storagetest
+
+import (
+	"testing"
+	"time"
+
+	"trackveilapi/internal/models"
+	"trackveilapi/internal/rollups"
+	"trackveilapi/internal/storage"
+
+	"github.com/google/uuid"
+)
+
+// Harness is a backend under test
+type Harness struct {
+	Store  storage.Store
+	SiteID string // a site no other test writes to
+
+	// NewSession returns a visitor and a session of the site to attach hits to
+	NewSession func(t *testing.T) (visitorID, sessionID uuid.UUID)
+
+	// Settle makes hits written so far visible to the analytics reads
+	Settle func(t *testing.T)
+}
+
+// Run runs the conformance suite
+func Run(t *testing.T, h Harness) {
+	t.Run("RecentPageView", func(t *testing.T) { testRecentPageView(t, h) })
+	t.Run("SessionSummary", func(t *testing.T) { testSessionSummary(t, h) })
+	t.Run("Events", func(t *testing.T) { testEvents(t, h) })
+	t.Run("Analytics", func(t *testing.T) { testAnalytics(t, h) })
+}
+
+func testRecentPageView(t *testing.T, h Harness) {
+	visitorID, sessionID := h.NewSession(t)
+	at := time.Now().UTC().Add(-time.Minute).Truncate(time.Millisecond)
+	insertPageView(t, h, visitorID, sessionID, "https://example.com/recent", "", "", at)
+
+	check := func(stage string) {
+		cases := []struct {
+			url      string
+			from, to time.Time
+			want     bool
+		}{
+			{"https://example.com/recent", at.Add(-10 * time.Second), at.Add(time.Second), true},
+			{"https://example.com/recent", at, at.Add(time.Second), false}, // from is exclusive
+			{"https://example.com/other", at.Add(-10 * time.Second), at.Add(time.Second), false},
+			{"https://example.com/recent", at.Add(-time.Hour), at.Add(-time.Second), false},
+		}
+		for _, c := range cases {
+			got, err := h.Store.RecentPageView(h.SiteID, visitorID, c.url, c.from, c.to)
+			if err != nil {
+				t.Fatalf("%s: RecentPageView: %v", stage, err)
+			}
+			if got != c.want {
+				t.Errorf("%s: RecentPageView(%s, %s, %s) = %v, want %v", stage, c.url,
+					c.from.Format(time.RFC3339Nano), c.to.Format(time.RFC3339Nano), got, c.want)
+			}
+		}
+	}
+
+	// Buffered hits must already count, or retries would slip through until the next flush
+	check("before flush")
+	flush(t, h)
+	check("after flush")
+}
+
+func testSessionSummary(t *testing.T, h Harness) {
+	visitorID, sessionID := h.NewSession(t)
+
+	summary, err := h.Store.SessionSummary(h.SiteID, sessionID)
+	if err != nil {
+		t.Fatalf("SessionSummary: %v", err)
+	}
+	if summary.PageViews != 0 || summary.Source() != models.DirectSource {
+		t.Errorf("empty session: got %d page views from %q, want 0 from %q", summary.PageViews, summary.Source(), models.DirectSource)
+	}
+
+	at := time.Now().UTC().Add(-10 * time.Minute).Truncate(time.Millisecond)
+	insertPageView(t, h, visitorID, sessionID, "https://example.com/landing", "Landing", "https://www.google.com/search", at)
+	flush(t, h)
+	insertPageView(t, h, visitorID, sessionID, "https://example.com/next", "Next", "https://example.com/landing", at.Add(time.Minute))
+
+	// One page view written, one possibly still buffered
+	summary, err = h.Store.SessionSummary(h.SiteID, sessionID)
+	if err != nil {
+		t.Fatalf("SessionSummary: %v", err)
+	}
+	if summary.PageViews != 2 {
+		t.Errorf("PageViews = %d, want 2", summary.PageViews)
+	}
+	if summary.LandingURL != "https://example.com/landing" {
+		t.Errorf("LandingURL = %q, want the first page view", summary.LandingURL)
+	}
+	if summary.Source() != "google.com" {
+		t.Errorf("Source() = %q, want google.com", summary.Source())
+	}
+}
+
+func testEvents(t *testing.T, h Harness) {
+	visitorID, sessionID := h.NewSession(t)
+	pageURL := "https://example.com/signup"
+	ev := &models.Event{
+		SiteID:     h.SiteID,
+		VisitorID:  visitorID,
+		SessionID:  sessionID,
+		EventName:  "Signup",
+		PageURL:    &pageURL,
+		Properties: map[string]string{"plan": "pro"},
+		OccurredAt: time.Now().UTC(),
+	}
+	if err := h.Store.InsertEvent(ev); err != nil {
+		t.Fatalf("InsertEvent: %v", err)
+	}
+	if ev.ID == uuid.Nil {
+		t.Error("InsertEvent did not assign an ID")
+	}
+	flush(t, h)
+}
+
+func testAnalytics(t *testing.T, h Harness) {
+	alice, aliceSession := h.NewSession(t)
+	bob, bobSession := h.NewSession(t)
+
+	// Two hours two days back, so the aggregation of past hours is exercised
+	base := time.Now().UTC().Truncate(time.Hour).Add(-48 * time.Hour)
+	insertPageView(t, h, alice, aliceSession, "https://example.com/a?utm_campaign=Launch", "Page A", "", base.Add(10*time.Minute))
+	insertPageView(t, h, alice, aliceSession, "https://example.com/a", "Page A", "", base.Add(12*time.Minute))
+	insertPageView(t, h, bob, bobSession, "https://example.com/b", "Page B", "https://news.ycombinator.com/", base.Add(20*time.Minute))
+	insertPageView(t, h, alice, aliceSession, "https://example.com/a", "Page A", "", base.Add(70*time.Minute))
+	flush(t, h)
+	h.Settle(t)
+
+	from, to := base, base.Add(2*time.Hour)
+
+	stats, err := h.Store.Stats(h.SiteID, from, to, rollups.IntervalHour, nil)
+	if err != nil {
+		t.Fatalf("Stats: %v", err)
+	}
+	if stats.PageViews != 4 || stats.Visitors != 2 {
+		t.Errorf("Stats totals = %d page views, %d visitors; want 4, 2", stats.PageViews, stats.Visitors)
+	}
+	wantSeries := []rollups.Point{
+		{Bucket: base, PageViews: 3, Visitors: 2},
+		{Bucket: base.Add(time.Hour), PageViews: 1, Visitors: 1},
+	}
+	if len(stats.Series) != len(wantSeries) {
+		t.Fatalf("Stats series has %d points, want %d: %+v", len(stats.Series), len(wantSeries), stats.Series)
+	}
+	for i, want := range wantSeries {
+		got := stats.Series[i]
+		if !got.Bucket.Equal(want.Bucket) || got.PageViews != want.PageViews || got.Visitors != want.Visitors {
+			t.Errorf("Stats series[%d] = %+v, want %+v", i, got, want)
+		}
+	}
+
+	// Ranges are widened to whole hours
+	widened, err := h.Store.Stats(h.SiteID, base.Add(5*time.Minute), base.Add(65*time.Minute), rollups.IntervalHour, nil)
+	if err != nil {
+		t.Fatalf("Stats: %v", err)
+	}
+	if !widened.From.Equal(from) || !widened.To.Equal(to) || widened.PageViews != 4 {
+		t.Errorf("widened Stats = [%s, %s) with %d page views, want [%s, %s) with 4",
+			widened.From, widened.To, widened.PageViews, from, to)
+	}
+
+	filtered, err := h.Store.Stats(h.SiteID, from, to, rollups.IntervalHour,
+		&rollups.Filter{Dimension: rollups.DimensionPage, Values: []string{"/a", "/missing"}})
+	if err != nil {
+		t.Fatalf("filtered Stats: %v", err)
+	}
+	if filtered.PageViews != 3 || filtered.Visitors != 1 {
+		t.Errorf("filtered Stats = %d page views, %d visitors; want 3, 1", filtered.PageViews, filtered.Visitors)
+	}
+
+	checkBreakdown(t, h, rollups.DimensionPage, from, to, []rollups.Row{
+		{Value: "/a", Label: "Page A", PageViews: 3, Visitors: 1},
+		{Value: "/b", Label: "Page B", PageViews: 1, Visitors: 1},
+	})
+	checkBreakdown(t, h, rollups.DimensionSource, from, to, []rollups.Row{
+		{Value: models.DirectSource, PageViews: 3, Visitors: 1},
+		{Value: "news.ycombinator.com", PageViews: 1, Visitors: 1},
+	})
+	checkBreakdown(t, h, rollups.DimensionBrowser, from, to, []rollups.Row{
+		{Value: "Firefox", PageViews: 4, Visitors: 2},
+	})
+	checkBreakdown(t, h, rollups.DimensionCampaign, from, to, []rollups.Row{
+		{Value: "launch", PageViews: 1, Visitors: 1},
+	})
+
+	visitors, err := h.Store.UniqueVisitors(h.SiteID, from, to)
+	if err != nil {
+		t.Fatalf("UniqueVisitors: %v", err)
+	}
+	if visitors != 2 {
+		t.Errorf("UniqueVisitors = %d, want 2", visitors)
+	}
+}
+
+func checkBreakdown(t *testing.T, h Harness, dimension string, from, to time.Time, want []rollups.Row) {
+	t.Helper()
+	breakdown, err := h.Store.Breakdown(h.SiteID, dimension, from, to, 10)
+	if err != nil {
+		t.Fatalf("Breakdown(%s): %v", dimension, err)
+	}
+	if len(breakdown.Rows) != len(want) {
+		t.Fatalf("Breakdown(%s) = %+v, want %+v", dimension, breakdown.Rows, want)
+	}
+	for i := range want {
+		if breakdown.Rows[i] != want[i] {
+			t.Errorf("Breakdown(%s)[%d] = %+v, want %+v", dimension, i, breakdown.Rows[i], want[i])
+		}
+	}
+}
+
+func insertPageView(t *testing.T, h Harness, visitorID, sessionID uuid.UUID, pageURL, title, referrer string, at time.Time) {
+	t.Helper()
+	browser, osName, device := "Firefox", "Linux", "desktop"
+	pv := &models.PageView{
+		SiteID:      h.SiteID,
+		VisitorID:   visitorID,
+		SessionID:   sessionID,
+		PageURL:     pageURL,
+		PageTitle:   optional(title),
+		Referrer:    optional(referrer),
+		IPAddress:   "192.0.2.1",
+		BrowserName: &browser,
+		OSName:      &osName,
+		DeviceType:  &device,
+		ViewedAt:    at,
+	}
+	if err := h.Store.InsertPageView(pv); err != nil {
+		t.Fatalf("InsertPageView: %v", err)
+	}
+	if pv.ID == uuid.Nil {
+		t.Error("InsertPageView did not assign an ID")
+	}
+}
+
+func flush(t *testing.T, h Harness) {
+	t.Helper()
+	if err := h.Store.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+}
+
+func optional(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
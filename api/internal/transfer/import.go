@@ -0,0 +1,274 @@
+package transfer
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"trackveilapi/internal/database"
+	"trackveilapi/internal/models"
+
+	"github.com/google/uuid"
+)
+
+// What an import does when the site ID is taken
+const (
+	ConflictFail    = "fail"    // give up
+	ConflictNew     = "new"     // import under a new site ID
+	ConflictReplace = "replace" // delete the existing site and its data first
+)
+
+// Options control an import
+type Options struct {
+	SiteID    string // the imported site's ID; the exported one if empty
+	AccountID string // the account the site is imported into; the exported one if empty
+	Conflict  string // ConflictFail if empty
+}
+
+// Result is what an import did
+type Result struct {
+	SiteID   string
+	Imported map[string]int64 // rows, by table
+	Skipped  map[string]int64 // rows that clashed with another site's, by table
+}
+
+// Describe summarizes the rows imported, in import order, leaving out
+// empty tables
+func (r *Result) Describe() string {
+	var parts []string
+	for _, t := range tables {
+		if n := r.Imported[t.name]; n > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", n, t.name))
+		}
+		if n := r.Skipped[t.name]; n > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s skipped", n, t.name))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// mapping remaps the IDs of an import. UUIDs are derived from the exported
+// ones and the imported site's ID, so references stay consistent without a
+// lookup table.
+type mapping struct {
+	siteID    string
+	accountID string
+	namespace uuid.UUID
+}
+
+func newMapping(siteID, accountID string) *mapping {
+	return &mapping{
+		siteID:    siteID,
+		accountID: accountID,
+		namespace: uuid.NewSHA1(uuid.NameSpaceURL, []byte("trackveil:site:"+siteID)),
+	}
+}
+
+func (m *mapping) uuid(s string, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	u, err := uuid.Parse(s)
+	if err != nil {
+		return "", err
+	}
+	return uuid.NewSHA1(m.namespace, u[:]).String(), nil
+}
+
+// Import verifies the export at path and inserts it. Rollups of the hours
+// with imported page views are marked for recomputation.
+func Import(ctx context.Context, db *database.DB, path string, opts Options) (*Result, error) {
+	m, err := Verify(path)
+	if err != nil {
+		return nil, err
+	}
+
+	siteID, accountID := opts.SiteID, opts.AccountID
+	if siteID == "" {
+		siteID = m.SiteID
+	}
+	if !models.ValidateSiteID(siteID) {
+		return nil, fmt.Errorf("invalid site ID %q", siteID)
+	}
+	if accountID == "" {
+		accountID = m.AccountID
+	}
+	var exists bool
+	if err := db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM accounts WHERE id = $1)`, accountID).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("account %s does not exist; choose another with -account", accountID)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if siteID, err = claimSiteID(ctx, tx, siteID, opts.Conflict); err != nil {
+		return nil, err
+	}
+
+	// Hours already aggregated are only recomputed if marked dirty
+	var watermark sql.NullTime
+	err = tx.QueryRowContext(ctx, `SELECT completed_through FROM rollup_state WHERE name = 'hourly'`).Scan(&watermark)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	im := &importer{
+		db:      db,
+		tx:      tx,
+		mapping: newMapping(siteID, accountID),
+		result:  &Result{SiteID: siteID, Imported: map[string]int64{}, Skipped: map[string]int64{}},
+		hours:   map[time.Time]bool{},
+	}
+	if watermark.Valid {
+		im.watermark = watermark.Time
+	}
+	err = readEntries(path, func(e entry) error {
+		t, ok := tableNamed(strings.TrimSuffix(e.name, ".ndjson"))
+		if e.name == manifestName || !ok {
+			return nil
+		}
+		if err := im.insert(ctx, t, e); err != nil {
+			return fmt.Errorf("importing %s: %w", t.name, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := im.finish(ctx); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return im.result, nil
+}
+
+// claimSiteID resolves a clash with an existing site and returns the ID to
+// import under
+func claimSiteID(ctx context.Context, tx *sql.Tx, siteID, conflict string) (string, error) {
+	taken := func(id string) (bool, error) {
+		var exists bool
+		err := tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM sites WHERE id = $1)`, id).Scan(&exists)
+		return exists, err
+	}
+	exists, err := taken(siteID)
+	if err != nil || !exists {
+		return siteID, err
+	}
+
+	switch conflict {
+	case "", ConflictFail:
+		return "", fmt.Errorf("site %s already exists; import it under a new ID or replace it", siteID)
+	case ConflictReplace:
+		// Deletes its visitors, hits, goals and settings with it
+		_, err := tx.ExecContext(ctx, `DELETE FROM sites WHERE id = $1`, siteID)
+		return siteID, err
+	case ConflictNew:
+		for {
+			id, err := models.GenerateSiteID()
+			if err != nil {
+				return "", err
+			}
+			if exists, err := taken(id); err != nil || !exists {
+				return id, err
+			}
+		}
+	}
+	return "", fmt.Errorf("invalid conflict mode %q (want %s, %s or %s)", conflict, ConflictFail, ConflictNew, ConflictReplace)
+}
+
+type importer struct {
+	db        *database.DB
+	tx        *sql.Tx
+	mapping   *mapping
+	result    *Result
+	watermark time.Time
+	hours     map[time.Time]bool // of imported page views before the watermark
+}
+
+// insert inserts the rows of an exported table
+func (im *importer) insert(ctx context.Context, t *table, e entry) error {
+	stmt, err := im.tx.PrepareContext(ctx, t.insertQuery(im.db))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	viewedAt := -1
+	if t.name == "page_views" {
+		for i, c := range t.columns {
+			if c.name == "viewed_at" {
+				viewedAt = i
+			}
+		}
+	}
+
+	_, _, err = scanLines(e.r, func(line []byte) error {
+		var row map[string]json.RawMessage
+		if err := json.Unmarshal(line, &row); err != nil {
+			return err
+		}
+		args, err := t.args(im.db, row, im.mapping)
+		if err != nil {
+			return err
+		}
+		res, err := stmt.ExecContext(ctx, args...)
+		if t.name == "sites" && database.IsUniqueViolation(err) {
+			return errors.New("the account already has a site for this domain")
+		}
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		im.result.Imported[t.name] += n
+		im.result.Skipped[t.name] += 1 - n
+
+		if viewedAt >= 0 {
+			if at, ok := args[viewedAt].(time.Time); ok && at.Before(im.watermark) {
+				im.hours[at.UTC().Truncate(time.Hour)] = true
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// finish marks the aggregated hours of the imported page views for
+// recomputation, and on Postgres takes back the visits the page view
+// trigger counted for the imported visitors: their exported counters
+// included them already
+func (im *importer) finish(ctx context.Context) error {
+	for hour := range im.hours {
+		if _, err := im.tx.ExecContext(ctx, `
+			INSERT INTO rollup_dirty_hours (site_id, hour) VALUES ($1, $2)
+			ON CONFLICT DO NOTHING
+		`, im.mapping.siteID, hour); err != nil {
+			return err
+		}
+	}
+	if im.db.SQLite() {
+		return nil
+	}
+	_, err := im.tx.ExecContext(ctx, `
+		UPDATE visitors v SET total_visits = v.total_visits - c.page_views
+		FROM (
+			SELECT visitor_id, COUNT(*) AS page_views FROM page_views WHERE site_id = $1 GROUP BY visitor_id
+		) c
+		WHERE v.id = c.visitor_id
+	`, im.mapping.siteID)
+	return err
+}
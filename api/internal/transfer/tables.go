@@ -0,0 +1,298 @@
+package transfer
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"trackveilapi/internal/database"
+)
+
+// kind is how a column is exported and imported
+type kind int
+
+const (
+	text    kind = iota
+	site         // the site ID, replaced by the imported site's
+	account      // the account ID, replaced by the importing account's
+	id           // a UUID, remapped on import
+	ref          // a UUID referencing an exported row, remapped on import
+	integer
+	boolean
+	timestamp
+	date  // a UTC day, exported as YYYY-MM-DD
+	bytes // exported as base64
+	array // TEXT[] on Postgres, a JSON array on SQLite
+	jsonb // JSON text; JSONB on Postgres
+	inet  // an IP address; INET on Postgres
+)
+
+type column struct {
+	name string
+	kind kind
+}
+
+// table is an exported table, holding the rows with the site's ID in its
+// site_id (or id) column
+type table struct {
+	name     string
+	columns  []column
+	order    string
+	conflict string // appended to the INSERT, for rows that may clash
+}
+
+// tables in import order: the hits reference the visitors and sessions, and
+// the conversions the goals and hits. API keys are not exported.
+var tables = []table{
+	{name: "sites", order: "id", columns: []column{
+		{"id", site}, {"account_id", account}, {"name", text}, {"domain", text},
+		{"created_at", timestamp}, {"updated_at", timestamp},
+	}},
+	{name: "site_tracker_settings", order: "site_id", columns: []column{
+		{"site_id", site}, {"endpoint", text}, {"spa_mode", boolean}, {"privacy_mode", boolean},
+		{"excluded_paths", array}, {"created_at", timestamp}, {"updated_at", timestamp},
+	}},
+	// Hostnames are unique across sites: one still used by another site
+	// (e.g. the exported one, on the same instance) is skipped
+	{name: "site_custom_domains", order: "hostname", conflict: "ON CONFLICT (hostname) DO NOTHING", columns: []column{
+		{"id", id}, {"site_id", site}, {"hostname", text}, {"created_at", timestamp},
+	}},
+	{name: "site_retention", order: "site_id", columns: []column{
+		{"site_id", site}, {"raw_hit_days", integer}, {"visitor_days", integer}, {"rollup_days", integer},
+		{"created_at", timestamp}, {"updated_at", timestamp},
+	}},
+	{name: "site_sinks", order: "sink", columns: []column{
+		{"site_id", site}, {"sink", text}, {"hit_types", array}, {"event_names", array},
+		{"created_at", timestamp}, {"updated_at", timestamp},
+	}},
+	{name: "goals", order: "name", columns: []column{
+		{"id", id}, {"site_id", site}, {"name", text}, {"goal_type", text}, {"page_path", text},
+		{"event_name", text}, {"min_page_views", integer}, {"min_duration_seconds", integer},
+		{"active", boolean}, {"created_at", timestamp}, {"updated_at", timestamp},
+	}},
+	{name: "funnels", order: "name", columns: []column{
+		{"id", id}, {"site_id", site}, {"name", text}, {"steps", jsonb}, {"mode", text},
+		{"window_seconds", integer}, {"created_at", timestamp}, {"updated_at", timestamp},
+	}},
+	{name: "visitors", order: "id", columns: []column{
+		{"id", id}, {"site_id", site}, {"fingerprint_hash", text}, {"first_seen_at", timestamp},
+		{"last_seen_at", timestamp}, {"total_visits", integer},
+	}},
+	{name: "sessions", order: "started_at, id", columns: []column{
+		{"id", id}, {"visitor_id", ref}, {"site_id", site}, {"started_at", timestamp},
+		{"last_activity_at", timestamp}, {"ended_at", timestamp},
+	}},
+	{name: "page_views", order: "viewed_at, id", columns: []column{
+		{"id", id}, {"site_id", site}, {"visitor_id", ref}, {"session_id", ref}, {"page_url", text},
+		{"page_title", text}, {"referrer", text}, {"user_agent", text}, {"ip_address", inet},
+		{"country_code", text}, {"browser_name", text}, {"browser_version", text}, {"os_name", text},
+		{"os_version", text}, {"device_type", text}, {"screen_width", integer}, {"screen_height", integer},
+		{"viewed_at", timestamp}, {"page_load_time", integer},
+	}},
+	{name: "events", order: "occurred_at, id", columns: []column{
+		{"id", id}, {"site_id", site}, {"visitor_id", ref}, {"session_id", ref}, {"event_name", text},
+		{"page_url", text}, {"properties", jsonb}, {"occurred_at", timestamp},
+	}},
+	{name: "conversions", order: "converted_at, id", columns: []column{
+		{"id", id}, {"goal_id", ref}, {"site_id", site}, {"visitor_id", ref}, {"session_id", ref},
+		{"page_view_id", ref}, {"event_id", ref}, {"source", text}, {"converted_at", timestamp},
+	}},
+	// Rollups outlive raw hits under most retention plans. The hours of the
+	// imported page views are recomputed, so only those of purged hits stay
+	// as exported.
+	{name: "rollups_hourly", order: "bucket, dimension, value", columns: []column{
+		{"site_id", site}, {"bucket", timestamp}, {"dimension", text}, {"value", text}, {"label", text},
+		{"page_views", integer}, {"visitors", integer}, {"visitors_sketch", bytes},
+	}},
+	{name: "rollups_daily", order: "bucket, dimension, value", columns: []column{
+		{"site_id", site}, {"bucket", date}, {"dimension", text}, {"value", text}, {"label", text},
+		{"page_views", integer}, {"visitors", integer}, {"visitors_sketch", bytes},
+	}},
+}
+
+// tableNamed returns the table of an archive file
+func tableNamed(name string) (*table, bool) {
+	for i := range tables {
+		if tables[i].name == name {
+			return &tables[i], true
+		}
+	}
+	return nil, false
+}
+
+// siteColumn is the column holding the site's ID
+func (t *table) siteColumn() string {
+	for _, c := range t.columns {
+		if c.kind == site {
+			return c.name
+		}
+	}
+	return ""
+}
+
+// selectQuery reads the site's rows
+func (t *table) selectQuery(db *database.DB) string {
+	exprs := make([]string, len(t.columns))
+	for i, c := range t.columns {
+		exprs[i] = c.name
+		if !db.SQLite() {
+			switch c.kind {
+			case inet:
+				exprs[i] = "host(" + c.name + ")"
+			case jsonb:
+				exprs[i] = c.name + "::text"
+			}
+		}
+	}
+	return fmt.Sprintf("SELECT %s FROM %s WHERE %s = $1 ORDER BY %s",
+		strings.Join(exprs, ", "), t.name, t.siteColumn(), t.order)
+}
+
+// insertQuery writes a row
+func (t *table) insertQuery(db *database.DB) string {
+	names := make([]string, len(t.columns))
+	placeholders := make([]string, len(t.columns))
+	for i, c := range t.columns {
+		names[i] = c.name
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+		if !db.SQLite() {
+			switch c.kind {
+			case inet:
+				placeholders[i] += "::inet"
+			case jsonb:
+				placeholders[i] += "::jsonb"
+			}
+		}
+	}
+	return strings.TrimSpace(fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) %s",
+		t.name, strings.Join(names, ", "), strings.Join(placeholders, ", "), t.conflict))
+}
+
+// scanRow scans a row into the values written to the archive, by column
+func (t *table) scanRow(db *database.DB, rows *sql.Rows) (map[string]interface{}, error) {
+	dest := make([]interface{}, len(t.columns))
+	arrays := make([][]string, len(t.columns))
+	for i, c := range t.columns {
+		switch c.kind {
+		case integer:
+			dest[i] = new(sql.NullInt64)
+		case boolean:
+			dest[i] = new(sql.NullBool)
+		case timestamp, date:
+			dest[i] = new(sql.NullTime)
+		case bytes:
+			dest[i] = new([]byte)
+		case array:
+			dest[i] = db.Array(&arrays[i])
+		default:
+			dest[i] = new(sql.NullString)
+		}
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return nil, err
+	}
+
+	row := make(map[string]interface{}, len(t.columns))
+	for i, c := range t.columns {
+		var v interface{}
+		switch d := dest[i].(type) {
+		case *sql.NullInt64:
+			if d.Valid {
+				v = d.Int64
+			}
+		case *sql.NullBool:
+			if d.Valid {
+				v = d.Bool
+			}
+		case *sql.NullTime:
+			if d.Valid && c.kind == date {
+				v = d.Time.Format("2006-01-02")
+			} else if d.Valid {
+				v = d.Time.UTC().Format(time.RFC3339Nano)
+			}
+		case *[]byte:
+			if *d != nil {
+				v = *d
+			}
+		case *sql.NullString:
+			if d.Valid {
+				v = d.String
+			}
+		default:
+			if arrays[i] == nil {
+				arrays[i] = []string{}
+			}
+			v = arrays[i]
+		}
+		row[c.name] = v
+	}
+	return row, nil
+}
+
+// args converts a row read from the archive into the INSERT's arguments,
+// with the site and every UUID remapped
+func (t *table) args(db *database.DB, row map[string]json.RawMessage, m *mapping) ([]interface{}, error) {
+	args := make([]interface{}, len(t.columns))
+	for i, c := range t.columns {
+		raw, ok := row[c.name]
+		if !ok || string(raw) == "null" {
+			if c.kind == site || c.kind == account || c.kind == id {
+				return nil, fmt.Errorf("%s is missing", c.name)
+			}
+			if c.kind == array {
+				args[i] = db.Array(&[]string{})
+			}
+			continue
+		}
+		var err error
+		switch c.kind {
+		case integer:
+			var n int64
+			err = json.Unmarshal(raw, &n)
+			args[i] = n
+		case boolean:
+			var b bool
+			err = json.Unmarshal(raw, &b)
+			args[i] = b
+		case timestamp:
+			var s string
+			var at time.Time
+			if err = json.Unmarshal(raw, &s); err == nil {
+				at, err = time.Parse(time.RFC3339Nano, s)
+			}
+			args[i] = at
+		case date:
+			var s string
+			if err = json.Unmarshal(raw, &s); err == nil {
+				_, err = time.Parse("2006-01-02", s)
+			}
+			args[i] = s // as a date, so the session time zone cannot shift it
+		case bytes:
+			var b []byte
+			err = json.Unmarshal(raw, &b)
+			args[i] = b
+		case array:
+			var a []string
+			err = json.Unmarshal(raw, &a)
+			args[i] = db.Array(&a)
+		default:
+			var s string
+			err = json.Unmarshal(raw, &s)
+			switch c.kind {
+			case site:
+				s = m.siteID
+			case account:
+				s = m.accountID
+			case id, ref:
+				s, err = m.uuid(s, err)
+			}
+			args[i] = s
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", c.name, err)
+		}
+	}
+	return args, nil
+}
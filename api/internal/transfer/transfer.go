@@ -0,0 +1,318 @@
+// Package transfer moves a site between Trackveil instances or accounts.
+//
+// An export is a gzipped tar file holding one NDJSON file per table: the
+// site with its tracker settings, custom domains, retention, sinks, goals
+// and funnels, then its visitors, sessions, page views, events, conversions
+// and rollups. manifest.json comes last, listing every file with its row
+// count and SHA-256. API keys are not exported; their secrets stay with the
+// instance that issued them.
+//
+// An import checks the whole file against its manifest before writing
+// anything, then inserts every row in one transaction. Every UUID is
+// remapped, so a site can be imported next to the one it was exported from.
+package transfer
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"trackveilapi/internal/database"
+)
+
+// FormatVersion is the version of the exports written
+const FormatVersion = 1
+
+const manifestName = "manifest.json"
+
+// Manifest describes an export
+type Manifest struct {
+	Version    int       `json:"version"`
+	SiteID     string    `json:"site_id"`
+	AccountID  string    `json:"account_id"`
+	ExportedAt time.Time `json:"exported_at"`
+	Files      []File    `json:"files"`
+}
+
+// File is an exported table
+type File struct {
+	Table  string `json:"table"`
+	Name   string `json:"name"`
+	Rows   int64  `json:"rows"`
+	Bytes  int64  `json:"bytes"`
+	SHA256 string `json:"sha256"`
+}
+
+// Rows returns the number of rows exported from a table
+func (m *Manifest) Rows(table string) int64 {
+	for _, f := range m.Files {
+		if f.Table == table {
+			return f.Rows
+		}
+	}
+	return 0
+}
+
+// Export writes a site's export to w
+func Export(ctx context.Context, db *database.DB, siteID string, w io.Writer) (*Manifest, error) {
+	var accountID string
+	if err := db.QueryRowContext(ctx, `SELECT account_id FROM sites WHERE id = $1`, siteID).Scan(&accountID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("site %s does not exist", siteID)
+		}
+		return nil, err
+	}
+	m := &Manifest{Version: FormatVersion, SiteID: siteID, AccountID: accountID, ExportedAt: time.Now().UTC()}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for i := range tables {
+		f, err := exportTable(ctx, db, &tables[i], siteID, tw, m.ExportedAt)
+		if err != nil {
+			return nil, fmt.Errorf("exporting %s: %w", tables[i].name, err)
+		}
+		m.Files = append(m.Files, *f)
+	}
+
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeEntry(tw, manifestName, int64(len(manifest)), strings.NewReader(string(manifest)), m.ExportedAt); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// exportTable adds a table's rows to the tar file. They are spooled to a
+// temporary file first, since a tar header holds the size of its file.
+func exportTable(ctx context.Context, db *database.DB, t *table, siteID string, tw *tar.Writer, at time.Time) (*File, error) {
+	tmp, err := os.CreateTemp("", "trackveil-export-*.ndjson")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	rows, err := db.QueryContext(ctx, t.selectQuery(db), siteID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	f := &File{Table: t.name, Name: t.name + ".ndjson"}
+	sum := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(tmp, sum)}
+	buf := bufio.NewWriter(counter)
+	enc := json.NewEncoder(buf)
+	for rows.Next() {
+		row, err := t.scanRow(db, rows)
+		if err != nil {
+			return nil, err
+		}
+		if err := enc.Encode(row); err != nil {
+			return nil, err
+		}
+		f.Rows++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if err := buf.Flush(); err != nil {
+		return nil, err
+	}
+	f.Bytes = counter.n
+	f.SHA256 = hex.EncodeToString(sum.Sum(nil))
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if err := writeEntry(tw, f.Name, f.Bytes, tmp, at); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func writeEntry(tw *tar.Writer, name string, size int64, r io.Reader, at time.Time) error {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: size, ModTime: at, Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+	_, err := io.Copy(tw, r)
+	return err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// entry is a file of an export being read
+type entry struct {
+	name string
+	r    io.Reader
+}
+
+// readEntries calls fn with each file of an export, in order
+func readEntries(path string, fn func(e entry) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(bufio.NewReader(file))
+	if err != nil {
+		return fmt.Errorf("%s is not a site export: %w", path, err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", path, err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := fn(entry{name: hdr.Name, r: tr}); err != nil {
+			return err
+		}
+	}
+}
+
+// Verify checks an export against its manifest: every file is listed with
+// its size, digest and row count, in import order, and every row is a JSON
+// object. It returns the manifest.
+func Verify(path string) (*Manifest, error) {
+	var m *Manifest
+	type seen struct {
+		rows  int64
+		bytes int64
+		sum   string
+	}
+	files := map[string]seen{}
+	var order []string
+
+	err := readEntries(path, func(e entry) error {
+		if e.name == manifestName {
+			m = new(Manifest)
+			if err := json.NewDecoder(e.r).Decode(m); err != nil {
+				return fmt.Errorf("reading %s: %w", manifestName, err)
+			}
+			return nil
+		}
+		table := strings.TrimSuffix(e.name, ".ndjson")
+		if _, ok := tableNamed(table); !ok || table == e.name {
+			return fmt.Errorf("unexpected file %s", e.name)
+		}
+		sum := sha256.New()
+		rows, n, err := scanLines(io.TeeReader(e.r, sum), func(line []byte) error {
+			var row map[string]json.RawMessage
+			return json.Unmarshal(line, &row)
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", e.name, err)
+		}
+		files[e.name] = seen{rows: rows, bytes: n, sum: hex.EncodeToString(sum.Sum(nil))}
+		order = append(order, table)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if m == nil {
+		return nil, fmt.Errorf("%s has no %s", path, manifestName)
+	}
+	if m.Version < 1 || m.Version > FormatVersion {
+		return nil, fmt.Errorf("unsupported export version %d", m.Version)
+	}
+	if len(m.Files) != len(files) {
+		return nil, fmt.Errorf("the export holds %d files, its manifest lists %d", len(files), len(m.Files))
+	}
+	for _, f := range m.Files {
+		s, ok := files[f.Name]
+		if !ok || f.Name != f.Table+".ndjson" {
+			return nil, fmt.Errorf("%s is missing", f.Name)
+		}
+		if s.bytes != f.Bytes || s.sum != f.SHA256 {
+			return nil, fmt.Errorf("%s does not match its manifest", f.Name)
+		}
+		if s.rows != f.Rows {
+			return nil, fmt.Errorf("%s holds %d rows, its manifest %d", f.Name, s.rows, f.Rows)
+		}
+	}
+	if m.Rows("sites") != 1 {
+		return nil, fmt.Errorf("the export holds %d sites, not 1", m.Rows("sites"))
+	}
+	if !inImportOrder(order) {
+		return nil, errors.New("the export's files are not in import order")
+	}
+	return m, nil
+}
+
+func inImportOrder(names []string) bool {
+	last := -1
+	for _, name := range names {
+		i := 0
+		for i < len(tables) && tables[i].name != name {
+			i++
+		}
+		if i <= last {
+			return false
+		}
+		last = i
+	}
+	return true
+}
+
+// scanLines calls fn with each line of r, returning the lines and bytes read
+func scanLines(r io.Reader, fn func(line []byte) error) (int64, int64, error) {
+	counter := &countingReader{r: r}
+	sc := bufio.NewScanner(counter)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	var rows int64
+	for sc.Scan() {
+		rows++
+		if err := fn(sc.Bytes()); err != nil {
+			return rows, counter.n, fmt.Errorf("line %d: %w", rows, err)
+		}
+	}
+	return rows, counter.n, sc.Err()
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -143,13 +143,8 @@ $deviceStats = getDeviceStats($siteId);
                     <div class="flex items-center justify-between py-2 border-b border-gray-100 dark:border-gray-700 last:border-0">
                         <div class="flex-1">
                             <div class="text-sm font-medium text-gray-900 dark:text-white">
-                                <?php echo e($ref['source'] === 'Direct' ? 'Direct' : getDomain($ref['source'])); ?>
+                                <?php echo e(truncate($ref['source'], 40)); ?>
                             </div>
-                            <?php if ($ref['source'] !== 'Direct'): ?>
-                                <div class="text-xs text-gray-500 dark:text-gray-400 truncate">
-                                    <?php echo e(truncate($ref['source'], 40)); ?>
-                                </div>
-                            <?php endif; ?>
                         </div>
                         <div class="ml-4 text-sm font-semibold text-gray-900 dark:text-white">
                             <?php echo formatNumber($ref['views']); ?>
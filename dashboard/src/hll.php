@@ -0,0 +1,84 @@
+<?php
+/**
+ * HyperLogLog visitor sketches
+ * Decodes the sketches stored in the rollups by the API (api/internal/hll)
+ * so unique visitors over several days can be counted by merging them.
+ * PHP 7.2 compatible
+ */
+
+const HLL_VERSION = 1;
+const HLL_PRECISION = 14;
+const HLL_REGISTERS = 16384;
+
+/**
+ * Merge a serialized sketch into a register array (index => rank)
+ */
+function hllMerge(array &$registers, $sketch) {
+    if (is_resource($sketch)) {
+        $sketch = stream_get_contents($sketch);
+    }
+    if (!is_string($sketch) || strlen($sketch) < 3
+        || ord($sketch[0]) !== HLL_VERSION || ord($sketch[1]) !== HLL_PRECISION) {
+        return;
+    }
+    
+    if (ord($sketch[2]) === 1) {
+        // Dense: one byte per register
+        for ($i = 0; $i < HLL_REGISTERS; $i++) {
+            $rank = ord($sketch[3 + $i]);
+            if ($rank > ($registers[$i] ?? 0)) {
+                $registers[$i] = $rank;
+            }
+        }
+        return;
+    }
+    
+    // Sparse: count, then delta-encoded indexes with their ranks
+    $pos = 3;
+    $count = hllUvarint($sketch, $pos);
+    $index = 0;
+    for ($n = 0; $n < $count; $n++) {
+        $index += hllUvarint($sketch, $pos);
+        $rank = ord($sketch[$pos++]);
+        if ($rank > ($registers[$index] ?? 0)) {
+            $registers[$index] = $rank;
+        }
+    }
+}
+
+/**
+ * Estimate the number of distinct visitors in merged registers
+ */
+function hllEstimate(array $registers) {
+    $m = HLL_REGISTERS;
+    $zeros = $m;
+    $sum = 0.0;
+    foreach ($registers as $rank) {
+        if ($rank > 0) {
+            $zeros--;
+            $sum += pow(2, -$rank);
+        }
+    }
+    $sum += $zeros;
+    
+    $alpha = 0.7213 / (1 + 1.079 / $m);
+    $estimate = $alpha * $m * $m / $sum;
+    if ($estimate <= 3 * $m && $zeros > 0) {
+        $estimate = $m * log($m / $zeros);
+    }
+    return (int)round($estimate);
+}
+
+/**
+ * Read an unsigned varint
+ */
+function hllUvarint($data, &$pos) {
+    $value = 0;
+    $shift = 0;
+    do {
+        $byte = ord($data[$pos++]);
+        $value |= ($byte & 0x7f) << $shift;
+        $shift += 7;
+    } while ($byte & 0x80);
+    return $value;
+}
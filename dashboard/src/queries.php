@@ -5,6 +5,7 @@
  */
 
 require_once __DIR__ . '/db.php';
+require_once __DIR__ . '/hll.php';
 
 /**
  * Get all sites for an account
@@ -38,30 +39,41 @@ function getSite($siteId, $accountId) {
     ", [$siteId, $accountId]);
 }
 
+/**
+ * Today's date in UTC, the day boundary of the rollups
+ */
+const ROLLUP_TODAY = "(CURRENT_TIMESTAMP AT TIME ZONE 'UTC')::date";
+
 /**
  * Get stats overview for a site
+ * Reads the daily rollups kept by the API; unique visitors over 30 days
+ * come from the merged daily visitor sketches.
  */
 function getStats($siteId, $days = 30) {
-    $db = getDB();
-    
-    // Page views (last 30 days and today)
-    $views = queryOne("
+    $rows = queryAll("
         SELECT 
-            COUNT(*) as total,
-            COUNT(*) FILTER (WHERE viewed_at::date = CURRENT_DATE) as today,
-            COUNT(*) FILTER (WHERE viewed_at::date = CURRENT_DATE - 1) as yesterday
-        FROM page_views
-        WHERE site_id = ? AND viewed_at > CURRENT_DATE - INTERVAL '30 days'
+            bucket = " . ROLLUP_TODAY . " as is_today,
+            bucket = " . ROLLUP_TODAY . " - 1 as is_yesterday,
+            page_views,
+            visitors,
+            visitors_sketch
+        FROM rollups_daily
+        WHERE site_id = ? AND dimension = 'total' AND bucket > " . ROLLUP_TODAY . " - 30
     ", [$siteId]);
     
-    // Unique visitors
-    $visitors = queryOne("
-        SELECT 
-            COUNT(DISTINCT visitor_id) as total,
-            COUNT(DISTINCT visitor_id) FILTER (WHERE viewed_at::date = CURRENT_DATE) as today
-        FROM page_views
-        WHERE site_id = ? AND viewed_at > CURRENT_DATE - INTERVAL '30 days'
-    ", [$siteId]);
+    $views = ['total' => 0, 'today' => 0, 'yesterday' => 0];
+    $visitorsToday = 0;
+    $registers = [];
+    foreach ($rows as $day) {
+        $views['total'] += $day['page_views'];
+        if ($day['is_today']) {
+            $views['today'] = (int)$day['page_views'];
+            $visitorsToday = (int)$day['visitors'];
+        } elseif ($day['is_yesterday']) {
+            $views['yesterday'] = (int)$day['page_views'];
+        }
+        hllMerge($registers, $day['visitors_sketch']);
+    }
     
     // Calculate change percentages
     $viewsChange = 0;
@@ -71,10 +83,10 @@ function getStats($siteId, $days = 30) {
     
     return [
         'page_views' => (int)$views['total'],
-        'page_views_today' => (int)$views['today'],
+        'page_views_today' => $views['today'],
         'views_change' => $viewsChange,
-        'unique_visitors' => (int)$visitors['total'],
-        'unique_visitors_today' => (int)$visitors['today'],
+        'unique_visitors' => hllEstimate($registers),
+        'unique_visitors_today' => $visitorsToday,
     ];
 }
 
@@ -84,90 +96,117 @@ function getStats($siteId, $days = 30) {
 function getVisitorsChartData($siteId, $days = 7) {
     return queryAll("
         SELECT 
-            DATE(viewed_at) as date,
-            COUNT(DISTINCT visitor_id) as visitors,
-            COUNT(*) as views
-        FROM page_views
+            bucket as date,
+            visitors,
+            page_views as views
+        FROM rollups_daily
         WHERE site_id = ? 
-        AND viewed_at > CURRENT_DATE - INTERVAL '7 days'
-        GROUP BY DATE(viewed_at)
+        AND dimension = 'total'
+        AND bucket > " . ROLLUP_TODAY . " - 7
         ORDER BY date
     ", [$siteId]);
 }
 
 /**
- * Get top pages
+ * Get top values of a rollup dimension over the last 7 days
+ * Unique visitors per value come from the merged daily visitor sketches.
  */
-function getTopPages($siteId, $limit = 10) {
-    return queryAll("
+function getTopDimension($siteId, $dimension, $limit) {
+    $top = queryAll("
         SELECT 
-            page_url,
-            page_title,
-            COUNT(*) as views,
-            COUNT(DISTINCT visitor_id) as unique_visitors
-        FROM page_views
+            value,
+            MAX(label) as label,
+            SUM(page_views) as views,
+            ROUND(100.0 * SUM(page_views) / SUM(SUM(page_views)) OVER (), 1) as percentage
+        FROM rollups_daily
         WHERE site_id = ?
-        AND viewed_at > CURRENT_DATE - INTERVAL '7 days'
-        GROUP BY page_url, page_title
+        AND dimension = ?
+        AND bucket > " . ROLLUP_TODAY . " - 7
+        GROUP BY value
         ORDER BY views DESC
         LIMIT ?
-    ", [$siteId, $limit]);
+    ", [$siteId, $dimension, $limit]);
+    
+    if (empty($top)) {
+        return [];
+    }
+    
+    $values = array_column($top, 'value');
+    $sketches = queryAll("
+        SELECT value, visitors_sketch
+        FROM rollups_daily
+        WHERE site_id = ?
+        AND dimension = ?
+        AND bucket > " . ROLLUP_TODAY . " - 7
+        AND value IN (" . implode(',', array_fill(0, count($values), '?')) . ")
+    ", array_merge([$siteId, $dimension], $values));
+    
+    $registers = [];
+    foreach ($sketches as $row) {
+        if (!isset($registers[$row['value']])) {
+            $registers[$row['value']] = [];
+        }
+        hllMerge($registers[$row['value']], $row['visitors_sketch']);
+    }
+    
+    foreach ($top as &$row) {
+        $row['visitors'] = hllEstimate($registers[$row['value']] ?? []);
+    }
+    unset($row);
+    return $top;
+}
+
+/**
+ * Get top pages
+ */
+function getTopPages($siteId, $limit = 10) {
+    return array_map(function ($row) {
+        return [
+            'page_url' => $row['value'],
+            'page_title' => $row['label'],
+            'views' => $row['views'],
+            'unique_visitors' => $row['visitors'],
+        ];
+    }, getTopDimension($siteId, 'page', $limit));
 }
 
 /**
- * Get top referrers
+ * Get top referrers (traffic sources: referrer host or utm_source)
  */
 function getTopReferrers($siteId, $limit = 10) {
-    return queryAll("
-        SELECT 
-            CASE 
-                WHEN referrer IS NULL OR referrer = '' THEN 'Direct'
-                ELSE referrer
-            END as source,
-            COUNT(*) as views,
-            COUNT(DISTINCT visitor_id) as visitors
-        FROM page_views
-        WHERE site_id = ?
-        AND viewed_at > CURRENT_DATE - INTERVAL '7 days'
-        GROUP BY referrer
-        ORDER BY views DESC
-        LIMIT ?
-    ", [$siteId, $limit]);
+    return array_map(function ($row) {
+        return [
+            'source' => $row['value'],
+            'views' => $row['views'],
+            'visitors' => $row['visitors'],
+        ];
+    }, getTopDimension($siteId, 'source', $limit));
 }
 
 /**
  * Get browser statistics
  */
 function getBrowserStats($siteId) {
-    return queryAll("
-        SELECT 
-            COALESCE(browser_name, 'Unknown') as browser,
-            COUNT(*) as count,
-            ROUND(100.0 * COUNT(*) / SUM(COUNT(*)) OVER (), 1) as percentage
-        FROM page_views
-        WHERE site_id = ?
-        AND viewed_at > CURRENT_DATE - INTERVAL '7 days'
-        GROUP BY browser_name
-        ORDER BY count DESC
-        LIMIT 10
-    ", [$siteId]);
+    return array_map(function ($row) {
+        return [
+            'browser' => $row['value'],
+            'count' => $row['views'],
+            'percentage' => $row['percentage'],
+        ];
+    }, getTopDimension($siteId, 'browser', 10));
 }
 
 /**
  * Get device statistics
  */
 function getDeviceStats($siteId) {
-    return queryAll("
-        SELECT 
-            COALESCE(device_type, 'Unknown') as device,
-            COUNT(*) as count,
-            ROUND(100.0 * COUNT(*) / SUM(COUNT(*)) OVER (), 1) as percentage
-        FROM page_views
-        WHERE site_id = ?
-        AND viewed_at > CURRENT_DATE - INTERVAL '7 days'
-        GROUP BY device_type
-        ORDER BY count DESC
-    ", [$siteId]);
+    return array_map(function ($row) {
+        return [
+            'device' => $row['value'],
+            'count' => $row['views'],
+            'percentage' => $row['percentage'],
+        ];
+    }, getTopDimension($siteId, 'device', 100));
 }
 
 /**
@@ -1,5 +0,0 @@
--- Seed data for development/testing
--- This creates a test account, user, and site for initial development
--- NOTE: This migration is deprecated - use 003_change_site_id_to_hash.sql instead
--- which includes the test data with the new 32-character site ID format
-
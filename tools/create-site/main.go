@@ -6,10 +6,12 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/google/uuid"
 	"github.com/joho/godotenv"
-	_ "github.com/lib/pq"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "modernc.org/sqlite"
 )
 
 // GenerateSiteID generates a random 32-character alphanumeric site ID
@@ -45,14 +47,15 @@ func main() {
 	siteName := flag.String("name", "", "Site name (required)")
 	siteDomain := flag.String("domain", "", "Site domain (required)")
 	listAccounts := flag.Bool("list-accounts", false, "List all accounts")
+	apiURL := flag.String("api-url", "https://api.trackveil.net", "Base URL of the Trackveil API that serves tracker.js")
 
 	flag.Parse()
 
 	// Load environment variables
 	_ = godotenv.Load("../../api/.env")
 
-	// Build connection string
-	connStr := fmt.Sprintf(
+	// Build connection string: the API's SQLite file if configured, Postgres otherwise
+	driver, connStr := "pgx", fmt.Sprintf(
 		"host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
 		os.Getenv("DB_HOST"),
 		os.Getenv("DB_PORT"),
@@ -61,9 +64,13 @@ func main() {
 		os.Getenv("DB_NAME"),
 		os.Getenv("DB_SSLMODE"),
 	)
+	if path := os.Getenv("SQLITE_PATH"); path != "" {
+		// The API creates the schema; start it once before adding sites
+		driver, connStr = "sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)"
+	}
 
 	// Connect to database
-	db, err := sql.Open("postgres", connStr)
+	db, err := sql.Open(driver, connStr)
 	if err != nil {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
@@ -170,8 +177,7 @@ func main() {
 
 	fmt.Println("\nAdd this snippet to your website:")
 	fmt.Println("----------------------------------------")
-	fmt.Printf(`<script async src="https://cdn.trackveil.net/tracker.js" 
-        data-site-id="%s"></script>
-`, siteID)
+	fmt.Printf(`<script async src="%s/js/%s.js"></script>
+`, strings.TrimSuffix(*apiURL, "/"), siteID)
 	fmt.Println("============================================================")
 }
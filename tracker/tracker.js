@@ -7,7 +7,9 @@
   'use strict';
 
   // Configuration
-  const API_ENDPOINT = 'https://api.trackveil.net/track';
+  // Site settings are passed in as TRACKVEIL_CONFIG when the API serves the script
+  const CONFIG = typeof TRACKVEIL_CONFIG !== 'undefined' ? TRACKVEIL_CONFIG : {};
+  const API_ENDPOINT = CONFIG.endpoint || 'https://api.trackveil.net/track';
   const FINGERPRINT_KEY = 'tv_fp';
   const SESSION_TIMEOUT = 30 * 60 * 1000; // 30 minutes
   const DEBUG = false; // Set to true during development only
@@ -25,6 +27,10 @@
    * Get the site ID from the script tag
    */
   function getSiteId() {
+    if (CONFIG.site_id) {
+      return CONFIG.site_id;
+    }
+
     const script = document.currentScript || 
                    document.querySelector('script[data-site-id]');
     
@@ -90,6 +96,11 @@
    * Get or create a persistent fingerprint
    */
   function getFingerprint() {
+    // Privacy mode stores nothing; the API identifies visitors by IP and user agent
+    if (CONFIG.privacy) {
+      return null;
+    }
+
     try {
       let fingerprint = localStorage.getItem(FINGERPRINT_KEY);
       
@@ -105,6 +116,23 @@
     }
   }
 
+  /**
+   * Check whether the current path matches an excluded pattern (* matches anything)
+   */
+  function isExcluded() {
+    const patterns = CONFIG.exclude || [];
+    const path = window.location.pathname;
+    for (let i = 0; i < patterns.length; i++) {
+      const re = new RegExp('^' + patterns[i].split('*').map(function(part) {
+        return part.replace(/[.+?^${}()|[\]\\]/g, '\\$&');
+      }).join('.*') + '$');
+      if (re.test(path)) {
+        return true;
+      }
+    }
+    return false;
+  }
+
   /**
    * Get page load time (if available)
    */
@@ -124,6 +152,23 @@
     return loadTime;
   }
 
+  /**
+   * Generate a random ID for this hit, so retries are recorded only once
+   */
+  function generateEventId() {
+    try {
+      const bytes = new Uint8Array(16);
+      window.crypto.getRandomValues(bytes);
+      let id = '';
+      for (let i = 0; i < bytes.length; i++) {
+        id += (bytes[i] < 16 ? '0' : '') + bytes[i].toString(16);
+      }
+      return id;
+    } catch (e) {
+      return Date.now().toString(36) + Math.random().toString(36).slice(2);
+    }
+  }
+
   /**
    * Collect tracking data
    */
@@ -136,7 +181,8 @@
       screen_width: screen.width,
       screen_height: screen.height,
       fingerprint: getFingerprint(),
-      load_time: getPageLoadTime()
+      load_time: getPageLoadTime(),
+      event_id: generateEventId()
     };
   }
 
@@ -160,7 +206,8 @@
       var params = [];
       for (var key in data) {
         if (data.hasOwnProperty(key) && data[key] != null) {
-          params.push(encodeURIComponent(key) + '=' + encodeURIComponent(String(data[key])));
+          var value = typeof data[key] === 'object' ? JSON.stringify(data[key]) : String(data[key]);
+          params.push(encodeURIComponent(key) + '=' + encodeURIComponent(value));
         }
       }
       
@@ -208,6 +255,28 @@
     }
   }
 
+  /**
+   * Track a custom event (used for event goals)
+   * Usage: trackveil.track('signup', { plan: 'pro' })
+   */
+  function trackEvent(siteId, name, props) {
+    if (!name) {
+      log('Event name is required');
+      return;
+    }
+    if (isExcluded()) {
+      log('Path excluded - event not tracked');
+      return;
+    }
+
+    const data = collectData(siteId);
+    data.event_name = String(name);
+    if (props && typeof props === 'object') {
+      data.props = props;
+    }
+    sendTracking(data);
+  }
+
   /**
    * Initialize tracking
    */
@@ -218,8 +287,19 @@
       return;
     }
 
+    // Public API
+    window.trackveil = {
+      track: function(name, props) {
+        trackEvent(siteId, name, props);
+      }
+    };
+
     // Wait for page to be interactive/complete
     function track() {
+      if (isExcluded()) {
+        log('Path excluded - page view not tracked');
+        return;
+      }
       const data = collectData(siteId);
       sendTracking(data);
     }
@@ -235,6 +315,23 @@
       });
     }
 
+    // Single-page apps: track a page view on every history navigation
+    if (CONFIG.spa) {
+      let lastUrl = window.location.href;
+      const onNavigate = function() {
+        if (window.location.href !== lastUrl) {
+          lastUrl = window.location.href;
+          track();
+        }
+      };
+      const pushState = history.pushState;
+      history.pushState = function() {
+        pushState.apply(this, arguments);
+        onNavigate();
+      };
+      window.addEventListener('popstate', onNavigate);
+    }
+
     // Track page visibility changes (for better load time accuracy)
     // and potential future session tracking
     document.addEventListener('visibilitychange', function() {